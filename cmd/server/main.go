@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"log/slog"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -12,7 +14,15 @@ import (
 	"github.com/Daneel-Li/gps-back/internal/handlers"
 	"github.com/Daneel-Li/gps-back/internal/services"
 	"github.com/Daneel-Li/gps-back/internal/vendors/btt"
+	"github.com/Daneel-Li/gps-back/internal/vendors/gt06"
+	"github.com/Daneel-Li/gps-back/internal/vendors/httppush"
+	"github.com/Daneel-Li/gps-back/internal/vendors/mqttjson"
+	"github.com/Daneel-Li/gps-back/internal/vendors/osmand"
+	"github.com/Daneel-Li/gps-back/internal/vendors/sg"
+	"github.com/Daneel-Li/gps-back/internal/vendors/sim"
+	"github.com/Daneel-Li/gps-back/internal/vendors/teltonika"
 	v53 "github.com/Daneel-Li/gps-back/internal/vendors/v53"
+	"github.com/Daneel-Li/gps-back/internal/vendors/yc"
 
 	//	"reflect"
 	"net/http"
@@ -78,35 +88,112 @@ func initDatabase(cfg *config.Config) *gorm.DB {
 }
 
 // initServices initializes service container
-func initServices(db *gorm.DB, cfg *config.Config) *services.SimpleServiceContainer {
+func initServices(db *gorm.DB, cfg *config.Config, wsManager *services.WSManager) *services.SimpleServiceContainer {
 	// Initialize map API service
 	services.InitService()
 
 	// Create data access layer
 	repo := dao.NewMysqlRepository(db)
+	// Track tables created by older versions need the rejected flag columns
+	if err := repo.UpgradePosTables(); err != nil {
+		slog.Error("upgrade track tables failed", "error", err)
+	}
 
-	// Create command manager
-	cmdM := services.NewCommandManager()
+	// Create command manager, timeouts are configured per action in seconds
+	timeouts := make(map[string]time.Duration, len(cfg.CommandTimeouts))
+	for action, sec := range cfg.CommandTimeouts {
+		timeouts[action] = time.Duration(sec) * time.Second
+	}
+	cmdM := services.NewCommandManager(services.CommandPolicy{Timeouts: timeouts, MaxRetries: cfg.CommandRetries})
 
 	// Create simplified service container
-	serviceContainer := services.NewSimpleServiceContainer(repo, cmdM)
+	serviceContainer := services.NewSimpleServiceContainer(repo, cmdM, wsManager)
+	// Command IDs are echoed back by devices, so continue after the ones already issued
+	if err := serviceContainer.RestoreCommandIDs(); err != nil {
+		log.Fatal("Restore command IDs failed", err)
+	}
 
 	// Initialize vendor drivers
-	initVendorDrivers(serviceContainer, cfg, repo)
+	initVendorDrivers(serviceContainer, cfg, repo, wsManager, cmdM)
+
+	// Deliver commands queued for offline devices and expire stale ones
+	serviceContainer.StartCommandQueue(context.Background())
+
+	// Send firmware upgrades of active rollouts
+	serviceContainer.StartOtaDispatcher(context.Background(), cfg.OtaBaseURL)
+
+	// Run one-shot and recurring command schedules
+	serviceContainer.StartCommandScheduler(context.Background())
 
 	return serviceContainer
 }
 
 // initVendorDrivers initializes vendor drivers
-func initVendorDrivers(serviceContainer *services.SimpleServiceContainer, cfg *config.Config, repo dao.Repository) {
+// Command results reach the requesting terminal only when the processor shares
+// the command manager and websocket manager used by the API handlers
+func initVendorDrivers(serviceContainer *services.SimpleServiceContainer, cfg *config.Config, repo dao.Repository,
+	wsManager *services.WSManager, cmdM services.CommandManager) {
 
 	bttDriver := btt.NewMqttHandler(btt.MqttConfig(cfg.Mqtt), services.NewBttTopicProvider(repo))
 	serviceContainer.RegisterDriver("btt", bttDriver)
-	v53Driver := v53.NewV53Handler(5353)
+	v53Port := cfg.V53Port
+	if v53Port == 0 {
+		v53Port = 5353
+	}
+	v53Driver := v53.NewV53Handler(v53Port)
 	serviceContainer.RegisterDriver("v53", v53Driver)
+	gt06Port := cfg.Gt06Port
+	if gt06Port == 0 {
+		gt06Port = 5023
+	}
+	serviceContainer.RegisterDriver("gt06", gt06.NewGt06Handler(gt06Port))
+	teltonikaPort := cfg.TeltonikaPort
+	if teltonikaPort == 0 {
+		teltonikaPort = 5027
+	}
+	serviceContainer.RegisterDriver("teltonika", teltonika.NewTeltonikaHandler(teltonikaPort))
+	osmandPort := cfg.OsmAndPort
+	if osmandPort == 0 {
+		osmandPort = 5055
+	}
+	serviceContainer.RegisterDriver("osmand", osmand.NewOsmAndHandler(osmandPort))
+	// sg、yc需对接厂商平台，未配置推送端口时不启用
+	if cfg.Sg.ListenPort != 0 {
+		serviceContainer.RegisterDriver("sg", sg.NewSgHandler(httppush.Config(cfg.Sg)))
+	} else {
+		slog.Info("sg driver is not configured, skipped")
+	}
+	if cfg.Yc.ListenPort != 0 {
+		serviceContainer.RegisterDriver("yc", yc.NewYcHandler(httppush.Config(cfg.Yc)))
+	} else {
+		slog.Info("yc driver is not configured, skipped")
+	}
+	if cfg.Sim.Devices > 0 {
+		serviceContainer.RegisterDriver("sim", sim.NewSimHandler(cfg.Sim, repo))
+	}
+	// 通用mqtt-json驱动，未单独配置mqtt时复用全局连接参数
+	for _, c := range cfg.MqttJsonDrivers {
+		mqttCfg := cfg.Mqtt
+		if c.Mqtt != nil {
+			mqttCfg = *c.Mqtt
+		} else {
+			mqttCfg.ClientID = mqttCfg.ClientID + "_" + c.Type
+			if mqttCfg.StorePath != "" { // 每个客户端需独立的会话目录
+				mqttCfg.StorePath = filepath.Join(mqttCfg.StorePath, c.Type)
+			}
+		}
+		driver, err := mqttjson.NewMqttJsonHandler(c, mqttCfg, services.NewTopicProvider(repo, c.Type))
+		if err != nil {
+			slog.Error("invalid mqtt json driver config, skipped", "type", c.Type, "error", err)
+			continue
+		}
+		if err := serviceContainer.RegisterDriver(c.Type, driver); err != nil {
+			slog.Error("register mqtt json driver failed", "type", c.Type, "error", err)
+		}
+	}
 
 	// Set message processor
-	messageProcessor := handlers.NewMessageProcessor(repo, services.NewWsManager(time.Minute*10), services.NewCommandManager())
+	messageProcessor := handlers.NewMessageProcessor(repo, wsManager, cmdM, serviceContainer, serviceContainer, services.NewTrackFilter())
 	serviceContainer.SetMessageHandler(messageProcessor)
 
 	serviceContainer.StartAllDrivers()
@@ -137,22 +224,25 @@ func main() {
 	// Initialize database connection
 	db := initDatabase(cfg)
 
+	// Websocket connections are shared by the API handlers and the message processor
+	wsManager := services.NewWsManager(time.Minute * 10)
+
 	// Initialize service container
-	serviceContainer := initServices(db, cfg)
+	serviceContainer := initServices(db, cfg, wsManager)
 
 	// Setup routes
-	router := setupRoutes(serviceContainer)
+	router := setupRoutes(serviceContainer, wsManager)
 
 	// Start HTTP server
 	startServer(router, cfg)
 }
 
 // setupRoutes sets up routes
-func setupRoutes(serviceContainer *services.SimpleServiceContainer) *mux.Router {
+func setupRoutes(serviceContainer *services.SimpleServiceContainer, wsManager *services.WSManager) *mux.Router {
 	r := mux.NewRouter()
 
 	// Create handler
-	h := handlers.NewSimpleHandler(serviceContainer, services.NewWsManager(time.Minute*10),
+	h := handlers.NewSimpleHandler(serviceContainer, wsManager,
 		services.NewJWTService(), services.NewWechatService())
 	// Set middleware
 	midWares := []handlers.Middleware{
@@ -173,13 +263,20 @@ func setupRoutes(serviceContainer *services.SimpleServiceContainer) *mux.Router
 	r.HandleFunc("/api/v1/devices/{device_id}/track", handlers.WithMidWare(h.GetTrack, midWares...)).Methods("GET")
 	r.HandleFunc("/api/v1/devices/{device_id}/safearea", handlers.WithMidWare(h.GetSafeRegions, midWares...)).Methods("GET")
 	r.HandleFunc("/api/v1/devices/{device_id}/safearea", handlers.WithMidWare(h.PutSafeRegion, midWares...)).Methods("PUT")
+	r.HandleFunc("/api/v1/devices/{device_id}/fence-events", handlers.WithMidWare(h.GetFenceEvents, midWares...)).Methods("GET")
 	r.HandleFunc("/api/v1/devices/{device_id}/interval", handlers.WithMidWare(h.GetReportInterval, midWares...)).Methods("GET")
 	r.HandleFunc("/api/v1/devices/{device_id}/autopower", handlers.WithMidWare(h.GetAutoPower, midWares...)).Methods("GET")
+	r.HandleFunc("/api/v1/devices/{device_id}/capabilities", handlers.WithMidWare(h.GetCapabilities, midWares...)).Methods("GET")
 
 	r.HandleFunc("/api/v1/sharemappings", handlers.WithMidWare(h.GetShareMappings, midWares...)).Methods("GET")
 	r.HandleFunc("/api/v1/sharemappings", handlers.WithMidWare(h.CreateShareMapping, midWares...)).Methods("POST")
 	r.HandleFunc("/api/v1/sharemappings", handlers.WithMidWare(h.MoveShareMapping, midWares...)).Methods("DELETE")
 	r.HandleFunc("/api/v1/devices/{device_id}/command", handlers.WithMidWare(h.Command, midWares...)).Methods("PUT")
+	r.HandleFunc("/api/v1/devices/{device_id}/commands", handlers.WithMidWare(h.GetCommands, midWares...)).Methods("GET")
+	r.HandleFunc("/api/v1/devices/{device_id}/schedules", handlers.WithMidWare(h.ListSchedules, midWares...)).Methods("GET")
+	r.HandleFunc("/api/v1/devices/{device_id}/schedules", handlers.WithMidWare(h.CreateSchedule, midWares...)).Methods("POST")
+	r.HandleFunc("/api/v1/devices/{device_id}/schedules/{schedule_id}", handlers.WithMidWare(h.UpdateSchedule, midWares...)).Methods("PUT")
+	r.HandleFunc("/api/v1/devices/{device_id}/schedules/{schedule_id}", handlers.WithMidWare(h.DeleteSchedule, midWares...)).Methods("DELETE")
 	r.HandleFunc("/api/v1/devices/{device_id}/activity", handlers.WithMidWare(h.GetSteps, midWares...)).Methods("GET")
 	r.HandleFunc("/api/v1/devices/{device_id}/alarms", handlers.WithMidWare(h.GetAlarms, midWares...)).Methods("GET")
 	r.HandleFunc("/api/v1/devices/{device_id}/profile", handlers.WithMidWare(h.UpdateProfile, midWares...)).Methods("PUT")
@@ -198,6 +295,17 @@ func setupRoutes(serviceContainer *services.SimpleServiceContainer) *mux.Router
 	r.HandleFunc("/api/v1/upload", handlers.WithMidWare(h.UploadFileHandler, midWares...)).Methods("POST")
 	r.HandleFunc("/ws", h.UpgradeWS).Methods("GET")
 
+	r.HandleFunc("/api/v1/admin/drivers", handlers.WithMidWare(h.ListDrivers, midWares...)).Methods("GET")
+	r.HandleFunc("/api/v1/admin/drivers/{name}/restart", handlers.WithMidWare(h.RestartDriver, midWares...)).Methods("POST")
+	r.HandleFunc("/api/v1/admin/firmwares", handlers.WithMidWare(h.UploadFirmware, midWares...)).Methods("POST")
+	r.HandleFunc("/api/v1/admin/firmwares", handlers.WithMidWare(h.ListFirmwares, midWares...)).Methods("GET")
+	r.HandleFunc("/api/v1/admin/rollouts", handlers.WithMidWare(h.CreateRollout, midWares...)).Methods("POST")
+	r.HandleFunc("/api/v1/admin/rollouts", handlers.WithMidWare(h.ListRollouts, midWares...)).Methods("GET")
+	r.HandleFunc("/api/v1/admin/rollouts/{rollout_id}", handlers.WithMidWare(h.GetRollout, midWares...)).Methods("GET")
+	r.HandleFunc("/api/v1/admin/rollouts/{rollout_id}", handlers.WithMidWare(h.UpdateRollout, midWares...)).Methods("PUT")
+	// Devices download firmware without credentials
+	r.HandleFunc("/ota/{file}", h.DownloadFirmware).Methods("GET")
+
 	r.HandleFunc("/api/v1/devices/{device_id}/paysuccess", h.PaySuccNotify).Methods("POST")
 	r.HandleFunc("/api/v1/devices/{device_id}/renew",
 		handlers.WithMidWare(h.Renew, midWares...)).Methods("POST")
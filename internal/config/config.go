@@ -32,6 +32,59 @@ type MqttConfig struct {
 	ClientID string `json:"clientid"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+
+	// 订阅模式(仅btt驱动): topic(默认，逐设备订阅)/wildcard(通配符订阅)/shared(共享订阅，多实例部署)
+	SubscribeMode string `json:"subscribe_mode"`
+	SharedGroup   string `json:"shared_group"` // shared模式的共享组名，默认gps-back
+
+	// TLS，broker使用ssl://或tls://时生效；配置ca_cert后只信任该CA签发的证书
+	CACert     string `json:"ca_cert"`     // CA证书路径(PEM)
+	ClientCert string `json:"client_cert"` // 可选，客户端证书路径(PEM)，需与client_key同时配置
+	ClientKey  string `json:"client_key"`  // 可选，客户端私钥路径(PEM)
+
+	UplinkQoS   *int   `json:"uplink_qos"`   // 订阅设备上报的QoS，默认1
+	DownlinkQoS *int   `json:"downlink_qos"` // 下发指令的QoS，默认1
+	KeepAlive   int    `json:"keepalive"`    // 心跳间隔(秒)，默认10
+	StorePath   string `json:"store_path"`   // 可选，持久化会话目录，未确认的指令重启后继续投递
+}
+
+// 通用mqtt-json驱动配置，用于接入白牌mqtt设备，无需编写代码
+// 字段映射、指令模板说明见 internal/vendors/mqttjson
+type MqttJsonConfig struct {
+	Type           string             `json:"type"`             // 设备类型，即devices.type，最长12个字符
+	Mqtt           *MqttConfig        `json:"mqtt"`             // 可选，未配置时使用全局mqtt连接参数
+	ReportTopic    string             `json:"report_topic"`     // 上报topic模板，{sn}替换为设备号，如 acme/{sn}/up
+	CommandTopic   string             `json:"command_topic"`    // 指令topic模板，如 acme/{sn}/down
+	SNField        string             `json:"sn_field"`         // 可选，payload中设备号的json路径，为空时从topic提取
+	MessageIDField string             `json:"message_id_field"` // 指令应答中消息id的json路径，与下发模板中的{{.MessageID}}对应
+	ResultField    string             `json:"result_field"`     // 可选，指令应答结果的json路径，存在该字段的消息视为指令应答
+	ResultSuccess  string             `json:"result_success"`   // 指令成功时result_field的取值，如 "0"、"true"
+	CoordSystem    string             `json:"coord_system"`     // 上报坐标系 wgs84(默认)/gcj02/bd09
+	Fields         map[string]string  `json:"fields"`           // 设备字段(Device的json名) -> payload json路径，如 "latitude": "data.gps.lat"
+	Scales         map[string]float64 `json:"scales"`           // 可选，数值字段的换算系数，如 "battery_voltage": 0.001
+	Commands       map[string]string  `json:"commands"`         // 指令(LOCATE/REBOOT/POWER_OFF/FIND/SET_REPORTINTERVAL) -> payload模板
+	IntervalRange  [2]int             `json:"interval_range"`   // 可选，允许的上报间隔范围(秒)，默认[10, 3600]
+}
+
+// 模拟设备驱动配置，设备需以sim型号入库，设备号为 sn_prefix+4位序号，如 SIM0001
+// 可将trial_device_id指向模拟设备，试用用户即可看到移动中的演示设备
+type SimConfig struct {
+	Devices        int        `json:"devices"`          // 模拟设备数量，为0时不启用
+	SNPrefix       string     `json:"sn_prefix"`        // 设备号前缀，默认SIM
+	Interval       int        `json:"interval"`         // 上报间隔(秒)，默认10
+	Mode           string     `json:"mode"`             // random(随机游走，默认)/replay(回放历史轨迹)
+	Center         [2]float64 `json:"center"`           // random模式起点 [经度, 纬度]，GCJ02
+	ReplayDeviceID string     `json:"replay_device_id"` // replay模式回放的设备id
+	ReplayDays     int        `json:"replay_days"`      // replay模式回放最近几天的轨迹，默认1
+	AckDelayMs     int        `json:"ack_delay_ms"`     // 指令应答延迟(毫秒)
+	AlarmRate      float64    `json:"alarm_rate"`       // 每次上报随机产生SOS/拆除报警的概率(0-1)，为0时不产生
+}
+
+// HTTP推送类厂商(sg、yc)配置
+type HttpPushConfig struct {
+	ListenPort int    `json:"listen_port"` // 接收厂商平台推送的端口，为0时不启用
+	ApiUrl     string `json:"api_url"`     // 厂商平台指令接口地址
+	ApiKey     string `json:"api_key"`     // 推送及指令接口鉴权密钥
 }
 
 type Tls struct {
@@ -53,7 +106,10 @@ type WechatPaymentConfig struct {
 }
 
 type Config struct {
-	JT808Url                string      `json:"jt808_url"`
+	V53Port                 int         `json:"v53_port"`        // v53终端JT/T 808接入端口
+	Gt06Port                int         `json:"gt06_port"`       // gt06(康凯斯)终端tcp接入端口
+	TeltonikaPort           int         `json:"teltonika_port"`  // teltonika终端tcp/udp接入端口
+	OsmAndPort              int         `json:"osmand_port"`     // OsmAnd/Traccar Client手机定位http上报端口
 	TrialDeviceID           string      `json:"trial_device_id"` //TODO: should be a list
 	JwtIssuer               string      `json:"jwt_issuer"`
 	MxmAPIKey               string      `json:"api_key"`
@@ -75,6 +131,20 @@ type Config struct {
 	DataPath                string              `json:"data_path"`      //数据路径
 	AvatarPath              string              `json:"avatar_path"`    //	头像存储路径
 	WechatPayment           WechatPaymentConfig `json:"wechat_payment"` // WeChat payment related parameters
+	Sg                      HttpPushConfig      `json:"sg"`             // sg平台推送
+	Yc                      HttpPushConfig      `json:"yc"`             // yc平台推送
+
+	// 通用mqtt-json驱动，每项对应一种设备类型
+	MqttJsonDrivers []MqttJsonConfig `json:"mqtt_json_drivers"`
+	// 模拟设备，用于演示和压测
+	Sim SimConfig `json:"sim"`
+	// 固件远程升级，固件包存放在firmware_path，设备从ota_base_url(指向本服务的/ota)下载
+	FirmwarePath string `json:"firmware_path"`
+	OtaBaseURL   string `json:"ota_base_url"`
+	// 指令超时(秒)，按指令配置，未配置的指令为30秒，超时后向发起终端推送失败结果
+	CommandTimeouts map[string]int `json:"command_timeouts"`
+	// 幂等指令(LOCATE/SET_REPORTINTERVAL/FIND)超时后的重发次数，每次等待时间翻倍，为0时不重发
+	CommandRetries int `json:"command_retries"`
 }
 
 var (
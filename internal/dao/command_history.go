@@ -0,0 +1,83 @@
+package dao
+
+import (
+	"fmt"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"gorm.io/gorm"
+)
+
+func (d *MysqlRepository) AddCommandRecord(rec *mxm.CommandRecord) error {
+	if err := d.db.Create(rec).Error; err != nil {
+		return fmt.Errorf("insert into command_history error, %v", err)
+	}
+	return nil
+}
+
+// latestCommandRecord 设备某条指令最近一次的记录id，没有记录时返回0
+func (d *MysqlRepository) latestCommandRecord(deviceID string, commandID int64) (int64, error) {
+	var ids []int64
+	if err := d.db.Model(&mxm.CommandRecord{}).Where("device_id = ? AND command_id = ?", deviceID, commandID).
+		Order("id DESC").Limit(1).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return ids[0], nil
+}
+
+// UpdateCommandRecord 只更新设备该指令最近一次的记录
+func (d *MysqlRepository) UpdateCommandRecord(deviceID string, commandID int64, updates map[string]interface{}) error {
+	id, err := d.latestCommandRecord(deviceID, commandID)
+	if err != nil {
+		return fmt.Errorf("query command record(%s, %d) error, %v", deviceID, commandID, err)
+	}
+	if id == 0 {
+		return nil
+	}
+	if err := d.db.Model(&mxm.CommandRecord{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return fmt.Errorf("update command record(%s, %d) error, %v", deviceID, commandID, err)
+	}
+	return nil
+}
+
+// ReplyCommandRecord 记录设备应答及下发到应答的耗时
+func (d *MysqlRepository) ReplyCommandRecord(deviceID string, commandID int64, succeed bool, reply string, at time.Time) error {
+	return d.UpdateCommandRecord(deviceID, commandID, map[string]interface{}{
+		"state":      mxm.CMD_ACKNOWLEDGED,
+		"succeed":    succeed,
+		"reply":      reply,
+		"replied_at": at,
+		"latency_ms": gorm.Expr("TIMESTAMPDIFF(MICROSECOND, sent_at, ?) DIV 1000", at),
+	})
+}
+
+// GetCommandRecords 按时间倒序分页查询设备的指令历史，同时返回总数
+func (d *MysqlRepository) GetCommandRecords(deviceID string, st, ed time.Time, limit, offset int) ([]*mxm.CommandRecord, int64, error) {
+	var total int64
+	query := func() *gorm.DB {
+		return d.db.Model(&mxm.CommandRecord{}).Where("device_id = ? AND created_at BETWEEN ? AND ?", deviceID, st, ed)
+	}
+	if err := query().Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("count command records of device(%s) error, %v", deviceID, err)
+	}
+	var lst []*mxm.CommandRecord
+	if err := query().Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&lst).Error; err != nil {
+		return nil, 0, fmt.Errorf("query command records of device(%s) error, %v", deviceID, err)
+	}
+	return lst, total, nil
+}
+
+// MaxCommandID 已持久化的最大指令ID，重启后指令ID从它之后继续分配
+func (d *MysqlRepository) MaxCommandID() (int64, error) {
+	var n int64
+	if err := d.db.Raw(`SELECT GREATEST(
+		(SELECT COALESCE(MAX(command_id), 0) FROM command_history),
+		(SELECT COALESCE(MAX(command_id), 0) FROM command_queue),
+		(SELECT COALESCE(MAX(command_id), 0) FROM ota_rollout_devices))`).Scan(&n).Error; err != nil {
+		return 0, fmt.Errorf("query max command id error, %v", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,97 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"gorm.io/gorm"
+)
+
+func (d *MysqlRepository) AddQueuedCommand(cmd *mxm.QueuedCommand) error {
+	if err := d.db.Create(cmd).Error; err != nil {
+		return fmt.Errorf("insert into command_queue error, %v", err)
+	}
+	return nil
+}
+
+// GetQueuedCommands 返回设备未过期的待下发指令，按提交顺序
+func (d *MysqlRepository) GetQueuedCommands(deviceID string) ([]*mxm.QueuedCommand, error) {
+	var lst []*mxm.QueuedCommand
+	if err := d.db.Where("device_id = ? AND state = ? AND expire_at > ?", deviceID, mxm.CMD_QUEUED, time.Now()).
+		Order("created_at, id").Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query queued commands of device(%s) error, %v", deviceID, err)
+	}
+	return lst, nil
+}
+
+// GetQueuedDeviceIDs 返回有待下发指令的设备
+func (d *MysqlRepository) GetQueuedDeviceIDs() ([]string, error) {
+	var ids []string
+	if err := d.db.Model(&mxm.QueuedCommand{}).Where("state = ?", mxm.CMD_QUEUED).
+		Distinct().Pluck("device_id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("query queued devices error, %v", err)
+	}
+	return ids, nil
+}
+
+// ClaimQueuedCommand 将指令置为已下发，并发下发同一条指令时只有一方返回true
+func (d *MysqlRepository) ClaimQueuedCommand(id int64) (bool, error) {
+	res := d.db.Model(&mxm.QueuedCommand{}).Where("id = ? AND state = ?", id, mxm.CMD_QUEUED).
+		Update("state", mxm.CMD_DELIVERED)
+	if res.Error != nil {
+		return false, fmt.Errorf("claim queued command(%d) error, %v", id, res.Error)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+func (d *MysqlRepository) UpdateQueuedCommand(id int64, updates map[string]interface{}) error {
+	if err := d.db.Model(&mxm.QueuedCommand{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return fmt.Errorf("update queued command(%d) error, %v", id, err)
+	}
+	return nil
+}
+
+// AckQueuedCommand 记录设备应答，按设备和指令ID匹配最近一次下发的记录，不是离线队列下发的指令返回nil
+func (d *MysqlRepository) AckQueuedCommand(deviceID string, commandID int64, succeed bool, msg string) (*mxm.QueuedCommand, error) {
+	var cmd mxm.QueuedCommand
+	if err := d.db.Where("device_id = ? AND command_id = ? AND state = ?", deviceID, commandID, mxm.CMD_DELIVERED).
+		Order("id DESC").First(&cmd).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("query queued command(%s, %d) error, %v", deviceID, commandID, err)
+	}
+	res := d.db.Model(&mxm.QueuedCommand{}).Where("id = ? AND state = ?", cmd.ID, mxm.CMD_DELIVERED).
+		Updates(map[string]interface{}{"state": mxm.CMD_ACKNOWLEDGED, "succeed": succeed, "msg": msg})
+	if res.Error != nil {
+		return nil, fmt.Errorf("ack queued command(%s, %d) error, %v", deviceID, commandID, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+	cmd.State, cmd.Succeed, cmd.Msg = mxm.CMD_ACKNOWLEDGED, &succeed, msg
+	return &cmd, nil
+}
+
+// ExpireQueuedCommands 将已过期仍未下发的指令置为expired并返回
+func (d *MysqlRepository) ExpireQueuedCommands(now time.Time) ([]*mxm.QueuedCommand, error) {
+	var lst []*mxm.QueuedCommand
+	if err := d.db.Where("state = ? AND expire_at <= ?", mxm.CMD_QUEUED, now).Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query expired commands error, %v", err)
+	}
+	if len(lst) == 0 {
+		return nil, nil
+	}
+	ids := make([]int64, 0, len(lst))
+	for _, cmd := range lst {
+		ids = append(ids, cmd.ID)
+		cmd.State = mxm.CMD_EXPIRED
+	}
+	if err := d.db.Model(&mxm.QueuedCommand{}).Where("id IN ? AND state = ?", ids, mxm.CMD_QUEUED).
+		Update("state", mxm.CMD_EXPIRED).Error; err != nil {
+		return nil, fmt.Errorf("expire commands error, %v", err)
+	}
+	return lst, nil
+}
@@ -0,0 +1,83 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"gorm.io/gorm"
+)
+
+func (d *MysqlRepository) CreateCommandSchedule(s *mxm.CommandSchedule) error {
+	if err := d.db.Create(s).Error; err != nil {
+		return fmt.Errorf("insert into command_schedules error, %v", err)
+	}
+	return nil
+}
+
+// GetCommandSchedule 不存在时返回nil
+func (d *MysqlRepository) GetCommandSchedule(id uint) (*mxm.CommandSchedule, error) {
+	var s mxm.CommandSchedule
+	if err := d.db.Where("id = ?", id).First(&s).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("query command schedule(%d) error, %v", id, err)
+	}
+	return &s, nil
+}
+
+func (d *MysqlRepository) GetCommandSchedules(deviceID string) ([]*mxm.CommandSchedule, error) {
+	var lst []*mxm.CommandSchedule
+	if err := d.db.Where("device_id = ?", deviceID).Order("id").Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query command schedules of device(%s) error, %v", deviceID, err)
+	}
+	return lst, nil
+}
+
+// GetSchedulesByDevices 返回多个设备的已启用定时指令，用于时区变更后重新计算执行时间
+func (d *MysqlRepository) GetSchedulesByDevices(deviceIDs []string) ([]*mxm.CommandSchedule, error) {
+	var lst []*mxm.CommandSchedule
+	if len(deviceIDs) == 0 {
+		return lst, nil
+	}
+	if err := d.db.Where("device_id IN ? AND enabled = ?", deviceIDs, true).Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query command schedules error, %v", err)
+	}
+	return lst, nil
+}
+
+func (d *MysqlRepository) UpdateCommandSchedule(id uint, updates map[string]interface{}) error {
+	if err := d.db.Model(&mxm.CommandSchedule{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return fmt.Errorf("update command schedule(%d) error, %v", id, err)
+	}
+	return nil
+}
+
+func (d *MysqlRepository) DeleteCommandSchedule(id uint) error {
+	if err := d.db.Where("id = ?", id).Delete(&mxm.CommandSchedule{}).Error; err != nil {
+		return fmt.Errorf("delete command schedule(%d) error, %v", id, err)
+	}
+	return nil
+}
+
+// GetDueSchedules 返回到期的定时指令
+func (d *MysqlRepository) GetDueSchedules(now time.Time, limit int) ([]*mxm.CommandSchedule, error) {
+	var lst []*mxm.CommandSchedule
+	if err := d.db.Where("enabled = ? AND next_run_at <= ?", true, now).
+		Order("next_run_at").Limit(limit).Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query due schedules error, %v", err)
+	}
+	return lst, nil
+}
+
+// ClaimSchedule 将定时指令的执行时间从prev推进到next，多实例部署时只有一方返回true
+func (d *MysqlRepository) ClaimSchedule(id uint, prev time.Time, next *time.Time, enabled bool) (bool, error) {
+	res := d.db.Model(&mxm.CommandSchedule{}).Where("id = ? AND enabled = ? AND next_run_at = ?", id, true, prev).
+		Updates(map[string]interface{}{"next_run_at": next, "enabled": enabled})
+	if res.Error != nil {
+		return false, fmt.Errorf("claim command schedule(%d) error, %v", id, res.Error)
+	}
+	return res.RowsAffected == 1, nil
+}
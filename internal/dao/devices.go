@@ -360,7 +360,17 @@ func (d *MysqlRepository) AddPosHis(deviceID string, loc *mxm.Location) error {
 	return nil
 }
 
+// GetPosHis 查询轨迹，不含被过滤的异常点
 func (d *MysqlRepository) GetPosHis(deviceID string, st string, ed string, types []string) ([]*mxm.Location, error) {
+	return d.queryPosHis(deviceID, st, ed, types, false)
+}
+
+// GetRawPosHis 查询轨迹，包含被过滤的异常点，用于核查原始数据
+func (d *MysqlRepository) GetRawPosHis(deviceID string, st string, ed string, types []string) ([]*mxm.Location, error) {
+	return d.queryPosHis(deviceID, st, ed, types, true)
+}
+
+func (d *MysqlRepository) queryPosHis(deviceID string, st string, ed string, types []string, withRejected bool) ([]*mxm.Location, error) {
 	var hispos []*mxm.Location
 	parsedSt, err := time.ParseInLocation("2006-1-2 15:4:5", st, time.Local)
 	if err != nil {
@@ -372,14 +382,41 @@ func (d *MysqlRepository) GetPosHis(deviceID string, st string, ed string, types
 		return nil, fmt.Errorf("failed to parse time: %v", err)
 	}
 	edUTC := parsedEd.UTC()
-	if err := d.db.Table(posDataPrefix+deviceID).
-		Where("loc_time BETWEEN ? AND ? AND `type` is not null AND `type` in (?)", stUTC, edUTC, types).
-		Find(&hispos).Error; err != nil {
+	query := d.db.Table(posDataPrefix+deviceID).
+		Where("loc_time BETWEEN ? AND ? AND `type` is not null AND `type` in (?)", stUTC, edUTC, types)
+	if !withRejected {
+		query = query.Where("rejected = 0")
+	}
+	if err := query.Find(&hispos).Error; err != nil {
 		return nil, fmt.Errorf("select his_pos_%s failed. error=%v ", deviceID, err)
 	}
 	return hispos, nil
 }
 
+// UpgradePosTables 为旧版本创建的轨迹表及其模板表补上异常点标记列，启动时执行，已有该列的表跳过
+// 模板表必须一起升级，新设备的轨迹表由它复制而来
+func (d *MysqlRepository) UpgradePosTables() error {
+	var tables []string
+	if err := d.db.Raw(`
+        SELECT t.table_name
+        FROM information_schema.tables t
+        WHERE t.table_schema = DATABASE()
+        AND (t.table_name LIKE ? OR t.table_name = ?)
+        AND NOT EXISTS (
+            SELECT 1 FROM information_schema.columns c
+            WHERE c.table_schema = t.table_schema AND c.table_name = t.table_name AND c.column_name = 'rejected')`,
+		posDataPrefix+"%", "device_his_pos_template").Scan(&tables).Error; err != nil {
+		return fmt.Errorf("query pos tables failed: %v", err)
+	}
+	for _, tbl := range tables {
+		if err := d.db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN rejected TINYINT(1) NOT NULL DEFAULT 0, "+
+			"ADD COLUMN reject_reason VARCHAR(32)", tbl)).Error; err != nil {
+			return fmt.Errorf("upgrade %s failed: %v", tbl, err)
+		}
+	}
+	return nil
+}
+
 func (d *MysqlRepository) UpdateDeviceAvatar(deviceID string, avatar string) error {
 	var device mxm.Device
 	if err := d.db.Model(device).Where("id = ?", deviceID).Update("avatar_url", avatar).Error; err != nil {
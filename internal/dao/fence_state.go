@@ -0,0 +1,56 @@
+package dao
+
+import (
+	"fmt"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func (d *MysqlRepository) GetFenceStates(deviceID string) ([]*mxm.FenceState, error) {
+	var lst []*mxm.FenceState
+	if err := d.db.Where("device_id = ?", deviceID).Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query fence states of device(%s) error, %v", deviceID, err)
+	}
+	return lst, nil
+}
+
+func (d *MysqlRepository) SaveFenceState(s *mxm.FenceState) error {
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(s).Error; err != nil {
+		return fmt.Errorf("save fence state(%s, %s) error, %v", s.DeviceID, s.RegionName, err)
+	}
+	return nil
+}
+
+// DeleteFenceState 围栏修改后重新判断内外状态
+func (d *MysqlRepository) DeleteFenceState(deviceID, regionName string) error {
+	if err := d.db.Where("device_id = ? AND region_name = ?", deviceID, regionName).
+		Delete(&mxm.FenceState{}).Error; err != nil {
+		return fmt.Errorf("delete fence state(%s, %s) error, %v", deviceID, regionName, err)
+	}
+	return nil
+}
+
+func (d *MysqlRepository) AddFenceEvent(e *mxm.FenceEvent) error {
+	if err := d.db.Create(e).Error; err != nil {
+		return fmt.Errorf("add fence event(%s, %s) error, %v", e.DeviceID, e.RegionName, err)
+	}
+	return nil
+}
+
+// GetFenceEvents 按时间倒序分页查询设备的围栏事件，同时返回总数
+func (d *MysqlRepository) GetFenceEvents(deviceID string, limit, offset int) ([]*mxm.FenceEvent, int64, error) {
+	var total int64
+	query := func() *gorm.DB {
+		return d.db.Model(&mxm.FenceEvent{}).Where("device_id = ?", deviceID)
+	}
+	if err := query().Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("count fence events of device(%s) error, %v", deviceID, err)
+	}
+	var lst []*mxm.FenceEvent
+	if err := query().Order("time DESC, id DESC").Limit(limit).Offset(offset).Find(&lst).Error; err != nil {
+		return nil, 0, fmt.Errorf("query fence events of device(%s) error, %v", deviceID, err)
+	}
+	return lst, total, nil
+}
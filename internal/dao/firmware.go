@@ -0,0 +1,147 @@
+package dao
+
+import (
+	"fmt"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"gorm.io/gorm"
+)
+
+func (d *MysqlRepository) CreateFirmware(fw *mxm.Firmware) error {
+	if err := d.db.Create(fw).Error; err != nil {
+		return fmt.Errorf("insert into firmwares error, %v", err)
+	}
+	return nil
+}
+
+func (d *MysqlRepository) GetFirmware(id uint) (*mxm.Firmware, error) {
+	var fw mxm.Firmware
+	if err := d.db.Where("id = ?", id).First(&fw).Error; err != nil {
+		return nil, fmt.Errorf("query firmware(%d) error, %v", id, err)
+	}
+	return &fw, nil
+}
+
+func (d *MysqlRepository) GetFirmwares() ([]*mxm.Firmware, error) {
+	var lst []*mxm.Firmware
+	if err := d.db.Order("id DESC").Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query firmwares error, %v", err)
+	}
+	return lst, nil
+}
+
+// CreateRollout 创建升级任务及其目标设备，目标设备初始为pending
+func (d *MysqlRepository) CreateRollout(r *mxm.Rollout, deviceIDs []string) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Firmware").Create(r).Error; err != nil {
+			return fmt.Errorf("insert into ota_rollouts error, %v", err)
+		}
+		if len(deviceIDs) == 0 {
+			return nil
+		}
+		lst := make([]*mxm.RolloutDevice, 0, len(deviceIDs))
+		for _, id := range deviceIDs {
+			lst = append(lst, &mxm.RolloutDevice{RolloutID: r.ID, DeviceID: id, State: mxm.OTA_PENDING})
+		}
+		if err := tx.CreateInBatches(lst, 500).Error; err != nil {
+			return fmt.Errorf("insert into ota_rollout_devices error, %v", err)
+		}
+		return nil
+	})
+}
+
+func (d *MysqlRepository) GetRollout(id uint) (*mxm.Rollout, error) {
+	var r mxm.Rollout
+	if err := d.db.Preload("Firmware").Where("id = ?", id).First(&r).Error; err != nil {
+		return nil, fmt.Errorf("query rollout(%d) error, %v", id, err)
+	}
+	return &r, nil
+}
+
+func (d *MysqlRepository) GetRollouts() ([]*mxm.Rollout, error) {
+	var lst []*mxm.Rollout
+	if err := d.db.Preload("Firmware").Order("id DESC").Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query rollouts error, %v", err)
+	}
+	return lst, nil
+}
+
+func (d *MysqlRepository) UpdateRollout(id uint, updates map[string]interface{}) error {
+	if err := d.db.Model(&mxm.Rollout{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return fmt.Errorf("update rollout(%d) error, %v", id, err)
+	}
+	return nil
+}
+
+func (d *MysqlRepository) GetRolloutDevices(rolloutID uint) ([]*mxm.RolloutDevice, error) {
+	var lst []*mxm.RolloutDevice
+	if err := d.db.Where("rollout_id = ?", rolloutID).Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query rollout(%d) devices error, %v", rolloutID, err)
+	}
+	return lst, nil
+}
+
+// StageRolloutDevices 将设备纳入放量范围
+func (d *MysqlRepository) StageRolloutDevices(rolloutID uint, deviceIDs []string) error {
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	if err := d.db.Model(&mxm.RolloutDevice{}).Where("rollout_id = ? AND device_id IN ?", rolloutID, deviceIDs).
+		Update("staged", true).Error; err != nil {
+		return fmt.Errorf("stage rollout(%d) devices error, %v", rolloutID, err)
+	}
+	return nil
+}
+
+// GetPendingRolloutDevices 返回进行中任务里已放量、待下发的设备
+func (d *MysqlRepository) GetPendingRolloutDevices(limit int) ([]*mxm.RolloutDevice, error) {
+	var lst []*mxm.RolloutDevice
+	if err := d.db.Joins("JOIN ota_rollouts ON ota_rollouts.id = ota_rollout_devices.rollout_id").
+		Where("ota_rollouts.status = ? AND ota_rollout_devices.staged = ? AND ota_rollout_devices.state = ?",
+			mxm.ROLLOUT_ACTIVE, true, mxm.OTA_PENDING).
+		Limit(limit).Find(&lst).Error; err != nil {
+		return nil, fmt.Errorf("query pending rollout devices error, %v", err)
+	}
+	return lst, nil
+}
+
+func (d *MysqlRepository) UpdateRolloutDevice(rolloutID uint, deviceID string, updates map[string]interface{}) error {
+	if err := d.db.Model(&mxm.RolloutDevice{}).Where("rollout_id = ? AND device_id = ?", rolloutID, deviceID).
+		Updates(updates).Error; err != nil {
+		return fmt.Errorf("update rollout(%d) device(%s) error, %v", rolloutID, deviceID, err)
+	}
+	return nil
+}
+
+// ConfirmFirmwareVersion 设备上报的版本与目标固件一致时，未完成的升级记为applied
+func (d *MysqlRepository) ConfirmFirmwareVersion(deviceID, version string) (int64, error) {
+	res := d.db.Exec(`UPDATE ota_rollout_devices rd
+		JOIN ota_rollouts r ON r.id = rd.rollout_id
+		JOIN firmwares f ON f.id = r.firmware_id
+		SET rd.state = ?, rd.last_error = '', rd.updated_at = ?
+		WHERE rd.device_id = ? AND rd.state IN ? AND f.version = ?`,
+		mxm.OTA_APPLIED, time.Now(), deviceID, []string{mxm.OTA_PENDING, mxm.OTA_DOWNLOADING}, version)
+	if res.Error != nil {
+		return 0, fmt.Errorf("confirm firmware version of device(%s) error, %v", deviceID, res.Error)
+	}
+	return res.RowsAffected, nil
+}
+
+// FailFirmwareCommand 设备拒绝升级指令时，对应的升级记为failed
+func (d *MysqlRepository) FailFirmwareCommand(deviceID string, commandID int64, msg string) error {
+	if err := d.db.Model(&mxm.RolloutDevice{}).Where("device_id = ? AND command_id = ? AND state = ?", deviceID, commandID, mxm.OTA_DOWNLOADING).
+		Updates(map[string]interface{}{"state": mxm.OTA_FAILED, "last_error": msg}).Error; err != nil {
+		return fmt.Errorf("fail firmware command(%s, %d) error, %v", deviceID, commandID, err)
+	}
+	return nil
+}
+
+// ExpireRolloutDevices 下发后超过期限仍未上报目标版本的设备记为failed
+func (d *MysqlRepository) ExpireRolloutDevices(before time.Time) error {
+	if err := d.db.Model(&mxm.RolloutDevice{}).Where("state = ? AND updated_at < ?", mxm.OTA_DOWNLOADING, before).
+		Updates(map[string]interface{}{"state": mxm.OTA_FAILED, "last_error": "timeout waiting for new version"}).Error; err != nil {
+		return fmt.Errorf("expire rollout devices error, %v", err)
+	}
+	return nil
+}
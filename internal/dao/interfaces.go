@@ -30,9 +30,11 @@ type DeviceRepository interface {
 	AddHisData(deviceID string, raw []byte) error
 	AddPosHis(deviceID string, loc *mxm.Location) error
 	GetPosHis(deviceID, startTime, endTime string, types []string) ([]*mxm.Location, error)
+	GetRawPosHis(deviceID, startTime, endTime string, types []string) ([]*mxm.Location, error)
 
 	// 设备相关表管理
 	CreateDeviceTables(deviceID string) error
+	UpgradePosTables() error
 	DropDeviceTables(deviceID string) error
 }
 
@@ -74,6 +76,15 @@ type SafeRegionRepository interface {
 	CreateSafeRegion(region interface{}) error
 	UpdateSafeRegion(regionID uint, updates map[string]interface{}) error
 	DeleteSafeRegion(regionID uint) error
+
+	// 围栏内外状态
+	GetFenceStates(deviceID string) ([]*mxm.FenceState, error)
+	SaveFenceState(s *mxm.FenceState) error
+	DeleteFenceState(deviceID, regionName string) error
+
+	// 围栏事件
+	AddFenceEvent(e *mxm.FenceEvent) error
+	GetFenceEvents(deviceID string, limit, offset int) ([]*mxm.FenceEvent, int64, error)
 }
 
 // StepsRepository 步数统计相关数据访问接口
@@ -109,6 +120,59 @@ type SettingsRepository interface {
 	GetAutoPowerParams(id string) (*mxm.AutoPowerParam, error)
 }
 
+// FirmwareRepository 固件及升级任务相关数据访问接口
+type FirmwareRepository interface {
+	CreateFirmware(fw *mxm.Firmware) error
+	GetFirmware(id uint) (*mxm.Firmware, error)
+	GetFirmwares() ([]*mxm.Firmware, error)
+
+	CreateRollout(r *mxm.Rollout, deviceIDs []string) error
+	GetRollout(id uint) (*mxm.Rollout, error)
+	GetRollouts() ([]*mxm.Rollout, error)
+	UpdateRollout(id uint, updates map[string]interface{}) error
+	GetRolloutDevices(rolloutID uint) ([]*mxm.RolloutDevice, error)
+	StageRolloutDevices(rolloutID uint, deviceIDs []string) error
+	GetPendingRolloutDevices(limit int) ([]*mxm.RolloutDevice, error)
+	UpdateRolloutDevice(rolloutID uint, deviceID string, updates map[string]interface{}) error
+
+	// 设备上报结果回写
+	ConfirmFirmwareVersion(deviceID, version string) (int64, error)
+	FailFirmwareCommand(deviceID string, commandID int64, msg string) error
+	ExpireRolloutDevices(before time.Time) error
+}
+
+// CommandQueueRepository 离线指令队列数据访问接口
+type CommandQueueRepository interface {
+	AddQueuedCommand(cmd *mxm.QueuedCommand) error
+	GetQueuedCommands(deviceID string) ([]*mxm.QueuedCommand, error)
+	GetQueuedDeviceIDs() ([]string, error)
+	ClaimQueuedCommand(id int64) (bool, error)
+	UpdateQueuedCommand(id int64, updates map[string]interface{}) error
+	AckQueuedCommand(deviceID string, commandID int64, succeed bool, msg string) (*mxm.QueuedCommand, error)
+	ExpireQueuedCommands(now time.Time) ([]*mxm.QueuedCommand, error)
+}
+
+// CommandHistoryRepository 指令历史数据访问接口
+type CommandHistoryRepository interface {
+	AddCommandRecord(rec *mxm.CommandRecord) error
+	UpdateCommandRecord(deviceID string, commandID int64, updates map[string]interface{}) error
+	ReplyCommandRecord(deviceID string, commandID int64, succeed bool, reply string, at time.Time) error
+	GetCommandRecords(deviceID string, st, ed time.Time, limit, offset int) ([]*mxm.CommandRecord, int64, error)
+	MaxCommandID() (int64, error)
+}
+
+// CommandScheduleRepository 定时指令数据访问接口
+type CommandScheduleRepository interface {
+	CreateCommandSchedule(s *mxm.CommandSchedule) error
+	GetCommandSchedule(id uint) (*mxm.CommandSchedule, error)
+	GetCommandSchedules(deviceID string) ([]*mxm.CommandSchedule, error)
+	GetSchedulesByDevices(deviceIDs []string) ([]*mxm.CommandSchedule, error)
+	UpdateCommandSchedule(id uint, updates map[string]interface{}) error
+	DeleteCommandSchedule(id uint) error
+	GetDueSchedules(now time.Time, limit int) ([]*mxm.CommandSchedule, error)
+	ClaimSchedule(id uint, prev time.Time, next *time.Time, enabled bool) (bool, error)
+}
+
 // Repository 统一的数据访问接口
 type Repository interface {
 	DeviceRepository
@@ -120,4 +184,8 @@ type Repository interface {
 	OrderRepository
 	FeedbackRepository
 	SettingsRepository
+	FirmwareRepository
+	CommandQueueRepository
+	CommandHistoryRepository
+	CommandScheduleRepository
 }
@@ -16,6 +16,9 @@ type safeRegionDB struct {
 	Type     string `gorm:"column:type"`
 	Name     string `gorm:"column:name"`
 	AreaJSON string `gorm:"column:area"` // 存储Area的JSON描述
+	Trigger  string `gorm:"column:trigger_type"`
+	Schedule string `gorm:"column:schedule"` // 生效时段JSON
+	Dwell    int    `gorm:"column:dwell"`
 }
 
 // 将mxm.Region转换为safeRegionDB
@@ -25,42 +28,42 @@ func regionToDBModel(deviceId string, region *mxm.Region) (*safeRegionDB, error)
 	if err != nil {
 		return nil, fmt.Errorf("marshal area failed: %v", err)
 	}
+	schedule, err := json.Marshal(region.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("marshal schedule failed: %v", err)
+	}
 
 	return &safeRegionDB{
 		DeviceId: deviceId,
 		Type:     region.Type,
 		Name:     region.Name,
 		AreaJSON: string(areaJSON),
+		Trigger:  region.Trigger,
+		Schedule: string(schedule),
+		Dwell:    region.Dwell,
 	}, nil
 }
 
 // 将safeRegionDB转换为mxm.Region
 func dbModelToRegion(db *safeRegionDB) (*mxm.Region, error) {
 	region := &mxm.Region{
-		Type: db.Type,
-		Name: db.Name,
+		Type:    db.Type,
+		Name:    db.Name,
+		Trigger: db.Trigger,
+		Dwell:   db.Dwell,
 	}
-
-	// 根据Type解析Area
-	var err error
-	switch db.Type {
-	case "circle":
-		var circle mxm.Circle
-		if err = json.Unmarshal([]byte(db.AreaJSON), &circle); err == nil {
-			region.Area = &circle
-		}
-	case "rectangle":
-		var rectangle mxm.Rectangle
-		if err = json.Unmarshal([]byte(db.AreaJSON), &rectangle); err == nil {
-			region.Area = &rectangle
+	if db.Schedule != "" {
+		if err := json.Unmarshal([]byte(db.Schedule), &region.Schedule); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal schedule: %v", err)
 		}
-	default:
-		return nil, fmt.Errorf("unknown region type: %s", db.Type)
 	}
 
+	// 根据Type解析Area
+	area, err := mxm.NewArea(db.Type, []byte(db.AreaJSON))
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal area: %v", err)
 	}
+	region.Area = area
 
 	return region, nil
 }
@@ -91,6 +94,7 @@ func (d *MysqlRepository) SetSafeRegion(deviceId string, region *mxm.Region) err
 	} else if err == nil {
 		if err := d.db.Table("safe_region").
 			Where("device_id = ? AND name = ?", deviceId, region.Name).
+			Select("type", "area", "trigger_type", "schedule", "dwell"). // 触发方式等可改回零值
 			Updates(dbModel).Error; err != nil {
 			return fmt.Errorf("set into safe_region error,%v", err)
 		}
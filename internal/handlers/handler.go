@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -17,6 +18,7 @@ import (
 	"github.com/Daneel-Li/gps-back/internal/config"
 	mxm "github.com/Daneel-Li/gps-back/internal/models"
 	"github.com/Daneel-Li/gps-back/internal/services"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
 	"github.com/Daneel-Li/gps-back/pkg/utils"
 
 	"github.com/gorilla/mux"
@@ -157,11 +159,13 @@ func (h *SimpleHandler) handleError(w http.ResponseWriter, err error) {
 	slog.Error("Handler error", "error", err)
 
 	switch {
-	case h.isNotFoundError(err):
+	case h.isNotFoundError(err), errors.Is(err, services.ErrScheduleNotFound):
 		http.Error(w, "Resource not found", http.StatusNotFound)
 	case h.isPermissionError(err):
 		http.Error(w, "Permission denied", http.StatusForbidden)
-	case h.isValidationError(err):
+	case h.isValidationError(err), errors.Is(err, vendors.ErrUnsupportedCommand), errors.Is(err, vendors.ErrInvalidArgument),
+		errors.Is(err, services.ErrInvalidOta), errors.Is(err, services.ErrInvalidSchedule), errors.Is(err, services.ErrInvalidTimezone),
+		errors.Is(err, services.ErrInvalidRegion):
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	default:
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -208,7 +212,10 @@ func (h *SimpleHandler) GetTrack(w http.ResponseWriter, r *http.Request) {
 	}
 	types := strings.Split(typeList, ",")
 
-	track, err := h.services.GetDeviceTrack(r.Context(), deviceId, startTime, endTime, types)
+	// rejected=true also returns the fixes dropped by the track filter, for auditing
+	withRejected := query.Get("rejected") == "true"
+
+	track, err := h.services.GetDeviceTrack(r.Context(), deviceId, startTime, endTime, types, withRejected)
 	if err != nil {
 		h.handleError(w, err)
 		return
@@ -232,6 +239,19 @@ func (h *SimpleHandler) GetReportInterval(w http.ResponseWriter, r *http.Request
 	})
 }
 
+// GetCapabilities gets the commands supported by the device
+func (h *SimpleHandler) GetCapabilities(w http.ResponseWriter, r *http.Request) {
+	deviceId := mux.Vars(r)["device_id"]
+
+	caps, err := h.services.GetCapabilities(r.Context(), deviceId)
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+
+	utils.WriteHttpResponse(w, http.StatusOK, caps)
+}
+
 // GetAutoPower gets scheduled power on/off parameters
 func (h *SimpleHandler) GetAutoPower(w http.ResponseWriter, r *http.Request) {
 	deviceId := mux.Vars(r)["device_id"]
@@ -296,14 +316,37 @@ func (h *SimpleHandler) GetAlarms(w http.ResponseWriter, r *http.Request) {
 	utils.WriteHttpResponse(w, http.StatusOK, alarms)
 }
 
+// maxCommandWait caps how long a synchronous command request may block
+const maxCommandWait = 60 * time.Second
+
+// parseWait accepts a Go duration such as 10s, or plain seconds
+func parseWait(v string) (time.Duration, error) {
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
 // Command handles device commands
+// With ?wait=10s the request blocks until the device replies or the wait ends, and the result is returned
 func (h *SimpleHandler) Command(w http.ResponseWriter, r *http.Request) {
 	deviceId := mux.Vars(r)["device_id"]
 
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := parseWait(v)
+		if err != nil || d <= 0 || d > maxCommandWait {
+			http.Error(w, "wait must be a duration between 1s and 60s", http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+
 	var req struct {
 		Action      string `json:"action"`
 		Args        string `json:"args"`
 		TerminalKey string `json:"terminal_key,omitempty"`
+		ExpireIn    int    `json:"expire_in,omitempty"` // seconds a command for an offline device stays queued
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -319,7 +362,51 @@ func (h *SimpleHandler) Command(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	commandID, err := h.services.ExecuteCommand(r.Context(), deviceId, action, args, req.TerminalKey)
+	// RAW passes args through to the vendor unchanged, admin only
+	if action == vendors.ACTION_RAW {
+		userID := h.getUserIDFromContext(r.Context())
+		if !h.services.IsAdmin(r.Context(), userID) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if req.Args == "" {
+			http.Error(w, "args is required for RAW", http.StatusBadRequest)
+			return
+		}
+		commandID, err := h.services.ExecuteRawCommand(r.Context(), userID, deviceId, req.Args, req.TerminalKey)
+		if err != nil {
+			h.handleError(w, err)
+			return
+		}
+		utils.WriteHttpResponse(w, http.StatusOK, map[string]interface{}{
+			"command_id": commandID,
+		})
+		return
+	}
+
+	userID := h.getUserIDFromContext(r.Context())
+	expireIn := time.Duration(req.ExpireIn) * time.Second
+	if wait > 0 {
+		commandID, state, result, err := h.services.ExecuteCommandAndWait(r.Context(), userID, deviceId, action, args,
+			req.TerminalKey, expireIn, wait)
+		if err != nil {
+			h.handleError(w, err)
+			return
+		}
+		// 202 when the device has not replied yet, the result still arrives over WebSocket
+		status := http.StatusOK
+		if result == nil {
+			status = http.StatusAccepted
+		}
+		utils.WriteHttpResponse(w, status, map[string]interface{}{
+			"command_id": commandID,
+			"state":      state,
+			"result":     result,
+		})
+		return
+	}
+
+	commandID, state, err := h.services.ExecuteCommand(r.Context(), userID, deviceId, action, args, req.TerminalKey, expireIn)
 	if err != nil {
 		h.handleError(w, err)
 		return
@@ -327,9 +414,62 @@ func (h *SimpleHandler) Command(w http.ResponseWriter, r *http.Request) {
 
 	utils.WriteHttpResponse(w, http.StatusOK, map[string]interface{}{
 		"command_id": commandID,
+		"state":      state,
 	})
 }
 
+// GetCommands gets the command history of a device, newest first
+func (h *SimpleHandler) GetCommands(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deviceId := mux.Vars(r)["device_id"]
+
+	// Same time format as track queries, defaults to the last 30 days
+	ed := time.Now()
+	if v := query.Get("endTime"); v != "" {
+		t, err := time.ParseInLocation("2006-1-2 15:4:5", v, time.Local)
+		if err != nil {
+			http.Error(w, "invalid endTime", http.StatusBadRequest)
+			return
+		}
+		ed = t
+	}
+	st := ed.AddDate(0, 0, -30)
+	if v := query.Get("startTime"); v != "" {
+		t, err := time.ParseInLocation("2006-1-2 15:4:5", v, time.Local)
+		if err != nil {
+			http.Error(w, "invalid startTime", http.StatusBadRequest)
+			return
+		}
+		st = t
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	offset, _ := strconv.Atoi(query.Get("offset"))
+
+	records, total, err := h.services.GetCommandHistory(r.Context(), h.getUserIDFromContext(r.Context()), deviceId, st, ed, limit, offset)
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+
+	utils.WriteHttpResponse(w, http.StatusOK, map[string]interface{}{"total": total, "data": records})
+}
+
+// GetFenceEvents lists fired and suppressed fence rule evaluations, newest first
+func (h *SimpleHandler) GetFenceEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deviceId := mux.Vars(r)["device_id"]
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	offset, _ := strconv.Atoi(query.Get("offset"))
+
+	events, total, err := h.services.GetFenceEvents(r.Context(), h.getUserIDFromContext(r.Context()), deviceId, limit, offset)
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+
+	utils.WriteHttpResponse(w, http.StatusOK, map[string]interface{}{"total": total, "data": events})
+}
+
 // GetSteps gets step count data
 func (h *SimpleHandler) GetSteps(w http.ResponseWriter, r *http.Request) {
 	deviceId := mux.Vars(r)["device_id"]
@@ -658,6 +798,32 @@ func (h *SimpleHandler) EnrollDeviceHandler(w http.ResponseWriter, r *http.Reque
 	utils.WriteHttpResponse(w, http.StatusOK, "success")
 }
 
+// ListDrivers lists vendor drivers and their health, admin only
+func (h *SimpleHandler) ListDrivers(w http.ResponseWriter, r *http.Request) {
+	if !h.services.IsAdmin(r.Context(), h.getUserIDFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	utils.WriteHttpResponse(w, http.StatusOK, h.services.ListDrivers(r.Context()))
+}
+
+// RestartDriver restarts a vendor driver in the background, admin only
+func (h *SimpleHandler) RestartDriver(w http.ResponseWriter, r *http.Request) {
+	if !h.services.IsAdmin(r.Context(), h.getUserIDFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if err := h.services.RestartDriver(r.Context(), name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	utils.WriteHttpResponse(w, http.StatusAccepted, "restarting")
+}
+
 // LoginHandler handles mini program login requests
 func (h *SimpleHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Login handler")
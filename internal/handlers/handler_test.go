@@ -959,3 +959,25 @@ func TestErrorTypeChecking(t *testing.T) {
 func stringPtr(s string) *string {
 	return &s
 }
+
+func TestDedupLowBattery(t *testing.T) {
+	mp := NewMessageProcessor(nil, nil, nil, nil, nil, nil)
+	level := func(e int, alarms ...mxm.Alarm) []mxm.Alarm {
+		status := &mxm.DeviceStatus1{Device: &mxm.Device{Electricity: &e}, Alarms: alarms}
+		mp.dedupLowBattery("dev1", status)
+		return status.Alarms
+	}
+	deviceAlarm := mxm.Alarm{Type: mxm.LOW_BATERY, Msg: "15%"}
+
+	// The device-raised alarm and the level check alarm only once per discharge
+	assert.Len(t, level(15, deviceAlarm), 1)
+	assert.Empty(t, level(15))
+	assert.Empty(t, level(22, deviceAlarm))
+	// Re-armed once the battery has recovered
+	assert.Empty(t, level(35))
+	alarms := level(18)
+	assert.Len(t, alarms, 1)
+	assert.Equal(t, mxm.LOW_BATERY, alarms[0].Type)
+	// Other alarms pass through
+	assert.Len(t, level(18, mxm.Alarm{Type: mxm.POWER_OFF}), 1)
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/Daneel-Li/gps-back/internal/dao"
@@ -11,14 +12,81 @@ import (
 	"github.com/Daneel-Li/gps-back/pkg/utils"
 )
 
+// CommandQueue delivers the commands held for a device while it was offline
+type CommandQueue interface {
+	DeliverQueuedCommands(deviceID string)
+}
+
+// FenceChecker tracks which safe regions a device is in and reports enter/exit alarms
+type FenceChecker interface {
+	CheckFences(deviceID string, loc *mxm.Location) []mxm.Alarm
+}
+
+// LocationFilter flags impossible jumps and smooths fixes before they are stored
+type LocationFilter interface {
+	FilterLocation(deviceID string, loc *mxm.Location)
+}
+
+// Battery levels for the low battery alarm; it is raised once below the threshold and re-armed
+// only after the level recovers past the reset level, so a level hovering at the threshold alarms once
+const (
+	_LOW_BATTERY_LEVEL = 20
+	_LOW_BATTERY_RESET = 30
+)
+
 type MessageProcessor struct {
 	repo        dao.Repository
 	wsManager   *services.WSManager
 	cmdsManager services.CommandManager
+	cmdQueue    CommandQueue
+	fences      FenceChecker
+	filter      LocationFilter
+	lowBattery  sync.Map // devices already alarmed for low battery
+}
+
+func NewMessageProcessor(repo dao.Repository, wsManager *services.WSManager, cmdManager services.CommandManager,
+	cmdQueue CommandQueue, fences FenceChecker, filter LocationFilter) *MessageProcessor {
+	return &MessageProcessor{
+		repo:        repo,
+		wsManager:   wsManager,
+		cmdsManager: cmdManager,
+		cmdQueue:    cmdQueue,
+		fences:      fences,
+		filter:      filter,
+	}
 }
 
-func NewMessageProcessor(repo dao.Repository, wsManager *services.WSManager, cmdManager services.CommandManager) *MessageProcessor {
-	return &MessageProcessor{repo, wsManager, cmdManager}
+// dedupLowBattery keeps one low battery alarm per discharge, whether the device raises it itself
+// or only reports its level, and drops repeats from status.Alarms
+func (mp *MessageProcessor) dedupLowBattery(devID string, status *mxm.DeviceStatus1) {
+	var alarms []mxm.Alarm
+	for _, a := range status.Alarms {
+		if a.Type == mxm.LOW_BATERY {
+			if _, alarmed := mp.lowBattery.LoadOrStore(devID, struct{}{}); alarmed {
+				continue
+			}
+		}
+		alarms = append(alarms, a)
+	}
+	status.Alarms = alarms
+
+	d := status.Device
+	if d == nil || d.Electricity == nil {
+		return
+	}
+	if *d.Electricity >= _LOW_BATTERY_RESET {
+		mp.lowBattery.Delete(devID)
+		return
+	}
+	if *d.Electricity < _LOW_BATTERY_LEVEL {
+		if _, alarmed := mp.lowBattery.LoadOrStore(devID, struct{}{}); !alarmed {
+			at := time.Now()
+			if d.LastOnline != nil {
+				at = *d.LastOnline
+			}
+			status.Alarms = append(status.Alarms, mxm.Alarm{Time: at, Type: mxm.LOW_BATERY, Msg: fmt.Sprintf("%v%%", *d.Electricity)})
+		}
+	}
 }
 
 func (mp *MessageProcessor) Process(status *mxm.DeviceStatus1) error {
@@ -38,26 +106,37 @@ func (mp *MessageProcessor) Process(status *mxm.DeviceStatus1) error {
 		return fmt.Errorf("get device failed: %v", err)
 	}
 
+	// Any message means the device is reachable now, so flush its queued commands
+	if mp.cmdQueue != nil {
+		go mp.cmdQueue.DeliverQueuedCommands(devID)
+	}
+
 	// Update history data table, as raw interaction data, whether position update, heartbeat or command, all stored for backup
 	if err := mp.repo.AddHisData(devID, status.RawMsg); err != nil {
 		slog.Error("Save history data failed", "error", err, "status", status)
 	}
 
+	// Buffered fixes flushed after a coverage gap only go to the track table, oldest first,
+	// ahead of the newest fix which is written below together with the device row
+	for _, loc := range status.Track {
+		if mp.filter != nil {
+			mp.filter.FilterLocation(devID, loc)
+		}
+		if err := mp.repo.AddPosHis(devID, loc); err != nil {
+			slog.Error("Save buffered pos data failed", "error", err, "loc", loc)
+		}
+	}
+
 	// 2. TODO: Business logic processing (supplement the following implementation)
 	// --------------------------------------------
 	// Example 1: Check if device online status changes
+	// Low battery alarms join the device-raised ones below, so they are stored and pushed too
+	mp.dedupLowBattery(devID, status)
+
+	var fenceAlarms []mxm.Alarm
 	if status.Device != nil {
 		d := status.Device
 		d.ID = &devID
-		if d.Electricity != nil && *d.Electricity < 20 {
-			// TODO Send reminder task
-			mp.repo.AddAlarm(mxm.Alarm{
-				DeviceID: devID,
-				Msg:      fmt.Sprintf("%v%%", *d.Electricity),
-				Time:     *d.LastOnline,
-				Type:     mxm.LOW_BATERY,
-			})
-		}
 
 		// Step count record
 		if d.Steps != nil {
@@ -66,6 +145,15 @@ func (mp *MessageProcessor) Process(status *mxm.DeviceStatus1) error {
 			}
 		}
 
+		// A reported firmware version completes any pending upgrade to that version
+		if d.SwVersion != nil && *d.SwVersion != "" {
+			if n, err := mp.repo.ConfirmFirmwareVersion(devID, *d.SwVersion); err != nil {
+				slog.Error("confirm firmware version failed", "error", err, "deviceID", devID)
+			} else if n > 0 {
+				slog.Info("firmware upgrade applied", "deviceID", devID, "version", *d.SwVersion)
+			}
+		}
+
 		// If positioning fails, coordinates and loctime, only update communication time
 		locFailed := false
 		if d.Latitude == nil || d.Longitude == nil ||
@@ -73,7 +161,33 @@ func (mp *MessageProcessor) Process(status *mxm.DeviceStatus1) error {
 			locFailed = true
 		}
 
-		if locFailed {
+		// Track point (historical track must come from device status to maintain consistency)
+		var loc *mxm.Location
+		if !locFailed {
+			loc = &mxm.Location{
+				Address:    utils.Deref(d.Address, ""),
+				Longitude:  utils.Deref(d.Longitude, 0),
+				Latitude:   utils.Deref(d.Latitude, 0),
+				Altitude:   utils.Deref(d.Altitude, 0),
+				Satellites: utils.Deref(d.Satellites, 0),
+				Type:       utils.Deref(d.LocType, "LBS"),
+				LocTime:    utils.Deref(d.LocTime, time.Now()),
+				Accuracy:   utils.Deref(d.Accuracy, 1000),
+				Speed:      utils.Deref(d.Speed, 0),
+				Heading:    utils.Deref(d.Heading, 0),
+			}
+			if mp.filter != nil {
+				mp.filter.FilterLocation(devID, loc)
+			}
+			if loc.Rejected {
+				slog.Info("location rejected", "deviceID", devID, "reason", loc.RejectReason, "loc", loc)
+			} else {
+				// The device row shows the smoothed position
+				d.Latitude, d.Longitude, d.Accuracy = &loc.Latitude, &loc.Longitude, &loc.Accuracy
+			}
+		}
+
+		if locFailed || loc.Rejected {
 			// Only update partial fields of device status table, no fence check
 			d.LocTime, d.Accuracy, d.Speed, d.Heading, d.Latitude, d.Longitude,
 				d.Address, d.LocType, d.Satellites = nil, nil, nil, nil, nil, nil, nil, nil, nil
@@ -87,70 +201,91 @@ func (mp *MessageProcessor) Process(status *mxm.DeviceStatus1) error {
 				slog.Debug("update device success", "device", dev)
 			}
 		} else {
-			//TODO Fence check
-			// if !locFailed && checkFence(d.Location) {
-			// 	slog.Error("Device out of fence:", "deviceID", devID)
-			// }
 			update := utils.StructToUpdateMap(*d)
 			utils.RemoveGormModelFields(update)
 
 			if dev, err := mp.repo.UpdateDevice(*d.ID, update); err != nil {
 				return fmt.Errorf("update device failed: %v", err)
 			} else {
-				//TODO Broadcast update
-				toNotify := make([]uint, 0)
-				if id, err := mp.repo.GetUserIdByDeviceId(*d.ID); err == nil {
-					toNotify = append(toNotify, id)
-				}
-				if ids, err := mp.repo.GetSharedUserIdsByDeviceId(*d.ID); err == nil {
-					toNotify = append(toNotify, ids...)
-				}
-				mp.wsManager.BroadcastToUsers(toNotify, services.WSMessage{
+				mp.notifyUsers(*d.ID, services.WSMessage{
 					Type: "device_update",
 					Data: dev,
 				})
 				slog.Debug("update device success", "device", dev)
 			}
+		}
 
-			// Update track table (historical track must come from device status to maintain consistency)
-			loc := mxm.Location{
-				Address:    utils.Deref(d.Address, ""),
-				Longitude:  utils.Deref(d.Longitude, 0),
-				Latitude:   utils.Deref(d.Latitude, 0),
-				Altitude:   utils.Deref(d.Altitude, 0),
-				Satellites: utils.Deref(d.Satellites, 0),
-				Type:       utils.Deref(d.LocType, "LBS"),
-				LocTime:    utils.Deref(d.LocTime, time.Now()),
-				Accuracy:   utils.Deref(d.Accuracy, 1000),
-				Speed:      utils.Deref(d.Speed, 0),
-				Heading:    utils.Deref(d.Heading, 0),
-			}
-			if err := mp.repo.AddPosHis(*d.ID, &loc); err != nil {
+		// Rejected fixes are stored with their flag so the raw track can be audited
+		if loc != nil {
+			if err := mp.repo.AddPosHis(devID, loc); err != nil {
 				slog.Error("Save pos data failed", "error", err, "status", status)
 			}
+			// Fence check runs on the newest fix only, buffered track points are history
+			if !loc.Rejected && mp.fences != nil {
+				fenceAlarms = mp.fences.CheckFences(devID, loc)
+			}
+		}
+	}
+	// Device-raised and fence alarms are stored and pushed to everyone who can see the device
+	for _, alarm := range append(status.Alarms, fenceAlarms...) {
+		alarm.DeviceID = devID
+		if err := mp.repo.AddAlarm(alarm); err != nil {
+			slog.Error("save alarm failed", "error", err, "alarm", alarm)
 		}
+		mp.notifyUsers(devID, services.WSMessage{
+			Type: "alarm",
+			Data: alarm,
+		})
 	}
+
 	if status.Command != nil && status.Command.Result != nil {
 		res := status.Command.Result
 
-		pCmd, ok := mp.cmdsManager.GetAndRemoveCommand(res.CommandID)
-		if !ok {
-			return nil // do nothing
+		// Upgrade commands are sent by the rollout dispatcher, not by a terminal, so check them first
+		if !res.Succeed {
+			if err := mp.repo.FailFirmwareCommand(devID, res.CommandID, res.Msg); err != nil {
+				slog.Error("update firmware upgrade failed", "error", err, "commandID", res.CommandID)
+			}
 		}
 
-		// 1. Push notification to client
-		m := &services.WSMessage{
-			Type: "command_result",
-			Data: res,
+		if err := mp.repo.ReplyCommandRecord(devID, res.CommandID, res.Succeed, res.Msg, time.Now()); err != nil {
+			slog.Error("save command reply failed", "error", err, "commandID", res.CommandID)
 		}
-		if err := mp.wsManager.PushMsg(*pCmd.Terminal, m); err != nil {
-			slog.Error("push command result failed", "error", err, "result", res)
+
+		// Commands delivered from the offline queue report their final state to the requester
+		queued, err := mp.repo.AckQueuedCommand(devID, res.CommandID, res.Succeed, res.Msg)
+		if err != nil {
+			slog.Error("ack queued command failed", "error", err, "commandID", res.CommandID)
+		} else if queued != nil {
+			mp.wsManager.BroadcastToUser(queued.UserID, services.WSMessage{
+				Type: "command_state",
+				Data: queued,
+			})
+		}
+
+		var cmd *mxm.Command
+		if pCmd, ok := mp.cmdsManager.GetAndRemoveCommand(res.CommandID); ok {
+			// 1. Hand the result to a synchronous caller and push it to the requesting terminal,
+			// including how many times the command was resent
+			res.Retries = pCmd.Retries
+			pCmd.Complete(res)
+			if pCmd.Terminal != nil {
+				m := &services.WSMessage{
+					Type: "command_result",
+					Data: res,
+				}
+				if err := mp.wsManager.PushMsg(*pCmd.Terminal, m); err != nil {
+					slog.Error("push command result failed", "error", err, "result", res)
+				}
+			}
+			cmd = pCmd.Command
+		} else if queued != nil {
+			cmd = &mxm.Command{Action: queued.Action, Args: queued.Args}
 		}
 		slog.Debug(fmt.Sprintf("command result: %v", res))
 
 		// 2. Some parameters need to be updated based on execution results, such as scheduled power on/off (no query method found yet)
-		if res.Succeed { // Only update database when execution succeeds
-			cmd := pCmd.Command
+		if cmd != nil && res.Succeed { // Only update database when execution succeeds
 			if cmd.Action == "AUTO_START" {
 				mp.repo.UpsertSettingsFields(map[string]interface{}{
 					"device_id":         devID,
@@ -169,3 +304,15 @@ func (mp *MessageProcessor) Process(status *mxm.DeviceStatus1) error {
 
 	return nil
 }
+
+// notifyUsers pushes a message to the device owner and the users it is shared with
+func (mp *MessageProcessor) notifyUsers(devID string, msg services.WSMessage) {
+	toNotify := make([]uint, 0)
+	if id, err := mp.repo.GetUserIdByDeviceId(devID); err == nil {
+		toNotify = append(toNotify, id)
+	}
+	if ids, err := mp.repo.GetSharedUserIdsByDeviceId(devID); err == nil {
+		toNotify = append(toNotify, ids...)
+	}
+	mp.wsManager.BroadcastToUsers(toNotify, msg)
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Daneel-Li/gps-back/internal/config"
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/services"
+	"github.com/Daneel-Li/gps-back/pkg/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// Firmware images are small (a few MB) on the trackers we support
+const maxFirmwareSize = 32 << 20
+
+// Characters allowed from the form in a stored firmware file name
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// UploadFirmware stores a firmware package for a device type and model, admin only
+func (h *SimpleHandler) UploadFirmware(w http.ResponseWriter, r *http.Request) {
+	if !h.services.IsAdmin(r.Context(), h.getUserIDFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFirmwareSize)
+	if err := r.ParseMultipartForm(maxFirmwareSize); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fw := &mxm.Firmware{
+		DeviceType: r.FormValue("device_type"),
+		Model:      r.FormValue("model"),
+		Version:    r.FormValue("version"),
+	}
+	if fw.DeviceType == "" || fw.Version == "" {
+		http.Error(w, "device_type and version are required", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	dir := config.GetConfig().FirmwarePath
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("create firmware dir failed", "err", err)
+		http.Error(w, "failed", http.StatusInternalServerError)
+		return
+	}
+	tmp, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		slog.Error("create firmware file failed", "err", err)
+		http.Error(w, "failed", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	sum := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), file)
+	tmp.Close()
+	if err != nil {
+		http.Error(w, "Unable to save file", http.StatusInternalServerError)
+		return
+	}
+	fw.Size = size
+	fw.MD5 = hex.EncodeToString(sum.Sum(nil))
+	fw.FileName = unsafeFileChars.ReplaceAllString(fmt.Sprintf("%s_%s_%s%s",
+		fw.DeviceType, fw.Version, fw.MD5[:8], filepath.Ext(header.Filename)), "_")
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, fw.FileName)); err != nil {
+		slog.Error("save firmware file failed", "err", err)
+		http.Error(w, "Unable to save file", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.services.CreateFirmware(r.Context(), fw); err != nil {
+		os.Remove(filepath.Join(dir, fw.FileName))
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, fw)
+}
+
+// ListFirmwares lists uploaded firmware packages, admin only
+func (h *SimpleHandler) ListFirmwares(w http.ResponseWriter, r *http.Request) {
+	if !h.services.IsAdmin(r.Context(), h.getUserIDFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	lst, err := h.services.ListFirmwares(r.Context())
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, lst)
+}
+
+// DownloadFirmware serves firmware files to devices, which cannot authenticate
+func (h *SimpleHandler) DownloadFirmware(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["file"]
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		http.Error(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(config.GetConfig().FirmwarePath, name))
+}
+
+// CreateRollout starts upgrading the target devices to a firmware, admin only
+func (h *SimpleHandler) CreateRollout(w http.ResponseWriter, r *http.Request) {
+	userID := h.getUserIDFromContext(r.Context())
+	if !h.services.IsAdmin(r.Context(), userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req services.RolloutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	rollout, err := h.services.CreateRollout(r.Context(), userID, req)
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, rollout)
+}
+
+// UpdateRollout raises the rollout percentage or pauses/resumes it, admin only
+func (h *SimpleHandler) UpdateRollout(w http.ResponseWriter, r *http.Request) {
+	if !h.services.IsAdmin(r.Context(), h.getUserIDFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["rollout_id"], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid rollout_id", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Percent *int    `json:"percent"`
+		Status  *string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.services.UpdateRollout(r.Context(), uint(id), req.Percent, req.Status); err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, "success")
+}
+
+// ListRollouts lists rollouts, admin only
+func (h *SimpleHandler) ListRollouts(w http.ResponseWriter, r *http.Request) {
+	if !h.services.IsAdmin(r.Context(), h.getUserIDFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	lst, err := h.services.ListRollouts(r.Context())
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, lst)
+}
+
+// GetRollout returns rollout progress and the devices that failed, admin only
+func (h *SimpleHandler) GetRollout(w http.ResponseWriter, r *http.Request) {
+	if !h.services.IsAdmin(r.Context(), h.getUserIDFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["rollout_id"], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid rollout_id", http.StatusBadRequest)
+		return
+	}
+	progress, err := h.services.GetRolloutProgress(r.Context(), uint(id))
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, progress)
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Daneel-Li/gps-back/internal/services"
+	"github.com/Daneel-Li/gps-back/pkg/utils"
+	"github.com/gorilla/mux"
+)
+
+// scheduleRequest mirrors the command request: args is a space separated string
+type scheduleRequest struct {
+	Action  string `json:"action"`
+	Args    string `json:"args"`
+	Cron    string `json:"cron"`    // minute hour day month weekday, in the device owner's timezone
+	RunAt   string `json:"run_at"`  // one-shot time, e.g. 2025-06-01 08:00:00 in the device owner's timezone
+	Enabled *bool  `json:"enabled"` // optional, defaults to true on create
+}
+
+func (req scheduleRequest) toService() services.ScheduleRequest {
+	s := services.ScheduleRequest{
+		Action:  strings.ToUpper(req.Action),
+		Cron:    strings.TrimSpace(req.Cron),
+		RunAt:   req.RunAt,
+		Enabled: req.Enabled,
+	}
+	if req.Args != "" {
+		s.Args = strings.Split(req.Args, " ")
+	}
+	return s
+}
+
+// ListSchedules lists the command schedules of a device
+func (h *SimpleHandler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	deviceId := mux.Vars(r)["device_id"]
+
+	lst, err := h.services.ListSchedules(r.Context(), h.getUserIDFromContext(r.Context()), deviceId)
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, lst)
+}
+
+// CreateSchedule creates a one-shot (run_at) or recurring (cron) command schedule
+func (h *SimpleHandler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	deviceId := mux.Vars(r)["device_id"]
+
+	var req scheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	s, err := h.services.CreateSchedule(r.Context(), h.getUserIDFromContext(r.Context()), deviceId, req.toService())
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, s)
+}
+
+// UpdateSchedule changes a schedule, fields left empty keep their value
+func (h *SimpleHandler) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	deviceId := mux.Vars(r)["device_id"]
+	id, err := strconv.ParseUint(mux.Vars(r)["schedule_id"], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid schedule_id", http.StatusBadRequest)
+		return
+	}
+
+	var req scheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	s, err := h.services.UpdateSchedule(r.Context(), h.getUserIDFromContext(r.Context()), deviceId, uint(id), req.toService())
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, s)
+}
+
+// DeleteSchedule deletes a schedule
+func (h *SimpleHandler) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	deviceId := mux.Vars(r)["device_id"]
+	id, err := strconv.ParseUint(mux.Vars(r)["schedule_id"], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid schedule_id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.services.DeleteSchedule(r.Context(), h.getUserIDFromContext(r.Context()), deviceId, uint(id)); err != nil {
+		h.handleError(w, err)
+		return
+	}
+	utils.WriteHttpResponse(w, http.StatusOK, "success")
+}
@@ -6,9 +6,14 @@ import (
 )
 
 const (
-	LOW_BATERY = 1
-	POWER_OFF  = 2
-	OUT_AREA   = 3
+	LOW_BATERY  = 1
+	POWER_OFF   = 2
+	OUT_AREA    = 3
+	SOS         = 4 //紧急求救
+	REMOVED     = 5 //设备被拆除(项圈摘除)
+	IN_AREA     = 6 //进入围栏，Msg为围栏名
+	OFF_ROUTE   = 7 //离开路线围栏，Msg为"围栏名:路段序号:偏离米数"，路段序号从1开始
+	NOT_IN_AREA = 8 //生效时段内不在围栏内(stay_inside)，Msg为围栏名
 )
 
 type Alarm struct {
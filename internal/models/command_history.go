@@ -0,0 +1,31 @@
+package mxm
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// CommandRecord 指令历史，每次下发指令都记录操作人、结果及设备应答，用于审计和售后排查
+type CommandRecord struct {
+	ID        int64                       `gorm:"primaryKey;column:id" json:"-"`
+	CommandID int64                       `gorm:"column:command_id" json:"command_id"` //重发时沿用，同一指令可能有多条记录
+	DeviceID  string                      `gorm:"column:device_id" json:"device_id"`
+	UserID    uint                        `gorm:"column:user_id" json:"user_id"` //操作人
+	Action    string                      `gorm:"column:action" json:"action"`
+	Args      datatypes.JSONSlice[string] `gorm:"column:args" json:"args"`
+	State     string                      `gorm:"column:state" json:"state"`                     //同离线指令状态
+	SendError string                      `gorm:"column:send_error" json:"send_error,omitempty"` //下发失败原因
+	Reply     string                      `gorm:"column:reply" json:"reply,omitempty"`           //设备应答
+	Succeed   *bool                       `gorm:"column:succeed" json:"succeed,omitempty"`
+	LatencyMs *int64                      `gorm:"column:latency_ms" json:"latency_ms,omitempty"` //下发到应答的耗时
+	Retries   int                         `gorm:"column:retries" json:"retries"`                 //超时重发次数
+	SentAt    *time.Time                  `gorm:"column:sent_at" json:"sent_at,omitempty"`
+	RepliedAt *time.Time                  `gorm:"column:replied_at" json:"replied_at,omitempty"`
+	CreatedAt time.Time                   `json:"created_at"`
+	UpdatedAt time.Time                   `json:"updated_at"`
+}
+
+func (CommandRecord) TableName() string {
+	return "command_history"
+}
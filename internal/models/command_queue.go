@@ -0,0 +1,38 @@
+package mxm
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// 离线指令状态
+const (
+	CMD_QUEUED       = "queued"       //设备离线，等待设备上线
+	CMD_DELIVERED    = "delivered"    //已下发，等待设备应答
+	CMD_ACKNOWLEDGED = "acknowledged" //设备已应答，结果见Succeed
+	CMD_EXPIRED      = "expired"      //有效期内设备未上线
+	CMD_FAILED       = "failed"       //设备上线后下发失败
+	CMD_TIMEOUT      = "timeout"      //已下发，设备超时未应答(仅指令历史)
+)
+
+// QueuedCommand 设备离线时暂存的指令，设备下次上报时按顺序下发
+type QueuedCommand struct {
+	ID          int64                       `gorm:"primaryKey;column:id" json:"-"`
+	CommandID   int64                       `gorm:"column:command_id" json:"command_id"`
+	DeviceID    string                      `gorm:"column:device_id" json:"device_id"`
+	UserID      uint                        `gorm:"column:user_id" json:"user_id"`
+	TerminalKey string                      `gorm:"column:terminal_key" json:"-"`
+	Action      string                      `gorm:"column:action" json:"action"`
+	Args        datatypes.JSONSlice[string] `gorm:"column:args" json:"args"`
+	State       string                      `gorm:"column:state" json:"state"`
+	Succeed     *bool                       `gorm:"column:succeed" json:"succeed,omitempty"`
+	Msg         string                      `gorm:"column:msg" json:"msg,omitempty"`
+	ExpireAt    time.Time                   `gorm:"column:expire_at" json:"expire_at"`
+	CreatedAt   time.Time                   `json:"created_at"`
+	UpdatedAt   time.Time                   `json:"updated_at"`
+}
+
+func (QueuedCommand) TableName() string {
+	return "command_queue"
+}
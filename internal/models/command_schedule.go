@@ -0,0 +1,31 @@
+package mxm
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// CommandSchedule 定时指令，Cron为空时在RunAt单次执行，否则按cron表达式周期执行，
+// 时间均按设备主人的时区计算
+type CommandSchedule struct {
+	ID            uint                        `gorm:"primaryKey" json:"id"`
+	DeviceID      string                      `gorm:"column:device_id" json:"device_id"`
+	UserID        uint                        `gorm:"column:user_id" json:"user_id"` //创建人
+	Action        string                      `gorm:"column:action" json:"action"`
+	Args          datatypes.JSONSlice[string] `gorm:"column:args" json:"args"`
+	Cron          string                      `gorm:"column:cron" json:"cron,omitempty"` //分 时 日 月 周
+	RunAt         *time.Time                  `gorm:"column:run_at" json:"run_at,omitempty"`
+	Enabled       bool                        `gorm:"column:enabled" json:"enabled"`
+	NextRunAt     *time.Time                  `gorm:"column:next_run_at" json:"next_run_at,omitempty"`
+	LastRunAt     *time.Time                  `gorm:"column:last_run_at" json:"last_run_at,omitempty"`
+	LastCommandID int64                       `gorm:"column:last_command_id" json:"last_command_id,omitempty"` //最近一次下发的指令，结果见指令历史
+	LastState     string                      `gorm:"column:last_state" json:"last_state,omitempty"`
+	LastError     string                      `gorm:"column:last_error" json:"last_error,omitempty"`
+	CreatedAt     time.Time                   `json:"created_at"`
+	UpdatedAt     time.Time                   `json:"updated_at"`
+}
+
+func (CommandSchedule) TableName() string {
+	return "command_schedules"
+}
@@ -45,6 +45,18 @@ type Device struct {
 	Sex           *string    `json:"sex"`
 	Weight        *int       `json:"weight"`
 	Buzzer        *bool      `json:"buzzer"`
+
+	// 车载终端状态
+	Ignition       *bool    `json:"ignition"`        //点火状态(ACC)
+	BatteryVoltage *float64 `json:"battery_voltage"` //电池电压(V)
+	Odometer       *float64 `json:"odometer"`        //总里程(km)
+
+	// 固件信息，由设备信息上报更新
+	SwVersion     *string `gorm:"column:sw_version" json:"sw_version"`         //软件版本
+	HwVersion     *string `gorm:"column:hw_version" json:"hw_version"`         //硬件版本
+	Project       *string `gorm:"column:project" json:"project"`               //固件项目名
+	LuatosVersion *string `gorm:"column:luatos_version" json:"luatos_version"` //LuatOS内核版本
+
 	// 关联关系（可选）
 	User *User `gorm:"foreignKey:UserID;references:ID" json:"user"`
 }
@@ -65,11 +77,18 @@ func (Device) TableName() string {
 	return "devices"
 }
 
+// 指令失败原因
+const (
+	RESULT_TIMEOUT = "timeout" //设备超时未应答
+)
+
 type CommandResult struct {
 	CommandID int64 `json:"command_id"`
 	Succeed   bool  `json:"succeed"`
 	Msg       string
 	Extra     []byte `json:"extra"`
+	Reason    string `json:"reason,omitempty"` //非设备应答的失败原因，如timeout
+	Retries   int    `json:"retries"`          //超时重发次数
 }
 
 type Command struct { //指令结构体
@@ -80,9 +99,11 @@ type Command struct { //指令结构体
 
 // 所有与设备相关的msg都看作状态，包括设备命令、设备状态、设备报警等
 type DeviceStatus1 struct {
-	OriginSN string   //这是接近原始数据的状态封装，所以使用原厂序列号和类型定位记录
-	Type     string   // 机型（厂商）
-	Device   *Device  `gorm:"foreignKey:ID;references:ID" json:"device"`
-	Command  *Command `gorm:"foreignKey:ID;references:ID" json:"command"`
-	RawMsg   []byte   `gorm:"foreignKey:ID;references:ID" json:"raw_msg"`
+	OriginSN string      //这是接近原始数据的状态封装，所以使用原厂序列号和类型定位记录
+	Type     string      // 机型（厂商）
+	Device   *Device     `gorm:"foreignKey:ID;references:ID" json:"device"`
+	Command  *Command    `gorm:"foreignKey:ID;references:ID" json:"command"`
+	RawMsg   []byte      `gorm:"foreignKey:ID;references:ID" json:"raw_msg"`
+	Alarms   []Alarm     `json:"alarms"` //设备主动上报的报警，DeviceID由消息处理器填充
+	Track    []*Location `json:"track"`  //补传的历史定位点(按时间升序，不含Device中的最新位置)，只写入轨迹表
 }
@@ -0,0 +1,109 @@
+package mxm
+
+import (
+	"fmt"
+	"time"
+)
+
+// 围栏触发方式
+const (
+	TRIGGER_BOTH        = ""            // 进入和离开都告警(默认)
+	TRIGGER_ENTER       = "enter"       // 进入时告警
+	TRIGGER_EXIT        = "exit"        // 离开时告警
+	TRIGGER_STAY_INSIDE = "stay_inside" // 生效时段内不在围栏内即告警，时段开始时已在外面也告警
+)
+
+const MaxFenceDwell = 24 * 60 * 60 // 最短停留时间上限，单位秒
+
+// ActiveWindow 围栏生效时段，按设备主人时区计算
+type ActiveWindow struct {
+	Days  []int  `json:"days,omitempty"` // 星期几，0为周日，为空表示每天
+	Start string `json:"start"`          // 开始时间，如08:00
+	End   string `json:"end"`            // 结束时间，小于开始时间表示跨天，与开始时间相同表示全天
+}
+
+// parseClock 解析HH:MM，返回当天的分钟数
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, must be like 08:00", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *ActiveWindow) hasDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, v := range w.Days {
+		if v == int(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains t需已转换到设备主人时区
+func (w *ActiveWindow) Contains(t time.Time) bool {
+	start, err1 := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	switch {
+	case start == end:
+		return w.hasDay(t.Weekday())
+	case start < end:
+		return w.hasDay(t.Weekday()) && m >= start && m < end
+	default:
+		// 跨天时段属于开始的那天
+		return (w.hasDay(t.Weekday()) && m >= start) || (w.hasDay(t.AddDate(0, 0, -1).Weekday()) && m < end)
+	}
+}
+
+func (w *ActiveWindow) Validate() error {
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	for _, d := range w.Days {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("invalid weekday %d, must be 0-6", d)
+		}
+	}
+	return nil
+}
+
+// ActiveAt 区域在t时刻是否生效，未设置时段时始终生效
+func (r *Region) ActiveAt(t time.Time) bool {
+	if len(r.Schedule) == 0 {
+		return true
+	}
+	for i := range r.Schedule {
+		if r.Schedule[i].Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRules 校验触发方式、生效时段和最短停留时间
+func (r *Region) ValidateRules() error {
+	switch r.Trigger {
+	case TRIGGER_BOTH, TRIGGER_ENTER, TRIGGER_EXIT, TRIGGER_STAY_INSIDE:
+	default:
+		return fmt.Errorf("unknown trigger %q", r.Trigger)
+	}
+	for i := range r.Schedule {
+		if err := r.Schedule[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Dwell < 0 || r.Dwell > MaxFenceDwell {
+		return fmt.Errorf("dwell must be between 0 and %d seconds", MaxFenceDwell)
+	}
+	return nil
+}
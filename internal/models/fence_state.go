@@ -0,0 +1,42 @@
+package mxm
+
+import "time"
+
+// FenceState 设备相对某个围栏的内外状态，用于判断进出围栏，跨重启保持
+type FenceState struct {
+	DeviceID   string    `gorm:"primaryKey;column:device_id" json:"device_id"`
+	RegionName string    `gorm:"primaryKey;column:region_name" json:"region_name"`
+	Inside     bool      `gorm:"column:inside" json:"inside"`
+	Pending    int       `gorm:"column:pending" json:"pending"` //连续落在另一侧的定位次数，达到确认次数才切换状态
+	Since      time.Time `gorm:"column:since" json:"since"`     //进入当前一侧的定位时间，用于计算停留时间
+	Fired      bool      `gorm:"column:fired" json:"fired"`     //当前一侧是否已告警或已判定不告警
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (FenceState) TableName() string {
+	return "fence_states"
+}
+
+// 围栏事件被抑制的原因
+const (
+	FENCE_SUPPRESS_INACTIVE = "inactive" // 不在生效时段
+	FENCE_SUPPRESS_DWELL    = "dwell"    // 停留时间不足就回到了另一侧
+)
+
+// FenceEvent 围栏规则判定记录，已告警和被抑制的都保留，便于排查
+type FenceEvent struct {
+	ID         int64     `gorm:"primaryKey;column:id" json:"id"`
+	DeviceID   string    `gorm:"column:device_id" json:"device_id"`
+	RegionName string    `gorm:"column:region_name" json:"region_name"`
+	Trigger    string    `gorm:"column:trigger_type" json:"trigger"`
+	Inside     bool      `gorm:"column:inside" json:"inside"`
+	Fired      bool      `gorm:"column:fired" json:"fired"`
+	Reason     string    `gorm:"column:reason" json:"reason,omitempty"`
+	AlarmType  int       `gorm:"column:alarm_type" json:"alarm_type,omitempty"`
+	Time       time.Time `gorm:"column:time" json:"time"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (FenceEvent) TableName() string {
+	return "fence_events"
+}
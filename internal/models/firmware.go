@@ -0,0 +1,78 @@
+package mxm
+
+import "time"
+
+// 升级任务中单台设备的状态
+const (
+	OTA_PENDING     = "pending"     //待下发
+	OTA_DOWNLOADING = "downloading" //已下发升级指令，等待设备上报新版本
+	OTA_APPLIED     = "applied"     //设备已上报目标版本
+	OTA_FAILED      = "failed"
+)
+
+// 升级任务状态
+const (
+	ROLLOUT_ACTIVE = "active"
+	ROLLOUT_PAUSED = "paused" //暂停后不再下发新的升级指令
+)
+
+// Firmware 固件包，按设备类型和型号区分
+type Firmware struct {
+	ID         uint      `gorm:"primaryKey;column:id" json:"id"`
+	DeviceType string    `gorm:"column:device_type" json:"device_type"`
+	Model      string    `gorm:"column:model" json:"model"` //型号，与设备上报的project一致，为空表示该类型所有设备
+	Version    string    `gorm:"column:version" json:"version"`
+	FileName   string    `gorm:"column:file_name" json:"file_name"`
+	Size       int64     `gorm:"column:size" json:"size"`
+	MD5        string    `gorm:"column:md5" json:"md5"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (Firmware) TableName() string {
+	return "firmwares"
+}
+
+// Rollout 升级任务，Percent为当前放量比例，逐步调大即分批升级
+type Rollout struct {
+	ID         uint      `gorm:"primaryKey;column:id" json:"id"`
+	FirmwareID uint      `gorm:"column:firmware_id" json:"firmware_id"`
+	Percent    int       `gorm:"column:percent" json:"percent"`
+	Status     string    `gorm:"column:status" json:"status"`
+	CreatedBy  uint      `gorm:"column:created_by" json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	Firmware *Firmware `gorm:"foreignKey:FirmwareID" json:"firmware,omitempty"`
+}
+
+func (Rollout) TableName() string {
+	return "ota_rollouts"
+}
+
+// RolloutDevice 升级任务中的单台设备，Staged表示已进入放量范围
+type RolloutDevice struct {
+	RolloutID uint      `gorm:"primaryKey;column:rollout_id" json:"rollout_id"`
+	DeviceID  string    `gorm:"primaryKey;column:device_id" json:"device_id"`
+	Staged    bool      `gorm:"column:staged" json:"staged"`
+	State     string    `gorm:"column:state" json:"state"`
+	CommandID int64     `gorm:"column:command_id" json:"command_id"`
+	Attempts  int       `gorm:"column:attempts" json:"attempts"`
+	LastError string    `gorm:"column:last_error" json:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (RolloutDevice) TableName() string {
+	return "ota_rollout_devices"
+}
+
+// RolloutProgress 升级任务进度，各状态只统计已进入放量范围的设备
+type RolloutProgress struct {
+	Rollout     *Rollout         `json:"rollout"`
+	Total       int              `json:"total"`  //目标设备总数
+	Staged      int              `json:"staged"` //已放量设备数
+	Pending     int              `json:"pending"`
+	Downloading int              `json:"downloading"`
+	Applied     int              `json:"applied"`
+	Failed      int              `json:"failed"`
+	Failures    []*RolloutDevice `json:"failures"`
+}
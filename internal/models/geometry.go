@@ -0,0 +1,371 @@
+package mxm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// 围栏限制
+const (
+	MaxFenceArea      = 100 * 1000 * 1000 // 围栏面积上限，单位平方米(100平方公里)
+	MaxFenceVertices  = 200               // 多边形顶点总数上限(含洞)
+	MaxCorridorBuffer = 1000              // 路线围栏距路线的最大允许距离，单位米
+)
+
+// NewArea 按区域类型解析区域描述
+func NewArea(typ string, data []byte) (Area, error) {
+	var area Area
+	switch typ {
+	case "circle":
+		area = &Circle{}
+	case "rectangle":
+		area = &Rectangle{}
+	case "polygon":
+		area = &Polygon{}
+	case "corridor":
+		area = &Corridor{}
+	default:
+		return nil, fmt.Errorf("unknown type: %s", typ)
+	}
+	if err := json.Unmarshal(data, area); err != nil {
+		return nil, err
+	}
+	return area, nil
+}
+
+// Distance 两点间的球面距离，单位米
+func Distance(a, b Point) float64 {
+	return haversine(a.Latitude, a.Longitude, b.Latitude, b.Longitude) * 1000
+}
+
+type LatLng struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Polygon 任意多边形，可带洞，顶点按顺序给出，首尾是否重复均可
+type Polygon struct {
+	Outer []LatLng   `json:"outer"`
+	Holes [][]LatLng `json:"holes,omitempty"`
+}
+
+func (p *Polygon) IsOut(pt Point) bool {
+	return p.BoundaryDistance(pt) >= 0
+}
+
+// BoundaryDistance 在以pt为中心的局部平面上计算，围栏面积有上限，误差可忽略
+func (p *Polygon) BoundaryDistance(pt Point) float64 {
+	origin := LatLng{pt.Latitude, pt.Longitude}
+	inside := false
+	dist := math.Inf(1)
+	for i, ring := range p.rings() {
+		xy := project(origin, ring)
+		dist = math.Min(dist, ringDistance(xy))
+		// 在外环内且不在任何洞内
+		if contains := ringContainsOrigin(xy); i == 0 {
+			inside = contains
+		} else if contains {
+			inside = false
+		}
+	}
+	if inside {
+		return -dist
+	}
+	return dist
+}
+
+func (p *Polygon) rings() [][]LatLng {
+	rings := make([][]LatLng, 0, 1+len(p.Holes))
+	rings = append(rings, closeRing(p.Outer))
+	for _, h := range p.Holes {
+		rings = append(rings, closeRing(h))
+	}
+	return rings
+}
+
+// Validate 校验顶点、自相交、洞的位置及面积
+func (p *Polygon) Validate() error {
+	rings := p.rings()
+	total := 0
+	for _, r := range rings {
+		if len(r) < 3 {
+			return fmt.Errorf("polygon ring needs at least 3 distinct points")
+		}
+		for _, v := range r {
+			if err := validLatLng(v.Latitude, v.Longitude); err != nil {
+				return err
+			}
+		}
+		total += len(r)
+	}
+	if total > MaxFenceVertices {
+		return fmt.Errorf("polygon has %d points, at most %d allowed", total, MaxFenceVertices)
+	}
+
+	origin := rings[0][0]
+	xy := make([][]xyPoint, len(rings))
+	for i, r := range rings {
+		xy[i] = project(origin, r)
+	}
+	for i := range xy {
+		if selfIntersects(xy[i]) {
+			return fmt.Errorf("polygon ring %d intersects itself", i)
+		}
+		for j := i + 1; j < len(xy); j++ {
+			if ringsIntersect(xy[i], xy[j]) {
+				return fmt.Errorf("polygon rings %d and %d intersect", i, j)
+			}
+		}
+	}
+	// 洞在外环内，且洞之间互不包含
+	area := math.Abs(ringArea(xy[0]))
+	for i := 1; i < len(rings); i++ {
+		v := rings[i][0]
+		if !ringContainsOrigin(project(v, rings[0])) {
+			return fmt.Errorf("polygon hole %d is outside the outer ring", i)
+		}
+		for j := 1; j < len(rings); j++ {
+			if j != i && ringContainsOrigin(project(v, rings[j])) {
+				return fmt.Errorf("polygon hole %d is inside hole %d", i, j)
+			}
+		}
+		area -= math.Abs(ringArea(xy[i]))
+	}
+	return validFenceArea(area)
+}
+
+// Corridor 路线围栏，距路线Buffer米以内为区域内
+type Corridor struct {
+	Path   []LatLng `json:"path"`
+	Buffer float64  `json:"buffer"` //单位米
+}
+
+func (c *Corridor) IsOut(pt Point) bool {
+	return c.BoundaryDistance(pt) >= 0
+}
+
+func (c *Corridor) BoundaryDistance(pt Point) float64 {
+	_, d := c.NearestSegment(pt)
+	return d - c.Buffer
+}
+
+// NearestSegment 返回离pt最近的路段序号(从0开始，第i段为Path[i]到Path[i+1])及距离(米)
+func (c *Corridor) NearestSegment(pt Point) (int, float64) {
+	path := project(LatLng{pt.Latitude, pt.Longitude}, c.Path)
+	seg, dist := 0, math.Inf(1)
+	for i := 0; i+1 < len(path); i++ {
+		if d := segmentDistance(path[i], path[i+1]); d < dist {
+			seg, dist = i, d
+		}
+	}
+	return seg, dist
+}
+
+func (c *Corridor) Validate() error {
+	if len(closeRing(c.Path)) < 2 {
+		return fmt.Errorf("corridor path needs at least 2 distinct points")
+	}
+	if len(c.Path) > MaxFenceVertices {
+		return fmt.Errorf("corridor has %d points, at most %d allowed", len(c.Path), MaxFenceVertices)
+	}
+	length := 0.0
+	for i, v := range c.Path {
+		if err := validLatLng(v.Latitude, v.Longitude); err != nil {
+			return err
+		}
+		if i > 0 {
+			length += haversine(c.Path[i-1].Latitude, c.Path[i-1].Longitude, v.Latitude, v.Longitude) * 1000
+		}
+	}
+	if c.Buffer <= 0 || c.Buffer > MaxCorridorBuffer {
+		return fmt.Errorf("corridor buffer must be between 0 and %d metres", MaxCorridorBuffer)
+	}
+	// 按不重叠估算，实际面积不会更大
+	return validFenceArea(length*2*c.Buffer + math.Pi*c.Buffer*c.Buffer)
+}
+
+// Rectangle 经纬度范围，west大于east时表示跨越180度经线
+type Rectangle struct {
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
+
+func (r *Rectangle) IsOut(pt Point) bool {
+	if pt.Latitude < r.South || pt.Latitude > r.North {
+		return true
+	}
+	if r.West <= r.East {
+		return pt.Longitude < r.West || pt.Longitude > r.East
+	}
+	return pt.Longitude < r.West && pt.Longitude > r.East
+}
+
+func (r *Rectangle) BoundaryDistance(pt Point) float64 {
+	d := ringDistance(project(LatLng{pt.Latitude, pt.Longitude}, r.ring()))
+	if r.IsOut(pt) {
+		return d
+	}
+	return -d
+}
+
+func (r *Rectangle) ring() []LatLng {
+	return []LatLng{{r.South, r.West}, {r.South, r.East}, {r.North, r.East}, {r.North, r.West}}
+}
+
+func (r *Rectangle) Validate() error {
+	for _, v := range r.ring() {
+		if err := validLatLng(v.Latitude, v.Longitude); err != nil {
+			return err
+		}
+	}
+	if r.South >= r.North || r.West == r.East {
+		return fmt.Errorf("rectangle needs south < north and west != east")
+	}
+	ring := r.ring()
+	return validFenceArea(math.Abs(ringArea(project(ring[0], ring))))
+}
+
+func (c *Circle) Validate() error {
+	if err := validLatLng(c.Latitude, c.Longitude); err != nil {
+		return err
+	}
+	if c.Radius <= 0 {
+		return fmt.Errorf("circle radius must be positive")
+	}
+	return validFenceArea(math.Pi * c.Radius * c.Radius)
+}
+
+func validLatLng(lat, lng float64) error {
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return fmt.Errorf("invalid coordinate (%v, %v)", lat, lng)
+	}
+	return nil
+}
+
+func validFenceArea(area float64) error {
+	if area <= 0 {
+		return fmt.Errorf("fence area is empty")
+	}
+	if area > MaxFenceArea {
+		return fmt.Errorf("fence area %.0f m² exceeds the limit of %d m²", area, MaxFenceArea)
+	}
+	return nil
+}
+
+// closeRing 去掉重复的首尾点及相邻重复点
+func closeRing(r []LatLng) []LatLng {
+	out := make([]LatLng, 0, len(r))
+	for _, v := range r {
+		if len(out) == 0 || out[len(out)-1] != v {
+			out = append(out, v)
+		}
+	}
+	if len(out) > 1 && out[0] == out[len(out)-1] {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+type xyPoint struct{ x, y float64 }
+
+// project 以origin为原点投影到局部平面(米)，经度差按跨越180度经线处理
+func project(origin LatLng, ring []LatLng) []xyPoint {
+	const mPerDeg = RadiusEarthKm * 1000 * math.Pi / 180
+	k := math.Cos(origin.Latitude * math.Pi / 180)
+	out := make([]xyPoint, len(ring))
+	for i, v := range ring {
+		dLng := math.Mod(v.Longitude-origin.Longitude+540, 360) - 180
+		out[i] = xyPoint{dLng * k * mPerDeg, (v.Latitude - origin.Latitude) * mPerDeg}
+	}
+	return out
+}
+
+// ringContainsOrigin 射线法判断原点是否在环内
+func ringContainsOrigin(ring []xyPoint) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.y > 0) != (b.y > 0) && 0 < (b.x-a.x)*(0-a.y)/(b.y-a.y)+a.x {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// ringDistance 原点到环上各边的最短距离
+func ringDistance(ring []xyPoint) float64 {
+	d := math.Inf(1)
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		d = math.Min(d, segmentDistance(ring[j], ring[i]))
+	}
+	return d
+}
+
+func segmentDistance(a, b xyPoint) float64 {
+	dx, dy := b.x-a.x, b.y-a.y
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, -(a.x*dx+a.y*dy)/l))
+	}
+	return math.Hypot(a.x+t*dx, a.y+t*dy)
+}
+
+// ringArea 有向面积
+func ringArea(ring []xyPoint) float64 {
+	s := 0.0
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		s += ring[j].x*ring[i].y - ring[i].x*ring[j].y
+	}
+	return s / 2
+}
+
+func cross(o, a, b xyPoint) float64 {
+	return (a.x-o.x)*(b.y-o.y) - (a.y-o.y)*(b.x-o.x)
+}
+
+func onSegment(p, a, b xyPoint) bool {
+	return math.Min(a.x, b.x) <= p.x && p.x <= math.Max(a.x, b.x) &&
+		math.Min(a.y, b.y) <= p.y && p.y <= math.Max(a.y, b.y)
+}
+
+// segmentsIntersect 线段相交或接触
+func segmentsIntersect(a, b, c, d xyPoint) bool {
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(a, c, d)) || (d2 == 0 && onSegment(b, c, d)) ||
+		(d3 == 0 && onSegment(c, a, b)) || (d4 == 0 && onSegment(d, a, b))
+}
+
+// selfIntersects 检查不相邻的边是否相交
+func selfIntersects(ring []xyPoint) bool {
+	n := len(ring)
+	for i := 0; i < n; i++ {
+		a, b := ring[i], ring[(i+1)%n]
+		for j := i + 2; j < n; j++ {
+			if i == 0 && j == n-1 {
+				continue
+			}
+			if segmentsIntersect(a, b, ring[j], ring[(j+1)%n]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ringsIntersect(r1, r2 []xyPoint) bool {
+	for i := range r1 {
+		for j := range r2 {
+			if segmentsIntersect(r1[i], r1[(i+1)%len(r1)], r2[j], r2[(j+1)%len(r2)]) {
+				return true
+			}
+		}
+	}
+	return false
+}
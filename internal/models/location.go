@@ -23,8 +23,17 @@ type Location struct {
 	Accuracy   float64   `json:"accuracy"`                        //精度
 	Speed      float64   `json:"speed"`                           //速度
 	Heading    float64   `json:"heading"`                         //方向
+
+	Rejected     bool   `gorm:"column:rejected" json:"rejected,omitempty"`           //被轨迹过滤判定为异常点，仍入库但不参与轨迹和围栏
+	RejectReason string `gorm:"column:reject_reason" json:"reject_reason,omitempty"` //异常原因，见LOC_REJECT_*
 }
 
+// 定位点被过滤的原因
+const (
+	LOC_REJECT_SPEED = "speed"          // 与上一个有效点相比速度不可能达到
+	LOC_REJECT_GPS   = "worse_than_gps" // 刚有GPS定位，精度更差的LBS/WIFI定位不替换它
+)
+
 // 定义WiFi信息结构体
 type WiFiInfo struct {
 	Mac  string `json:"mac"`
@@ -2,7 +2,6 @@ package mxm
 
 import (
 	"encoding/json"
-	"fmt"
 	"math"
 )
 
@@ -27,13 +26,24 @@ type Share struct {
 }
 
 type Region struct {
-	Type string `json:"type"` //类型，circle，rectangle,square等
+	Type string `json:"type"` //类型，circle、rectangle、polygon
 	Name string `json:"name"` //区域名
 	Area Area   `json:"area"` //区域描述
+
+	Trigger  string         `json:"trigger,omitempty"`  //触发方式，为空时进出都告警
+	Schedule []ActiveWindow `json:"schedule,omitempty"` //生效时段，为空时始终生效
+	Dwell    int            `json:"dwell,omitempty"`    //最短停留时间(秒)，在另一侧停留满该时间才告警
 }
 
 type Area interface {
 	IsOut(pt Point) bool
+	Validate() error // 保存前校验区域是否合法
+}
+
+// BoundaryDistancer 可计算点到区域边界距离(米)的区域，区域外为正、区域内为负，
+// 围栏判断时距边界小于定位精度的点不计入
+type BoundaryDistancer interface {
+	BoundaryDistance(pt Point) float64
 }
 
 // RegionUnmarshaler 是一个辅助结构体，用于反序列化
@@ -41,6 +51,10 @@ type RegionUnmarshaler struct {
 	Type string          `json:"type"`
 	Name string          `json:"name"`
 	Area json.RawMessage `json:"area"`
+
+	Trigger  string         `json:"trigger"`
+	Schedule []ActiveWindow `json:"schedule"`
+	Dwell    int            `json:"dwell"`
 }
 
 func (r *Region) UnmarshalJSON(data []byte) error {
@@ -50,24 +64,12 @@ func (r *Region) UnmarshalJSON(data []byte) error {
 	}
 	r.Type = u.Type
 	r.Name = u.Name
-	switch u.Type {
-	case "circle":
-		var c Circle
-		if err := json.Unmarshal(u.Area, &c); err != nil {
-			return err
-		}
-		r.Area = &c
-	case "rectangle":
-		var rct Rectangle
-		if err := json.Unmarshal(u.Area, &rct); err != nil {
-			return err
-		}
-		r.Area = &rct
-	// Add more cases for other types
-	default:
-		return fmt.Errorf("unknown type: %s", u.Type)
+	r.Trigger, r.Schedule, r.Dwell = u.Trigger, u.Schedule, u.Dwell
+	area, err := NewArea(u.Type, u.Area)
+	if err != nil {
+		return err
 	}
-
+	r.Area = area
 	return nil
 }
 
@@ -79,21 +81,15 @@ type Point struct {
 type Circle struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
-	Radius    float64 `json:"radius"`
+	Radius    float64 `json:"radius"` //半径，单位米
 }
 
 func (c *Circle) IsOut(pt Point) bool {
-	return haversine(pt.Latitude, pt.Longitude, c.Latitude, c.Longitude) >= c.Radius
-}
-
-type Rectangle struct {
-	Width  float64 `json:"width"`
-	Height float64 `json:"height"`
+	return c.BoundaryDistance(pt) >= 0
 }
 
-func (r Rectangle) IsOut(pt Point) bool {
-	return true
-	//return pt.X < 0 || pt.X > r.Width || pt.Y < 0 || pt.Y > r.Height
+func (c *Circle) BoundaryDistance(pt Point) float64 {
+	return haversine(pt.Latitude, pt.Longitude, c.Latitude, c.Longitude)*1000 - c.Radius
 }
 
 const (
@@ -15,4 +15,6 @@ type User struct {
 	OpenID      string         `gorm:"column:openid" json:"openID"` //对应微信openID
 	Nickname    string         `gorm:"column:nick_name" json:"nick_name"`
 	EnrollAdmin bool           `gorm:"column:enroll_admin" json:"enroll_admin"` //是否为入库管理员
+	Admin       bool           `gorm:"column:admin" json:"admin"`               //是否为系统管理员，可管理驱动等
+	Timezone    string         `gorm:"column:timezone" json:"timezone"`         //IANA时区，如Asia/Shanghai，为空时取服务器时区
 }
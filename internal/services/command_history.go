@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+)
+
+// ========== 指令历史 ==========
+
+const (
+	_CMD_HISTORY_DEFAULT_LIMIT = 20
+	_CMD_HISTORY_MAX_LIMIT     = 100
+)
+
+// 指令历史写入失败不影响指令下发，只记录日志
+func (c *SimpleServiceContainer) addCommandRecord(rec *mxm.CommandRecord) {
+	if err := c.repo.AddCommandRecord(rec); err != nil {
+		slog.Error("save command record failed", "commandID", rec.CommandID, "deviceID", rec.DeviceID, "error", err)
+	}
+}
+
+func (c *SimpleServiceContainer) updateCommandRecord(deviceID string, commandID int64, updates map[string]interface{}) {
+	if err := c.repo.UpdateCommandRecord(deviceID, commandID, updates); err != nil {
+		slog.Error("update command record failed", "deviceID", deviceID, "commandID", commandID, "error", err)
+	}
+}
+
+// canAccessDevice 设备主人、被分享用户及管理员可访问
+func (c *SimpleServiceContainer) canAccessDevice(userID uint, deviceID string) bool {
+	if owner, err := c.repo.GetUserIdByDeviceId(deviceID); err == nil && owner == userID {
+		return true
+	}
+	if ids, err := c.repo.GetSharedUserIdsByDeviceId(deviceID); err == nil {
+		for _, id := range ids {
+			if id == userID {
+				return true
+			}
+		}
+	}
+	return c.IsAdmin(context.Background(), userID)
+}
+
+// GetCommandHistory 按时间倒序分页查询设备指令历史，返回记录及总数
+func (c *SimpleServiceContainer) GetCommandHistory(ctx context.Context, userID uint, deviceID string, st, ed time.Time,
+	limit, offset int) ([]*mxm.CommandRecord, int64, error) {
+	if !c.canAccessDevice(userID, deviceID) {
+		return nil, 0, fmt.Errorf("permission denied")
+	}
+	if limit <= 0 {
+		limit = _CMD_HISTORY_DEFAULT_LIMIT
+	}
+	limit = min(limit, _CMD_HISTORY_MAX_LIMIT)
+	offset = max(offset, 0)
+
+	lst, total, err := c.repo.GetCommandRecords(deviceID, st.UTC(), ed.UTC(), limit, offset)
+	if err != nil {
+		slog.Error("get command history failed", "deviceID", deviceID, "error", err)
+		return nil, 0, fmt.Errorf("get command history failed: %w", err)
+	}
+	return lst, total, nil
+}
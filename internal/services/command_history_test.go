@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Daneel-Li/gps-back/internal/dao"
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+	"github.com/stretchr/testify/assert"
+)
+
+// cmdRepo 只实现指令下发涉及的数据访问，其余方法未实现
+type cmdRepo struct {
+	dao.Repository
+	device  *mxm.Device
+	records map[int64]*mxm.CommandRecord
+	queued  []*mxm.QueuedCommand
+	user    map[string]interface{}
+}
+
+func newCmdRepo(device *mxm.Device) *cmdRepo {
+	return &cmdRepo{device: device, records: make(map[int64]*mxm.CommandRecord)}
+}
+
+func (r *cmdRepo) GetDeviceByID(id string) (*mxm.Device, error) { return r.device, nil }
+func (r *cmdRepo) AddCommandRecord(rec *mxm.CommandRecord) error {
+	cp := *rec
+	r.records[rec.CommandID] = &cp
+	return nil
+}
+func (r *cmdRepo) UpdateCommandRecord(deviceID string, commandID int64, updates map[string]interface{}) error {
+	rec := r.records[commandID]
+	if v, ok := updates["state"]; ok {
+		rec.State = v.(string)
+	}
+	if v, ok := updates["send_error"]; ok {
+		rec.SendError = v.(string)
+	}
+	return nil
+}
+func (r *cmdRepo) UpdateUser(userID uint, updates map[string]interface{}) error {
+	r.user = updates
+	return nil
+}
+func (r *cmdRepo) MaxCommandID() (int64, error) { return 65535, nil }
+func (r *cmdRepo) AddQueuedCommand(cmd *mxm.QueuedCommand) error {
+	r.queued = append(r.queued, cmd)
+	return nil
+}
+
+type cmdDriver struct {
+	fakeDriver
+	locateErr error
+}
+
+func (d *cmdDriver) Locate(int64, string) error { return d.locateErr }
+func (d *cmdDriver) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities(vendors.ActionLocate)
+}
+
+func newCmdContainer(t *testing.T, device *mxm.Device, driver vendors.VendorDriver) (*SimpleServiceContainer, *cmdRepo) {
+	repo := newCmdRepo(device)
+	c := NewSimpleServiceContainer(repo, NewCommandManager(CommandPolicy{}), nil)
+	assert.NoError(t, c.RegisterDriver("btt", driver))
+	return c, repo
+}
+
+func TestExecuteCommandRecordsHistory(t *testing.T) {
+	id, sn, tp := "dev1", "868909071429404", "btt"
+	now := time.Now()
+	device := &mxm.Device{ID: &id, OriginSN: &sn, Type: &tp, LastOnline: &now}
+
+	c, repo := newCmdContainer(t, device, &cmdDriver{})
+	commandID, state, err := c.ExecuteCommand(context.Background(), 7, id, "LOCATE", nil, "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, mxm.CMD_DELIVERED, state)
+	rec := repo.records[commandID]
+	assert.Equal(t, uint(7), rec.UserID)
+	assert.Equal(t, mxm.CMD_DELIVERED, rec.State)
+	assert.NotNil(t, rec.SentAt)
+
+	// 驱动不支持的指令同样记录
+	_, _, err = c.ExecuteCommand(context.Background(), 7, id, "POWER_OFF", nil, "", 0)
+	assert.ErrorIs(t, err, vendors.ErrUnsupportedCommand)
+	assert.Len(t, repo.records, 2)
+	for _, rec := range repo.records {
+		if rec.Action == "POWER_OFF" {
+			assert.Equal(t, mxm.CMD_FAILED, rec.State)
+			assert.NotEmpty(t, rec.SendError)
+		}
+	}
+}
+
+func TestExecuteCommandQueuesWhenOffline(t *testing.T) {
+	id, sn, tp := "dev1", "868909071429404", "btt"
+	lastOnline := time.Now().Add(-time.Hour)
+	device := &mxm.Device{ID: &id, OriginSN: &sn, Type: &tp, LastOnline: &lastOnline}
+
+	c, repo := newCmdContainer(t, device, &cmdDriver{})
+	commandID, state, err := c.ExecuteCommand(context.Background(), 7, id, "LOCATE", nil, "", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, mxm.CMD_QUEUED, state)
+	assert.Len(t, repo.queued, 1)
+	assert.Equal(t, commandID, repo.queued[0].CommandID)
+	assert.Equal(t, mxm.CMD_QUEUED, repo.records[commandID].State)
+
+	// 在线但下发失败时也进入队列
+	now := time.Now()
+	device.LastOnline = &now
+	c, repo = newCmdContainer(t, device, &cmdDriver{locateErr: errors.New("device is not connected")})
+	commandID, state, err = c.ExecuteCommand(context.Background(), 7, id, "LOCATE", nil, "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, mxm.CMD_QUEUED, state)
+	assert.Len(t, repo.queued, 1)
+	assert.Equal(t, "device is not connected", repo.records[commandID].SendError)
+}
+
+func TestCommandIDRestored(t *testing.T) {
+	id, sn, tp := "dev1", "868909071429404", "btt"
+	now := time.Now()
+	device := &mxm.Device{ID: &id, OriginSN: &sn, Type: &tp, LastOnline: &now}
+
+	// 重启后从已下发的最大ID之后继续，不回绕
+	c, _ := newCmdContainer(t, device, &cmdDriver{})
+	assert.NoError(t, c.RestoreCommandIDs())
+	commandID, _, err := c.ExecuteCommand(context.Background(), 7, id, "LOCATE", nil, "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(65536), commandID)
+}
+
+func TestUpdateUserIgnoresPrivilegedFields(t *testing.T) {
+	c, repo := newCmdContainer(t, &mxm.Device{}, &cmdDriver{})
+	assert.NoError(t, c.UpdateUser(context.Background(), 7, map[string]interface{}{
+		"nick_name": "tom", "admin": true, "enroll_admin": true,
+	}))
+	assert.Equal(t, map[string]interface{}{"nick_name": "tom"}, repo.user)
+
+	repo.user = nil
+	assert.NoError(t, c.UpdateUser(context.Background(), 7, map[string]interface{}{"admin": true}))
+	assert.Nil(t, repo.user)
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -10,46 +11,113 @@ import (
 
 /*
 *
-缓存未响应指令
+缓存未响应指令，超时未应答时向发起终端推送超时结果，幂等指令可按退避重发
 */
 
+const (
+	_CMD_DEFAULT_TIMEOUT  = 30 * time.Second
+	_CMD_CHECK_INTERVAL   = 5 * time.Second
+	_CMD_CHECK_BATCH_SIZE = 100 //避免长时间占用锁，小量多次处理
+)
+
+// 幂等指令，重复执行无副作用，超时后可重发
+var idempotentActions = map[string]bool{
+	"LOCATE":             true,
+	"SET_REPORTINTERVAL": true,
+	"FIND":               true,
+}
+
 type pendingCommand struct {
-	Terminal *TerminalKey
+	Terminal *TerminalKey //发起终端，未提供时为nil
+	DeviceID string
 	Command  *mxm.Command
 	ExpireAt time.Time
+	Retries  int                     //已重发次数
+	Done     chan *mxm.CommandResult //设备应答或超时结果，供同步等待
+}
+
+// Complete 投递指令结果，每条指令只投递一次，不阻塞
+func (p *pendingCommand) Complete(res *mxm.CommandResult) {
+	select {
+	case p.Done <- res:
+	default:
+	}
+}
+
+// CommandPolicy 指令超时及重发策略
+type CommandPolicy struct {
+	Timeouts   map[string]time.Duration //按指令配置的超时，未配置的指令为30秒
+	MaxRetries int                      //幂等指令超时后的最大重发次数，每次等待时间翻倍，为0时不重发
+}
+
+// CommandTimeoutHandler 处理超时指令，由服务容器实现
+type CommandTimeoutHandler interface {
+	ResendCommand(requestID int64, p *pendingCommand) error //重发，沿用原CommandID
+	CommandTimedOut(requestID int64, p *pendingCommand)     //不再重发，通知发起终端
 }
 
 // 2. 全局变量
 type commandsWaiting struct {
 	sync.Mutex
-	data map[int64]*pendingCommand
+	data    map[int64]*pendingCommand
+	policy  CommandPolicy
+	handler CommandTimeoutHandler
 }
 
 type CommandManager interface {
-	AddCommand(requestID int64, terminal TerminalKey, cmd *mxm.Command)
+	AddCommand(requestID int64, terminal *TerminalKey, deviceID string, cmd *mxm.Command) <-chan *mxm.CommandResult
 	GetAndRemoveCommand(requestID int64) (*pendingCommand, bool)
+	SetTimeoutHandler(handler CommandTimeoutHandler)
 }
 
-func NewCommandManager() CommandManager {
-	m := commandsWaiting{
-		data: make(map[int64]*pendingCommand),
-	}
+func NewCommandManager(policy CommandPolicy) CommandManager {
+	m := newCommandsWaiting(policy)
 	m.start(context.Background())
-	return &m
+	return m
+}
+
+func newCommandsWaiting(policy CommandPolicy) *commandsWaiting {
+	return &commandsWaiting{
+		data:   make(map[int64]*pendingCommand),
+		policy: policy,
+	}
+}
+
+func (m *commandsWaiting) SetTimeoutHandler(handler CommandTimeoutHandler) {
+	m.Lock()
+	defer m.Unlock()
+	m.handler = handler
 }
 
-// 3. 添加命令
-func (m *commandsWaiting) AddCommand(requestID int64, terminal TerminalKey, cmd *mxm.Command) {
+// timeout 第retries次重发后的等待时间
+func (m *commandsWaiting) timeout(action string, retries int) time.Duration {
+	d, ok := m.policy.Timeouts[action]
+	if !ok || d <= 0 {
+		d = _CMD_DEFAULT_TIMEOUT
+	}
+	return d << retries
+}
+
+func (m *commandsWaiting) retryable(p *pendingCommand) bool {
+	return idempotentActions[p.Command.Action] && p.Retries < m.policy.MaxRetries
+}
+
+// 3. 添加命令，返回的通道在设备应答或最终超时后收到结果
+func (m *commandsWaiting) AddCommand(requestID int64, terminal *TerminalKey, deviceID string, cmd *mxm.Command) <-chan *mxm.CommandResult {
 	m.Lock()
 	defer m.Unlock()
-	m.data[requestID] = &pendingCommand{
-		Terminal: &terminal,
+	p := &pendingCommand{
+		Terminal: terminal,
+		DeviceID: deviceID,
 		Command:  cmd,
-		ExpireAt: time.Now().Add(30 * time.Second),
+		ExpireAt: time.Now().Add(m.timeout(cmd.Action, 0)),
+		Done:     make(chan *mxm.CommandResult, 1),
 	}
+	m.data[requestID] = p
+	return p.Done
 }
 
-// 4. 获取并删除命令（如果未超时）
+// 4. 获取并删除命令，已超时但尚未推送超时结果的也返回，以设备应答为准
 func (m *commandsWaiting) GetAndRemoveCommand(requestID int64) (*pendingCommand, bool) {
 	m.Lock()
 	defer m.Unlock()
@@ -59,39 +127,73 @@ func (m *commandsWaiting) GetAndRemoveCommand(requestID int64) (*pendingCommand,
 		return nil, false
 	}
 	delete(m.data, requestID)
-	if time.Now().After(pCmd.ExpireAt) {
-		return nil, false
-	}
 	return pCmd, true
 }
 
 func (m *commandsWaiting) start(ctx context.Context) {
 	go func() {
-		ticker := time.NewTicker(10 * time.Second)
+		ticker := time.NewTicker(_CMD_CHECK_INTERVAL)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				m.cleanExpiredCommands()
+				m.checkExpiredCommands(time.Now())
 			}
 		}
 	}()
 }
 
-func (m *commandsWaiting) cleanExpiredCommands() {
-	now := time.Now()
-	toDel := []int64{}
+// checkExpiredCommands 取出超时指令，可重发的重新计时后重发，其余通知超时
+func (m *commandsWaiting) checkExpiredCommands(now time.Time) {
+	m.Lock()
+	expired := make(map[int64]*pendingCommand)
 	for k, cmd := range m.data {
 		if now.After(cmd.ExpireAt) {
-			toDel = append(toDel, k)
+			expired[k] = cmd
+			delete(m.data, k)
 		}
-		if len(toDel) > 100 { //避免长时间占用锁，小量多次处理
+		if len(expired) >= _CMD_CHECK_BATCH_SIZE {
 			break
 		}
 	}
-	for _, id := range toDel {
+	handler := m.handler
+	m.Unlock()
+
+	if handler == nil {
+		return
+	}
+	for id, p := range expired {
+		if m.retryable(p) {
+			m.resend(handler, id, p, now)
+			continue
+		}
+		slog.Info("command timed out", "commandID", id, "deviceID", p.DeviceID, "action", p.Command.Action, "retries", p.Retries)
+		handler.CommandTimedOut(id, p)
+	}
+}
+
+// resend 先重新登记再重发，避免应答早于登记；重发失败按超时处理
+func (m *commandsWaiting) resend(handler CommandTimeoutHandler, id int64, p *pendingCommand, now time.Time) {
+	next := *p
+	next.Retries++
+	next.ExpireAt = now.Add(m.timeout(p.Command.Action, next.Retries))
+	m.Lock()
+	m.data[id] = &next
+	m.Unlock()
+
+	if err := handler.ResendCommand(id, &next); err != nil {
+		slog.Error("resend command failed", "commandID", id, "deviceID", p.DeviceID, "retries", next.Retries, "error", err)
+		// 重发失败期间设备可能已应答，仍在等待时才按超时处理
+		m.Lock()
+		_, waiting := m.data[id]
 		delete(m.data, id)
+		m.Unlock()
+		if waiting {
+			handler.CommandTimedOut(id, p)
+		}
+		return
 	}
+	slog.Info("command resent", "commandID", id, "deviceID", p.DeviceID, "action", p.Command.Action, "retries", next.Retries)
 }
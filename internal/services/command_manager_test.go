@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutRecorder struct {
+	resendErr error
+	resent    []int
+	timedOut  []*pendingCommand
+}
+
+func (h *timeoutRecorder) ResendCommand(requestID int64, p *pendingCommand) error {
+	h.resent = append(h.resent, p.Retries)
+	return h.resendErr
+}
+
+func (h *timeoutRecorder) CommandTimedOut(requestID int64, p *pendingCommand) {
+	h.timedOut = append(h.timedOut, p)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	m := newCommandsWaiting(CommandPolicy{Timeouts: map[string]time.Duration{"REBOOT": time.Minute}})
+	h := &timeoutRecorder{}
+	m.SetTimeoutHandler(h)
+	m.AddCommand(1, &TerminalKey{UserID: 7}, "dev1", &mxm.Command{Action: "REBOOT"})
+	m.AddCommand(2, &TerminalKey{UserID: 7}, "dev1", &mxm.Command{Action: "POWER_OFF"})
+
+	// POWER_OFF按默认30秒超时，REBOOT按配置的1分钟
+	m.checkExpiredCommands(time.Now().Add(45 * time.Second))
+	assert.Len(t, h.timedOut, 1)
+	assert.Equal(t, "POWER_OFF", h.timedOut[0].Command.Action)
+	_, ok := m.GetAndRemoveCommand(2)
+	assert.False(t, ok)
+
+	// 未开启重发时超时即通知
+	m.checkExpiredCommands(time.Now().Add(2 * time.Minute))
+	assert.Len(t, h.timedOut, 2)
+	assert.Empty(t, h.resent)
+}
+
+func TestCommandRetry(t *testing.T) {
+	m := newCommandsWaiting(CommandPolicy{MaxRetries: 2})
+	h := &timeoutRecorder{}
+	m.SetTimeoutHandler(h)
+	m.AddCommand(1, &TerminalKey{UserID: 7}, "dev1", &mxm.Command{Action: "LOCATE"})
+
+	now := time.Now().Add(31 * time.Second)
+	m.checkExpiredCommands(now)
+	assert.Equal(t, []int{1}, h.resent)
+	// 第一次重发后等待60秒
+	m.checkExpiredCommands(now.Add(59 * time.Second))
+	assert.Equal(t, []int{1}, h.resent)
+	m.checkExpiredCommands(now.Add(61 * time.Second))
+	assert.Equal(t, []int{1, 2}, h.resent)
+	assert.Empty(t, h.timedOut)
+
+	// 重发次数用完后通知超时，结果中带重发次数
+	m.checkExpiredCommands(now.Add(10 * time.Minute))
+	assert.Len(t, h.timedOut, 1)
+	assert.Equal(t, 2, h.timedOut[0].Retries)
+
+	// 重发期间收到应答则不再超时
+	m.AddCommand(2, &TerminalKey{UserID: 7}, "dev1", &mxm.Command{Action: "FIND"})
+	m.checkExpiredCommands(now)
+	p, ok := m.GetAndRemoveCommand(2)
+	assert.True(t, ok)
+	assert.Equal(t, 1, p.Retries)
+	m.checkExpiredCommands(now.Add(10 * time.Minute))
+	assert.Len(t, h.timedOut, 1)
+}
+
+func TestCommandRetryFailed(t *testing.T) {
+	m := newCommandsWaiting(CommandPolicy{MaxRetries: 3})
+	h := &timeoutRecorder{resendErr: errors.New("device is not connected")}
+	m.SetTimeoutHandler(h)
+	m.AddCommand(1, &TerminalKey{UserID: 7}, "dev1", &mxm.Command{Action: "SET_REPORTINTERVAL", Args: []string{"60"}})
+
+	m.checkExpiredCommands(time.Now().Add(time.Minute))
+	assert.Equal(t, []int{1}, h.resent)
+	assert.Len(t, h.timedOut, 1)
+	assert.Equal(t, 0, h.timedOut[0].Retries)
+	_, ok := m.GetAndRemoveCommand(1)
+	assert.False(t, ok)
+}
+
+// replyDriver 下发后模拟设备应答
+type replyDriver struct {
+	cmdDriver
+	c *SimpleServiceContainer
+}
+
+func (d *replyDriver) Locate(commandID int64, originSN string) error {
+	go func() {
+		if p, ok := d.c.cmdManager.GetAndRemoveCommand(commandID); ok {
+			p.Complete(&mxm.CommandResult{CommandID: commandID, Succeed: true})
+		}
+	}()
+	return nil
+}
+
+func TestExecuteCommandAndWait(t *testing.T) {
+	id, sn, tp := "dev1", "868909071429404", "btt"
+	now := time.Now()
+	device := &mxm.Device{ID: &id, OriginSN: &sn, Type: &tp, LastOnline: &now}
+
+	driver := &replyDriver{}
+	c, _ := newCmdContainer(t, device, driver)
+	driver.c = c
+	commandID, state, res, err := c.ExecuteCommandAndWait(context.Background(), 7, id, "LOCATE", nil, "", 0, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, mxm.CMD_ACKNOWLEDGED, state)
+	assert.Equal(t, commandID, res.CommandID)
+	assert.True(t, res.Succeed)
+
+	// 设备未应答时等待结束返回已下发状态
+	c, _ = newCmdContainer(t, device, &cmdDriver{})
+	_, state, res, err = c.ExecuteCommandAndWait(context.Background(), 7, id, "LOCATE", nil, "", 0, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, mxm.CMD_DELIVERED, state)
+	assert.Nil(t, res)
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/types"
+)
+
+/*
+*
+离线指令队列：设备离线时指令持久化到command_queue，设备下次上报时按提交顺序下发，
+状态变化(queued/delivered/acknowledged/expired/failed)推送给提交指令的用户
+*/
+
+const (
+	_CMD_QUEUE_DEFAULT_TTL     = 24 * time.Hour
+	_CMD_QUEUE_MAX_TTL         = 7 * 24 * time.Hour
+	_CMD_QUEUE_EXPIRE_INTERVAL = time.Minute
+	_DEVICE_ONLINE_MIN_WINDOW  = 3 * time.Minute // 上报间隔很短的设备也至少按该时长判断在线
+)
+
+// queueIndex 记录有待下发指令的设备，避免每条上报都查库
+type queueIndex struct {
+	mu         sync.Mutex
+	devices    map[string]bool
+	delivering map[string]bool //正在下发的设备，同一设备的指令串行下发
+}
+
+func newQueueIndex() *queueIndex {
+	return &queueIndex{devices: make(map[string]bool), delivering: make(map[string]bool)}
+}
+
+func (q *queueIndex) add(deviceID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.devices[deviceID] = true
+}
+
+// begin 设备有待下发指令且未在下发中时返回true，并从索引中移除
+func (q *queueIndex) begin(deviceID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.devices[deviceID] || q.delivering[deviceID] {
+		return false
+	}
+	delete(q.devices, deviceID)
+	q.delivering[deviceID] = true
+	return true
+}
+
+func (q *queueIndex) end(deviceID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.delivering, deviceID)
+}
+
+// queueTTL 指令在队列中的有效期，未指定时取默认值
+func queueTTL(expireIn time.Duration) time.Duration {
+	if expireIn <= 0 {
+		return _CMD_QUEUE_DEFAULT_TTL
+	}
+	return min(expireIn, _CMD_QUEUE_MAX_TTL)
+}
+
+// deviceOnline 最近两个上报周期内有通信即视为在线
+func deviceOnline(dev *mxm.Device, now time.Time) bool {
+	if dev.LastOnline == nil {
+		return false
+	}
+	window := _DEVICE_ONLINE_MIN_WINDOW
+	if dev.Interval != nil {
+		window = max(window, 2*time.Duration(*dev.Interval)*time.Second)
+	}
+	return now.Sub(*dev.LastOnline) < window
+}
+
+func (c *SimpleServiceContainer) enqueueCommand(cmd *mxm.QueuedCommand) error {
+	if err := c.repo.AddQueuedCommand(cmd); err != nil {
+		slog.Error("queue command failed", "deviceID", cmd.DeviceID, "action", cmd.Action, "error", err)
+		return err
+	}
+	c.queue.add(cmd.DeviceID)
+	slog.Info("command queued", "deviceID", cmd.DeviceID, "action", cmd.Action, "commandID", cmd.CommandID, "expireAt", cmd.ExpireAt)
+	c.notifyCommandState(cmd)
+	return nil
+}
+
+func (c *SimpleServiceContainer) notifyCommandState(cmd *mxm.QueuedCommand) {
+	if c.wsManager == nil || cmd.UserID == 0 {
+		return
+	}
+	c.wsManager.BroadcastToUser(cmd.UserID, WSMessage{Type: "command_state", Data: cmd})
+}
+
+// DeliverQueuedCommands 设备上报时调用，按顺序下发其离线期间暂存的指令
+func (c *SimpleServiceContainer) DeliverQueuedCommands(deviceID string) {
+	if !c.queue.begin(deviceID) {
+		return
+	}
+	defer c.queue.end(deviceID)
+
+	lst, err := c.repo.GetQueuedCommands(deviceID)
+	if err != nil {
+		slog.Error("get queued commands failed", "deviceID", deviceID, "error", err)
+		c.queue.add(deviceID)
+		return
+	}
+	if len(lst) == 0 {
+		return
+	}
+	device, err := c.repo.GetDeviceByID(deviceID)
+	if err != nil || device.Type == nil || device.OriginSN == nil {
+		slog.Error("get device failed", "deviceID", deviceID, "error", err)
+		c.queue.add(deviceID)
+		return
+	}
+	driver, err := c.driverManager.GetDriver(types.DeviceType(*device.Type))
+	if err != nil {
+		slog.Error("driver not found", "deviceID", deviceID, "type", *device.Type, "error", err)
+		c.queue.add(deviceID)
+		return
+	}
+
+	for _, cmd := range lst {
+		if ok, err := c.repo.ClaimQueuedCommand(cmd.ID); err != nil || !ok {
+			continue
+		}
+		c.cmdManager.AddCommand(cmd.CommandID, parseTerminalKey(cmd.TerminalKey), cmd.DeviceID, &mxm.Command{Action: cmd.Action, Args: cmd.Args})
+		// 先更新指令历史再下发，避免设备应答早于更新
+		c.updateCommandRecord(cmd.DeviceID, cmd.CommandID, map[string]interface{}{"state": mxm.CMD_DELIVERED, "sent_at": time.Now()})
+		if err := sendCommand(driver, *device.Type, *device.OriginSN, cmd.CommandID, cmd.Action, cmd.Args); err != nil {
+			slog.Error("deliver queued command failed", "deviceID", deviceID, "commandID", cmd.CommandID, "error", err)
+			c.cmdManager.GetAndRemoveCommand(cmd.CommandID) //未下发，不再等待应答
+			cmd.State, cmd.Msg = mxm.CMD_FAILED, err.Error()
+			c.repo.UpdateQueuedCommand(cmd.ID, map[string]interface{}{"state": cmd.State, "msg": cmd.Msg})
+			c.updateCommandRecord(cmd.DeviceID, cmd.CommandID, map[string]interface{}{"state": cmd.State, "send_error": cmd.Msg, "sent_at": nil})
+		} else {
+			slog.Info("queued command delivered", "deviceID", deviceID, "action", cmd.Action, "commandID", cmd.CommandID)
+			cmd.State = mxm.CMD_DELIVERED
+		}
+		c.notifyCommandState(cmd)
+	}
+}
+
+// StartCommandQueue 加载有待下发指令的设备，并定期将过期指令置为expired
+func (c *SimpleServiceContainer) StartCommandQueue(ctx context.Context) {
+	ids, err := c.repo.GetQueuedDeviceIDs()
+	if err != nil {
+		slog.Error("load queued devices failed", "error", err)
+	}
+	for _, id := range ids {
+		c.queue.add(id)
+	}
+
+	go func() {
+		ticker := time.NewTicker(_CMD_QUEUE_EXPIRE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				lst, err := c.repo.ExpireQueuedCommands(time.Now())
+				if err != nil {
+					slog.Error("expire queued commands failed", "error", err)
+					continue
+				}
+				for _, cmd := range lst {
+					slog.Info("queued command expired", "deviceID", cmd.DeviceID, "action", cmd.Action, "commandID", cmd.CommandID)
+					c.updateCommandRecord(cmd.DeviceID, cmd.CommandID, map[string]interface{}{"state": mxm.CMD_EXPIRED})
+					c.notifyCommandState(cmd)
+				}
+			}
+		}
+	}()
+}
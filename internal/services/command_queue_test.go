@@ -0,0 +1,46 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceOnline(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		tm := now.Add(-d)
+		return &tm
+	}
+	interval := 600
+
+	assert.False(t, deviceOnline(&mxm.Device{}, now))
+	assert.True(t, deviceOnline(&mxm.Device{LastOnline: at(time.Minute)}, now))
+	assert.False(t, deviceOnline(&mxm.Device{LastOnline: at(5 * time.Minute)}, now))
+	// 上报间隔10分钟的设备，15分钟前有通信仍视为在线
+	assert.True(t, deviceOnline(&mxm.Device{LastOnline: at(15 * time.Minute), Interval: &interval}, now))
+	assert.False(t, deviceOnline(&mxm.Device{LastOnline: at(25 * time.Minute), Interval: &interval}, now))
+}
+
+func TestQueueTTL(t *testing.T) {
+	assert.Equal(t, _CMD_QUEUE_DEFAULT_TTL, queueTTL(0))
+	assert.Equal(t, time.Hour, queueTTL(time.Hour))
+	assert.Equal(t, _CMD_QUEUE_MAX_TTL, queueTTL(30*24*time.Hour))
+}
+
+func TestQueueIndex(t *testing.T) {
+	q := newQueueIndex()
+	assert.False(t, q.begin("dev1"))
+
+	q.add("dev1")
+	assert.True(t, q.begin("dev1"))
+	// 下发过程中新入队的指令等本轮结束后的下一次上报
+	q.add("dev1")
+	assert.False(t, q.begin("dev1"))
+	q.end("dev1")
+	assert.True(t, q.begin("dev1"))
+	q.end("dev1")
+	assert.False(t, q.begin("dev1"))
+}
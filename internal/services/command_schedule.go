@@ -0,0 +1,300 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/types"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+)
+
+// ========== 定时指令 ==========
+
+const (
+	_SCHEDULE_INTERVAL    = 10 * time.Second
+	_SCHEDULE_BATCH       = 100
+	_SCHEDULE_TIME_LAYOUT = "2006-1-2 15:4:5"
+)
+
+var (
+	// ErrInvalidSchedule 定时指令参数不合法
+	ErrInvalidSchedule = errors.New("invalid schedule")
+	// ErrScheduleNotFound 定时指令不存在或不属于该设备
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrInvalidTimezone 不是有效的IANA时区
+	ErrInvalidTimezone = errors.New("invalid timezone")
+)
+
+// ScheduleRequest 创建或修改定时指令的参数，Cron与RunAt二选一，RunAt为设备主人时区的本地时间
+// 修改时为空的字段保持不变
+type ScheduleRequest struct {
+	Action  string
+	Args    []string
+	Cron    string
+	RunAt   string
+	Enabled *bool
+}
+
+// userLocation 用户设置的时区，未设置或无效时取服务器时区
+func (c *SimpleServiceContainer) userLocation(userID uint) *time.Location {
+	if user, err := c.repo.GetUserByID(userID); err == nil && user.Timezone != "" {
+		if loc, err := time.LoadLocation(user.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// deviceLocation 定时指令按设备主人的时区计算
+func (c *SimpleServiceContainer) deviceLocation(deviceID string) *time.Location {
+	owner, err := c.repo.GetUserIdByDeviceId(deviceID)
+	if err != nil || owner == 0 {
+		return time.Local
+	}
+	return c.userLocation(owner)
+}
+
+// nextRunAt 计算now之后的执行时间，单次执行已过期时返回nil
+func nextRunAt(s *mxm.CommandSchedule, loc *time.Location, now time.Time) (*time.Time, error) {
+	if s.Cron == "" {
+		if s.RunAt == nil || !s.RunAt.After(now) {
+			return nil, nil
+		}
+		return s.RunAt, nil
+	}
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+	}
+	next := spec.next(now.In(loc))
+	if next.IsZero() {
+		return nil, fmt.Errorf("%w: cron %q never fires", ErrInvalidSchedule, s.Cron)
+	}
+	return &next, nil
+}
+
+// validateCommand 按设备驱动的能力校验指令
+func (c *SimpleServiceContainer) validateCommand(deviceID, action string, args []string) error {
+	device, err := c.repo.GetDeviceByID(deviceID)
+	if err != nil {
+		return fmt.Errorf("get device failed: %w", err)
+	}
+	if device.Type == nil {
+		return fmt.Errorf("device type is nil")
+	}
+	driver, err := c.driverManager.GetDriver(types.DeviceType(*device.Type))
+	if err != nil {
+		return fmt.Errorf("driver not found for device type: %s", *device.Type)
+	}
+	spec, ok := driver.Capabilities().Action(action)
+	if !ok {
+		return vendors.NewUnsupportedError(*device.Type, action)
+	}
+	return spec.ValidateArgs(args)
+}
+
+// applyScheduleRequest 将请求合入s并计算下次执行时间
+func (c *SimpleServiceContainer) applyScheduleRequest(s *mxm.CommandSchedule, req ScheduleRequest, now time.Time) error {
+	if req.Action != "" {
+		if err := c.validateCommand(s.DeviceID, req.Action, req.Args); err != nil {
+			return err
+		}
+		s.Action, s.Args = req.Action, req.Args
+	}
+	if req.Cron != "" && req.RunAt != "" {
+		return fmt.Errorf("%w: only one of cron and run_at may be set", ErrInvalidSchedule)
+	}
+	loc := c.deviceLocation(s.DeviceID)
+	if req.Cron != "" {
+		s.Cron, s.RunAt = req.Cron, nil
+	} else if req.RunAt != "" {
+		t, err := time.ParseInLocation(_SCHEDULE_TIME_LAYOUT, req.RunAt, loc)
+		if err != nil {
+			return fmt.Errorf("%w: run_at must be like 2025-06-01 08:00:00", ErrInvalidSchedule)
+		}
+		if !t.After(now) {
+			return fmt.Errorf("%w: run_at is in the past", ErrInvalidSchedule)
+		}
+		s.Cron, s.RunAt = "", &t
+	}
+	if s.Cron == "" && s.RunAt == nil {
+		return fmt.Errorf("%w: cron or run_at is required", ErrInvalidSchedule)
+	}
+	if req.Enabled != nil {
+		s.Enabled = *req.Enabled
+	}
+
+	s.NextRunAt = nil
+	if s.Enabled {
+		next, err := nextRunAt(s, loc, now)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return fmt.Errorf("%w: run_at is in the past", ErrInvalidSchedule)
+		}
+		s.NextRunAt = next
+	}
+	return nil
+}
+
+// CreateSchedule 为设备创建定时指令，执行时以创建人身份下发
+func (c *SimpleServiceContainer) CreateSchedule(ctx context.Context, userID uint, deviceID string, req ScheduleRequest) (*mxm.CommandSchedule, error) {
+	if !c.canAccessDevice(userID, deviceID) {
+		return nil, fmt.Errorf("permission denied")
+	}
+	if req.Action == "" {
+		return nil, fmt.Errorf("%w: action is required", ErrInvalidSchedule)
+	}
+	s := &mxm.CommandSchedule{DeviceID: deviceID, UserID: userID, Enabled: true}
+	if err := c.applyScheduleRequest(s, req, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := c.repo.CreateCommandSchedule(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *SimpleServiceContainer) ListSchedules(ctx context.Context, userID uint, deviceID string) ([]*mxm.CommandSchedule, error) {
+	if !c.canAccessDevice(userID, deviceID) {
+		return nil, fmt.Errorf("permission denied")
+	}
+	return c.repo.GetCommandSchedules(deviceID)
+}
+
+func (c *SimpleServiceContainer) getSchedule(userID uint, deviceID string, id uint) (*mxm.CommandSchedule, error) {
+	if !c.canAccessDevice(userID, deviceID) {
+		return nil, fmt.Errorf("permission denied")
+	}
+	s, err := c.repo.GetCommandSchedule(id)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.DeviceID != deviceID {
+		return nil, ErrScheduleNotFound
+	}
+	return s, nil
+}
+
+func (c *SimpleServiceContainer) UpdateSchedule(ctx context.Context, userID uint, deviceID string, id uint, req ScheduleRequest) (*mxm.CommandSchedule, error) {
+	s, err := c.getSchedule(userID, deviceID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.applyScheduleRequest(s, req, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := c.repo.UpdateCommandSchedule(id, map[string]interface{}{
+		"action":      s.Action,
+		"args":        s.Args,
+		"cron":        s.Cron,
+		"run_at":      s.RunAt,
+		"enabled":     s.Enabled,
+		"next_run_at": s.NextRunAt,
+	}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *SimpleServiceContainer) DeleteSchedule(ctx context.Context, userID uint, deviceID string, id uint) error {
+	if _, err := c.getSchedule(userID, deviceID, id); err != nil {
+		return err
+	}
+	return c.repo.DeleteCommandSchedule(id)
+}
+
+// rescheduleUser 用户修改时区后，按新时区重新计算其设备上周期指令的执行时间
+func (c *SimpleServiceContainer) rescheduleUser(userID uint) {
+	devices, err := c.repo.GetDevicesByUserID(int(userID))
+	if err != nil {
+		slog.Error("get devices failed", "userID", userID, "error", err)
+		return
+	}
+	ids := make([]string, 0, len(devices))
+	for _, d := range devices {
+		if d.ID != nil {
+			ids = append(ids, *d.ID)
+		}
+	}
+	lst, err := c.repo.GetSchedulesByDevices(ids)
+	if err != nil {
+		slog.Error("get schedules failed", "userID", userID, "error", err)
+		return
+	}
+	loc, now := c.userLocation(userID), time.Now()
+	for _, s := range lst {
+		if s.Cron == "" {
+			continue
+		}
+		next, err := nextRunAt(s, loc, now)
+		if err != nil {
+			continue
+		}
+		c.repo.UpdateCommandSchedule(s.ID, map[string]interface{}{"next_run_at": next})
+	}
+}
+
+// runSchedule 推进执行时间后下发指令，错过的周期不补发
+func (c *SimpleServiceContainer) runSchedule(ctx context.Context, s *mxm.CommandSchedule, now time.Time) {
+	next, err := nextRunAt(s, c.deviceLocation(s.DeviceID), now)
+	if err != nil {
+		slog.Error("compute next run failed", "scheduleID", s.ID, "error", err)
+	}
+	if ok, err := c.repo.ClaimSchedule(s.ID, *s.NextRunAt, next, next != nil); err != nil || !ok {
+		return
+	}
+
+	updates := map[string]interface{}{"last_run_at": now, "last_command_id": 0, "last_state": "", "last_error": ""}
+	if !c.canAccessDevice(s.UserID, s.DeviceID) {
+		// 创建人已无权操作该设备(解绑或取消分享)，停用
+		updates["enabled"], updates["next_run_at"], updates["last_error"] = false, nil, "permission denied"
+		c.repo.UpdateCommandSchedule(s.ID, updates)
+		return
+	}
+	// 周期指令在离线队列中最多保留到下次执行
+	var expireIn time.Duration
+	if s.Cron != "" && next != nil {
+		expireIn = next.Sub(now)
+	}
+	commandID, state, err := c.ExecuteCommand(ctx, s.UserID, s.DeviceID, s.Action, s.Args, "", expireIn)
+	if err != nil {
+		slog.Error("run schedule failed", "scheduleID", s.ID, "deviceID", s.DeviceID, "action", s.Action, "error", err)
+		updates["last_state"], updates["last_error"] = mxm.CMD_FAILED, err.Error()
+	} else {
+		slog.Info("schedule executed", "scheduleID", s.ID, "deviceID", s.DeviceID, "action", s.Action, "commandID", commandID)
+		updates["last_command_id"], updates["last_state"] = commandID, state
+	}
+	if err := c.repo.UpdateCommandSchedule(s.ID, updates); err != nil {
+		slog.Error("update schedule failed", "scheduleID", s.ID, "error", err)
+	}
+}
+
+// StartCommandScheduler 定期执行到期的定时指令，执行时间存于数据库，重启后继续
+func (c *SimpleServiceContainer) StartCommandScheduler(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(_SCHEDULE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				now := time.Now()
+				lst, err := c.repo.GetDueSchedules(now, _SCHEDULE_BATCH)
+				if err != nil {
+					slog.Error("get due schedules failed", "error", err)
+					continue
+				}
+				for _, s := range lst {
+					c.runSchedule(ctx, s, now)
+				}
+			}
+		}
+	}()
+}
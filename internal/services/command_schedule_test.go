@@ -0,0 +1,75 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"0 8 * * 1-5", "*/15 * * * *", "0 0-6/2 1,15 * *", "30 20 * 1-12/3 0,7"} {
+		_, err := parseCron(expr)
+		assert.NoError(t, err, expr)
+	}
+	for _, expr := range []string{"", "0 8 * *", "60 * * * *", "0 24 * * *", "0 0 0 * *", "0 0 * 13 *", "0 0 * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	at := func(s string) time.Time {
+		tm, _ := time.ParseInLocation("2006-01-02 15:04", s, shanghai)
+		return tm
+	}
+
+	// 工作日08:00，2025-06-06为周五
+	spec, _ := parseCron("0 8 * * 1-5")
+	assert.Equal(t, at("2025-06-06 08:00"), spec.next(at("2025-06-05 20:00")))
+	assert.Equal(t, at("2025-06-09 08:00"), spec.next(at("2025-06-06 08:00")))
+
+	// 夜间每小时
+	spec, _ = parseCron("0 22-23,0-6 * * *")
+	assert.Equal(t, at("2025-06-06 22:00"), spec.next(at("2025-06-06 07:30")))
+	assert.Equal(t, at("2025-06-07 00:00"), spec.next(at("2025-06-06 23:00")))
+
+	// 日和周都指定时满足其一即可
+	spec, _ = parseCron("0 12 1 * 0")
+	assert.Equal(t, at("2025-06-08 12:00"), spec.next(at("2025-06-02 00:00")))
+	assert.Equal(t, at("2025-07-01 12:00"), spec.next(at("2025-06-29 13:00")))
+
+	// 按所在时区计算
+	spec, _ = parseCron("0 8 * * *")
+	assert.Equal(t, at("2025-06-07 08:00"), spec.next(at("2025-06-06 09:00")))
+	// UTC 08:00即北京时间16:00
+	assert.True(t, at("2025-06-06 16:00").Equal(spec.next(at("2025-06-06 09:00").In(time.UTC))))
+
+	// 不存在的日期
+	spec, _ = parseCron("0 0 30 2 *")
+	assert.True(t, spec.next(at("2025-01-01 00:00")).IsZero())
+}
+
+func TestNextRunAt(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	next, err := nextRunAt(&mxm.CommandSchedule{RunAt: &later}, time.Local, now)
+	assert.NoError(t, err)
+	assert.Equal(t, later, *next)
+
+	// 单次执行过后不再执行
+	next, err = nextRunAt(&mxm.CommandSchedule{RunAt: &later}, time.Local, later)
+	assert.NoError(t, err)
+	assert.Nil(t, next)
+
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	next, err = nextRunAt(&mxm.CommandSchedule{Cron: "0 20 * * *"}, tokyo, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, next.In(tokyo).Hour())
+
+	_, err = nextRunAt(&mxm.CommandSchedule{Cron: "0 20 * *"}, tokyo, now)
+	assert.True(t, errors.Is(err, ErrInvalidSchedule))
+}
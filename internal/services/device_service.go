@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
@@ -21,16 +22,38 @@ type SimpleServiceContainer struct {
 	driverManager *DriverManager
 	cmdManager    CommandManager
 	idGen         *utils.IDGenerator
+	cmdIDs        *utils.SeqGenerator //指令ID，设备应答时回传，不能重复
+	otaBaseURL    string              //固件下载地址前缀
+	otaKick       chan struct{}       //创建或调整升级任务后立即触发下发
+	wsManager     *WSManager          //推送离线指令状态
+	queue         *queueIndex
 }
 
 // NewSimpleServiceContainer 创建简化的服务容器
-func NewSimpleServiceContainer(repo dao.Repository, cmdManager CommandManager) *SimpleServiceContainer {
-	return &SimpleServiceContainer{
+func NewSimpleServiceContainer(repo dao.Repository, cmdManager CommandManager, wsManager *WSManager) *SimpleServiceContainer {
+	c := &SimpleServiceContainer{
 		repo:          repo,
 		driverManager: NewDriverManager(),
 		cmdManager:    cmdManager,
 		idGen:         &utils.IDGenerator{},
+		cmdIDs:        &utils.SeqGenerator{},
+		otaKick:       make(chan struct{}, 1),
+		wsManager:     wsManager,
+		queue:         newQueueIndex(),
 	}
+	cmdManager.SetTimeoutHandler(c)
+	return c
+}
+
+// RestoreCommandIDs 从已持久化的指令中恢复指令ID，需在下发任何指令前调用
+func (c *SimpleServiceContainer) RestoreCommandIDs() error {
+	n, err := c.repo.MaxCommandID()
+	if err != nil {
+		return err
+	}
+	c.cmdIDs.Restore(n)
+	slog.Info("command id restored", "max", n)
+	return nil
 }
 
 // RegisterDriver 注册厂商驱动
@@ -47,6 +70,26 @@ func (c *SimpleServiceContainer) StartAllDrivers() error {
 	return c.driverManager.StartAllDrivers()
 }
 
+// ListDrivers 列出所有驱动的运行状态
+func (c *SimpleServiceContainer) ListDrivers(ctx context.Context) []DriverStatus {
+	return c.driverManager.ListDrivers()
+}
+
+// RestartDriver 重启驱动
+func (c *SimpleServiceContainer) RestartDriver(ctx context.Context, name string) error {
+	return c.driverManager.RestartDriver(name)
+}
+
+// IsAdmin 检查用户是否为系统管理员
+func (c *SimpleServiceContainer) IsAdmin(ctx context.Context, userID uint) bool {
+	user, err := c.repo.GetUserByID(userID)
+	if err != nil {
+		slog.Error("get user failed", "userID", userID, "error", err)
+		return false
+	}
+	return user.Admin
+}
+
 // ========== 设备相关方法 ==========
 
 // GetDeviceByID 获取单个设备信息
@@ -127,8 +170,9 @@ func (c *SimpleServiceContainer) UnbindDevice(ctx context.Context, userID uint,
 	return nil
 }
 
-// GetDeviceTrack 获取设备轨迹
-func (c *SimpleServiceContainer) GetDeviceTrack(ctx context.Context, deviceID string, startTime, endTime string, types []string) ([]*mxm.Location, error) {
+// GetDeviceTrack 获取设备轨迹，withRejected为true时包含被过滤的异常点
+func (c *SimpleServiceContainer) GetDeviceTrack(ctx context.Context, deviceID string, startTime, endTime string, types []string,
+	withRejected bool) ([]*mxm.Location, error) {
 	if deviceID == "" {
 		return nil, fmt.Errorf("deviceID is required")
 	}
@@ -143,7 +187,11 @@ func (c *SimpleServiceContainer) GetDeviceTrack(ctx context.Context, deviceID st
 		types = []string{"GPS", "WIFI", "LBS"}
 	}
 
-	track, err := c.repo.GetPosHis(deviceID, startTime, endTime, types)
+	getPosHis := c.repo.GetPosHis
+	if withRejected {
+		getPosHis = c.repo.GetRawPosHis
+	}
+	track, err := getPosHis(deviceID, startTime, endTime, types)
 	if err != nil {
 		slog.Error("get track error", "deviceID", deviceID, "startTime", startTime, "endTime", endTime, "types", types, "error", err)
 		return nil, fmt.Errorf("get track error: %w", err)
@@ -219,88 +267,278 @@ func (c *SimpleServiceContainer) IsEnrollAdmin(ctx context.Context, userID uint)
 // ========== 设备命令相关方法 ==========
 
 // ExecuteCommand 执行设备命令（统一入口）
-func (c *SimpleServiceContainer) ExecuteCommand(ctx context.Context, deviceID string, action string, args []string, terminalKey string) (int64, error) {
+// 设备离线或下发失败时指令进入离线队列，设备下次上报时下发，expireIn为在队列中的有效期(0为默认)
+// 返回的state为delivered(已下发)或queued(已入队)
+func (c *SimpleServiceContainer) ExecuteCommand(ctx context.Context, userID uint, deviceID string, action string, args []string,
+	terminalKey string, expireIn time.Duration) (int64, string, error) {
+	commandID, state, _, err := c.executeCommand(ctx, userID, deviceID, action, args, terminalKey, expireIn)
+	return commandID, state, err
+}
+
+// ExecuteCommandAndWait 下发指令并等待设备应答，最长等待wait
+// 指令进入离线队列或等待超时时result为nil；设备超时未应答时result为超时结果
+func (c *SimpleServiceContainer) ExecuteCommandAndWait(ctx context.Context, userID uint, deviceID string, action string, args []string,
+	terminalKey string, expireIn time.Duration, wait time.Duration) (commandID int64, state string, result *mxm.CommandResult, err error) {
+	commandID, state, done, err := c.executeCommand(ctx, userID, deviceID, action, args, terminalKey, expireIn)
+	if err != nil || done == nil {
+		return commandID, state, nil, err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case result = <-done:
+		state = mxm.CMD_ACKNOWLEDGED
+		if result.Reason == mxm.RESULT_TIMEOUT {
+			state = mxm.CMD_TIMEOUT
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return commandID, state, result, nil
+}
+
+// executeCommand 返回的通道在指令已下发时收到设备应答或超时结果，指令入队时为nil
+func (c *SimpleServiceContainer) executeCommand(ctx context.Context, userID uint, deviceID string, action string, args []string,
+	terminalKey string, expireIn time.Duration) (int64, string, <-chan *mxm.CommandResult, error) {
 	device, err := c.repo.GetDeviceByID(deviceID)
 	if err != nil {
 		slog.Error("get device failed", "deviceID", deviceID, "error", err)
-		return 0, fmt.Errorf("get device failed: %w", err)
+		return 0, "", nil, fmt.Errorf("get device failed: %w", err)
 	}
 
 	if device.Type == nil {
-		return 0, fmt.Errorf("device type is nil")
+		return 0, "", nil, fmt.Errorf("device type is nil")
 	}
 
 	driver, err := c.driverManager.GetDriver(types.DeviceType(*device.Type))
 	if err != nil {
 		slog.Error("driver not found", "deviceID", deviceID, "type", *device.Type, "error", err)
-		return 0, fmt.Errorf("driver not found for device type: %s", *device.Type)
+		return 0, "", nil, fmt.Errorf("driver not found for device type: %s", *device.Type)
 	}
 
 	if device.OriginSN == nil {
-		return 0, fmt.Errorf("device origin SN is nil")
+		return 0, "", nil, fmt.Errorf("device origin SN is nil")
+	}
+
+	// 每次调用都记入指令历史，包括被拒绝的指令
+	commandID := c.cmdIDs.Next()
+	rec := &mxm.CommandRecord{
+		CommandID: commandID,
+		DeviceID:  deviceID,
+		UserID:    userID,
+		Action:    action,
+		Args:      args,
+	}
+
+	// 按驱动声明的能力校验，不支持或参数非法的指令不下发
+	spec, ok := driver.Capabilities().Action(action)
+	if !ok {
+		err := vendors.NewUnsupportedError(*device.Type, action)
+		rec.State, rec.SendError = mxm.CMD_FAILED, err.Error()
+		c.addCommandRecord(rec)
+		return 0, "", nil, err
+	}
+	if err := spec.ValidateArgs(args); err != nil {
+		rec.State, rec.SendError = mxm.CMD_FAILED, err.Error()
+		c.addCommandRecord(rec)
+		return 0, "", nil, err
+	}
+
+	queued := &mxm.QueuedCommand{
+		CommandID:   commandID,
+		DeviceID:    deviceID,
+		UserID:      userID,
+		TerminalKey: terminalKey,
+		Action:      action,
+		Args:        args,
+		State:       mxm.CMD_QUEUED,
+		ExpireAt:    time.Now().Add(queueTTL(expireIn)),
+	}
+	if !deviceOnline(device, time.Now()) {
+		rec.State = mxm.CMD_QUEUED
+		c.addCommandRecord(rec)
+		if err := c.enqueueCommand(queued); err != nil {
+			c.updateCommandRecord(deviceID, commandID, map[string]interface{}{"state": mxm.CMD_FAILED, "send_error": err.Error()})
+			return 0, "", nil, err
+		}
+		return commandID, mxm.CMD_QUEUED, nil, nil
 	}
 
-	commandID := c.idGen.Next()
+	done := c.cmdManager.AddCommand(commandID, parseTerminalKey(terminalKey), deviceID, &mxm.Command{Action: action, Args: args})
 
-	if terminalKey != "" {
-		t := TerminalKey{}
-		c.cmdManager.AddCommand(commandID, t, &mxm.Command{Action: action, Args: args})
+	// 先记录再下发，避免设备应答早于记录写入
+	sentAt := time.Now()
+	rec.State, rec.SentAt = mxm.CMD_DELIVERED, &sentAt
+	c.addCommandRecord(rec)
+	if execErr := sendCommand(driver, *device.Type, *device.OriginSN, commandID, action, args); execErr != nil {
+		slog.Error("exec cmd to device error", "deviceID", deviceID, "action", action, "args", args, "error", execErr.Error())
+		c.cmdManager.GetAndRemoveCommand(commandID) //未下发，不再等待应答
+		failed := map[string]interface{}{"state": mxm.CMD_FAILED, "send_error": execErr.Error(), "sent_at": nil}
+		if errors.Is(execErr, vendors.ErrUnsupportedCommand) || errors.Is(execErr, vendors.ErrInvalidArgument) {
+			c.updateCommandRecord(deviceID, commandID, failed)
+			return 0, "", nil, fmt.Errorf("exec cmd to device error: %w", execErr)
+		}
+		// 多为设备刚离线，留待下次上报时重发
+		if err := c.enqueueCommand(queued); err != nil {
+			c.updateCommandRecord(deviceID, commandID, failed)
+			return 0, "", nil, fmt.Errorf("exec cmd to device error: %w", execErr)
+		}
+		c.updateCommandRecord(deviceID, commandID, map[string]interface{}{"state": mxm.CMD_QUEUED, "send_error": execErr.Error(), "sent_at": nil})
+		return commandID, mxm.CMD_QUEUED, nil, nil
 	}
 
-	var execErr error
+	slog.Info("command executed successfully", "deviceID", deviceID, "action", action, "commandID", commandID)
+	return commandID, mxm.CMD_DELIVERED, done, nil
+}
+
+// sendCommand 调用驱动下发指令
+func sendCommand(driver vendors.VendorDriver, deviceType, originSN string, commandID int64, action string, args []string) error {
 	switch action {
 	case "POWER_OFF":
-		execErr = driver.PowerOff(commandID, *device.OriginSN)
+		return driver.PowerOff(commandID, originSN)
 	case "REBOOT":
-		execErr = driver.Reboot(commandID, *device.OriginSN)
+		return driver.Reboot(commandID, originSN)
 	case "LOCATE":
-		execErr = driver.Locate(commandID, *device.OriginSN)
+		return driver.Locate(commandID, originSN)
 	case "FIND":
-		execErr = driver.Find(commandID, *device.OriginSN)
+		return driver.Find(commandID, originSN)
 	case "AUTO_START":
 		advancedDriver, ok := driver.(vendors.AdvancedDriver)
 		if !ok {
-			return 0, fmt.Errorf("driver does not support advanced operations")
+			return vendors.NewUnsupportedError(deviceType, action)
 		}
 		if len(args) < 2 {
-			return 0, fmt.Errorf("AUTO_START requires 2 arguments: time and enable")
+			return fmt.Errorf("AUTO_START requires 2 arguments: time and enable")
 		}
 		tm := args[0]
 		enable := args[1] == "1"
-		execErr = advancedDriver.AutoStart(commandID, *device.OriginSN, tm, enable)
+		return advancedDriver.AutoStart(commandID, originSN, tm, enable)
 	case "AUTO_SHUT":
 		advancedDriver, ok := driver.(vendors.AdvancedDriver)
 		if !ok {
-			return 0, fmt.Errorf("driver does not support advanced operations")
+			return vendors.NewUnsupportedError(deviceType, action)
 		}
 		if len(args) < 2 {
-			return 0, fmt.Errorf("AUTO_SHUT requires 2 arguments: time and enable")
+			return fmt.Errorf("AUTO_SHUT requires 2 arguments: time and enable")
 		}
 		tm := args[0]
 		enable := args[1] == "1"
-		execErr = advancedDriver.AutoShut(commandID, *device.OriginSN, tm, enable)
+		return advancedDriver.AutoShut(commandID, originSN, tm, enable)
 	case "SET_REPORTINTERVAL":
 		if len(args) < 1 {
-			return 0, fmt.Errorf("SET_REPORTINTERVAL requires 1 argument: interval")
+			return fmt.Errorf("SET_REPORTINTERVAL requires 1 argument: interval")
 		}
 		interval, err := strconv.Atoi(args[0])
 		if err != nil {
-			return 0, fmt.Errorf("invalid interval: %s", args[0])
+			return fmt.Errorf("invalid interval: %s", args[0])
 		}
-		execErr = driver.SetReportInterval(commandID, *device.OriginSN, interval)
+		return driver.SetReportInterval(commandID, originSN, interval)
 	default:
-		execErr = fmt.Errorf("action not found: %s", action)
+		return fmt.Errorf("action not found: %s", action)
 	}
+}
 
-	if execErr != nil {
-		slog.Error("exec cmd to device error", "deviceID", deviceID, "action", action, "args", args, "error", execErr.Error())
-		return 0, fmt.Errorf("exec cmd to device error: %w", execErr)
+// ResendCommand 幂等指令超时后沿用原CommandID重发
+func (c *SimpleServiceContainer) ResendCommand(commandID int64, p *pendingCommand) error {
+	device, err := c.repo.GetDeviceByID(p.DeviceID)
+	if err != nil {
+		return fmt.Errorf("get device failed: %w", err)
+	}
+	if device.Type == nil || device.OriginSN == nil {
+		return fmt.Errorf("device type or origin SN is nil")
+	}
+	driver, err := c.driverManager.GetDriver(types.DeviceType(*device.Type))
+	if err != nil {
+		return fmt.Errorf("driver not found for device type: %s", *device.Type)
 	}
+	c.updateCommandRecord(p.DeviceID, commandID, map[string]interface{}{"retries": p.Retries})
+	return sendCommand(driver, *device.Type, *device.OriginSN, commandID, p.Command.Action, p.Command.Args)
+}
 
-	slog.Info("command executed successfully", "deviceID", deviceID, "action", action, "commandID", commandID)
+// CommandTimedOut 设备超时未应答，向同步等待方及发起终端返回失败结果
+func (c *SimpleServiceContainer) CommandTimedOut(commandID int64, p *pendingCommand) {
+	c.updateCommandRecord(p.DeviceID, commandID, map[string]interface{}{"state": mxm.CMD_TIMEOUT, "retries": p.Retries})
+	res := &mxm.CommandResult{
+		CommandID: commandID,
+		Succeed:   false,
+		Msg:       "device did not reply in time",
+		Reason:    mxm.RESULT_TIMEOUT,
+		Retries:   p.Retries,
+	}
+	p.Complete(res)
+	if c.wsManager == nil || p.Terminal == nil {
+		return
+	}
+	if err := c.wsManager.PushMsg(*p.Terminal, &WSMessage{Type: "command_result", Data: res}); err != nil {
+		slog.Error("push command timeout failed", "commandID", commandID, "error", err)
+	}
+}
+
+// ExecuteRawCommand 透传厂商原始指令，供技术支持排查问题，调用方需确认operatorID为管理员
+// 每次调用(无论成败)都记录审计日志
+func (c *SimpleServiceContainer) ExecuteRawCommand(ctx context.Context, operatorID uint, deviceID string, payload string, terminalKey string) (commandID int64, err error) {
+	defer func() {
+		slog.Warn("audit: raw command", "operator", operatorID, "deviceID", deviceID, "payload", payload,
+			"commandID", commandID, "error", err)
+	}()
+
+	device, err := c.repo.GetDeviceByID(deviceID)
+	if err != nil {
+		return 0, fmt.Errorf("get device failed: %w", err)
+	}
+	if device.Type == nil || device.OriginSN == nil {
+		return 0, fmt.Errorf("device type or origin SN is nil")
+	}
+	driver, err := c.driverManager.GetDriver(types.DeviceType(*device.Type))
+	if err != nil {
+		return 0, fmt.Errorf("driver not found for device type: %s", *device.Type)
+	}
+	raw, ok := driver.(vendors.RawCommander)
+	if !ok {
+		return 0, vendors.NewUnsupportedError(*device.Type, vendors.ACTION_RAW)
+	}
+
+	commandID = c.cmdIDs.Next()
+	c.cmdManager.AddCommand(commandID, parseTerminalKey(terminalKey), deviceID, &mxm.Command{Action: vendors.ACTION_RAW, Args: []string{payload}})
+	sentAt := time.Now()
+	c.addCommandRecord(&mxm.CommandRecord{
+		CommandID: commandID,
+		DeviceID:  deviceID,
+		UserID:    operatorID,
+		Action:    vendors.ACTION_RAW,
+		Args:      []string{payload},
+		State:     mxm.CMD_DELIVERED,
+		SentAt:    &sentAt,
+	})
+	if err := raw.SendRaw(commandID, *device.OriginSN, payload); err != nil {
+		c.cmdManager.GetAndRemoveCommand(commandID)
+		c.updateCommandRecord(deviceID, commandID, map[string]interface{}{"state": mxm.CMD_FAILED, "send_error": err.Error(), "sent_at": nil})
+		return 0, fmt.Errorf("exec raw cmd to device error: %w", err)
+	}
 	return commandID, nil
 }
 
+// GetCapabilities 获取设备驱动支持的指令及参数
+func (c *SimpleServiceContainer) GetCapabilities(ctx context.Context, deviceID string) (*vendors.Capabilities, error) {
+	device, err := c.repo.GetDeviceByID(deviceID)
+	if err != nil {
+		slog.Error("get device failed", "deviceID", deviceID, "error", err)
+		return nil, fmt.Errorf("get device failed: %w", err)
+	}
+	if device.Type == nil {
+		return nil, fmt.Errorf("device type is nil")
+	}
+
+	driver, err := c.driverManager.GetDriver(types.DeviceType(*device.Type))
+	if err != nil {
+		slog.Error("driver not found", "deviceID", deviceID, "type", *device.Type, "error", err)
+		return nil, fmt.Errorf("driver not found for device type: %s", *device.Type)
+	}
+	caps := driver.Capabilities()
+	return &caps, nil
+}
+
 // GetReportInterval 获取设备上报间隔
 func (c *SimpleServiceContainer) GetReportInterval(ctx context.Context, deviceID string) (int, error) {
 	device, err := c.repo.GetDeviceByID(deviceID)
@@ -345,6 +583,9 @@ func (c *SimpleServiceContainer) GetSafeRegions(ctx context.Context, deviceID st
 
 // SetSafeRegion 设置安全区域
 func (c *SimpleServiceContainer) SetSafeRegion(ctx context.Context, deviceID string, region *mxm.Region) error {
+	if err := validateRegion(region); err != nil {
+		return err
+	}
 	// 首先检查是否已存在同名的安全区域
 	existingRegions, err := c.repo.GetSafeRegions(deviceID)
 	if err != nil {
@@ -369,6 +610,10 @@ func (c *SimpleServiceContainer) SetSafeRegion(ctx context.Context, deviceID str
 			return fmt.Errorf("update safe region failed: %w", err)
 		}
 		slog.Info("update safe region success", "deviceID", deviceID, "region", region)
+		// 区域范围变了，按新范围重新判断内外
+		if err := c.repo.DeleteFenceState(deviceID, region.Name); err != nil {
+			slog.Error("reset fence state failed", "deviceID", deviceID, "region", region.Name, "error", err)
+		}
 	} else {
 		// 区域不存在，执行创建操作
 		slog.Info("creating new safe region", "deviceID", deviceID, "regionName", region.Name)
@@ -472,12 +717,46 @@ func (c *SimpleServiceContainer) GetUser(ctx context.Context, userID uint) (*mxm
 	return user, nil
 }
 
-// UpdateUser 更新用户信息
+// userEditableFields 用户可自行修改的字段，admin、enroll_admin等权限字段只能由后台设置
+var userEditableFields = map[string]bool{
+	"nick_name":  true,
+	"avatar_url": true,
+	"timezone":   true,
+}
+
+// UpdateUser 更新用户信息，不可修改的字段被忽略
 func (c *SimpleServiceContainer) UpdateUser(ctx context.Context, userID uint, updates map[string]interface{}) error {
+	allowed := make(map[string]interface{}, len(updates))
+	for k, v := range updates {
+		if !userEditableFields[k] {
+			slog.Warn("user field not editable, ignored", "userID", userID, "field", k)
+			continue
+		}
+		allowed[k] = v
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	updates = allowed
+
+	tz, tzChanged := updates["timezone"]
+	if tzChanged {
+		name, ok := tz.(string)
+		if !ok {
+			return ErrInvalidTimezone
+		}
+		if _, err := time.LoadLocation(name); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidTimezone, name)
+		}
+	}
 	if err := c.repo.UpdateUser(userID, updates); err != nil {
 		slog.Error("update user failed", "userID", userID, "error", err)
 		return fmt.Errorf("update user failed: %w", err)
 	}
+	// 定时指令按设备主人的时区执行
+	if tzChanged {
+		c.rescheduleUser(userID)
+	}
 	return nil
 }
 
@@ -3,22 +3,49 @@ package services
 import (
 	"fmt"
 	"log/slog"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Daneel-Li/gps-back/internal/types"
 	"github.com/Daneel-Li/gps-back/internal/vendors"
 )
 
+// 驱动运行状态
+type DriverState string
+
+const (
+	DRIVER_STARTING DriverState = "starting"
+	DRIVER_HEALTHY  DriverState = "healthy"
+	DRIVER_DEGRADED DriverState = "degraded" //启动失败或运行中与上游断开
+	DRIVER_STOPPED  DriverState = "stopped"
+)
+
+// DriverStatus 驱动状态快照
+type DriverStatus struct {
+	Name      string      `json:"name"`
+	State     DriverState `json:"state"`
+	LastError string      `json:"last_error,omitempty"`
+	Since     time.Time   `json:"since"` //进入当前状态的时间
+}
+
+type driverEntry struct {
+	driver  vendors.VendorDriver
+	status  DriverStatus
+	started bool       //Start成功且未Stop
+	op      sync.Mutex //串行化同一驱动的启停
+}
+
 // DriverManager 管理所有厂商驱动的生命周期
 type DriverManager struct {
-	drivers map[types.DeviceType]vendors.VendorDriver
+	drivers map[types.DeviceType]*driverEntry
 	mu      sync.RWMutex
 }
 
 // NewDriverManager 创建新的驱动管理器
 func NewDriverManager() *DriverManager {
 	return &DriverManager{
-		drivers: make(map[types.DeviceType]vendors.VendorDriver),
+		drivers: make(map[types.DeviceType]*driverEntry),
 	}
 }
 
@@ -31,41 +58,130 @@ func (dm *DriverManager) RegisterDriver(name string, driver vendors.VendorDriver
 	if _, exists := dm.drivers[deviceType]; exists {
 		return fmt.Errorf("driver %s already registered", name)
 	}
-	dm.drivers[deviceType] = driver
+	dm.drivers[deviceType] = &driverEntry{
+		driver: driver,
+		status: DriverStatus{Name: name, State: DRIVER_STOPPED, Since: time.Now()},
+	}
 	slog.Info("Driver registered", "name", name, "type", deviceType)
 	return nil
 }
 
-// StartDriver 启动指定的厂商驱动
-func (dm *DriverManager) StartDriver(name string) error {
-	dm.mu.RLock()
-	driver, exists := dm.drivers[types.DeviceType(name)]
-	dm.mu.RUnlock()
+// UnregisterDriver 停止并移除驱动
+func (dm *DriverManager) UnregisterDriver(name string) error {
+	dm.mu.Lock()
+	entry, exists := dm.drivers[types.DeviceType(name)]
+	delete(dm.drivers, types.DeviceType(name))
+	dm.mu.Unlock()
 
 	if !exists {
 		return fmt.Errorf("driver %s not registered", name)
 	}
+	entry.op.Lock()
+	defer entry.op.Unlock()
+	if err := entry.driver.Stop(); err != nil {
+		slog.Warn("stop driver failed", "name", name, "error", err)
+	}
+	slog.Info("Driver unregistered", "name", name)
+	return nil
+}
+
+func (dm *DriverManager) entry(name string) (*driverEntry, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	entry, exists := dm.drivers[types.DeviceType(name)]
+	if !exists {
+		return nil, fmt.Errorf("driver %s not registered", name)
+	}
+	return entry, nil
+}
+
+func (dm *DriverManager) setState(entry *driverEntry, state DriverState, err error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	entry.status.State = state
+	entry.started = state == DRIVER_HEALTHY
+	entry.status.Since = time.Now()
+	entry.status.LastError = ""
+	if err != nil {
+		entry.status.LastError = err.Error()
+	}
+}
+
+// StartDriver 启动指定的厂商驱动，失败时驱动标记为degraded
+// 驱动的Start需限时返回，期间持有op，同一驱动的Stop/Restart会等待它结束
+func (dm *DriverManager) StartDriver(name string) error {
+	entry, err := dm.entry(name)
+	if err != nil {
+		return err
+	}
+	entry.op.Lock()
+	defer entry.op.Unlock()
 
-	if err := driver.Start(); err != nil {
+	dm.setState(entry, DRIVER_STARTING, nil)
+	if err := entry.driver.Start(); err != nil {
+		dm.setState(entry, DRIVER_DEGRADED, err)
 		return fmt.Errorf("failed to start driver %s: %w", name, err)
 	}
+	dm.setState(entry, DRIVER_HEALTHY, nil)
 
 	slog.Info("Driver started", "name", name)
 	return nil
 }
 
-// StartAllDrivers 启动所有已注册的驱动
-func (dm *DriverManager) StartAllDrivers() error {
-	dm.mu.RLock()
-	defer dm.mu.RUnlock()
+// StopDriver 停止指定的厂商驱动
+func (dm *DriverManager) StopDriver(name string) error {
+	entry, err := dm.entry(name)
+	if err != nil {
+		return err
+	}
+	entry.op.Lock()
+	defer entry.op.Unlock()
 
-	for name, driver := range dm.drivers {
-		if err := driver.Start(); err != nil {
-			return fmt.Errorf("failed to start driver %s: %w", name, err)
+	err = entry.driver.Stop()
+	dm.setState(entry, DRIVER_STOPPED, err)
+	if err != nil {
+		return fmt.Errorf("failed to stop driver %s: %w", name, err)
+	}
+	slog.Info("Driver stopped", "name", name)
+	return nil
+}
+
+// RestartDriver 停止后重新启动驱动，启动在后台进行，结果通过ListDrivers查看
+func (dm *DriverManager) RestartDriver(name string) error {
+	if err := dm.StopDriver(name); err != nil {
+		slog.Warn("stop driver before restart failed", "name", name, "error", err)
+	}
+	entry, err := dm.entry(name)
+	if err != nil {
+		return err
+	}
+	dm.setState(entry, DRIVER_STARTING, nil)
+	go func() {
+		if err := dm.StartDriver(name); err != nil {
+			slog.Error("restart driver failed", "name", name, "error", err)
 		}
-		slog.Info("Driver started", "name", name)
+	}()
+	return nil
+}
+
+// StartAllDrivers 在后台并行启动所有已注册的驱动，单个驱动失败或阻塞(如mqtt broker不可达)不影响其它驱动
+func (dm *DriverManager) StartAllDrivers() error {
+	dm.mu.RLock()
+	names := make([]string, 0, len(dm.drivers))
+	for name := range dm.drivers {
+		names = append(names, string(name))
 	}
+	dm.mu.RUnlock()
 
+	for _, name := range names {
+		go func(name string) {
+			if err := dm.StartDriver(name); err != nil {
+				slog.Error("start driver failed", "name", name, "error", err)
+			}
+		}(name)
+	}
 	return nil
 }
 
@@ -74,12 +190,12 @@ func (dm *DriverManager) GetDriver(deviceType types.DeviceType) (vendors.VendorD
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
 
-	driver, exists := dm.drivers[deviceType]
+	entry, exists := dm.drivers[deviceType]
 	if !exists {
 		return nil, fmt.Errorf("driver for type %s not found", deviceType)
 	}
 
-	return driver, nil
+	return entry.driver, nil
 }
 
 // SetMessageHandler 为所有驱动设置消息处理器
@@ -87,8 +203,8 @@ func (dm *DriverManager) SetMessageHandler(handler vendors.MessageHandler) {
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
 
-	for name, driver := range dm.drivers {
-		driver.SetMessageHandler(handler)
+	for name, entry := range dm.drivers {
+		entry.driver.SetMessageHandler(handler)
 		slog.Debug("Message handler set for driver", "name", name)
 	}
 }
@@ -113,15 +229,41 @@ func (dm *DriverManager) DeactivateDevice(deviceType types.DeviceType, originSN
 	return driver.Deactivate(originSN)
 }
 
-// ListDrivers 列出所有已注册的驱动
-func (dm *DriverManager) ListDrivers() []string {
+// ListDrivers 列出所有已注册驱动的状态，按名称排序
+// 已启动的驱动若实现了HealthChecker，以其当前健康状况为准
+func (dm *DriverManager) ListDrivers() []DriverStatus {
 	dm.mu.RLock()
-	defer dm.mu.RUnlock()
+	entries := make([]*driverEntry, 0, len(dm.drivers))
+	for _, entry := range dm.drivers {
+		entries = append(entries, entry)
+	}
+	dm.mu.RUnlock()
 
-	var names []string
-	for name := range dm.drivers {
-		names = append(names, string(name))
+	statuses := make([]DriverStatus, 0, len(entries))
+	for _, entry := range entries {
+		if checker, ok := entry.driver.(vendors.HealthChecker); ok && dm.running(entry) {
+			err := checker.Health()
+			dm.mu.Lock()
+			switch {
+			case err != nil && entry.status.State == DRIVER_HEALTHY:
+				entry.status = DriverStatus{Name: entry.status.Name, State: DRIVER_DEGRADED, LastError: err.Error(), Since: time.Now()}
+			case err == nil && entry.status.State == DRIVER_DEGRADED:
+				entry.status = DriverStatus{Name: entry.status.Name, State: DRIVER_HEALTHY, Since: time.Now()}
+			}
+			dm.mu.Unlock()
+		}
+		dm.mu.RLock()
+		statuses = append(statuses, entry.status)
+		dm.mu.RUnlock()
 	}
 
-	return names
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// running 驱动已成功启动且未停止，启动失败的驱动不参与健康检查
+func (dm *DriverManager) running(entry *driverEntry) bool {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return entry.started
 }
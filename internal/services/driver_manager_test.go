@@ -0,0 +1,138 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDriver struct {
+	mu       sync.Mutex
+	startErr error
+	health   error
+	block    chan struct{} //非nil时Start阻塞到close
+	starts   int
+	stops    int
+}
+
+func (d *fakeDriver) SetMessageHandler(vendors.MessageHandler) {}
+func (d *fakeDriver) Start() error {
+	if d.block != nil {
+		<-d.block
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.starts++
+	return d.startErr
+}
+func (d *fakeDriver) Stop() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stops++
+	return nil
+}
+func (d *fakeDriver) Health() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.health
+}
+func (d *fakeDriver) SetReportInterval(int64, string, int) error { return nil }
+func (d *fakeDriver) Locate(int64, string) error                 { return nil }
+func (d *fakeDriver) Reboot(int64, string) error                 { return nil }
+func (d *fakeDriver) PowerOff(int64, string) error               { return nil }
+func (d *fakeDriver) Find(int64, string) error                   { return nil }
+func (d *fakeDriver) Activate(string) error                      { return nil }
+func (d *fakeDriver) Deactivate(string) error                    { return nil }
+func (d *fakeDriver) Capabilities() vendors.Capabilities         { return vendors.NewCapabilities() }
+
+func stateOf(dm *DriverManager, name string) DriverStatus {
+	for _, s := range dm.ListDrivers() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return DriverStatus{}
+}
+
+func TestStartAllDriversIsolatesFailures(t *testing.T) {
+	dm := NewDriverManager()
+	blocked := &fakeDriver{block: make(chan struct{})}
+	failed := &fakeDriver{startErr: errors.New("port in use")}
+	ok := &fakeDriver{}
+	assert.NoError(t, dm.RegisterDriver("btt", blocked))
+	assert.NoError(t, dm.RegisterDriver("gt06", failed))
+	assert.NoError(t, dm.RegisterDriver("v53", ok))
+	assert.Equal(t, DRIVER_STOPPED, stateOf(dm, "v53").State)
+
+	assert.NoError(t, dm.StartAllDrivers())
+	// 阻塞的broker连接和启动失败都不影响v53
+	assert.Eventually(t, func() bool { return stateOf(dm, "v53").State == DRIVER_HEALTHY }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return stateOf(dm, "gt06").State == DRIVER_DEGRADED }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "port in use", stateOf(dm, "gt06").LastError)
+	assert.Equal(t, DRIVER_STARTING, stateOf(dm, "btt").State)
+
+	close(blocked.block)
+	assert.Eventually(t, func() bool { return stateOf(dm, "btt").State == DRIVER_HEALTHY }, time.Second, 10*time.Millisecond)
+
+	names := []string{}
+	for _, s := range dm.ListDrivers() {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"btt", "gt06", "v53"}, names)
+}
+
+func TestDriverHealth(t *testing.T) {
+	dm := NewDriverManager()
+	d := &fakeDriver{}
+	assert.NoError(t, dm.RegisterDriver("btt", d))
+	assert.NoError(t, dm.StartDriver("btt"))
+	assert.Equal(t, DRIVER_HEALTHY, stateOf(dm, "btt").State)
+
+	d.mu.Lock()
+	d.health = errors.New("mqtt disconnected")
+	d.mu.Unlock()
+	s := stateOf(dm, "btt")
+	assert.Equal(t, DRIVER_DEGRADED, s.State)
+	assert.Equal(t, "mqtt disconnected", s.LastError)
+
+	d.mu.Lock()
+	d.health = nil
+	d.mu.Unlock()
+	s = stateOf(dm, "btt")
+	assert.Equal(t, DRIVER_HEALTHY, s.State)
+	assert.Empty(t, s.LastError)
+
+	// 停止后不再做健康检查
+	assert.NoError(t, dm.StopDriver("btt"))
+	d.mu.Lock()
+	d.health = errors.New("mqtt client not started")
+	d.mu.Unlock()
+	assert.Equal(t, DRIVER_STOPPED, stateOf(dm, "btt").State)
+}
+
+func TestRestartAndUnregisterDriver(t *testing.T) {
+	dm := NewDriverManager()
+	d := &fakeDriver{startErr: errors.New("boom")}
+	assert.NoError(t, dm.RegisterDriver("gt06", d))
+	assert.Error(t, dm.StartDriver("gt06"))
+	assert.Equal(t, DRIVER_DEGRADED, stateOf(dm, "gt06").State)
+
+	d.mu.Lock()
+	d.startErr = nil
+	d.mu.Unlock()
+	assert.NoError(t, dm.RestartDriver("gt06"))
+	assert.Eventually(t, func() bool { return stateOf(dm, "gt06").State == DRIVER_HEALTHY }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, d.stops)
+	assert.Equal(t, 2, d.starts)
+
+	assert.Error(t, dm.RestartDriver("nope"))
+	assert.NoError(t, dm.UnregisterDriver("gt06"))
+	assert.Equal(t, 2, d.stops)
+	_, err := dm.GetDriver("gt06")
+	assert.Error(t, err)
+	assert.NoError(t, dm.RegisterDriver("gt06", d))
+}
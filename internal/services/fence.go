@@ -0,0 +1,226 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+)
+
+// ========== 电子围栏 ==========
+
+const (
+	_FENCE_CONFIRM_FIXES = 2     // LBS/WIFI等低精度定位需连续落在另一侧的次数，GPS定位一次即可
+	_FENCE_MAX_MARGIN    = 200.0 // 距边界小于定位精度的点不计入，精度很差时最多按该距离(米)计
+)
+
+// ErrInvalidRegion 安全区域参数不合法
+var ErrInvalidRegion = errors.New("invalid region")
+
+// validateRegion 保存前校验区域名称和范围
+func validateRegion(region *mxm.Region) error {
+	if region.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidRegion)
+	}
+	if region.Area == nil {
+		return fmt.Errorf("%w: area is required", ErrInvalidRegion)
+	}
+	if err := region.Area.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRegion, err)
+	}
+	if err := region.ValidateRules(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRegion, err)
+	}
+	return nil
+}
+
+// fenceSide 判断定位点在围栏内还是外，离边界太近无法判断时ok为false
+func fenceSide(area mxm.Area, pt mxm.Point, accuracy float64) (inside bool, ok bool) {
+	if d, isDist := area.(mxm.BoundaryDistancer); isDist {
+		dist := d.BoundaryDistance(pt)
+		if math.Abs(dist) < math.Min(accuracy, _FENCE_MAX_MARGIN) {
+			return false, false
+		}
+		return dist < 0, true
+	}
+	return !area.IsOut(pt), true
+}
+
+func confirmFixes(locType string) int {
+	if strings.EqualFold(locType, "GPS") {
+		return 1
+	}
+	return _FENCE_CONFIRM_FIXES
+}
+
+// stepFence 用一次定位推进围栏状态，连续need次落在另一侧才切换，返回是否发生进出
+func stepFence(s *mxm.FenceState, inside bool, need int) bool {
+	if inside == s.Inside {
+		s.Pending = 0
+		return false
+	}
+	s.Pending++
+	if s.Pending < need {
+		return false
+	}
+	s.Inside, s.Pending = inside, 0
+	return true
+}
+
+// violating 设备在该侧时是否满足区域的触发条件
+func violating(trigger string, inside bool) bool {
+	switch trigger {
+	case mxm.TRIGGER_ENTER:
+		return inside
+	case mxm.TRIGGER_EXIT, mxm.TRIGGER_STAY_INSIDE:
+		return !inside
+	}
+	return true
+}
+
+// CheckFences 用设备最新定位判断各安全区域的进出，返回进出围栏告警，由调用方保存并推送
+// 设备第一次出现在某个围栏的判断中时只记录状态，不告警(stay_inside除外)
+// 生效时段和停留时间按定位时间、设备主人时区判断，停留时间在后续定位到达时检查
+func (c *SimpleServiceContainer) CheckFences(deviceID string, loc *mxm.Location) []mxm.Alarm {
+	regions, err := c.repo.GetSafeRegions(deviceID)
+	if err != nil {
+		slog.Error("get safe regions failed", "deviceID", deviceID, "error", err)
+		return nil
+	}
+	if len(regions) == 0 {
+		return nil
+	}
+	states, err := c.repo.GetFenceStates(deviceID)
+	if err != nil {
+		slog.Error("get fence states failed", "deviceID", deviceID, "error", err)
+		return nil
+	}
+	byName := make(map[string]*mxm.FenceState, len(states))
+	for _, s := range states {
+		byName[s.RegionName] = s
+	}
+
+	now := loc.LocTime
+	if now.IsZero() {
+		now = time.Now()
+	}
+	var tz *time.Location
+	activeAt := func(r *mxm.Region) bool {
+		if len(r.Schedule) == 0 {
+			return true
+		}
+		if tz == nil {
+			tz = c.deviceLocation(deviceID)
+		}
+		return r.ActiveAt(now.In(tz))
+	}
+
+	pt := mxm.Point{Latitude: loc.Latitude, Longitude: loc.Longitude}
+	var alarms []mxm.Alarm
+	for _, r := range regions {
+		// 旧版本保存的矩形没有经纬度范围，不参与判断
+		if r.Area == nil || r.Area.Validate() != nil {
+			continue
+		}
+		inside, ok := fenceSide(r.Area, pt, loc.Accuracy)
+		if !ok {
+			continue
+		}
+		var before mxm.FenceState
+		s, known := byName[r.Name]
+		if !known {
+			s = &mxm.FenceState{DeviceID: deviceID, RegionName: r.Name, Inside: inside, Since: now,
+				Fired: r.Trigger != mxm.TRIGGER_STAY_INSIDE}
+		} else {
+			before = *s
+			if stepFence(s, inside, confirmFixes(loc.Type)) {
+				slog.Info("fence crossed", "deviceID", deviceID, "region", r.Name, "inside", s.Inside)
+				// 停留时间不足就回来了
+				if !before.Fired && r.Dwell > 0 && violating(r.Trigger, before.Inside) && activeAt(r) {
+					c.addFenceEvent(r, &before, now, false, mxm.FENCE_SUPPRESS_DWELL, 0)
+				}
+				s.Since, s.Fired = now, false
+			}
+		}
+		if alarm := c.evalFenceRule(r, s, pt, now, activeAt(r)); alarm != nil {
+			alarms = append(alarms, *alarm)
+		}
+		if *s != before {
+			c.saveFenceState(s)
+		}
+	}
+	return alarms
+}
+
+// evalFenceRule 当前一侧满足触发条件且停留满最短时间时告警，不在生效时段的记为抑制
+func (c *SimpleServiceContainer) evalFenceRule(r *mxm.Region, s *mxm.FenceState, pt mxm.Point, now time.Time, active bool) *mxm.Alarm {
+	if r.Trigger == mxm.TRIGGER_STAY_INSIDE && !active {
+		// 时段外不要求在围栏内，下个时段开始时仍在外面要再次告警
+		s.Fired = false
+		return nil
+	}
+	if s.Fired || !violating(r.Trigger, s.Inside) {
+		return nil
+	}
+	if now.Sub(s.Since) < time.Duration(r.Dwell)*time.Second {
+		return nil
+	}
+	s.Fired = true
+	if !active {
+		c.addFenceEvent(r, s, now, false, mxm.FENCE_SUPPRESS_INACTIVE, 0)
+		return nil
+	}
+
+	alarm := &mxm.Alarm{DeviceID: s.DeviceID, Time: now, Type: mxm.OUT_AREA, Msg: r.Name}
+	if s.Inside {
+		alarm.Type = mxm.IN_AREA
+	} else if r.Trigger == mxm.TRIGGER_STAY_INSIDE {
+		alarm.Type = mxm.NOT_IN_AREA
+	} else if corridor, ok := r.Area.(*mxm.Corridor); ok {
+		// 路线围栏告警带上偏离的路段和距离
+		seg, dist := corridor.NearestSegment(pt)
+		alarm.Type = mxm.OFF_ROUTE
+		alarm.Msg = fmt.Sprintf("%s:%d:%.0f", r.Name, seg+1, dist-corridor.Buffer)
+	}
+	c.addFenceEvent(r, s, now, true, "", alarm.Type)
+	return alarm
+}
+
+// 围栏事件只用于排查，写入失败不影响告警
+func (c *SimpleServiceContainer) addFenceEvent(r *mxm.Region, s *mxm.FenceState, now time.Time, fired bool, reason string, alarmType int) {
+	e := &mxm.FenceEvent{DeviceID: s.DeviceID, RegionName: r.Name, Trigger: r.Trigger, Inside: s.Inside,
+		Fired: fired, Reason: reason, AlarmType: alarmType, Time: now}
+	if err := c.repo.AddFenceEvent(e); err != nil {
+		slog.Error("add fence event failed", "deviceID", s.DeviceID, "region", r.Name, "error", err)
+	}
+}
+
+// GetFenceEvents 查询设备的围栏告警及被抑制的记录
+func (c *SimpleServiceContainer) GetFenceEvents(ctx context.Context, userID uint, deviceID string, limit, offset int) ([]*mxm.FenceEvent, int64, error) {
+	if !c.canAccessDevice(userID, deviceID) {
+		return nil, 0, fmt.Errorf("permission denied")
+	}
+	if limit <= 0 {
+		limit = _CMD_HISTORY_DEFAULT_LIMIT
+	}
+	limit = min(limit, _CMD_HISTORY_MAX_LIMIT)
+	offset = max(offset, 0)
+
+	lst, total, err := c.repo.GetFenceEvents(deviceID, limit, offset)
+	if err != nil {
+		slog.Error("get fence events failed", "deviceID", deviceID, "error", err)
+		return nil, 0, fmt.Errorf("get fence events failed: %w", err)
+	}
+	return lst, total, nil
+}
+
+func (c *SimpleServiceContainer) saveFenceState(s *mxm.FenceState) {
+	if err := c.repo.SaveFenceState(s); err != nil {
+		slog.Error("save fence state failed", "deviceID", s.DeviceID, "region", s.RegionName, "error", err)
+	}
+}
@@ -0,0 +1,289 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Daneel-Li/gps-back/internal/dao"
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// fenceRepo 只实现围栏判断涉及的数据访问
+type fenceRepo struct {
+	dao.Repository
+	regions []*mxm.Region
+	states  map[string]*mxm.FenceState
+	events  []*mxm.FenceEvent
+}
+
+func (r *fenceRepo) GetSafeRegions(string) ([]*mxm.Region, error) { return r.regions, nil }
+func (r *fenceRepo) GetFenceStates(string) ([]*mxm.FenceState, error) {
+	var lst []*mxm.FenceState
+	for _, s := range r.states {
+		cp := *s
+		lst = append(lst, &cp)
+	}
+	return lst, nil
+}
+func (r *fenceRepo) SaveFenceState(s *mxm.FenceState) error {
+	cp := *s
+	r.states[s.RegionName] = &cp
+	return nil
+}
+func (r *fenceRepo) AddFenceEvent(e *mxm.FenceEvent) error {
+	r.events = append(r.events, e)
+	return nil
+}
+func (r *fenceRepo) GetUserIdByDeviceId(string) (uint, error) { return 7, nil }
+func (r *fenceRepo) GetUserByID(uint) (*mxm.User, error) {
+	return &mxm.User{Timezone: "Asia/Shanghai"}, nil
+}
+
+// 围栏中心(22.5431, 114.0579)，纬度每0.001度约111米
+func fenceLoc(lat float64, locType string, accuracy float64) *mxm.Location {
+	return &mxm.Location{Latitude: lat, Longitude: 114.0579, Type: locType, Accuracy: accuracy, LocTime: time.Now()}
+}
+
+func TestCircleRadiusInMetres(t *testing.T) {
+	c := &mxm.Circle{Latitude: 22.5431, Longitude: 114.0579, Radius: 500}
+	assert.False(t, c.IsOut(mxm.Point{Latitude: 22.5461, Longitude: 114.0579})) // 约333米
+	assert.True(t, c.IsOut(mxm.Point{Latitude: 22.5491, Longitude: 114.0579}))  // 约667米
+}
+
+func TestCheckFences(t *testing.T) {
+	repo := &fenceRepo{
+		regions: []*mxm.Region{{Type: "circle", Name: "home", Area: &mxm.Circle{Latitude: 22.5431, Longitude: 114.0579, Radius: 500}}},
+		states:  make(map[string]*mxm.FenceState),
+	}
+	c := NewSimpleServiceContainer(repo, NewCommandManager(CommandPolicy{}), nil)
+
+	// 首次只记录状态
+	assert.Empty(t, c.CheckFences("dev1", fenceLoc(22.5431, "GPS", 10)))
+	assert.True(t, repo.states["home"].Inside)
+
+	// 单次LBS定位落在外面不告警，离边界太近的定位不计入
+	assert.Empty(t, c.CheckFences("dev1", fenceLoc(22.5531, "LBS", 1000)))
+	assert.Equal(t, 1, repo.states["home"].Pending)
+	assert.Empty(t, c.CheckFences("dev1", fenceLoc(22.5476, "LBS", 1000)))
+	assert.Equal(t, 1, repo.states["home"].Pending)
+	assert.Empty(t, c.CheckFences("dev1", fenceLoc(22.5431, "WIFI", 50)))
+	assert.Equal(t, 0, repo.states["home"].Pending)
+
+	// 连续两次LBS定位落在外面才告警
+	assert.Empty(t, c.CheckFences("dev1", fenceLoc(22.5531, "LBS", 1000)))
+	alarms := c.CheckFences("dev1", fenceLoc(22.5531, "LBS", 1000))
+	assert.Len(t, alarms, 1)
+	assert.Equal(t, mxm.OUT_AREA, alarms[0].Type)
+	assert.Equal(t, "home", alarms[0].Msg)
+	assert.False(t, repo.states["home"].Inside)
+
+	// GPS定位一次即可确认
+	alarms = c.CheckFences("dev1", fenceLoc(22.5431, "GPS", 10))
+	assert.Len(t, alarms, 1)
+	assert.Equal(t, mxm.IN_AREA, alarms[0].Type)
+}
+
+func TestRectangleFence(t *testing.T) {
+	r := &mxm.Rectangle{South: 22.54, West: 114.05, North: 22.55, East: 114.06}
+	assert.NoError(t, r.Validate())
+	assert.False(t, r.IsOut(mxm.Point{Latitude: 22.545, Longitude: 114.055}))
+	assert.True(t, r.IsOut(mxm.Point{Latitude: 22.545, Longitude: 114.065}))
+	// 距东边约103米
+	assert.InDelta(t, -103, r.BoundaryDistance(mxm.Point{Latitude: 22.545, Longitude: 114.059}), 2)
+
+	// 跨越180度经线
+	r = &mxm.Rectangle{South: -17, West: 179.99, North: -16.99, East: -179.99}
+	assert.NoError(t, r.Validate())
+	assert.False(t, r.IsOut(mxm.Point{Latitude: -16.995, Longitude: 180}))
+	assert.True(t, r.IsOut(mxm.Point{Latitude: -16.995, Longitude: 0}))
+}
+
+func TestPolygonFence(t *testing.T) {
+	var region mxm.Region
+	err := json.Unmarshal([]byte(`{"type":"polygon","name":"garden","area":{
+		"outer":[{"latitude":22.54,"longitude":114.05},{"latitude":22.54,"longitude":114.06},
+			{"latitude":22.55,"longitude":114.06},{"latitude":22.545,"longitude":114.055},
+			{"latitude":22.55,"longitude":114.05},{"latitude":22.54,"longitude":114.05}],
+		"holes":[[{"latitude":22.541,"longitude":114.051},{"latitude":22.541,"longitude":114.053},
+			{"latitude":22.543,"longitude":114.053},{"latitude":22.543,"longitude":114.051}]]}}`), &region)
+	assert.NoError(t, err)
+	assert.NoError(t, validateRegion(&region))
+
+	p := region.Area
+	assert.False(t, p.IsOut(mxm.Point{Latitude: 22.544, Longitude: 114.058}))
+	// 凹口内和洞内都算区域外
+	assert.True(t, p.IsOut(mxm.Point{Latitude: 22.549, Longitude: 114.055}))
+	assert.True(t, p.IsOut(mxm.Point{Latitude: 22.542, Longitude: 114.052}))
+	assert.True(t, p.IsOut(mxm.Point{Latitude: 22.56, Longitude: 114.055}))
+}
+
+func TestValidateRegion(t *testing.T) {
+	square := []mxm.LatLng{{Latitude: 22.54, Longitude: 114.05}, {Latitude: 22.54, Longitude: 114.06},
+		{Latitude: 22.55, Longitude: 114.06}, {Latitude: 22.55, Longitude: 114.05}}
+	cases := map[string]mxm.Area{
+		"bowtie": &mxm.Polygon{Outer: []mxm.LatLng{{Latitude: 22.54, Longitude: 114.05}, {Latitude: 22.55, Longitude: 114.06},
+			{Latitude: 22.54, Longitude: 114.06}, {Latitude: 22.55, Longitude: 114.05}}},
+		"too few points": &mxm.Polygon{Outer: square[:2]},
+		"hole outside": &mxm.Polygon{Outer: square, Holes: [][]mxm.LatLng{{{Latitude: 22.56, Longitude: 114.05},
+			{Latitude: 22.56, Longitude: 114.051}, {Latitude: 22.561, Longitude: 114.051}}}},
+		"hole crossing": &mxm.Polygon{Outer: square, Holes: [][]mxm.LatLng{{{Latitude: 22.545, Longitude: 114.055},
+			{Latitude: 22.545, Longitude: 114.07}, {Latitude: 22.546, Longitude: 114.07}}}},
+		"too large":      &mxm.Rectangle{South: 22, West: 114, North: 23, East: 115},
+		"empty":          &mxm.Rectangle{South: 22.55, West: 114.05, North: 22.54, East: 114.06},
+		"zero radius":    &mxm.Circle{Latitude: 22.54, Longitude: 114.05},
+		"circle too big": &mxm.Circle{Latitude: 22.54, Longitude: 114.05, Radius: 6000},
+	}
+	for name, area := range cases {
+		err := validateRegion(&mxm.Region{Name: name, Area: area})
+		assert.ErrorIs(t, err, ErrInvalidRegion, name)
+	}
+	assert.ErrorIs(t, validateRegion(&mxm.Region{Area: &mxm.Polygon{Outer: square}}), ErrInvalidRegion)
+	assert.NoError(t, validateRegion(&mxm.Region{Name: "park", Area: &mxm.Polygon{Outer: square}}))
+}
+
+func TestCorridorFence(t *testing.T) {
+	// 先向北约1110米，再向东
+	walk := &mxm.Corridor{Buffer: 50, Path: []mxm.LatLng{{Latitude: 22.54, Longitude: 114.05},
+		{Latitude: 22.55, Longitude: 114.05}, {Latitude: 22.55, Longitude: 114.06}}}
+	assert.NoError(t, validateRegion(&mxm.Region{Name: "walk", Area: walk}))
+	assert.ErrorIs(t, validateRegion(&mxm.Region{Name: "walk", Area: &mxm.Corridor{Buffer: 50, Path: walk.Path[:1]}}), ErrInvalidRegion)
+	assert.ErrorIs(t, validateRegion(&mxm.Region{Name: "walk", Area: &mxm.Corridor{Path: walk.Path}}), ErrInvalidRegion)
+
+	seg, dist := walk.NearestSegment(mxm.Point{Latitude: 22.551, Longitude: 114.055})
+	assert.Equal(t, 1, seg)
+	assert.InDelta(t, 111, dist, 1)
+
+	repo := &fenceRepo{
+		regions: []*mxm.Region{{Type: "corridor", Name: "walk", Area: walk}},
+		states:  make(map[string]*mxm.FenceState),
+	}
+	c := NewSimpleServiceContainer(repo, NewCommandManager(CommandPolicy{}), nil)
+	loc := func(lat, lng float64) *mxm.Location {
+		return &mxm.Location{Latitude: lat, Longitude: lng, Type: "GPS", Accuracy: 10, LocTime: time.Now()}
+	}
+	assert.Empty(t, c.CheckFences("dev1", loc(22.545, 114.0501)))
+	assert.True(t, repo.states["walk"].Inside)
+
+	// 在第一段东侧约103米处离开路线
+	alarms := c.CheckFences("dev1", loc(22.545, 114.051))
+	if assert.Len(t, alarms, 1) {
+		assert.Equal(t, mxm.OFF_ROUTE, alarms[0].Type)
+		assert.Equal(t, "walk:1:53", alarms[0].Msg)
+	}
+	alarms = c.CheckFences("dev1", loc(22.5501, 114.055))
+	if assert.Len(t, alarms, 1) {
+		assert.Equal(t, mxm.IN_AREA, alarms[0].Type)
+		assert.Equal(t, "walk", alarms[0].Msg)
+	}
+}
+
+func TestFenceDwell(t *testing.T) {
+	// 离开Home超过5分钟才告警
+	repo := &fenceRepo{
+		regions: []*mxm.Region{{Type: "circle", Name: "home", Trigger: mxm.TRIGGER_EXIT, Dwell: 300,
+			Area: &mxm.Circle{Latitude: 22.5431, Longitude: 114.0579, Radius: 500}}},
+		states: make(map[string]*mxm.FenceState),
+	}
+	c := NewSimpleServiceContainer(repo, NewCommandManager(CommandPolicy{}), nil)
+	start := time.Now()
+	at := func(lat float64, d time.Duration) *mxm.Location {
+		return &mxm.Location{Latitude: lat, Longitude: 114.0579, Type: "GPS", Accuracy: 10, LocTime: start.Add(d)}
+	}
+
+	assert.Empty(t, c.CheckFences("dev1", at(22.5431, 0)))
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, time.Minute)))
+	// 3分钟后回来，不告警，记为停留不足
+	assert.Empty(t, c.CheckFences("dev1", at(22.5431, 4*time.Minute)))
+	if assert.Len(t, repo.events, 1) {
+		assert.False(t, repo.events[0].Fired)
+		assert.Equal(t, mxm.FENCE_SUPPRESS_DWELL, repo.events[0].Reason)
+	}
+	// 进入不告警
+	assert.Len(t, repo.events, 1)
+
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 5*time.Minute)))
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 9*time.Minute)))
+	alarms := c.CheckFences("dev1", at(22.5531, 11*time.Minute))
+	if assert.Len(t, alarms, 1) {
+		assert.Equal(t, mxm.OUT_AREA, alarms[0].Type)
+	}
+	assert.True(t, repo.events[1].Fired)
+	// 只告警一次
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 20*time.Minute)))
+}
+
+func TestFenceStayInside(t *testing.T) {
+	// 工作日08:00-15:00不在School内告警，按主人所在的上海时区
+	repo := &fenceRepo{
+		regions: []*mxm.Region{{Type: "circle", Name: "school", Trigger: mxm.TRIGGER_STAY_INSIDE,
+			Schedule: []mxm.ActiveWindow{{Days: []int{1, 2, 3, 4, 5}, Start: "08:00", End: "15:00"}},
+			Area:     &mxm.Circle{Latitude: 22.5431, Longitude: 114.0579, Radius: 500}}},
+		states: make(map[string]*mxm.FenceState),
+	}
+	assert.NoError(t, validateRegion(repo.regions[0]))
+	c := NewSimpleServiceContainer(repo, NewCommandManager(CommandPolicy{}), nil)
+	sh, _ := time.LoadLocation("Asia/Shanghai")
+	at := func(lat float64, day, hour, minute int) *mxm.Location {
+		// 2025-06-02是周一
+		tm := time.Date(2025, 6, day, hour, minute, 0, 0, sh).UTC()
+		return &mxm.Location{Latitude: lat, Longitude: 114.0579, Type: "GPS", Accuracy: 10, LocTime: tm}
+	}
+
+	// 时段开始前在外面不告警，时段开始后仍在外面告警
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 2, 7, 50)))
+	alarms := c.CheckFences("dev1", at(22.5531, 2, 8, 5))
+	if assert.Len(t, alarms, 1) {
+		assert.Equal(t, mxm.NOT_IN_AREA, alarms[0].Type)
+		assert.Equal(t, "school", alarms[0].Msg)
+	}
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 2, 9, 0)))
+
+	// 到校后再离开再次告警
+	assert.Empty(t, c.CheckFences("dev1", at(22.5431, 2, 9, 30)))
+	assert.Len(t, c.CheckFences("dev1", at(22.5531, 2, 10, 0)), 1)
+
+	// 放学后和周末离开不告警
+	assert.Empty(t, c.CheckFences("dev1", at(22.5431, 2, 14, 0)))
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 2, 16, 0)))
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 7, 10, 0)))
+	// 周一一早仍在外面
+	assert.Len(t, c.CheckFences("dev1", at(22.5531, 9, 8, 0)), 1)
+}
+
+func TestFenceInactiveWindow(t *testing.T) {
+	repo := &fenceRepo{
+		regions: []*mxm.Region{{Type: "circle", Name: "home", Trigger: mxm.TRIGGER_ENTER,
+			Schedule: []mxm.ActiveWindow{{Start: "22:00", End: "06:00"}},
+			Area:     &mxm.Circle{Latitude: 22.5431, Longitude: 114.0579, Radius: 500}}},
+		states: make(map[string]*mxm.FenceState),
+	}
+	c := NewSimpleServiceContainer(repo, NewCommandManager(CommandPolicy{}), nil)
+	sh, _ := time.LoadLocation("Asia/Shanghai")
+	at := func(lat float64, day, hour int) *mxm.Location {
+		return &mxm.Location{Latitude: lat, Longitude: 114.0579, Type: "GPS", Accuracy: 10, LocTime: time.Date(2025, 6, day, hour, 0, 0, 0, sh)}
+	}
+
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 2, 12)))
+	// 白天进入被抑制并记录
+	assert.Empty(t, c.CheckFences("dev1", at(22.5431, 2, 13)))
+	if assert.Len(t, repo.events, 1) {
+		assert.Equal(t, mxm.FENCE_SUPPRESS_INACTIVE, repo.events[0].Reason)
+	}
+	// 跨天时段，凌晨进入告警
+	assert.Empty(t, c.CheckFences("dev1", at(22.5531, 3, 1)))
+	assert.Len(t, c.CheckFences("dev1", at(22.5431, 3, 2)), 1)
+}
+
+func TestValidateRegionRules(t *testing.T) {
+	area := &mxm.Circle{Latitude: 22.5431, Longitude: 114.0579, Radius: 500}
+	for _, r := range []*mxm.Region{
+		{Name: "a", Area: area, Trigger: "leave"},
+		{Name: "a", Area: area, Dwell: -1},
+		{Name: "a", Area: area, Schedule: []mxm.ActiveWindow{{Start: "25:00", End: "15:00"}}},
+		{Name: "a", Area: area, Schedule: []mxm.ActiveWindow{{Days: []int{7}, Start: "08:00", End: "15:00"}}},
+	} {
+		assert.ErrorIs(t, validateRegion(r), ErrInvalidRegion)
+	}
+}
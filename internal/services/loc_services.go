@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
@@ -30,6 +31,38 @@ type LocationService interface {
 	Geocode(latitude, longitude float64, timeout time.Duration) (*GeoCoderResult, error)
 }
 
+// GeocodeWithFallback 依次尝试各地理编码服务，返回第一个成功的结果
+func GeocodeWithFallback(locS []LocationService, latitude, longitude float64, timeout time.Duration) (*GeoCoderResult, error) {
+	var lastErr error = fmt.Errorf("no geocoder service available")
+	for i, locService := range locS {
+		geoRes, err := locService.Geocode(latitude, longitude, timeout)
+		if err == nil {
+			return geoRes, nil
+		}
+		lastErr = err
+		if i < len(locS)-1 {
+			slog.Warn("invoking geocoder service failed, trying next service...", "error", err.Error())
+		}
+	}
+	return nil, fmt.Errorf("all geocoder services failed, last error: %w", lastErr)
+}
+
+// LocateWithFallback 依次尝试各网络定位服务(wifi/基站)，返回第一个成功的结果
+func LocateWithFallback(locS []LocationService, req LocationRequest, timeout time.Duration) (*LocationResult, error) {
+	var lastErr error = fmt.Errorf("no loc service available")
+	for i, locService := range locS {
+		locRes, err := locService.LocateByNetwork(req, timeout)
+		if err == nil {
+			return locRes, nil
+		}
+		lastErr = err
+		if i < len(locS)-1 {
+			slog.Warn("invoking loc service failed, trying next service...", "error", err.Error())
+		}
+	}
+	return nil, fmt.Errorf("all loc services failed, last error: %w", lastErr)
+}
+
 // txLocationService Tencent Map location service implementation
 type txLocationService struct{}
 
@@ -0,0 +1,337 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strings"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/types"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+)
+
+// ========== 固件远程升级(OTA) ==========
+
+const (
+	_OTA_DISPATCH_INTERVAL = time.Minute
+	_OTA_DISPATCH_BATCH    = 100
+	_OTA_MAX_ATTEMPTS      = 5                // 下发失败(多为设备离线)的重试次数，间隔逐次递增
+	_OTA_RETRY_STEP        = 10 * time.Minute //第n次重试至少间隔n*_OTA_RETRY_STEP
+	_OTA_APPLY_TIMEOUT     = 2 * time.Hour    // 下发后超过该时长未上报新版本视为失败
+)
+
+// ErrInvalidOta 固件或升级任务参数不合法
+var ErrInvalidOta = errors.New("invalid ota request")
+
+// RolloutRequest 创建升级任务的参数，DeviceIDs为空时按固件的设备类型和型号圈定设备，
+// 可再用UserID限定为某个用户名下的设备
+type RolloutRequest struct {
+	FirmwareID uint     `json:"firmware_id"`
+	DeviceIDs  []string `json:"device_ids"`
+	UserID     uint     `json:"user_id"`
+	Percent    int      `json:"percent"`
+}
+
+// inStage 按设备和任务哈希分桶，放量比例增大时已放量的设备保持不变
+func inStage(rolloutID uint, deviceID string, percent int) bool {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d:%s", rolloutID, deviceID)
+	return int(h.Sum32()%100) < percent
+}
+
+// otaRetryDue 下发失败后按次数递增间隔重试
+func otaRetryDue(rd *mxm.RolloutDevice, now time.Time) bool {
+	if rd.Attempts == 0 {
+		return true
+	}
+	return now.Sub(rd.UpdatedAt) >= time.Duration(rd.Attempts)*_OTA_RETRY_STEP
+}
+
+// CreateFirmware 登记已上传的固件包
+func (c *SimpleServiceContainer) CreateFirmware(ctx context.Context, fw *mxm.Firmware) error {
+	if fw.DeviceType == "" || fw.Version == "" || fw.FileName == "" {
+		return fmt.Errorf("%w: device_type, version and file are required", ErrInvalidOta)
+	}
+	driver, err := c.driverManager.GetDriver(types.DeviceType(fw.DeviceType))
+	if err != nil {
+		return fmt.Errorf("%w: unknown device type %s", ErrInvalidOta, fw.DeviceType)
+	}
+	if _, ok := driver.(vendors.FirmwareUpdater); !ok {
+		return fmt.Errorf("%w: %s devices do not support firmware upgrade", ErrInvalidOta, fw.DeviceType)
+	}
+	return c.repo.CreateFirmware(fw)
+}
+
+func (c *SimpleServiceContainer) ListFirmwares(ctx context.Context) ([]*mxm.Firmware, error) {
+	return c.repo.GetFirmwares()
+}
+
+// otaTargets 圈定升级任务的目标设备，只包含已分配给用户的设备
+func (c *SimpleServiceContainer) otaTargets(fw *mxm.Firmware, req RolloutRequest) ([]string, error) {
+	var devs []*mxm.Device
+	if len(req.DeviceIDs) > 0 {
+		for _, id := range req.DeviceIDs {
+			dev, err := c.repo.GetDeviceByID(id)
+			if err != nil {
+				return nil, fmt.Errorf("%w: device %s not found", ErrInvalidOta, id)
+			}
+			if dev.Type == nil || *dev.Type != fw.DeviceType {
+				return nil, fmt.Errorf("%w: device %s is not of type %s", ErrInvalidOta, id, fw.DeviceType)
+			}
+			devs = append(devs, dev)
+		}
+	} else {
+		lst, err := c.repo.GetDevicesByType(fw.DeviceType)
+		if err != nil {
+			return nil, err
+		}
+		for _, dev := range lst {
+			if dev.UserID == nil || *dev.UserID == 0 {
+				continue
+			}
+			if req.UserID != 0 && *dev.UserID != req.UserID {
+				continue
+			}
+			if fw.Model != "" && (dev.Project == nil || *dev.Project != fw.Model) {
+				continue
+			}
+			devs = append(devs, dev)
+		}
+	}
+
+	ids := make([]string, 0, len(devs))
+	seen := make(map[string]bool)
+	for _, dev := range devs {
+		if dev.ID == nil || seen[*dev.ID] {
+			continue
+		}
+		seen[*dev.ID] = true
+		ids = append(ids, *dev.ID)
+	}
+	return ids, nil
+}
+
+// CreateRollout 创建升级任务，按Percent放量后由后台任务逐台下发
+func (c *SimpleServiceContainer) CreateRollout(ctx context.Context, operatorID uint, req RolloutRequest) (*mxm.Rollout, error) {
+	if req.Percent < 0 || req.Percent > 100 {
+		return nil, fmt.Errorf("%w: percent must be within [0, 100]", ErrInvalidOta)
+	}
+	fw, err := c.repo.GetFirmware(req.FirmwareID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: firmware %d not found", ErrInvalidOta, req.FirmwareID)
+	}
+	ids, err := c.otaTargets(fw, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: no device matches the rollout", ErrInvalidOta)
+	}
+
+	r := &mxm.Rollout{
+		FirmwareID: fw.ID,
+		Percent:    req.Percent,
+		Status:     mxm.ROLLOUT_ACTIVE,
+		CreatedBy:  operatorID,
+	}
+	if err := c.repo.CreateRollout(r, ids); err != nil {
+		return nil, err
+	}
+	if err := c.stageRollout(r.ID, r.Percent); err != nil {
+		return nil, err
+	}
+	slog.Info("ota rollout created", "rollout", r.ID, "firmware", fw.ID, "version", fw.Version,
+		"devices", len(ids), "percent", r.Percent, "operator", operatorID)
+	c.kickOta()
+	r.Firmware = fw
+	return r, nil
+}
+
+// UpdateRollout 调整放量比例或暂停/恢复任务，比例只能增大
+func (c *SimpleServiceContainer) UpdateRollout(ctx context.Context, rolloutID uint, percent *int, status *string) error {
+	r, err := c.repo.GetRollout(rolloutID)
+	if err != nil {
+		return fmt.Errorf("%w: rollout %d not found", ErrInvalidOta, rolloutID)
+	}
+	updates := make(map[string]interface{})
+	if percent != nil {
+		if *percent < r.Percent || *percent > 100 {
+			return fmt.Errorf("%w: percent must be within [%d, 100]", ErrInvalidOta, r.Percent)
+		}
+		updates["percent"] = *percent
+	}
+	if status != nil {
+		if *status != mxm.ROLLOUT_ACTIVE && *status != mxm.ROLLOUT_PAUSED {
+			return fmt.Errorf("%w: unknown status %s", ErrInvalidOta, *status)
+		}
+		updates["status"] = *status
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	if err := c.repo.UpdateRollout(rolloutID, updates); err != nil {
+		return err
+	}
+	if percent != nil {
+		if err := c.stageRollout(rolloutID, *percent); err != nil {
+			return err
+		}
+	}
+	c.kickOta()
+	return nil
+}
+
+func (c *SimpleServiceContainer) ListRollouts(ctx context.Context) ([]*mxm.Rollout, error) {
+	return c.repo.GetRollouts()
+}
+
+// GetRolloutProgress 统计升级任务进度及失败设备
+func (c *SimpleServiceContainer) GetRolloutProgress(ctx context.Context, rolloutID uint) (*mxm.RolloutProgress, error) {
+	r, err := c.repo.GetRollout(rolloutID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: rollout %d not found", ErrInvalidOta, rolloutID)
+	}
+	lst, err := c.repo.GetRolloutDevices(rolloutID)
+	if err != nil {
+		return nil, err
+	}
+	p := &mxm.RolloutProgress{Rollout: r, Total: len(lst), Failures: []*mxm.RolloutDevice{}}
+	for _, rd := range lst {
+		if !rd.Staged {
+			continue
+		}
+		p.Staged++
+		switch rd.State {
+		case mxm.OTA_PENDING:
+			p.Pending++
+		case mxm.OTA_DOWNLOADING:
+			p.Downloading++
+		case mxm.OTA_APPLIED:
+			p.Applied++
+		case mxm.OTA_FAILED:
+			p.Failed++
+			p.Failures = append(p.Failures, rd)
+		}
+	}
+	return p, nil
+}
+
+// stageRollout 将落入放量比例的设备纳入下发范围
+func (c *SimpleServiceContainer) stageRollout(rolloutID uint, percent int) error {
+	lst, err := c.repo.GetRolloutDevices(rolloutID)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, rd := range lst {
+		if !rd.Staged && inStage(rolloutID, rd.DeviceID, percent) {
+			ids = append(ids, rd.DeviceID)
+		}
+	}
+	return c.repo.StageRolloutDevices(rolloutID, ids)
+}
+
+func (c *SimpleServiceContainer) kickOta() {
+	select {
+	case c.otaKick <- struct{}{}:
+	default:
+	}
+}
+
+// StartOtaDispatcher 启动升级指令下发任务，baseURL为固件下载地址前缀
+func (c *SimpleServiceContainer) StartOtaDispatcher(ctx context.Context, baseURL string) {
+	c.otaBaseURL = strings.TrimSuffix(baseURL, "/")
+	go func() {
+		ticker := time.NewTicker(_OTA_DISPATCH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-c.otaKick:
+			}
+			c.dispatchOta()
+		}
+	}()
+}
+
+func (c *SimpleServiceContainer) dispatchOta() {
+	now := time.Now()
+	if err := c.repo.ExpireRolloutDevices(now.Add(-_OTA_APPLY_TIMEOUT)); err != nil {
+		slog.Error("expire ota devices failed", "error", err)
+	}
+	lst, err := c.repo.GetPendingRolloutDevices(_OTA_DISPATCH_BATCH)
+	if err != nil {
+		slog.Error("get pending ota devices failed", "error", err)
+		return
+	}
+	firmwares := make(map[uint]*mxm.Firmware)
+	for _, rd := range lst {
+		if !otaRetryDue(rd, now) {
+			continue
+		}
+		fw, ok := firmwares[rd.RolloutID]
+		if !ok {
+			r, err := c.repo.GetRollout(rd.RolloutID)
+			if err != nil || r.Firmware == nil {
+				slog.Error("get rollout failed", "rollout", rd.RolloutID, "error", err)
+				continue
+			}
+			fw = r.Firmware
+			firmwares[rd.RolloutID] = fw
+		}
+		if err := c.repo.UpdateRolloutDevice(rd.RolloutID, rd.DeviceID, c.upgradeDevice(rd, fw)); err != nil {
+			slog.Error("update ota device failed", "rollout", rd.RolloutID, "deviceID", rd.DeviceID, "error", err)
+		}
+	}
+}
+
+// upgradeDevice 向单台设备下发升级指令，返回该设备升级记录的更新
+func (c *SimpleServiceContainer) upgradeDevice(rd *mxm.RolloutDevice, fw *mxm.Firmware) map[string]interface{} {
+	fail := func(err error) map[string]interface{} {
+		state := mxm.OTA_PENDING
+		if rd.Attempts+1 >= _OTA_MAX_ATTEMPTS || errors.Is(err, vendors.ErrUnsupportedCommand) {
+			state = mxm.OTA_FAILED
+		}
+		return map[string]interface{}{"state": state, "attempts": rd.Attempts + 1, "last_error": err.Error()}
+	}
+
+	device, err := c.repo.GetDeviceByID(rd.DeviceID)
+	if err != nil {
+		return fail(err)
+	}
+	if device.Type == nil || device.OriginSN == nil {
+		return fail(errors.New("device type or origin SN is nil"))
+	}
+	if device.SwVersion != nil && *device.SwVersion == fw.Version {
+		return map[string]interface{}{"state": mxm.OTA_APPLIED}
+	}
+	driver, err := c.driverManager.GetDriver(types.DeviceType(*device.Type))
+	if err != nil {
+		return fail(err)
+	}
+	updater, ok := driver.(vendors.FirmwareUpdater)
+	if !ok {
+		return fail(vendors.NewUnsupportedError(*device.Type, vendors.ACTION_OTA))
+	}
+
+	commandID := c.cmdIDs.Next()
+	pkg := vendors.FirmwarePackage{
+		Version: fw.Version,
+		URL:     c.otaBaseURL + "/" + fw.FileName,
+		MD5:     fw.MD5,
+		Size:    fw.Size,
+	}
+	if err := updater.UpgradeFirmware(commandID, *device.OriginSN, pkg); err != nil {
+		slog.Warn("send firmware upgrade failed", "deviceID", rd.DeviceID, "version", fw.Version, "error", err)
+		return fail(err)
+	}
+	slog.Info("firmware upgrade sent", "deviceID", rd.DeviceID, "version", fw.Version, "commandID", commandID)
+	return map[string]interface{}{"state": mxm.OTA_DOWNLOADING, "command_id": commandID,
+		"attempts": rd.Attempts + 1, "last_error": ""}
+}
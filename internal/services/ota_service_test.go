@@ -0,0 +1,44 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInStage(t *testing.T) {
+	ids := make([]string, 1000)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("dev%04d", i)
+	}
+
+	count := func(percent int) int {
+		n := 0
+		for _, id := range ids {
+			if inStage(7, id, percent) {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Equal(t, 0, count(0))
+	assert.Equal(t, len(ids), count(100))
+	assert.InDelta(t, 100, count(10), 40)
+
+	// 放量比例增大时，已放量的设备仍在范围内
+	for _, id := range ids {
+		if inStage(7, id, 10) {
+			assert.True(t, inStage(7, id, 50), id)
+		}
+	}
+}
+
+func TestOtaRetryDue(t *testing.T) {
+	now := time.Now()
+	assert.True(t, otaRetryDue(&mxm.RolloutDevice{}, now))
+	assert.False(t, otaRetryDue(&mxm.RolloutDevice{Attempts: 2, UpdatedAt: now.Add(-15 * time.Minute)}, now))
+	assert.True(t, otaRetryDue(&mxm.RolloutDevice{Attempts: 2, UpdatedAt: now.Add(-25 * time.Minute)}, now))
+}
@@ -44,6 +44,16 @@ func (t *TerminalKey) FromString(s string) {
 	fmt.Sscanf(s, "%d:%s", &t.UserID, &t.Random)
 }
 
+// parseTerminalKey 未提供终端时返回nil
+func parseTerminalKey(s string) *TerminalKey {
+	if s == "" {
+		return nil
+	}
+	t := &TerminalKey{}
+	t.FromString(s)
+	return t
+}
+
 func (t TerminalKey) ToString() string {
 	return fmt.Sprintf("%d:%s", t.UserID, t.Random)
 }
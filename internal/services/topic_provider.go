@@ -10,11 +10,17 @@ import (
 // 话题提供者，实现mqtthandler中的TopicProvider接口
 type BttTopicProvider struct {
 	// 话题列表
-	dao dao.Repository
+	dao        dao.Repository
+	deviceType string
 }
 
 func NewBttTopicProvider(dao dao.Repository) *BttTopicProvider {
-	return &BttTopicProvider{dao: dao}
+	return NewTopicProvider(dao, "btt")
+}
+
+// NewTopicProvider 按设备类型查找需要监听的设备，供通用mqtt驱动使用
+func NewTopicProvider(dao dao.Repository, deviceType string) *BttTopicProvider {
+	return &BttTopicProvider{dao: dao, deviceType: deviceType}
 }
 
 const _PREFIX_DEV = "dwq/device/hy/"
@@ -22,7 +28,7 @@ const _PREFIX_APP = "dwq/app/hy/"
 
 // 查找需要监听的设备列表
 func (p *BttTopicProvider) GetSubscriptionList() ([]string, error) {
-	if dvcs, err := p.dao.GetDevicesByType("btt"); err == nil {
+	if dvcs, err := p.dao.GetDevicesByType(p.deviceType); err == nil {
 		lst := []string{}
 		for _, d := range dvcs {
 			if d.UserID == nil || *d.UserID == 0 { //设备未分配，不用监听
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+)
+
+// ========== 轨迹过滤 ==========
+
+const (
+	_TRACK_MAX_SPEED     = 50.0            // 允许的最大移动速度(米/秒)，约180公里/小时
+	_TRACK_MAX_REJECTS   = 3               // 连续这么多个因速度被拒的点彼此吻合时，认为设备确实到了新位置
+	_TRACK_GPS_HOLD      = 2 * time.Minute // GPS定位后该时间内不用精度更差的定位替换它
+	_TRACK_PROCESS_SPEED = 2.0             // 滤波假设的移动速度(米/秒)，决定估计位置跟随新定位的快慢
+)
+
+type trackFix struct {
+	lat, lng float64
+	acc      float64 // 精度(米)
+	at       time.Time
+}
+
+type trackState struct {
+	trackFix           // 当前估计位置，acc为估计的标准差
+	gpsAt    time.Time // 最近一次GPS定位的时间和精度
+	gpsAcc   float64
+	cand     trackFix // 因速度被拒的点，连续吻合时以它为准重新开始
+	rejects  int
+}
+
+// TrackFilter 定位入库前剔除不可能的跳点，并按精度加权平滑(一维卡尔曼滤波)
+// 状态只保存在内存中，重启后从下一个定位重新开始
+type TrackFilter struct {
+	mu     sync.Mutex
+	states map[string]*trackState
+}
+
+func NewTrackFilter() *TrackFilter {
+	return &TrackFilter{states: make(map[string]*trackState)}
+}
+
+func newTrackFix(loc *mxm.Location) trackFix {
+	return trackFix{lat: loc.Latitude, lng: loc.Longitude, acc: math.Max(loc.Accuracy, 1), at: loc.LocTime}
+}
+
+func newTrackState(fix trackFix, isGPS bool) *trackState {
+	s := &trackState{trackFix: fix}
+	if isGPS {
+		s.gpsAt, s.gpsAcc = fix.at, fix.acc
+	}
+	return s
+}
+
+// reachable b相对a的移动扣除两者精度后，是否在最大速度允许的范围内
+func reachable(a, b trackFix) bool {
+	dist := mxm.Distance(mxm.Point{Latitude: a.lat, Longitude: a.lng}, mxm.Point{Latitude: b.lat, Longitude: b.lng})
+	dt := math.Max(b.at.Sub(a.at).Seconds(), 1)
+	return dist-a.acc-b.acc <= _TRACK_MAX_SPEED*dt
+}
+
+func reject(loc *mxm.Location, reason string) {
+	loc.Rejected, loc.RejectReason = true, reason
+}
+
+// FilterLocation 判定定位是否异常，异常时标记Rejected和RejectReason，坐标保持原样；
+// 否则用平滑后的坐标和精度替换loc中的值。早于上一个有效点的定位不参与过滤
+func (f *TrackFilter) FilterLocation(deviceID string, loc *mxm.Location) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fix, isGPS := newTrackFix(loc), strings.EqualFold(loc.Type, "GPS")
+	s, ok := f.states[deviceID]
+	if !ok {
+		f.states[deviceID] = newTrackState(fix, isGPS)
+		return
+	}
+	if fix.at.Before(s.at) {
+		return
+	}
+	if !isGPS && fix.at.Sub(s.gpsAt) < _TRACK_GPS_HOLD && fix.acc > s.gpsAcc {
+		reject(loc, mxm.LOC_REJECT_GPS)
+		return
+	}
+	if !reachable(s.trackFix, fix) {
+		if s.rejects > 0 && reachable(s.cand, fix) {
+			s.rejects++
+		} else {
+			s.rejects = 1
+		}
+		s.cand = fix
+		if s.rejects < _TRACK_MAX_REJECTS {
+			reject(loc, mxm.LOC_REJECT_SPEED)
+			return
+		}
+		// 连续几个点都在新位置，说明之前的估计错了
+		f.states[deviceID] = newTrackState(fix, isGPS)
+		return
+	}
+
+	s.rejects = 0
+	dt := fix.at.Sub(s.at).Seconds()
+	variance := s.acc*s.acc + math.Pow(_TRACK_PROCESS_SPEED*dt, 2)
+	k := variance / (variance + fix.acc*fix.acc)
+	dLng := math.Mod(fix.lng-s.lng+540, 360) - 180
+	s.lat += k * (fix.lat - s.lat)
+	s.lng = math.Mod(s.lng+k*dLng+540, 360) - 180
+	s.acc = math.Sqrt(variance * (1 - k))
+	s.at = fix.at
+	if isGPS {
+		s.gpsAt, s.gpsAcc = fix.at, fix.acc
+	}
+	loc.Latitude, loc.Longitude, loc.Accuracy = s.lat, s.lng, s.acc
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackFilter(t *testing.T) {
+	f := NewTrackFilter()
+	t0 := time.Now()
+	fix := func(typ string, lat, acc float64, d time.Duration) *mxm.Location {
+		loc := &mxm.Location{Type: typ, Latitude: lat, Longitude: 114.05, Accuracy: acc, LocTime: t0.Add(d)}
+		f.FilterLocation("dev1", loc)
+		return loc
+	}
+
+	assert.False(t, fix("GPS", 22.54, 10, 0).Rejected)
+	loc := fix("GPS", 22.5401, 10, time.Minute)
+	assert.False(t, loc.Rejected)
+	assert.InDelta(t, 22.5401, loc.Latitude, 0.00001)
+
+	// GPS定位后不久，精度更差的LBS定位不替换它
+	loc = fix("LBS", 22.541, 800, 90*time.Second)
+	assert.True(t, loc.Rejected)
+	assert.Equal(t, mxm.LOC_REJECT_GPS, loc.RejectReason)
+	assert.Equal(t, 22.541, loc.Latitude)
+
+	// 低精度定位只把估计位置拉动一点
+	loc = fix("LBS", 22.545, 1000, 3*time.Minute)
+	assert.False(t, loc.Rejected)
+	assert.Greater(t, loc.Latitude, 22.5401)
+	assert.Less(t, loc.Latitude, 22.5405)
+	assert.Less(t, loc.Accuracy, 1000.0)
+
+	// 4分钟跳出近30公里，不可能
+	loc = fix("WIFI", 22.80, 100, 7*time.Minute)
+	assert.True(t, loc.Rejected)
+	assert.Equal(t, mxm.LOC_REJECT_SPEED, loc.RejectReason)
+	assert.Equal(t, 22.80, loc.Latitude)
+
+	// 乱序的旧点原样保留
+	loc = fix("LBS", 22.9, 1000, 2*time.Minute)
+	assert.False(t, loc.Rejected)
+	assert.Equal(t, 22.9, loc.Latitude)
+}
+
+func TestTrackFilterRelocate(t *testing.T) {
+	f := NewTrackFilter()
+	t0 := time.Now()
+	fix := func(lat float64, d time.Duration) *mxm.Location {
+		loc := &mxm.Location{Type: "GPS", Latitude: lat, Longitude: 114.05, Accuracy: 10, LocTime: t0.Add(d)}
+		f.FilterLocation("dev1", loc)
+		return loc
+	}
+
+	// 第一个点就是错的，之后的点彼此吻合，连续几次后以新位置为准
+	assert.False(t, fix(23.5, 0).Rejected)
+	assert.True(t, fix(22.54, time.Minute).Rejected)
+	assert.True(t, fix(22.5401, 2*time.Minute).Rejected)
+	assert.False(t, fix(22.5402, 3*time.Minute).Rejected)
+	assert.False(t, fix(22.5403, 4*time.Minute).Rejected)
+
+	// 分散的跳点不会让状态重置
+	assert.True(t, fix(23.0, 5*time.Minute).Rejected)
+	assert.True(t, fix(22.0, 6*time.Minute).Rejected)
+	assert.True(t, fix(23.0, 7*time.Minute).Rejected)
+	assert.False(t, fix(22.5404, 8*time.Minute).Rejected)
+}
@@ -4,9 +4,12 @@ package types
 type DeviceType string
 
 const (
-	TYPE_BTT DeviceType = "btt"
-	TYPE_SG  DeviceType = "sg"
-	TYPE_YC  DeviceType = "yc"
-	TYPE_V53 DeviceType = "v53"
+	TYPE_BTT       DeviceType = "btt"
+	TYPE_SG        DeviceType = "sg"
+	TYPE_YC        DeviceType = "yc"
+	TYPE_V53       DeviceType = "v53"
+	TYPE_GT06      DeviceType = "gt06"
+	TYPE_TELTONIKA DeviceType = "teltonika"
+	TYPE_OSMAND    DeviceType = "osmand"
+	TYPE_SIM       DeviceType = "sim"
 )
-
@@ -68,12 +68,27 @@ func (f *bttDeviceStatusFactory) CreateDeviceStatus(m interface{}) (*mxm.DeviceS
 
 	switch msg.DataType {
 	case REPORT_HEARTBEAT:
-		d, err := f.handleHeartBeat(msg)
+		d, track, err := f.handleHeartBeat(msg)
 		if err != nil {
 			slog.Error(fmt.Sprintf("handleHeartBeat:%v", err.Error()))
 			res.Device = nil
 		} else {
 			res.Device = d
+			res.Track = track
+		}
+	case DEVICE_INFO:
+		d, err := f.handleDeviceInfo(msg)
+		if err != nil {
+			slog.Error(fmt.Sprintf("handleDeviceInfo:%v", err.Error()))
+		} else {
+			res.Device = d
+		}
+	case ALARM:
+		a, err := handleAlarm(msg)
+		if err != nil {
+			slog.Error(fmt.Sprintf("handleAlarm:%v", err.Error()))
+		} else if a != nil {
+			res.Alarms = []mxm.Alarm{*a}
 		}
 	case POWRER, SET_REPORTINTERVAL, FIND, CMD_REPLY:
 		c, err := f.handleCommand(msg)
@@ -124,6 +139,11 @@ func (h *bttDeviceStatusFactory) handleCommand(msg *Message) (*mxm.Command, erro
 }
 
 func (h *bttDeviceStatusFactory) handleGnss(gnss *Gnss) (*mxm.Location, error) {
+	return h.parseGnss(gnss, true)
+}
+
+// parseGnss 解析单个定位点，geocode为false时gps点不解析地址(补传的历史点无需地址，节省地图服务调用)
+func (h *bttDeviceStatusFactory) parseGnss(gnss *Gnss, geocode bool) (*mxm.Location, error) {
 
 	tp, _ := strconv.Atoi(gnss.Type)
 
@@ -148,26 +168,13 @@ func (h *bttDeviceStatusFactory) handleGnss(gnss *Gnss) (*mxm.Location, error) {
 			return nil, fmt.Errorf("wrong gnss, lng,lati are invalid:(%s,%s)", gnss.Lng, gnss.Lat)
 		}
 		loc.Longitude, loc.Latitude = coordtransform.WGS84toGCJ02(longi, lati)
-		var geoRes *services.GeoCoderResult = nil
-		var lastErr error
-
-		// 循环尝试不同的地理编码服务
-		for i, locService := range h.locS {
-			var err error
-			geoRes, err = locService.Geocode(loc.Latitude, loc.Longitude, 2*time.Second)
-			if err == nil {
-				break // 成功则跳出循环
-			}
-			lastErr = err
-			if i < len(h.locS)-1 {
-				slog.Warn("invoking geocoder service failed, trying next service...", "error", err.Error())
+		if geocode {
+			geoRes, err := services.GeocodeWithFallback(h.locS, loc.Latitude, loc.Longitude, 2*time.Second)
+			if err != nil {
+				return nil, err
 			}
+			loc.Address = geoRes.Address
 		}
-
-		if geoRes == nil {
-			return nil, fmt.Errorf("all geocoder services failed, last error: %v", lastErr)
-		}
-		loc.Address = geoRes.Address
 	} else if tp == _WIFI {
 		macs := strings.Split(gnss.Bssid, "|")
 		rssi := strings.Split(gnss.Rssi, "|")
@@ -196,30 +203,15 @@ func (h *bttDeviceStatusFactory) handleGnss(gnss *Gnss) (*mxm.Location, error) {
 				WifiInfo: wifiList,
 			}
 
-			//等待结果/或失效
-			var locRes *services.LocationResult
-			var lastErr error
-
-			// 循环尝试不同的位置服务
-			for i, locService := range h.locS {
-				var err error
-				locRes, err = locService.LocateByNetwork(req, 2*time.Second)
-				if err == nil {
-					succ = true
-					loc.Address = locRes.Address
-					loc.Longitude = locRes.Location.Longitude
-					loc.Latitude = locRes.Location.Latitude
-					loc.Accuracy = locRes.Location.Accuracy
-					break // 成功则跳出循环
-				}
-				lastErr = err
-				if i < len(h.locS)-1 {
-					slog.Warn("invoking loc service failed, trying next service...", "error", err.Error())
-				}
-			}
-
-			if !succ {
-				slog.Error("invoking loc service failed(all services): " + lastErr.Error())
+			locRes, err := services.LocateWithFallback(h.locS, req, 2*time.Second)
+			if err != nil {
+				slog.Error("wifi locate failed", "error", err.Error())
+			} else if locRes.Location != nil {
+				succ = true
+				loc.Address = locRes.Address
+				loc.Longitude = locRes.Location.Longitude
+				loc.Latitude = locRes.Location.Latitude
+				loc.Accuracy = locRes.Location.Accuracy
 			}
 		} else {
 			// TODO 相似度校验，若超过阈值也需要更新
@@ -321,24 +313,79 @@ func (h *bttDeviceStatusFactory) chargingStatus(originSN string, elect int) (boo
 	return preE.LazyStatus, preE.Elect
 }
 
-func (h *bttDeviceStatusFactory) handleHeartBeat(msg *Message) (*mxm.Device, error) {
+// 设备信息上报，通常在开机联网后发送，更新固件版本等信息
+func (h *bttDeviceStatusFactory) handleDeviceInfo(msg *Message) (*mxm.Device, error) {
+	var info DeviceInfoReport
+	if err := json.Unmarshal(msg.Data, &info); err != nil {
+		return nil, fmt.Errorf("unmarshal:%v", err.Error())
+	}
 
-	var hb HeartBeat
-	if err := json.Unmarshal(msg.Data, &hb); err != nil {
+	var btt string = TYPE_BTT
+	now := time.Now()
+	di := info.DeviceInfo
+	d := mxm.Device{
+		OriginSN:      &msg.DeviceSN,
+		Type:          &btt,
+		LastOnline:    &now,
+		SwVersion:     &di.SwVersion,
+		HwVersion:     &di.HwVersion,
+		Project:       &di.Project,
+		LuatosVersion: &di.LuatosVersion,
+	}
+	if interval, err := strconv.Atoi(info.Heartbeat.Gpstime); err == nil {
+		d.Interval = &interval
+	}
+	if vol, err := strconv.Atoi(info.BAT.Vol); err == nil {
+		status, electFiltered := h.chargingStatus(msg.DeviceSN, Vol2Percent(vol))
+		d.Charging = &status
+		d.Electricity = &electFiltered
+	}
+	return &d, nil
+}
+
+// 设备报警上报，转换为统一报警记录，未知类型返回nil
+// 低电报警与按电量产生的低电报警由消息处理器去重
+func handleAlarm(msg *Message) (*mxm.Alarm, error) {
+	var report AlarmReport
+	if err := json.Unmarshal(msg.Data, &report); err != nil {
 		return nil, fmt.Errorf("unmarshal:%v", err.Error())
 	}
 
-	if len(hb.GNSS) != 1 { //GNSS长度大于1，需要修改代码
-		slog.Warn("length of GNSS is not 1" + string(msg.Data))
-	} else if hb.GNSS[0].Lng == "" && hb.GNSS[0].Bssid == "" { //既无坐标又无wifi列表，gnss为无效数据
-		slog.Warn("GNSS is empty:" + string(msg.Data))
+	a := &mxm.Alarm{Time: time.Now()}
+	switch report.Alarm.Type {
+	case ALARM_SOS:
+		a.Type = mxm.SOS
+		a.Msg = "SOS"
+	case ALARM_LOW_BAT:
+		a.Type = mxm.LOW_BATERY
+		vol, _ := strconv.Atoi(report.Alarm.Vol)
+		a.Msg = fmt.Sprintf("%v%%", Vol2Percent(vol))
+	case ALARM_REMOVED:
+		a.Type = mxm.REMOVED
+		a.Msg = "removed"
+	case ALARM_SHUTDOWN:
+		a.Type = mxm.POWER_OFF
+		a.Msg = "shutdown"
+	default:
+		slog.Warn("unknown btt alarm type", "deviceSN", msg.DeviceSN, "type", report.Alarm.Type, "value", report.Alarm.Value)
+		return nil, nil
+	}
+	return a, nil
+}
+
+// handleHeartBeat 返回设备最新状态及补传的历史定位点
+// 设备离线后重新联网会在GNSS中批量补传缓存的定位点，最新的点更新设备状态，其余按时间升序作为轨迹点返回
+func (h *bttDeviceStatusFactory) handleHeartBeat(msg *Message) (*mxm.Device, []*mxm.Location, error) {
+
+	var hb HeartBeat
+	if err := json.Unmarshal(msg.Data, &hb); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal:%v", err.Error())
 	}
 
 	vol, _ := strconv.Atoi(hb.BAT.Vol)
 	csq, _ := strconv.Atoi(hb.Lte.Csq)
 	interval, _ := strconv.Atoi(hb.Other.Gpstime)
 	steps, _ := strconv.Atoi(hb.Health.Step)
-	//locBytes, _ := json.Marshal(loc)
 	var btt string = TYPE_BTT
 	simSignal := CsqAsPercent(csq)
 	elect := Vol2Percent(vol)
@@ -356,7 +403,26 @@ func (h *bttDeviceStatusFactory) handleHeartBeat(msg *Message) (*mxm.Device, err
 	d.Electricity = &electFiltered
 
 	// 坐标地址处理
-	gnss := hb.GNSS[0]
+	gnssList := validGnss(hb.GNSS)
+	if len(gnssList) == 0 { //既无坐标又无wifi列表，gnss为无效数据
+		slog.Warn("GNSS is empty:" + string(msg.Data))
+		t := time.Now()
+		d.LastOnline = &t
+		return &d, nil, nil
+	}
+
+	// 只有最新的点需要解析地址
+	var track []*mxm.Location
+	for _, gnss := range gnssList[:len(gnssList)-1] {
+		loc, err := h.parseGnss(&gnss, false)
+		if err != nil || (loc.Latitude == 0 && loc.Longitude == 0) {
+			slog.Warn("drop buffered gnss", "gnss", gnss, "error", err)
+			continue
+		}
+		track = append(track, loc)
+	}
+
+	gnss := gnssList[len(gnssList)-1]
 	loc, err := h.handleGnss(&gnss)
 	if err != nil {
 		slog.Error("handleGnss failed", "gnss", gnss)
@@ -376,5 +442,25 @@ func (h *bttDeviceStatusFactory) handleHeartBeat(msg *Message) (*mxm.Device, err
 
 		d.LastOnline = &loc.LocTime
 	}
-	return &d, nil
+	return &d, track, nil
+}
+
+// validGnss 去掉既无坐标又无wifi列表的点，按定位时间升序排列，时间无法解析的点视为最新
+func validGnss(list []Gnss) []Gnss {
+	res := make([]Gnss, 0, len(list))
+	for _, g := range list {
+		if g.Lng == "" && g.Bssid == "" {
+			continue
+		}
+		res = append(res, g)
+	}
+	tm := func(g Gnss) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", g.TimeStr, time.Local)
+		if err != nil {
+			return time.Now()
+		}
+		return t
+	}
+	sort.SliceStable(res, func(i, j int) bool { return tm(res[i]).Before(tm(res[j])) })
+	return res
 }
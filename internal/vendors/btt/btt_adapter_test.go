@@ -426,7 +426,7 @@ func TestBttDeviceStatusFactory_HandleHeartBeat(t *testing.T) {
 			mockCache.On("GetCache", "btt_elect", tt.message.DeviceSN).Return(nil, false)
 			mockCache.On("SetCache", "btt_elect", tt.message.DeviceSN, mock.AnythingOfType("ElectWithTm")).Return()
 
-			result, err := factory.handleHeartBeat(tt.message)
+			result, _, err := factory.handleHeartBeat(tt.message)
 
 			if tt.expectError {
 				assert.Error(t, err)
@@ -441,6 +441,95 @@ func TestBttDeviceStatusFactory_HandleHeartBeat(t *testing.T) {
 	}
 }
 
+func TestBttDeviceStatusFactory_HandleHeartBeatBuffered(t *testing.T) {
+	mockCache := &MockLocalCache{}
+	factory := &bttDeviceStatusFactory{cache: mockCache}
+	mockCache.On("GetCache", "btt_elect", "863644076543074").Return(nil, false)
+	mockCache.On("SetCache", "btt_elect", "863644076543074", mock.AnythingOfType("ElectWithTm")).Return()
+
+	// 补传的点乱序到达，最新的点没有地图服务可用，只验证排序和拆分
+	msg := &Message{
+		MessageId: 102,
+		DeviceSN:  "863644076543074",
+		DataType:  REPORT_HEARTBEAT,
+		Data: json.RawMessage(`{"LTE":{"csq":"13"},"BAT":{"vol":"4020"},"other":{"gpstime":"60"},"health":{"step":"0"},"GNSS":[` +
+			`{"lng":"114.0002","lat":"22.5","type":"3","time":"2025-04-03 13:02:00"},` +
+			`{"lng":"114.0000","lat":"22.5","type":"3","time":"2025-04-03 13:00:00"},` +
+			`{"lng":"","lat":"","bssid":"","type":"1","time":"2025-04-03 13:03:00"},` +
+			`{"lng":"114.0001","lat":"22.5","type":"3","time":"2025-04-03 13:01:00"}]}`),
+	}
+	d, track, err := factory.handleHeartBeat(msg)
+	assert.NoError(t, err)
+	assert.NotNil(t, d.LastOnline)
+	assert.Len(t, track, 2)
+	assert.True(t, track[0].LocTime.Before(track[1].LocTime))
+	assert.Equal(t, 13, track[0].LocTime.Hour())
+	assert.Equal(t, 0, track[0].LocTime.Minute())
+	assert.Equal(t, 1, track[1].LocTime.Minute())
+	for _, loc := range track {
+		assert.Empty(t, loc.Address)
+		assert.NotZero(t, loc.Longitude)
+	}
+}
+
+func TestBttDeviceStatusFactory_HandleDeviceInfo(t *testing.T) {
+	mockCache := &MockLocalCache{}
+	factory := &bttDeviceStatusFactory{cache: mockCache}
+	mockCache.On("GetCache", "btt_elect", "869861062618140").Return(nil, false)
+	mockCache.On("SetCache", "btt_elect", "869861062618140", mock.AnythingOfType("ElectWithTm")).Return()
+
+	msg := &Message{
+		MessageId: 101,
+		DeviceSN:  "869861062618140",
+		DataType:  DEVICE_INFO,
+		Data: json.RawMessage(`{"DeviceInfo":{"productKey":"Air780EG","project":"dwq_fanqie","luatos_version":"V1110",` +
+			`"hwVersion":"1.0.0","swVersion":"1.81"},"Heartbeat":{"gpstime":"1800"},"BAT":{"vol":"3404"}}`),
+	}
+	d, err := factory.handleDeviceInfo(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.81", *d.SwVersion)
+	assert.Equal(t, "1.0.0", *d.HwVersion)
+	assert.Equal(t, "dwq_fanqie", *d.Project)
+	assert.Equal(t, "V1110", *d.LuatosVersion)
+	assert.Equal(t, 1800, *d.Interval)
+	assert.NotNil(t, d.Electricity)
+	assert.Nil(t, d.Latitude)
+
+	_, err = factory.handleDeviceInfo(&Message{DeviceSN: "869861062618140", Data: json.RawMessage(`invalid json`)})
+	assert.Error(t, err)
+}
+
+func TestHandleAlarm(t *testing.T) {
+	tests := []struct {
+		alarmType string
+		expect    int
+	}{
+		{ALARM_SOS, mxm.SOS},
+		{ALARM_LOW_BAT, mxm.LOW_BATERY},
+		{ALARM_REMOVED, mxm.REMOVED},
+		{ALARM_SHUTDOWN, mxm.POWER_OFF},
+	}
+	for _, tt := range tests {
+		msg := &Message{
+			DeviceSN: "869861062618140",
+			DataType: ALARM,
+			Data:     json.RawMessage(`{"Alarm":{"type":"` + tt.alarmType + `","value":"3","vol":"3032"}}`),
+		}
+		a, err := handleAlarm(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, a.Type)
+		assert.False(t, a.Time.IsZero())
+	}
+
+	// 未知类型忽略
+	a, err := handleAlarm(&Message{Data: json.RawMessage(`{"Alarm":{"type":"9"}}`)})
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+
+	_, err = handleAlarm(&Message{Data: json.RawMessage(`invalid json`)})
+	assert.Error(t, err)
+}
+
 func TestTypeAsString(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -38,6 +38,45 @@ type Health struct {
 	Step string `json:"step"`
 }
 
+// 设备信息上报(1001)
+type DeviceInfo struct {
+	ProductKey    string `json:"productKey"`
+	Project       string `json:"project"`
+	LuatosVersion string `json:"luatos_version"`
+	DeviceType    string `json:"deviceType"`
+	HwVersion     string `json:"hwVersion"`
+	SwVersion     string `json:"swVersion"`
+	Imsi          string `json:"imsi"`
+	Imei          string `json:"imei"`
+	Iccid         string `json:"iccid"`
+	BuildDate     string `json:"buildDate"`
+}
+
+type DeviceInfoReport struct {
+	DeviceInfo DeviceInfo `json:"DeviceInfo"`
+	Heartbeat  Other      `json:"Heartbeat"`
+	BAT        Bat        `json:"BAT"`
+}
+
+// 报警类型
+const (
+	ALARM_SOS      = "1"
+	ALARM_LOW_BAT  = "2"
+	ALARM_REMOVED  = "3"
+	ALARM_SHUTDOWN = "4" //关机
+)
+
+// 报警上报(1003)
+type AlarmInfo struct {
+	Type  string `json:"type"`
+	Value string `json:"value"` //报警级别
+	Vol   string `json:"vol"`   //当前电压(mV)
+}
+
+type AlarmReport struct {
+	Alarm AlarmInfo `json:"Alarm"`
+}
+
 type HeartBeat struct {
 	Lte    Lte    `json:"LTE"`
 	GNSS   []Gnss `json:"GNSS"`
@@ -14,6 +14,12 @@ const (
 	CMD_REPLY          = "8001" //指令响应
 	POWRER             = "3900"
 	QUERY_ELECTRICITY  = "2006"
+	UPGRADE            = "3100" //远程升级，设备按url下载固件，校验md5后重启，启动后以1001上报新版本
+	// {
+	//     "messageId": 110,
+	//     "dataType": "3100",
+	//     "data": [{"url": "https://.../ota/xxx.bin", "version": "1.82", "md5": "...", "size": "524288"}]
+	// }
 
 	REPORT_HEARTBEAT = "1002" //心跳上报
 	// {
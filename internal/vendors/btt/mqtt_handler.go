@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 
 	mxm "github.com/Daneel-Li/gps-back/internal/models"
@@ -19,6 +20,20 @@ const _STB_LOCATION = "stb_location"
 const _CMD_TOPIC_PREFIX = "dwq/device/hy" //device消费的消息，即为指令
 const _REPORT_TOPIC_PREFIX = "dwq/app/hy" //app消费的消息，自然就是数据上报
 
+// 订阅模式
+// 设备量大时逐设备订阅会产生巨大的SUBSCRIBE包并拖慢重连，wildcard/shared模式只订阅两个通配符topic，
+// 未分配设备的消息按缓存的设备集合在代码中过滤
+const (
+	SUBSCRIBE_TOPIC    = "topic"    //逐设备订阅
+	SUBSCRIBE_WILDCARD = "wildcard" //通配符订阅
+	SUBSCRIBE_SHARED   = "shared"   //共享订阅($share/{group}/...)，多个服务实例分摊消息，需broker支持
+)
+
+const _DEFAULT_SHARED_GROUP = "gps-back"
+
+// 设备集合刷新周期，其它实例上激活的设备最迟在一个周期后生效
+const _DEVICE_SET_REFRESH = time.Minute
+
 var shanghai *time.Location = nil
 
 func init() {
@@ -38,6 +53,12 @@ type MqttHandler struct {
 	provider    TopicProvider
 	mqClient    mqtt.Client
 	factory     DeviceStatusFactory
+	mu          sync.Mutex
+	connErr     error //最近一次断线原因
+
+	devMu       sync.RWMutex
+	devices     map[string]struct{} //wildcard/shared模式下接收消息的设备集合
+	stopRefresh chan struct{}
 }
 
 func (h *MqttHandler) SetMessageHandler(handler vendors.MessageHandler) {
@@ -54,6 +75,25 @@ type MqttConfig struct {
 	ClientID string `json:"clientid"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+
+	// 订阅模式(仅btt驱动): topic(默认，逐设备订阅)/wildcard(通配符订阅)/shared(共享订阅，多实例部署)
+	SubscribeMode string `json:"subscribe_mode"`
+	SharedGroup   string `json:"shared_group"` // shared模式的共享组名，默认gps-back
+
+	// TLS，broker使用ssl://或tls://时生效；配置ca_cert后只信任该CA签发的证书
+	CACert     string `json:"ca_cert"`     // CA证书路径(PEM)
+	ClientCert string `json:"client_cert"` // 可选，客户端证书路径(PEM)，需与client_key同时配置
+	ClientKey  string `json:"client_key"`  // 可选，客户端私钥路径(PEM)
+
+	UplinkQoS   *int   `json:"uplink_qos"`   // 订阅设备上报的QoS，默认1
+	DownlinkQoS *int   `json:"downlink_qos"` // 下发指令的QoS，默认1
+	KeepAlive   int    `json:"keepalive"`    // 心跳间隔(秒)，默认10
+	StorePath   string `json:"store_path"`   // 可选，持久化会话目录，未确认的指令重启后继续投递
+}
+
+// filtered wildcard/shared模式下消息需按设备集合过滤
+func (h *MqttHandler) filtered() bool {
+	return h.config.SubscribeMode == SUBSCRIBE_WILDCARD || h.config.SubscribeMode == SUBSCRIBE_SHARED
 }
 
 // 启动mqtt客户端
@@ -62,36 +102,95 @@ type MqttConfig struct {
 // and connection settings. The function also configures automatic reconnection and handles
 // connection loss events. Returns an error if the connection fails.
 func (h *MqttHandler) Start() error {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(h.config.Broker)
-	opts.SetClientID(h.config.ClientID)              // 客户端ID
+	switch h.config.SubscribeMode {
+	case "", SUBSCRIBE_TOPIC, SUBSCRIBE_WILDCARD, SUBSCRIBE_SHARED:
+	default:
+		return fmt.Errorf("unknown subscribe mode: %s", h.config.SubscribeMode)
+	}
+
+	opts, err := NewClientOptions(h.config)
+	if err != nil {
+		return err
+	}
 	opts.SetDefaultPublishHandler(h.messageCallback) // 设置消息处理器
-	opts.SetUsername(h.config.Username)
-	opts.SetPassword(h.config.Password)
-	opts.SetKeepAlive(10 * time.Second)
-	opts.SetAutoReconnect(true) // 开启自动重连
-	opts.SetResumeSubs(true)    // 恢复订阅
-	opts.SetConnectRetry(true)
-	opts.SetMaxReconnectInterval(5 * time.Second) //最多隔5秒重试一次
-	opts.SetCleanSession(false)
 	opts.SetOnConnectHandler(func(c mqtt.Client) {
 		slog.Debug("mqtt 连接成功！")
+		h.setConnErr(nil)
 	})
 	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
 		slog.Warn("mqtt client disconnected. trying to reconnect...")
+		h.setConnErr(err)
 		// 说明有，如果想要重连，不要自己实现，要用gsetAutoreconnect来做
 		// if token := c.Connect(); token.Wait() && token.Error() != nil {
 		// 	slog.Error("mqtt client connect failed. " + token.Error().Error())
 		// }
 	})
 	// 创建并启动客户端
-	h.mqClient = mqtt.NewClient(opts)
-	if token := h.mqClient.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("mqtt client failed: %v", token.Error())
+	cli := mqtt.NewClient(opts)
+	if err := Connect(cli); err != nil {
+		return fmt.Errorf("mqtt client failed: %v", err)
 	}
+	h.mu.Lock()
+	h.mqClient = cli
+	h.mu.Unlock()
 
-	// 监听，这里从provider读取topic
-	return h.reloadTopics()
+	if !h.filtered() {
+		// 监听，这里从provider读取topic
+		return h.reloadTopics()
+	}
+	if err := h.reloadDevices(); err != nil {
+		return err
+	}
+	if err := h.subscribeMqttTopics(h.wildcardTopics()); err != nil {
+		return fmt.Errorf("subscribe wildcard topics failed: %v", err)
+	}
+	h.stopRefresh = make(chan struct{})
+	go h.refreshDevices(h.stopRefresh)
+	return nil
+}
+
+// 断开mqtt连接
+func (h *MqttHandler) Stop() error {
+	if h.stopRefresh != nil {
+		close(h.stopRefresh)
+		h.stopRefresh = nil
+	}
+	h.mu.Lock()
+	cli := h.mqClient
+	h.mqClient = nil
+	h.mu.Unlock()
+	if cli != nil {
+		cli.Disconnect(250)
+	}
+	return nil
+}
+
+func (h *MqttHandler) client() mqtt.Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.mqClient
+}
+
+func (h *MqttHandler) setConnErr(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connErr = err
+}
+
+// Health mqtt断线时返回断线原因，自动重连成功后恢复
+func (h *MqttHandler) Health() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.mqClient == nil {
+		return errors.New("mqtt client not started")
+	}
+	if h.mqClient.IsConnectionOpen() {
+		return nil
+	}
+	if h.connErr != nil {
+		return fmt.Errorf("mqtt disconnected: %v", h.connErr)
+	}
+	return errors.New("mqtt not connected")
 }
 
 func getDevTopicBySN(sn string) string {
@@ -126,7 +225,7 @@ func (h *MqttHandler) reloadTopics() error {
 	}
 
 	// 检查 mqClient 是否已初始化
-	if h.mqClient == nil {
+	if h.client() == nil {
 		return fmt.Errorf("mqtt client not initialized")
 	}
 
@@ -136,6 +235,72 @@ func (h *MqttHandler) reloadTopics() error {
 	return nil
 }
 
+// wildcardTopics 与逐设备订阅的topic一一对应，shared模式加上共享组前缀
+func (h *MqttHandler) wildcardTopics() []string {
+	topics := []string{getDevTopicBySN("+"), getAppTopicBySN("+")}
+	if h.config.SubscribeMode == SUBSCRIBE_SHARED {
+		group := h.config.SharedGroup
+		if group == "" {
+			group = _DEFAULT_SHARED_GROUP
+		}
+		for i, t := range topics {
+			topics[i] = fmt.Sprintf("$share/%s/%s", group, t)
+		}
+	}
+	return topics
+}
+
+// reloadDevices 从provider重新加载设备集合
+func (h *MqttHandler) reloadDevices() error {
+	devs, err := h.provider.GetSubscriptionList()
+	if err != nil {
+		return fmt.Errorf("get device list failed: %v", err)
+	}
+	set := make(map[string]struct{}, len(devs))
+	for _, sn := range devs {
+		set[sn] = struct{}{}
+	}
+	h.devMu.Lock()
+	h.devices = set
+	h.devMu.Unlock()
+	return nil
+}
+
+func (h *MqttHandler) refreshDevices(stop chan struct{}) {
+	ticker := time.NewTicker(_DEVICE_SET_REFRESH)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := h.reloadDevices(); err != nil {
+				slog.Error("refresh btt device set failed", "error", err)
+			}
+		}
+	}
+}
+
+func (h *MqttHandler) knownDevice(sn string) bool {
+	h.devMu.RLock()
+	defer h.devMu.RUnlock()
+	_, ok := h.devices[sn]
+	return ok
+}
+
+func (h *MqttHandler) setDevice(sn string, known bool) {
+	h.devMu.Lock()
+	defer h.devMu.Unlock()
+	if h.devices == nil {
+		h.devices = make(map[string]struct{})
+	}
+	if known {
+		h.devices[sn] = struct{}{}
+	} else {
+		delete(h.devices, sn)
+	}
+}
+
 /*
 *
 自动调整算法，处理btt产品紧急模式下空包问题
@@ -185,6 +350,10 @@ func (h *MqttHandler) messageCallback(_ mqtt.Client, m mqtt.Message) {
 			return
 		}
 		deviceSN := getSNByTopic(topic)
+		if h.filtered() && !h.knownDevice(deviceSN) {
+			slog.Debug("drop message of unassigned device", "topic", topic)
+			return
+		}
 
 		msg := wrapper.Message
 
@@ -237,13 +406,14 @@ func (h *MqttHandler) subscribeMqttTopics(topics []string) error {
 	}
 	m := make(map[string]byte)
 	for _, topic := range topics {
-		m[topic] = 1
+		m[topic] = h.config.UpQoS()
 	}
-	if h.mqClient == nil {
+	cli := h.client()
+	if cli == nil {
 		return errors.New("mq client is invalid")
 	}
-	if token := h.mqClient.SubscribeMultiple(m, nil); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("subscribe failed: %v", token.Error())
+	if err := WaitToken(cli.SubscribeMultiple(m, nil)); err != nil {
+		return fmt.Errorf("subscribe failed: %v", err)
 	}
 	slog.Debug("subscribed topics:", "topics", topics)
 	return nil
@@ -253,11 +423,12 @@ func (h *MqttHandler) unsubscribeMqttTopics(topics []string) error {
 	if len(topics) == 0 {
 		return nil
 	}
-	if h.mqClient == nil {
+	cli := h.client()
+	if cli == nil {
 		return errors.New("mq client is invalid")
 	}
-	if token := h.mqClient.Unsubscribe(topics...); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("unsubscribe failed: %v", token.Error())
+	if err := WaitToken(cli.Unsubscribe(topics...)); err != nil {
+		return fmt.Errorf("unsubscribe failed: %v", err)
 	}
 	slog.Debug("unsubscribed topics:", "topics", topics)
 	return nil
@@ -308,12 +479,47 @@ func (op *MqttHandler) Find(CommandID int64, deviceSN string) error {
 	return op.publishBttMessage(deviceSN, msg)
 }
 
+// 透传原始指令，payload为btt消息json，如{"dataType":"2006"}，messageId替换为CommandID
+func (op *MqttHandler) SendRaw(CommandID int64, deviceSN string, payload string) error {
+	var msg Message
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		return fmt.Errorf("%w: raw btt payload must be a json message: %v", vendors.ErrInvalidArgument, err)
+	}
+	if msg.DataType == "" {
+		return fmt.Errorf("%w: raw btt payload requires dataType", vendors.ErrInvalidArgument)
+	}
+	msg.MessageId = CommandID
+	return op.publishBttMessage(deviceSN, msg)
+}
+
+// 远程升级，结果以8001应答，升级完成以1001上报的swVersion确认
+func (op *MqttHandler) UpgradeFirmware(CommandID int64, deviceSN string, fw vendors.FirmwarePackage) error {
+	msg := Message{MessageId: CommandID, DataType: UPGRADE}
+	msg.Data, _ = json.Marshal([]map[string]string{
+		{
+			"url":     fw.URL,
+			"version": fw.Version,
+			"md5":     fw.MD5,
+			"size":    fmt.Sprintf("%d", fw.Size),
+		},
+	})
+	return op.publishBttMessage(deviceSN, msg)
+}
+
 func (op *MqttHandler) Activate(deviceSN string) error {
+	if op.filtered() {
+		op.setDevice(deviceSN, true)
+		return nil
+	}
 	// 监听话题
 	return op.subscribeMqttTopics(op.getTopics([]string{deviceSN}))
 }
 
 func (op *MqttHandler) Deactivate(deviceSN string) error {
+	if op.filtered() {
+		op.setDevice(deviceSN, false)
+		return nil
+	}
 	return op.unsubscribeMqttTopics(op.getTopics([]string{deviceSN}))
 }
 
@@ -327,11 +533,18 @@ func (h *MqttHandler) publishBttMessage(deviceSN string, msg Message) error {
 	}
 
 	// 5. 发布命令
-	if h.mqClient == nil {
+	cli := h.client()
+	if cli == nil {
 		return errors.New("mp client is invalid.")
 	}
-	if token := h.mqClient.Publish(topic, 1, false, payload); token.Error() != nil {
+	if token := cli.Publish(topic, h.config.DownQoS(), false, payload); token.Error() != nil {
 		return fmt.Errorf("publish failed: %v", token.Error())
 	}
 	return nil
 }
+
+// 紧急模式最快10秒上报一次
+func (op *MqttHandler) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities(vendors.ActionSetReportInterval(10, 3600), vendors.ActionLocate,
+		vendors.ActionReboot, vendors.ActionPowerOff, vendors.ActionFind)
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/stretchr/testify/assert"
@@ -232,6 +233,58 @@ func TestMqttHandler_MessageCallback(t *testing.T) {
 	}
 }
 
+func TestMqttHandler_WildcardTopics(t *testing.T) {
+	handler := &MqttHandler{config: MqttConfig{SubscribeMode: SUBSCRIBE_WILDCARD}}
+	assert.Equal(t, []string{"dwq/device/hy/+/", "dwq/app/hy/+/"}, handler.wildcardTopics())
+
+	handler.config.SubscribeMode = SUBSCRIBE_SHARED
+	assert.Equal(t, []string{"$share/gps-back/dwq/device/hy/+/", "$share/gps-back/dwq/app/hy/+/"}, handler.wildcardTopics())
+
+	handler.config.SharedGroup = "g1"
+	assert.Equal(t, "$share/g1/dwq/app/hy/+/", handler.wildcardTopics()[1])
+
+	handler.config.SubscribeMode = "bogus"
+	assert.ErrorContains(t, handler.Start(), "unknown subscribe mode")
+}
+
+func TestMqttHandler_FilterUnknownDevice(t *testing.T) {
+	provider := &MockTopicProvider{}
+	provider.On("GetSubscriptionList").Return([]string{"863644076543074"}, nil)
+	messageHandler := &MockMessageHandler{}
+	messageHandler.On("Process", mock.AnythingOfType("*mxm.DeviceStatus1")).Return(nil)
+	factory := &MockDeviceStatusFactory{}
+	factory.On("CreateDeviceStatus", mock.Anything).Return(&mxm.DeviceStatus1{}, nil)
+
+	handler := &MqttHandler{
+		config:      MqttConfig{SubscribeMode: SUBSCRIBE_SHARED},
+		provider:    provider,
+		unifiedFunc: messageHandler,
+		factory:     factory,
+	}
+	assert.NoError(t, handler.reloadDevices())
+
+	send := func(sn string) {
+		mockMsg := &MockMQTTMessage{}
+		mockMsg.On("Topic").Return("dwq/app/hy/" + sn + "/")
+		mockMsg.On("Payload").Return([]byte(`{"messageId":1,"dataType":"1002"}`))
+		handler.messageCallback(nil, mockMsg)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	send("111111111111111")
+	messageHandler.AssertNotCalled(t, "Process", mock.Anything)
+	send("863644076543074")
+	messageHandler.AssertNumberOfCalls(t, "Process", 1)
+
+	// 激活/停用只更新设备集合，不订阅
+	assert.NoError(t, handler.Activate("111111111111111"))
+	send("111111111111111")
+	messageHandler.AssertNumberOfCalls(t, "Process", 2)
+	assert.NoError(t, handler.Deactivate("863644076543074"))
+	send("863644076543074")
+	messageHandler.AssertNumberOfCalls(t, "Process", 2)
+}
+
 func TestMqttHandler_SetReportInterval(t *testing.T) {
 	handler := &MqttHandler{}
 
@@ -278,6 +331,26 @@ func TestMqttHandler_Find(t *testing.T) {
 	})
 }
 
+func TestMqttHandler_SendRaw(t *testing.T) {
+	handler := &MqttHandler{}
+
+	assert.ErrorIs(t, handler.SendRaw(123, "123456789", "upload,60#"), vendors.ErrInvalidArgument)
+	assert.ErrorIs(t, handler.SendRaw(123, "123456789", `{"data":[]}`), vendors.ErrInvalidArgument)
+	// 格式正确时才会下发，这里没有mqtt客户端
+	err := handler.SendRaw(123, "123456789", `{"dataType":"2006"}`)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, vendors.ErrInvalidArgument)
+}
+
+func TestMqttHandler_UpgradeFirmware(t *testing.T) {
+	handler := &MqttHandler{}
+
+	var _ vendors.FirmwareUpdater = handler
+	assert.NotPanics(t, func() {
+		handler.UpgradeFirmware(123, "123456789", vendors.FirmwarePackage{Version: "1.82", URL: "https://example.com/ota/fw.bin"})
+	})
+}
+
 func TestMqttHandler_Activate(t *testing.T) {
 	handler := &MqttHandler{}
 
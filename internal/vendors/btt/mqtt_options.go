@@ -0,0 +1,131 @@
+package btt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const _DEFAULT_QOS = 1
+const _DEFAULT_KEEPALIVE = 10 //秒
+
+// MqttTimeout 启动时连接broker及订阅的最长等待时间。开启了ConnectRetry，连不上时不限时会一直等下去
+const MqttTimeout = 30 * time.Second
+
+// WaitToken 限时等待mqtt操作完成
+func WaitToken(token mqtt.Token) error {
+	if !token.WaitTimeout(MqttTimeout) {
+		return fmt.Errorf("timed out after %v", MqttTimeout)
+	}
+	return token.Error()
+}
+
+// Connect 限时连接broker，失败时断开客户端以停止后台重试，由调用方报告启动失败
+func Connect(cli mqtt.Client) error {
+	if err := WaitToken(cli.Connect()); err != nil {
+		cli.Disconnect(0)
+		return err
+	}
+	return nil
+}
+
+// NewClientOptions 按配置生成mqtt连接参数(broker、认证、TLS、心跳、会话存储、重连策略)，
+// 消息回调和连接事件由调用方设置
+func NewClientOptions(cfg MqttConfig) (*mqtt.ClientOptions, error) {
+	if _, err := qos(cfg.UplinkQoS); err != nil {
+		return nil, fmt.Errorf("uplink_qos: %v", err)
+	}
+	if _, err := qos(cfg.DownlinkQoS); err != nil {
+		return nil, fmt.Errorf("downlink_qos: %v", err)
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cfg.Broker)
+	opts.SetClientID(cfg.ClientID) // 客户端ID
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	keepAlive := cfg.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = _DEFAULT_KEEPALIVE
+	}
+	opts.SetKeepAlive(time.Duration(keepAlive) * time.Second)
+	opts.SetAutoReconnect(true) // 开启自动重连
+	opts.SetResumeSubs(true)    // 恢复订阅
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(5 * time.Second) //最多隔5秒重试一次
+	opts.SetCleanSession(false)
+	if cfg.StorePath != "" {
+		// 默认为内存存储，重启后未确认的QoS1/2消息会丢失
+		opts.SetStore(mqtt.NewFileStore(cfg.StorePath))
+	}
+
+	tlsCfg, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+	return opts, nil
+}
+
+// newTLSConfig 未配置证书时返回nil，使用系统CA
+func newTLSConfig(cfg MqttConfig) (*tls.Config, error) {
+	if cfg.CACert == "" && cfg.ClientCert == "" && cfg.ClientKey == "" {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read ca_cert failed: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca_cert %s", cfg.CACert)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		if cfg.ClientCert == "" || cfg.ClientKey == "" {
+			return nil, errors.New("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate failed: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func qos(v *int) (byte, error) {
+	if v == nil {
+		return _DEFAULT_QOS, nil
+	}
+	if *v < 0 || *v > 2 {
+		return 0, fmt.Errorf("qos must be 0, 1 or 2, got %d", *v)
+	}
+	return byte(*v), nil
+}
+
+// UpQoS 订阅上报topic使用的QoS，配置非法时使用默认值(NewClientOptions会先行报错)
+func (c MqttConfig) UpQoS() byte {
+	if q, err := qos(c.UplinkQoS); err == nil {
+		return q
+	}
+	return _DEFAULT_QOS
+}
+
+// DownQoS 下发指令使用的QoS
+func (c MqttConfig) DownQoS() byte {
+	if q, err := qos(c.DownlinkQoS); err == nil {
+		return q
+	}
+	return _DEFAULT_QOS
+}
@@ -0,0 +1,91 @@
+package btt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert 生成自签名证书及私钥，返回文件路径
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certPath, keyPath
+}
+
+func TestNewClientOptions(t *testing.T) {
+	opts, err := NewClientOptions(MqttConfig{Broker: "tcp://localhost:1883", ClientID: "c1"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), opts.KeepAlive)
+	assert.Nil(t, opts.TLSConfig)
+	assert.False(t, opts.CleanSession)
+
+	opts, err = NewClientOptions(MqttConfig{Broker: "tcp://localhost:1883", KeepAlive: 30})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), opts.KeepAlive)
+
+	bad := 3
+	_, err = NewClientOptions(MqttConfig{UplinkQoS: &bad})
+	assert.ErrorContains(t, err, "uplink_qos")
+	_, err = NewClientOptions(MqttConfig{DownlinkQoS: &bad})
+	assert.ErrorContains(t, err, "downlink_qos")
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCert(t, dir)
+
+	tlsCfg, err := newTLSConfig(MqttConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsCfg)
+
+	tlsCfg, err = newTLSConfig(MqttConfig{CACert: certPath})
+	assert.NoError(t, err)
+	assert.NotNil(t, tlsCfg.RootCAs)
+	assert.Empty(t, tlsCfg.Certificates)
+
+	tlsCfg, err = newTLSConfig(MqttConfig{CACert: certPath, ClientCert: certPath, ClientKey: keyPath})
+	assert.NoError(t, err)
+	assert.Len(t, tlsCfg.Certificates, 1)
+
+	_, err = newTLSConfig(MqttConfig{ClientCert: certPath})
+	assert.Error(t, err)
+	_, err = newTLSConfig(MqttConfig{CACert: filepath.Join(dir, "missing.pem")})
+	assert.Error(t, err)
+	_, err = newTLSConfig(MqttConfig{CACert: keyPath}) // 不是证书
+	assert.Error(t, err)
+}
+
+func TestQoS(t *testing.T) {
+	zero, two := 0, 2
+	assert.Equal(t, byte(1), MqttConfig{}.UpQoS())
+	assert.Equal(t, byte(1), MqttConfig{}.DownQoS())
+	assert.Equal(t, byte(0), MqttConfig{UplinkQoS: &zero}.UpQoS())
+	assert.Equal(t, byte(2), MqttConfig{DownlinkQoS: &two}.DownQoS())
+}
@@ -0,0 +1,132 @@
+package vendors
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Actions accepted by the device command API
+const (
+	ACTION_SET_REPORTINTERVAL = "SET_REPORTINTERVAL"
+	ACTION_LOCATE             = "LOCATE"
+	ACTION_REBOOT             = "REBOOT"
+	ACTION_POWER_OFF          = "POWER_OFF"
+	ACTION_FIND               = "FIND"
+	ACTION_AUTO_START         = "AUTO_START"
+	ACTION_AUTO_SHUT          = "AUTO_SHUT"
+	ACTION_RAW                = "RAW" // admin only vendor passthrough, never declared in Capabilities
+	ACTION_OTA                = "OTA" // firmware upgrade, only sent by rollouts through FirmwareUpdater
+)
+
+// Argument types
+const (
+	ARG_INT  = "int"  // decimal integer, bounded by Min/Max when set
+	ARG_TIME = "time" // HH:MM
+	ARG_BOOL = "bool" // "1" or "0"
+)
+
+// ErrInvalidArgument is matched (via errors.Is) by every argument validation error
+var ErrInvalidArgument = errors.New("invalid command argument")
+
+var timeArg = regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d$`)
+
+// ArgSpec describes one positional argument of an action
+type ArgSpec struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Min  *int   `json:"min,omitempty"`
+	Max  *int   `json:"max,omitempty"`
+}
+
+// ActionSpec describes an action a driver accepts and its arguments, in order
+type ActionSpec struct {
+	Action string    `json:"action"`
+	Args   []ArgSpec `json:"args"`
+}
+
+// Capabilities is what a driver declares it can do, so that clients only
+// offer supported commands and bad ones are rejected before reaching the device
+type Capabilities struct {
+	Actions       []ActionSpec `json:"actions"`
+	Buzzer        bool         `json:"buzzer"`         // FIND makes the device sound
+	PowerSchedule bool         `json:"power_schedule"` // AUTO_START/AUTO_SHUT are supported
+}
+
+// Action specs shared by drivers
+var (
+	ActionLocate    = ActionSpec{Action: ACTION_LOCATE, Args: []ArgSpec{}}
+	ActionReboot    = ActionSpec{Action: ACTION_REBOOT, Args: []ArgSpec{}}
+	ActionPowerOff  = ActionSpec{Action: ACTION_POWER_OFF, Args: []ArgSpec{}}
+	ActionFind      = ActionSpec{Action: ACTION_FIND, Args: []ArgSpec{}}
+	ActionAutoStart = ActionSpec{Action: ACTION_AUTO_START, Args: []ArgSpec{{Name: "time", Type: ARG_TIME}, {Name: "enable", Type: ARG_BOOL}}}
+	ActionAutoShut  = ActionSpec{Action: ACTION_AUTO_SHUT, Args: []ArgSpec{{Name: "time", Type: ARG_TIME}, {Name: "enable", Type: ARG_BOOL}}}
+)
+
+// ActionSetReportInterval allows report intervals in [min, max] seconds
+func ActionSetReportInterval(min, max int) ActionSpec {
+	return ActionSpec{
+		Action: ACTION_SET_REPORTINTERVAL,
+		Args:   []ArgSpec{{Name: "interval", Type: ARG_INT, Min: &min, Max: &max}},
+	}
+}
+
+// NewCapabilities builds Capabilities from the given actions, deriving the feature flags
+func NewCapabilities(actions ...ActionSpec) Capabilities {
+	c := Capabilities{Actions: actions}
+	if c.Actions == nil {
+		c.Actions = []ActionSpec{}
+	}
+	_, c.Buzzer = c.Action(ACTION_FIND)
+	_, start := c.Action(ACTION_AUTO_START)
+	_, shut := c.Action(ACTION_AUTO_SHUT)
+	c.PowerSchedule = start && shut
+	return c
+}
+
+// Action returns the spec of the given action, if supported
+func (c Capabilities) Action(action string) (ActionSpec, bool) {
+	for _, a := range c.Actions {
+		if a.Action == action {
+			return a, true
+		}
+	}
+	return ActionSpec{}, false
+}
+
+// ValidateArgs checks args against the spec; extra args are ignored
+func (a ActionSpec) ValidateArgs(args []string) error {
+	if len(args) < len(a.Args) {
+		return fmt.Errorf("%w: %s requires %d arguments", ErrInvalidArgument, a.Action, len(a.Args))
+	}
+	for i, spec := range a.Args {
+		v := args[i]
+		switch spec.Type {
+		case ARG_INT:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%w: %s must be an integer, got %q", ErrInvalidArgument, spec.Name, v)
+			}
+			if (spec.Min != nil && n < *spec.Min) || (spec.Max != nil && n > *spec.Max) {
+				return fmt.Errorf("%w: %s must be in [%s, %s], got %d", ErrInvalidArgument, spec.Name, bound(spec.Min), bound(spec.Max), n)
+			}
+		case ARG_TIME:
+			if !timeArg.MatchString(v) {
+				return fmt.Errorf("%w: %s must be HH:MM, got %q", ErrInvalidArgument, spec.Name, v)
+			}
+		case ARG_BOOL:
+			if v != "0" && v != "1" {
+				return fmt.Errorf("%w: %s must be 0 or 1, got %q", ErrInvalidArgument, spec.Name, v)
+			}
+		}
+	}
+	return nil
+}
+
+func bound(b *int) string {
+	if b == nil {
+		return "-"
+	}
+	return strconv.Itoa(*b)
+}
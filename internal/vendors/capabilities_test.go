@@ -0,0 +1,43 @@
+package vendors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCapabilities(t *testing.T) {
+	c := NewCapabilities(ActionSetReportInterval(10, 3600), ActionLocate, ActionFind, ActionAutoStart, ActionAutoShut)
+	assert.True(t, c.Buzzer)
+	assert.True(t, c.PowerSchedule)
+
+	_, ok := c.Action(ACTION_REBOOT)
+	assert.False(t, ok)
+	spec, ok := c.Action(ACTION_SET_REPORTINTERVAL)
+	assert.True(t, ok)
+	assert.Equal(t, 10, *spec.Args[0].Min)
+	assert.Equal(t, 3600, *spec.Args[0].Max)
+
+	c = NewCapabilities()
+	assert.NotNil(t, c.Actions)
+	assert.False(t, c.Buzzer)
+	assert.False(t, c.PowerSchedule)
+}
+
+func TestValidateArgs(t *testing.T) {
+	interval := ActionSetReportInterval(10, 3600)
+	assert.NoError(t, interval.ValidateArgs([]string{"60"}))
+	assert.NoError(t, interval.ValidateArgs([]string{"10", "extra"}))
+	for _, args := range [][]string{{}, {""}, {"abc"}, {"5"}, {"3601"}} {
+		assert.ErrorIs(t, interval.ValidateArgs(args), ErrInvalidArgument, "%v", args)
+	}
+
+	assert.NoError(t, ActionAutoStart.ValidateArgs([]string{"09:30", "1"}))
+	assert.NoError(t, ActionAutoShut.ValidateArgs([]string{"23:59", "0"}))
+	for _, args := range [][]string{{"9:30", "1"}, {"24:00", "1"}, {"09:30", "yes"}, {"09:30"}} {
+		assert.ErrorIs(t, ActionAutoStart.ValidateArgs(args), ErrInvalidArgument, "%v", args)
+	}
+
+	// actions without arguments ignore extras
+	assert.NoError(t, ActionLocate.ValidateArgs([]string{""}))
+}
@@ -0,0 +1,29 @@
+package vendors
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupportedCommand is matched (via errors.Is) by every error a driver returns
+// for a command its hardware or protocol cannot perform.
+var ErrUnsupportedCommand = errors.New("unsupported command")
+
+// UnsupportedCommandError tells the caller which vendor rejected which action
+type UnsupportedCommandError struct {
+	Vendor string
+	Action string
+}
+
+func (e *UnsupportedCommandError) Error() string {
+	return fmt.Sprintf("%s does not support %s", e.Vendor, e.Action)
+}
+
+func (e *UnsupportedCommandError) Is(target error) bool {
+	return target == ErrUnsupportedCommand
+}
+
+// NewUnsupportedError creates an UnsupportedCommandError
+func NewUnsupportedError(vendor, action string) error {
+	return &UnsupportedCommandError{Vendor: vendor, Action: action}
+}
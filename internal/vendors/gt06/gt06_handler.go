@@ -0,0 +1,311 @@
+package gt06
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/services"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+
+	"github.com/qichengzx/coordtransform"
+)
+
+//gt06(康凯斯)驱动
+
+var _gt06 = "gt06"
+
+type gt06_Handler struct {
+	listenerPort   int                    //监听端口
+	messageHandler vendors.MessageHandler //统一消息处理接口
+	locS           []services.LocationService
+	listener       net.Listener
+	sessions       *sessionStore //在线终端
+}
+
+// 原始报文存档格式（his_data表要求json）
+type NotifyMsg struct {
+	Proto  string      `json:"proto"`
+	IMEI   string      `json:"imei"`
+	Serial uint16      `json:"serial"`
+	Data   interface{} `json:"data"`
+	Hex    string      `json:"hex"`
+}
+
+func newStatus(imei string, p *Packet, data interface{}) *mxm.DeviceStatus1 {
+	raw, _ := json.Marshal(NotifyMsg{
+		Proto:  fmt.Sprintf("%02x", p.Proto),
+		IMEI:   imei,
+		Serial: p.Serial,
+		Data:   data,
+		Hex:    hex.EncodeToString(p.Content),
+	})
+	return &mxm.DeviceStatus1{
+		OriginSN: imei,
+		Type:     _gt06,
+		RawMsg:   raw,
+		Device: &mxm.Device{
+			OriginSN: &imei,
+			Type:     &_gt06,
+		},
+	}
+}
+
+func (h *gt06_Handler) handlePacket(ss *session, p *Packet) {
+	var status *mxm.DeviceStatus1
+	switch p.Proto {
+	case PROTO_LOGIN, PROTO_STATUS: // 登录、心跳，均需应答
+		if err := ss.ack(p); err != nil {
+			slog.Error("gt06 ack failed", "imei", ss.imei, "error", err)
+		}
+		var info *StatusInfo
+		if p.Proto == PROTO_STATUS {
+			var err error
+			if info, err = decodeStatus(p.Content); err != nil {
+				slog.Error("decode status failed", "imei", ss.imei, "error", err)
+				return
+			}
+		}
+		status = newStatus(ss.imei, p, info)
+		handleStatus(status, info)
+	case PROTO_GPS, PROTO_GPS_2: // 定位包无需应答
+		loc, err := decodeLocation(p.Content)
+		if err != nil {
+			slog.Error("decode location failed", "imei", ss.imei, "error", err)
+			return
+		}
+		status = newStatus(ss.imei, p, loc)
+		h.handleLocation(status, loc)
+	case PROTO_ALARM, PROTO_ALARM_2:
+		if err := ss.ack(p); err != nil {
+			slog.Error("gt06 ack failed", "imei", ss.imei, "error", err)
+		}
+		loc, err := decodeAlarm(p.Content)
+		if err != nil {
+			slog.Error("decode alarm failed", "imei", ss.imei, "error", err)
+			return
+		}
+		status = newStatus(ss.imei, p, loc)
+		handleStatus(status, loc.Status)
+		handleAlarm(status, loc.Status.Alarm)
+		h.handleLocation(status, loc)
+	case PROTO_CMD_REPLY, PROTO_CMD_REPLY_EX: // 指令回复，按服务器标志位找到CommandID
+		reply, err := decodeCmdReply(p.Proto, p.Content)
+		if err != nil {
+			slog.Error("decode cmd reply failed", "imei", ss.imei, "error", err)
+			return
+		}
+		commandID, ok := ss.takeCommand(reply.Flag)
+		if !ok {
+			slog.Debug("cmd reply without command", "imei", ss.imei, "flag", reply.Flag)
+			return
+		}
+		status = newStatus(ss.imei, p, reply)
+		status.Device = nil
+		status.Command = &mxm.Command{
+			Result: &mxm.CommandResult{
+				CommandID: commandID,
+				Succeed:   reply.Succeed(),
+				Msg:       reply.Content,
+			},
+		}
+	default:
+		slog.Warn("Unknown gt06 protocol", "proto", fmt.Sprintf("%02x", p.Proto), "imei", ss.imei)
+		return
+	}
+
+	// 调用统一消息处理接口
+	if h.messageHandler == nil {
+		slog.Error("message handler of gt06 is not set")
+		return
+	}
+	if err := h.messageHandler.Process(status); err != nil {
+		slog.Error("Failed to process message", "error", err)
+	}
+}
+
+// 状态信息(心跳、报警包)，info为nil时仅更新通信时间
+func handleStatus(status *mxm.DeviceStatus1, info *StatusInfo) {
+	dev := status.Device
+	now := time.Now()
+	dev.LastOnline = &now
+	if info == nil {
+		return
+	}
+	if info.Voltage >= 0 && info.Voltage < len(voltageLevelPercent) {
+		ele := voltageLevelPercent[info.Voltage]
+		dev.Electricity = &ele
+	}
+	dev.Charging = &info.Charging
+	signal := min(info.Gsm, 4) * 25
+	dev.SimCardSignal = &signal
+}
+
+// 终端报警转为统一报警，由消息处理器入库并推送
+// 低电由消息处理器按电量统一告警，这里不重复；平台无对应类型的报警只记录日志
+var alarmTypes = map[byte]int{
+	ALARM_SOS:       mxm.SOS,
+	ALARM_POWER_CUT: mxm.POWER_OFF,
+}
+
+func handleAlarm(status *mxm.DeviceStatus1, alarm byte) {
+	if alarm == ALARM_NORMAL || alarm == ALARM_LOW_BATTERY {
+		return
+	}
+	tp, ok := alarmTypes[alarm]
+	if !ok {
+		slog.Info("gt06 alarm ignored", "imei", status.OriginSN, "alarm", alarmName(alarm))
+		return
+	}
+	status.Alarms = append(status.Alarms, mxm.Alarm{Time: time.Now(), Type: tp, Msg: alarmName(alarm)})
+}
+
+func (h *gt06_Handler) handleLocation(status *mxm.DeviceStatus1, loc *Location) {
+	dev := status.Device
+	now := time.Now()
+	dev.LastOnline = &now
+	dev.LocTime = &loc.Gps.Time
+	sate := loc.Gps.Satellites
+	dev.Satellites = &sate
+
+	locT := "GPS"
+	if loc.Gps.Positioned {
+		longi, lati := coordtransform.WGS84toGCJ02(loc.Gps.Longitude, loc.Gps.Latitude)
+		dev.Latitude, dev.Longitude = &lati, &longi
+		speed, heading := loc.Gps.Speed, float64(loc.Gps.Course)
+		dev.Speed, dev.Heading = &speed, &heading
+
+		geoRes, err := services.GeocodeWithFallback(h.locS, lati, longi, 2*time.Second)
+		if err != nil {
+			slog.Error("geocode failed", "error", err.Error())
+		} else {
+			dev.Address = &geoRes.Address
+		}
+	} else if loc.Lbs != nil {
+		// 未定位时使用基站定位
+		locT = "LBS"
+		req := services.LocationRequest{
+			CellInfo: []services.CellInfo{{
+				Mcc:    loc.Lbs.Mcc,
+				Mnc:    loc.Lbs.Mnc,
+				Lac:    loc.Lbs.Lac,
+				Cellid: loc.Lbs.CellID,
+			}},
+		}
+		locRes, err := services.LocateWithFallback(h.locS, req, 2*time.Second)
+		if err != nil {
+			slog.Error("lbs locate failed", "error", err.Error())
+		} else if locRes.Location != nil {
+			dev.Address = &locRes.Address
+			dev.Latitude, dev.Longitude = &locRes.Location.Latitude, &locRes.Location.Longitude
+			dev.Accuracy = &locRes.Location.Accuracy
+		}
+	}
+	dev.LocType = &locT
+}
+
+func NewGt06Handler(port int) vendors.VendorDriver {
+	return &gt06_Handler{
+		listenerPort: port,
+		sessions:     &sessionStore{data: make(map[string]*session)},
+		locS:         []services.LocationService{services.NewTxLocationService(), services.NewWzLocationService()},
+	}
+}
+
+func (h *gt06_Handler) SetMessageHandler(handler vendors.MessageHandler) {
+	h.messageHandler = handler
+}
+
+// 厂商自己的启动逻辑
+func (h *gt06_Handler) Start() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", h.listenerPort))
+	if err != nil {
+		return fmt.Errorf("gt06 listen failed: %v", err)
+	}
+	h.listener = ln
+
+	go func() {
+		slog.Info("Starting gt06 driver server:" + ln.Addr().String() + "...")
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("gt06 accept failed:" + err.Error())
+				continue
+			}
+			go h.serveConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+// 关闭侦听并断开所有终端
+func (h *gt06_Handler) Stop() error {
+	if h.listener == nil {
+		return nil
+	}
+	err := h.listener.Close()
+	h.listener = nil
+	h.sessions.closeAll()
+	return err
+}
+
+func (h *gt06_Handler) Activate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+func (h *gt06_Handler) Deactivate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+// 下发在线指令，终端回复(0x15/0x21)时原样带回服务器标志位
+func (h *gt06_Handler) sendCmd(CommandID int64, originSN string, cmd string) error {
+	ss, ok := h.sessions.get(originSN)
+	if !ok {
+		return fmt.Errorf("gt06 device %s is not connected", originSN)
+	}
+	return ss.sendCommand(CommandID, cmd)
+}
+
+// 定位上报间隔，单位秒
+func (h *gt06_Handler) SetReportInterval(CommandID int64, originSN string, interval int) error {
+	return h.sendCmd(CommandID, originSN, fmt.Sprintf("TIMER,%d#", interval))
+}
+
+func (h *gt06_Handler) Locate(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "WHERE#")
+}
+
+func (h *gt06_Handler) Reboot(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "RESET#")
+}
+
+func (h *gt06_Handler) PowerOff(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "SHUTDOWN#")
+}
+
+// gt06无蜂鸣器，不支持寻找设备
+func (h *gt06_Handler) Find(CommandID int64, originSN string) error {
+	return vendors.NewUnsupportedError(_gt06, "FIND")
+}
+
+// 透传在线指令，如 PARAM#
+func (h *gt06_Handler) SendRaw(CommandID int64, originSN string, payload string) error {
+	return h.sendCmd(CommandID, originSN, payload)
+}
+
+// TIMER指令允许10~18000秒
+func (h *gt06_Handler) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities(vendors.ActionSetReportInterval(10, 18000), vendors.ActionLocate,
+		vendors.ActionReboot, vendors.ActionPowerOff)
+}
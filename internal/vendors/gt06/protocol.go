@@ -0,0 +1,341 @@
+package gt06
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// GT06(康凯斯)通讯协议
+// 数据包格式: 起始位(0x7878,长度1字节 | 0x7979,长度2字节) + 包长度 + 协议号 + 信息内容 + 信息序列号 + 错误校验(CRC-ITU) + 停止位(0x0d0a)
+// 包长度 = 协议号 + 信息内容 + 信息序列号 + 错误校验 的字节数, 校验范围为 包长度 至 信息序列号
+
+// 协议号
+const (
+	PROTO_LOGIN        = 0x01 // 登录信息包
+	PROTO_GPS          = 0x12 // 定位数据包(GPS+LBS)
+	PROTO_STATUS       = 0x13 // 心跳包(状态信息)
+	PROTO_CMD_REPLY    = 0x15 // 终端回复服务器指令(字符串)
+	PROTO_ALARM        = 0x16 // 报警数据包(GPS+LBS+状态)
+	PROTO_CMD_REPLY_EX = 0x21 // 终端回复服务器指令(0x7979扩展包)
+	PROTO_GPS_2        = 0x22 // 定位数据包(新版，含ACC)
+	PROTO_ALARM_2      = 0x26 // 报警数据包(新版)
+	PROTO_ONLINE_CMD   = 0x80 // 服务器下发指令
+)
+
+// 报警类型(状态信息中报警/语言的第一个字节)
+const (
+	ALARM_NORMAL      = 0x00
+	ALARM_SOS         = 0x01
+	ALARM_POWER_CUT   = 0x02
+	ALARM_VIBRATION   = 0x03
+	ALARM_FENCE_IN    = 0x04
+	ALARM_FENCE_OUT   = 0x05
+	ALARM_OVER_SPEED  = 0x06
+	ALARM_MOVING      = 0x09
+	ALARM_LOW_BATTERY = 0x0e
+)
+
+var alarmNames = map[byte]string{
+	ALARM_SOS:         "SOS",
+	ALARM_POWER_CUT:   "power cut",
+	ALARM_VIBRATION:   "vibration",
+	ALARM_FENCE_IN:    "enter fence",
+	ALARM_FENCE_OUT:   "exit fence",
+	ALARM_OVER_SPEED:  "over speed",
+	ALARM_MOVING:      "moving",
+	ALARM_LOW_BATTERY: "low battery",
+}
+
+func alarmName(a byte) string {
+	if name, ok := alarmNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%02x)", a)
+}
+
+const (
+	_LANG_ENGLISH = 0x0002
+	_MAX_PKG_LEN  = 1024
+)
+
+// 电压等级(0-6)对应的电量百分比
+var voltageLevelPercent = []int{0, 5, 10, 25, 50, 75, 100}
+
+type Packet struct {
+	Extended bool // 0x7979起始，包长度为2字节
+	Proto    byte
+	Content  []byte
+	Serial   uint16
+}
+
+// crcITU CRC-ITU(CRC-16/X-25)校验
+func crcITU(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+// Encode 组包
+func Encode(p Packet) []byte {
+	length := 1 + len(p.Content) + 4
+	buf := make([]byte, 0, length+7)
+	if p.Extended {
+		buf = append(buf, 0x79, 0x79)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	} else {
+		buf = append(buf, 0x78, 0x78, byte(length))
+	}
+	buf = append(buf, p.Proto)
+	buf = append(buf, p.Content...)
+	buf = binary.BigEndian.AppendUint16(buf, p.Serial)
+	buf = binary.BigEndian.AppendUint16(buf, crcITU(buf[2:]))
+	return append(buf, 0x0d, 0x0a)
+}
+
+// readPacket 读取并校验一个数据包
+func readPacket(r *bufio.Reader) (*Packet, error) {
+	start := make([]byte, 2)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	var lenField []byte
+	switch {
+	case start[0] == 0x78 && start[1] == 0x78:
+		lenField = make([]byte, 1)
+	case start[0] == 0x79 && start[1] == 0x79:
+		lenField = make([]byte, 2)
+	default:
+		return nil, fmt.Errorf("invalid start bits: %s", hex.EncodeToString(start))
+	}
+	if _, err := io.ReadFull(r, lenField); err != nil {
+		return nil, err
+	}
+	length := int(lenField[0])
+	if len(lenField) == 2 {
+		length = int(binary.BigEndian.Uint16(lenField))
+	}
+	if length < 5 || length > _MAX_PKG_LEN {
+		return nil, fmt.Errorf("invalid packet length: %d", length)
+	}
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if data[length] != 0x0d || data[length+1] != 0x0a {
+		return nil, fmt.Errorf("invalid stop bits: %s", hex.EncodeToString(data[length:]))
+	}
+	body := data[:length-2]
+	crc := binary.BigEndian.Uint16(data[length-2 : length])
+	if sum := crcITU(append(lenField, body...)); sum != crc {
+		return nil, fmt.Errorf("crc mismatch: expect %04x, got %04x", sum, crc)
+	}
+	return &Packet{
+		Extended: len(lenField) == 2,
+		Proto:    body[0],
+		Content:  body[1 : len(body)-2],
+		Serial:   binary.BigEndian.Uint16(body[len(body)-2:]),
+	}, nil
+}
+
+// 登录包：终端ID为8字节BCD编码的IMEI
+func decodeLogin(content []byte) (string, error) {
+	if len(content) < 8 {
+		return "", fmt.Errorf("login content too short: %d", len(content))
+	}
+	imei := strings.TrimLeft(hex.EncodeToString(content[:8]), "0")
+	if imei == "" {
+		return "", fmt.Errorf("invalid imei")
+	}
+	return imei, nil
+}
+
+type GpsInfo struct {
+	Time       time.Time `json:"time"`
+	Satellites int       `json:"satellites"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Speed      float64   `json:"speed"`  // km/h
+	Course     int       `json:"course"` // 航向,正北为0
+	Positioned bool      `json:"positioned"`
+}
+
+type LbsInfo struct {
+	Mcc    int `json:"mcc"`
+	Mnc    int `json:"mnc"`
+	Lac    int `json:"lac"`
+	CellID int `json:"cell_id"`
+}
+
+type StatusInfo struct {
+	Defense     bool `json:"defense"`
+	Acc         bool `json:"acc"`
+	Charging    bool `json:"charging"`
+	GpsTracking bool `json:"gps_tracking"`
+	Voltage     int  `json:"voltage"` // 电压等级0-6
+	Gsm         int  `json:"gsm"`     // 信号等级0-4
+	Alarm       byte `json:"alarm"`
+}
+
+// 定位数据包内容
+type Location struct {
+	Gps    *GpsInfo    `json:"gps"`
+	Lbs    *LbsInfo    `json:"lbs,omitempty"`
+	Status *StatusInfo `json:"status,omitempty"`
+}
+
+const (
+	_GPS_LEN = 18
+	_LBS_LEN = 8
+)
+
+// decodeGps 日期时间(6) + 卫星数(1) + 纬度(4) + 经度(4) + 速度(1) + 航向状态(2)
+func decodeGps(b []byte) (*GpsInfo, error) {
+	if len(b) < _GPS_LEN {
+		return nil, fmt.Errorf("gps content too short: %d", len(b))
+	}
+	g := &GpsInfo{
+		Time:       time.Date(2000+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, time.UTC),
+		Satellites: int(b[6] & 0x0f),
+		Latitude:   float64(binary.BigEndian.Uint32(b[7:11])) / 1800000,
+		Longitude:  float64(binary.BigEndian.Uint32(b[11:15])) / 1800000,
+		Speed:      float64(b[15]),
+	}
+	cs := binary.BigEndian.Uint16(b[16:18])
+	g.Course = int(cs & 0x03ff)
+	g.Positioned = cs&0x1000 != 0
+	if cs&0x0400 == 0 { // 南纬
+		g.Latitude = -g.Latitude
+	}
+	if cs&0x0800 != 0 { // 西经
+		g.Longitude = -g.Longitude
+	}
+	return g, nil
+}
+
+// decodeLbs MCC(2) + MNC(1) + LAC(2) + CellID(3)
+func decodeLbs(b []byte) (*LbsInfo, error) {
+	if len(b) < _LBS_LEN {
+		return nil, fmt.Errorf("lbs content too short: %d", len(b))
+	}
+	return &LbsInfo{
+		Mcc:    int(binary.BigEndian.Uint16(b[0:2])),
+		Mnc:    int(b[2]),
+		Lac:    int(binary.BigEndian.Uint16(b[3:5])),
+		CellID: int(b[5])<<16 | int(b[6])<<8 | int(b[7]),
+	}, nil
+}
+
+// decodeStatus 终端信息(1) + 电压等级(1) + GSM信号(1) + 报警/语言(2,可选)
+func decodeStatus(b []byte) (*StatusInfo, error) {
+	if len(b) < 3 {
+		return nil, fmt.Errorf("status content too short: %d", len(b))
+	}
+	s := &StatusInfo{
+		Defense:     b[0]&0x01 != 0,
+		Acc:         b[0]&0x02 != 0,
+		Charging:    b[0]&0x04 != 0,
+		GpsTracking: b[0]&0x40 != 0,
+		Voltage:     int(b[1]),
+		Gsm:         int(b[2]),
+	}
+	if len(b) >= 4 {
+		s.Alarm = b[3]
+	}
+	return s, nil
+}
+
+// decodeLocation 解析0x12/0x22定位包
+func decodeLocation(content []byte) (*Location, error) {
+	gps, err := decodeGps(content)
+	if err != nil {
+		return nil, err
+	}
+	loc := &Location{Gps: gps}
+	if len(content) >= _GPS_LEN+_LBS_LEN {
+		if loc.Lbs, err = decodeLbs(content[_GPS_LEN:]); err != nil {
+			return nil, err
+		}
+	}
+	return loc, nil
+}
+
+// decodeAlarm 解析0x16/0x26报警包，基站信息前有1字节长度
+func decodeAlarm(content []byte) (*Location, error) {
+	gps, err := decodeGps(content)
+	if err != nil {
+		return nil, err
+	}
+	loc := &Location{Gps: gps}
+	if len(content) < _GPS_LEN+1 {
+		return nil, fmt.Errorf("alarm content too short: %d", len(content))
+	}
+	lbsLen := int(content[_GPS_LEN])
+	rest := content[_GPS_LEN+1:]
+	if lbsLen > 0 {
+		if lbsLen-1 > len(rest) {
+			return nil, fmt.Errorf("invalid lbs length: %d", lbsLen)
+		}
+		if loc.Lbs, err = decodeLbs(rest); err != nil {
+			return nil, err
+		}
+		rest = rest[lbsLen-1:]
+	}
+	if loc.Status, err = decodeStatus(rest); err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
+
+// encodeOnlineCmd 服务器下发指令: 指令长度(1) + 服务器标志位(4) + 指令内容(ASCII) + 语言(2)
+func encodeOnlineCmd(flag uint32, cmd string) []byte {
+	buf := make([]byte, 0, 7+len(cmd))
+	buf = append(buf, byte(4+len(cmd)))
+	buf = binary.BigEndian.AppendUint32(buf, flag)
+	buf = append(buf, cmd...)
+	return binary.BigEndian.AppendUint16(buf, _LANG_ENGLISH)
+}
+
+type CmdReply struct {
+	Flag    uint32 `json:"flag"`
+	Content string `json:"content"`
+}
+
+// decodeCmdReply 解析终端对服务器指令的回复(0x15/0x21)
+func decodeCmdReply(proto byte, content []byte) (*CmdReply, error) {
+	if proto == PROTO_CMD_REPLY_EX {
+		// 服务器标志位(4) + 编码(1) + 内容
+		if len(content) < 5 {
+			return nil, fmt.Errorf("cmd reply too short: %d", len(content))
+		}
+		return &CmdReply{Flag: binary.BigEndian.Uint32(content[:4]), Content: string(content[5:])}, nil
+	}
+	// 指令长度(1) + 服务器标志位(4) + 内容 + 语言(2,可选)
+	if len(content) < 5 {
+		return nil, fmt.Errorf("cmd reply too short: %d", len(content))
+	}
+	n := int(content[0])
+	if n < 4 || n+1 > len(content) {
+		return nil, fmt.Errorf("invalid cmd reply length: %d", n)
+	}
+	return &CmdReply{Flag: binary.BigEndian.Uint32(content[1:5]), Content: string(content[5 : n+1])}, nil
+}
+
+// 终端回复内容中无失败字样即认为执行成功
+func (r *CmdReply) Succeed() bool {
+	s := strings.ToUpper(r.Content)
+	return !strings.Contains(s, "FAIL") && !strings.Contains(s, "ERROR")
+}
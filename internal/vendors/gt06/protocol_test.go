@@ -0,0 +1,129 @@
+package gt06
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCrcITU(t *testing.T) {
+	assert.Equal(t, uint16(0x906e), crcITU([]byte("123456789")))
+}
+
+func TestReadPacket_Login(t *testing.T) {
+	// 协议文档中的登录包示例
+	r := bufio.NewReader(bytes.NewReader(mustHex(t, "78780d01012345678901234500018cdd0d0a")))
+	p, err := readPacket(r)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(PROTO_LOGIN), p.Proto)
+	assert.Equal(t, uint16(1), p.Serial)
+
+	imei, err := decodeLogin(p.Content)
+	assert.NoError(t, err)
+	assert.Equal(t, "123456789012345", imei)
+
+	// 服务器应答
+	assert.Equal(t, mustHex(t, "787805010001d9dc0d0a"), Encode(Packet{Proto: PROTO_LOGIN, Serial: 1}))
+}
+
+func TestReadPacket_Gps(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(mustHex(t, "78781f120b081d112e10cc027ac7eb0c46584900148f01cc00287d001fb8000373770d0a")))
+	p, err := readPacket(r)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(PROTO_GPS), p.Proto)
+	assert.Equal(t, uint16(3), p.Serial)
+
+	loc, err := decodeLocation(p.Content)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2011, 8, 29, 17, 46, 16, 0, time.UTC), loc.Gps.Time)
+	assert.Equal(t, 12, loc.Gps.Satellites)
+	assert.InDelta(t, 23.111668, loc.Gps.Latitude, 1e-6)
+	assert.InDelta(t, 114.409285, loc.Gps.Longitude, 1e-6)
+	assert.Equal(t, 143, loc.Gps.Course)
+	assert.True(t, loc.Gps.Positioned)
+	assert.Equal(t, &LbsInfo{Mcc: 460, Mnc: 0, Lac: 0x287d, CellID: 0x1fb8}, loc.Lbs)
+}
+
+func TestReadPacket_BadCrc(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(mustHex(t, "78780d01012345678901234500018cde0d0a")))
+	_, err := readPacket(r)
+	assert.Error(t, err)
+}
+
+func TestEncode_Extended(t *testing.T) {
+	frame := Encode(Packet{Extended: true, Proto: PROTO_CMD_REPLY_EX, Content: append([]byte{0, 0, 0, 9, 1}, "OK"...), Serial: 5})
+	p, err := readPacket(bufio.NewReader(bytes.NewReader(frame)))
+	assert.NoError(t, err)
+	assert.True(t, p.Extended)
+
+	reply, err := decodeCmdReply(p.Proto, p.Content)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(9), reply.Flag)
+	assert.Equal(t, "OK", reply.Content)
+	assert.True(t, reply.Succeed())
+}
+
+func TestOnlineCmdReply(t *testing.T) {
+	content := encodeOnlineCmd(1234, "WHERE#")
+	assert.Equal(t, byte(10), content[0])
+
+	// 终端回复与下发指令格式相同，服务器标志位原样带回
+	reply, err := decodeCmdReply(PROTO_CMD_REPLY, content)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1234), reply.Flag)
+	assert.Equal(t, "WHERE#", reply.Content)
+
+	reply.Content = "Execution failed"
+	assert.False(t, reply.Succeed())
+}
+
+func TestDecodeAlarm(t *testing.T) {
+	content := mustHex(t, "0b081d112e10cc027ac7eb0c46584900148f"+"0901cc00287d001fb8"+"440604"+"0102")
+	loc, err := decodeAlarm(content)
+	assert.NoError(t, err)
+	assert.NotNil(t, loc.Lbs)
+	assert.Equal(t, 460, loc.Lbs.Mcc)
+	assert.True(t, loc.Status.GpsTracking)
+	assert.Equal(t, 6, loc.Status.Voltage)
+	assert.Equal(t, 4, loc.Status.Gsm)
+	assert.Equal(t, byte(ALARM_SOS), loc.Status.Alarm)
+}
+
+func TestHandleAlarm(t *testing.T) {
+	status := &mxm.DeviceStatus1{OriginSN: "868120145233604"}
+	handleAlarm(status, ALARM_SOS)
+	handleAlarm(status, ALARM_LOW_BATTERY) // 由电量统一告警
+	handleAlarm(status, ALARM_VIBRATION)
+	assert.Len(t, status.Alarms, 1)
+	assert.Equal(t, mxm.SOS, status.Alarms[0].Type)
+}
+
+func TestSessionCommandFlag(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+
+	// 超过32位的CommandID按会话内的标志位对应
+	ss := &session{conn: server, imei: "868120145233604"}
+	assert.NoError(t, ss.sendCommand(1<<33+5, "WHERE#"))
+	commandID, ok := ss.takeCommand(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1<<33+5), commandID)
+	_, ok = ss.takeCommand(1)
+	assert.False(t, ok)
+}
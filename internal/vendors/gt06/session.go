@@ -0,0 +1,153 @@
+package gt06
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// 终端无数据的最长等待时间，超过则断开连接(心跳一般为3分钟)
+const _READ_TIMEOUT = 10 * time.Minute
+
+// 单个终端的tcp会话
+type session struct {
+	conn     net.Conn
+	imei     string
+	serial   uint16           //平台流水号
+	flag     uint32           //服务器标志位
+	commands map[uint32]int64 //服务器标志位到CommandID，终端回复时据此回传指令结果
+	mu       sync.Mutex
+}
+
+func (s *session) nextSerial() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serial++
+	return s.serial
+}
+
+func (s *session) send(p Packet) error {
+	frame := Encode(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.conn.Write(frame); err != nil {
+		return fmt.Errorf("write %02x to %s failed: %v", p.Proto, s.imei, err)
+	}
+	return nil
+}
+
+// sendCommand 以会话内自增的服务器标志位下发在线指令，并记下标志位对应的CommandID
+// 标志位只有32位，CommandID不能直接用作标志位
+func (s *session) sendCommand(commandID int64, cmd string) error {
+	s.mu.Lock()
+	s.flag++
+	flag := s.flag
+	if s.commands == nil {
+		s.commands = make(map[uint32]int64)
+	}
+	s.commands[flag] = commandID
+	s.mu.Unlock()
+	if err := s.send(Packet{Proto: PROTO_ONLINE_CMD, Content: encodeOnlineCmd(flag, cmd), Serial: s.nextSerial()}); err != nil {
+		s.takeCommand(flag)
+		return err
+	}
+	return nil
+}
+
+// takeCommand 取出回复标志位对应的CommandID，不是本会话下发的指令时返回false
+func (s *session) takeCommand(flag uint32) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	commandID, ok := s.commands[flag]
+	delete(s.commands, flag)
+	return commandID, ok
+}
+
+// ack 服务器应答，协议号与序列号同终端上报包
+func (s *session) ack(p *Packet) error {
+	return s.send(Packet{Proto: p.Proto, Serial: p.Serial})
+}
+
+// 在线终端表
+type sessionStore struct {
+	sync.RWMutex
+	data map[string]*session
+}
+
+func (s *sessionStore) get(imei string) (*session, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	ss, ok := s.data[imei]
+	return ss, ok
+}
+
+func (s *sessionStore) put(ss *session) {
+	s.Lock()
+	defer s.Unlock()
+	if old, ok := s.data[ss.imei]; ok && old != ss {
+		old.conn.Close() //同一终端重连，关闭旧连接
+	}
+	s.data[ss.imei] = ss
+}
+
+func (s *sessionStore) remove(ss *session) {
+	s.Lock()
+	defer s.Unlock()
+	if cur, ok := s.data[ss.imei]; ok && cur == ss {
+		delete(s.data, ss.imei)
+	}
+}
+
+// closeAll 断开所有终端，驱动停止时调用
+func (s *sessionStore) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+	for k, ss := range s.data {
+		ss.conn.Close()
+		delete(s.data, k)
+	}
+}
+
+func (h *gt06_Handler) serveConn(conn net.Conn) {
+	ss := &session{conn: conn}
+	defer func() {
+		conn.Close()
+		if ss.imei != "" {
+			h.sessions.remove(ss)
+			slog.Info("gt06 terminal disconnected", "imei", ss.imei)
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(_READ_TIMEOUT))
+		p, err := readPacket(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("gt06 read packet failed", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return // 协议无转义，出错后无法重新定位包头，直接断开由终端重连
+		}
+		if p.Proto == PROTO_LOGIN {
+			imei, err := decodeLogin(p.Content)
+			if err != nil {
+				slog.Warn("gt06 decode login failed", "remote", conn.RemoteAddr().String(), "error", err)
+				return
+			}
+			ss.imei = imei
+			h.sessions.put(ss)
+			slog.Info("gt06 terminal login", "imei", imei, "remote", conn.RemoteAddr().String())
+		} else if ss.imei == "" {
+			slog.Warn("gt06 packet before login", "remote", conn.RemoteAddr().String(), "proto", fmt.Sprintf("%02x", p.Proto))
+			return
+		}
+
+		h.handlePacket(ss, p)
+	}
+}
@@ -0,0 +1,129 @@
+package httppush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTP推送类厂商(设备数据由厂商平台推送，指令调用厂商平台接口下发)的公共部分
+
+const (
+	_MAX_BODY = 1024 * 1024
+	_API_KEY  = "X-Api-Key"
+)
+
+// Config 需与config.HttpPushConfig保持一致
+type Config struct {
+	ListenPort int    `json:"listen_port"` // 接收厂商平台推送的端口
+	ApiUrl     string `json:"api_url"`     // 厂商平台指令接口地址
+	ApiKey     string `json:"api_key"`     // 调用厂商接口的密钥，厂商推送时也需携带
+}
+
+// Server 接收厂商平台推送
+type Server struct {
+	name   string
+	cfg    Config
+	handle func(body []byte) error
+	server *http.Server
+	client *http.Client
+}
+
+// NewServer handle收到推送内容后调用，返回错误时应答400，厂商平台会重推
+func NewServer(name string, cfg Config, handle func(body []byte) error) *Server {
+	return &Server{
+		name:   name,
+		cfg:    cfg,
+		handle: handle,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cfg.ApiKey != "" && r.Header.Get(_API_KEY) != s.cfg.ApiKey {
+		slog.Warn(s.name+" push with invalid api key", "remote", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, _MAX_BODY))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := s.handle(body); err != nil {
+		slog.Warn(s.name+" handle push failed", "error", err, "body", string(body))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Start 侦听推送端口
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", s.cfg.ListenPort))
+	if err != nil {
+		return fmt.Errorf("%s listen failed: %v", s.name, err)
+	}
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("Starting " + s.name + " driver push server:" + ln.Addr().String() + "...")
+		if err := s.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(s.name + " push server failed:" + err.Error())
+		}
+	}()
+	return nil
+}
+
+// Stop 关闭推送端口
+func (s *Server) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.Close()
+	s.server = nil
+	return err
+}
+
+// Post 调用厂商平台接口，返回应答内容
+func (s *Server) Post(path string, req interface{}) ([]byte, error) {
+	if s.cfg.ApiUrl == "" {
+		return nil, fmt.Errorf("%s api_url is not configured", s.name)
+	}
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, s.cfg.ApiUrl+path, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(_API_KEY, s.cfg.ApiKey)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%s api request failed: %v", s.name, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, _MAX_BODY))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s api failed, status code: %d, body: %s", s.name, resp.StatusCode, body)
+	}
+	return body, nil
+}
@@ -0,0 +1,342 @@
+package mqttjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Daneel-Li/gps-back/internal/config"
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/services"
+
+	"github.com/qichengzx/coordtransform"
+)
+
+// 坐标系
+const (
+	COORD_WGS84 = "wgs84"
+	COORD_GCJ02 = "gcj02"
+	COORD_BD09  = "bd09"
+)
+
+// 允许映射的设备字段(Device的json名)
+var mappableFields = []string{
+	"electricity", "charging", "interval", "sim_card_signal", "steps",
+	"address", "longitude", "latitude", "altitude", "satellites", "loc_type", "loc_time",
+	"accuracy", "speed", "heading", "ignition", "battery_voltage", "odometer", "last_online",
+}
+
+// Message mqtt原始消息，作为DeviceStatusFactory的输入
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// statusFactory 按配置将json报文转换为统一的DeviceStatus1，实现btt.DeviceStatusFactory
+type statusFactory struct {
+	cfg        config.MqttJsonConfig
+	fieldIndex map[string]int // Device的json名 -> 字段下标
+	locS       []services.LocationService
+}
+
+func newStatusFactory(cfg config.MqttJsonConfig) (*statusFactory, error) {
+	if cfg.Type == "" || len(cfg.Type) > 12 {
+		return nil, fmt.Errorf("invalid type: %q", cfg.Type)
+	}
+	if !strings.Contains(cfg.ReportTopic, "{sn}") {
+		return nil, fmt.Errorf("%s report_topic must contain {sn}", cfg.Type)
+	}
+	switch strings.ToLower(cfg.CoordSystem) {
+	case "", COORD_WGS84, COORD_GCJ02, COORD_BD09:
+	default:
+		return nil, fmt.Errorf("%s unknown coord_system: %s", cfg.Type, cfg.CoordSystem)
+	}
+
+	tags := make(map[string]int)
+	t := reflect.TypeOf(mxm.Device{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		tags[tag] = i
+	}
+	index := make(map[string]int)
+	for _, name := range mappableFields {
+		index[name] = tags[name]
+	}
+	for name := range cfg.Fields {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("%s field %s can not be mapped", cfg.Type, name)
+		}
+	}
+	return &statusFactory{
+		cfg:        cfg,
+		fieldIndex: index,
+		locS:       []services.LocationService{services.NewTxLocationService(), services.NewWzLocationService()},
+	}, nil
+}
+
+// lookup 按点分路径取值，数组使用下标，如 data.gnss.0.lat
+func lookup(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return nil, false
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, v != nil
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch val := v.(type) {
+	case float64:
+		return val, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(val), 64)
+	case bool:
+		if val {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("not a number: %v", v)
+}
+
+func toInt64(v interface{}) (int64, error) {
+	if s, ok := v.(string); ok {
+		return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	}
+	f, err := toFloat(v)
+	return int64(f), err
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch val := v.(type) {
+	case bool:
+		return val, nil
+	case float64:
+		return val != 0, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "1", "true", "on", "yes":
+			return true, nil
+		case "0", "false", "off", "no":
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("not a bool: %v", v)
+}
+
+// toTime 支持unix秒/毫秒及常见时间格式
+func toTime(v interface{}) (time.Time, error) {
+	if s, ok := v.(string); ok {
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+				if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+					return t, nil
+				}
+			}
+			return time.Time{}, fmt.Errorf("invalid time: %s", s)
+		}
+	}
+	n, err := toInt64(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if n > 1e12 { // 毫秒
+		return time.UnixMilli(n), nil
+	}
+	return time.Unix(n, 0), nil
+}
+
+// setField 将json值转换后写入Device对应的指针字段
+func (f *statusFactory) setField(dev *mxm.Device, name string, v interface{}) error {
+	field := reflect.ValueOf(dev).Elem().Field(f.fieldIndex[name])
+	scale, scaled := f.cfg.Scales[name]
+	switch field.Type().Elem().Kind() {
+	case reflect.Float64:
+		n, err := toFloat(v)
+		if err != nil {
+			return err
+		}
+		if scaled {
+			n *= scale
+		}
+		field.Set(reflect.ValueOf(&n))
+	case reflect.Int:
+		n, err := toFloat(v)
+		if err != nil {
+			return err
+		}
+		if scaled {
+			n *= scale
+		}
+		i := int(math.Round(n))
+		field.Set(reflect.ValueOf(&i))
+	case reflect.Bool:
+		b, err := toBool(v)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(&b))
+	case reflect.String:
+		s := fmt.Sprint(v)
+		field.Set(reflect.ValueOf(&s))
+	case reflect.Struct: // time.Time
+		t, err := toTime(v)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(&t))
+	default:
+		return fmt.Errorf("unsupported field type: %s", field.Type())
+	}
+	return nil
+}
+
+// snFromTopic 按topic模板提取设备号
+func snFromTopic(pattern, topic string) string {
+	prefix, suffix, _ := strings.Cut(pattern, "{sn}")
+	if !strings.HasPrefix(topic, prefix) || !strings.HasSuffix(topic, suffix) ||
+		len(topic) <= len(prefix)+len(suffix) {
+		return ""
+	}
+	return topic[len(prefix) : len(topic)-len(suffix)]
+}
+
+func (f *statusFactory) CreateDeviceStatus(m interface{}) (*mxm.DeviceStatus1, error) {
+	msg, ok := m.(*Message)
+	if !ok || msg == nil {
+		return nil, fmt.Errorf("invalid param:%v", m)
+	}
+	var payload interface{}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("invalid json payload: %v", err)
+	}
+
+	sn := snFromTopic(f.cfg.ReportTopic, msg.Topic)
+	if v, ok := lookup(payload, f.cfg.SNField); ok {
+		sn = fmt.Sprint(v)
+	}
+	if sn == "" {
+		return nil, fmt.Errorf("can not get sn from topic %s", msg.Topic)
+	}
+
+	res := &mxm.DeviceStatus1{
+		OriginSN: sn,
+		Type:     f.cfg.Type,
+		RawMsg:   msg.Payload,
+	}
+
+	// 指令应答
+	if cmd, ok := f.commandResult(payload); ok {
+		res.Command = cmd
+		return res, nil
+	}
+
+	dev, err := f.toDevice(sn, payload)
+	if err != nil {
+		return nil, err
+	}
+	res.Device = dev
+	return res, nil
+}
+
+// commandResult 配置了result_field时以其是否存在判断应答，否则以message_id_field判断
+func (f *statusFactory) commandResult(payload interface{}) (*mxm.Command, bool) {
+	idVal, ok := lookup(payload, f.cfg.MessageIDField)
+	if !ok {
+		return nil, false
+	}
+	succeed := true
+	msg := ""
+	if f.cfg.ResultField != "" {
+		result, ok := lookup(payload, f.cfg.ResultField)
+		if !ok {
+			return nil, false
+		}
+		msg = fmt.Sprint(result)
+		succeed = msg == f.cfg.ResultSuccess
+	}
+	id, err := toInt64(idVal)
+	if err != nil {
+		slog.Warn("invalid message id", "type", f.cfg.Type, "value", idVal)
+		return nil, false
+	}
+	return &mxm.Command{
+		Result: &mxm.CommandResult{
+			CommandID: id,
+			Succeed:   succeed,
+			Msg:       msg,
+		},
+	}, true
+}
+
+func (f *statusFactory) toDevice(sn string, payload interface{}) (*mxm.Device, error) {
+	typ := f.cfg.Type
+	dev := &mxm.Device{
+		OriginSN: &sn,
+		Type:     &typ,
+	}
+	for name, path := range f.cfg.Fields {
+		v, ok := lookup(payload, path)
+		if !ok {
+			continue
+		}
+		if err := f.setField(dev, name, v); err != nil {
+			return nil, fmt.Errorf("field %s(%s): %v", name, path, err)
+		}
+	}
+	if dev.LastOnline == nil {
+		now := time.Now()
+		dev.LastOnline = &now
+	}
+
+	if dev.Latitude == nil || dev.Longitude == nil || (*dev.Latitude == 0 && *dev.Longitude == 0) {
+		return dev, nil
+	}
+	// 统一转换为GCJ02
+	var longi, lati float64
+	switch strings.ToLower(f.cfg.CoordSystem) {
+	case COORD_GCJ02:
+		longi, lati = *dev.Longitude, *dev.Latitude
+	case COORD_BD09:
+		longi, lati = coordtransform.BD09toGCJ02(*dev.Longitude, *dev.Latitude)
+	default:
+		longi, lati = coordtransform.WGS84toGCJ02(*dev.Longitude, *dev.Latitude)
+	}
+	dev.Latitude, dev.Longitude = &lati, &longi
+	if dev.LocType == nil {
+		locT := "GPS"
+		dev.LocType = &locT
+	}
+	if dev.LocTime == nil {
+		dev.LocTime = dev.LastOnline
+	}
+	if dev.Address == nil {
+		geoRes, err := services.GeocodeWithFallback(f.locS, lati, longi, 2*time.Second)
+		if err != nil {
+			slog.Error("geocode failed", "error", err.Error())
+		} else {
+			dev.Address = &geoRes.Address
+		}
+	}
+	return dev, nil
+}
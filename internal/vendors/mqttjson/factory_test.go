@@ -0,0 +1,150 @@
+package mqttjson
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Daneel-Li/gps-back/internal/config"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConfig() config.MqttJsonConfig {
+	return config.MqttJsonConfig{
+		Type:           "acme",
+		ReportTopic:    "acme/{sn}/up",
+		CommandTopic:   "acme/{sn}/down",
+		MessageIDField: "msgId",
+		ResultField:    "code",
+		ResultSuccess:  "0",
+		CoordSystem:    "gcj02",
+		Fields: map[string]string{
+			"latitude":        "gps.0.lat",
+			"longitude":       "gps.0.lng",
+			"electricity":     "bat",
+			"charging":        "chg",
+			"loc_time":        "ts",
+			"address":         "addr",
+			"battery_voltage": "vol",
+		},
+		Scales: map[string]float64{"battery_voltage": 0.001},
+		Commands: map[string]string{
+			"LOCATE":             `{"msgId":{{.MessageID}},"cmd":"locate"}`,
+			"SET_REPORTINTERVAL": `{"msgId":{{.MessageID}},"interval":{{.Interval}}}`,
+		},
+	}
+}
+
+func TestLookup(t *testing.T) {
+	var payload interface{} = map[string]interface{}{
+		"a": map[string]interface{}{"b": []interface{}{1.0, "x"}},
+	}
+	v, ok := lookup(payload, "a.b.1")
+	assert.True(t, ok)
+	assert.Equal(t, "x", v)
+
+	_, ok = lookup(payload, "a.b.2")
+	assert.False(t, ok)
+	_, ok = lookup(payload, "a.c")
+	assert.False(t, ok)
+	_, ok = lookup(payload, "")
+	assert.False(t, ok)
+}
+
+func TestSnFromTopic(t *testing.T) {
+	assert.Equal(t, "123", snFromTopic("acme/{sn}/up", "acme/123/up"))
+	assert.Equal(t, "", snFromTopic("acme/{sn}/up", "acme/123/down"))
+	assert.Equal(t, "", snFromTopic("acme/{sn}/up", "acme//up"))
+	assert.Equal(t, "abc", snFromTopic("dev/{sn}", "dev/abc"))
+}
+
+func TestCreateDeviceStatus_Report(t *testing.T) {
+	f, err := newStatusFactory(testConfig())
+	assert.NoError(t, err)
+
+	payload := `{"gps":[{"lat":"22.5","lng":114.1}],"bat":76.4,"chg":1,"ts":1700000000,"addr":"深圳","vol":3950}`
+	status, err := f.CreateDeviceStatus(&Message{Topic: "acme/SN01/up", Payload: []byte(payload)})
+	assert.NoError(t, err)
+	assert.Equal(t, "SN01", status.OriginSN)
+	assert.Equal(t, "acme", status.Type)
+	assert.Nil(t, status.Command)
+
+	dev := status.Device
+	assert.Equal(t, 22.5, *dev.Latitude) // gcj02无需转换
+	assert.Equal(t, 114.1, *dev.Longitude)
+	assert.Equal(t, 76, *dev.Electricity)
+	assert.True(t, *dev.Charging)
+	assert.Equal(t, time.Unix(1700000000, 0), *dev.LocTime)
+	assert.Equal(t, "深圳", *dev.Address)
+	assert.Equal(t, "GPS", *dev.LocType)
+	assert.InDelta(t, 3.95, *dev.BatteryVoltage, 1e-9)
+	assert.NotNil(t, dev.LastOnline)
+}
+
+func TestCreateDeviceStatus_CommandResult(t *testing.T) {
+	f, err := newStatusFactory(testConfig())
+	assert.NoError(t, err)
+
+	status, err := f.CreateDeviceStatus(&Message{Topic: "acme/SN01/up", Payload: []byte(`{"msgId":"42","code":0}`)})
+	assert.NoError(t, err)
+	assert.Nil(t, status.Device)
+	assert.Equal(t, int64(42), status.Command.Result.CommandID)
+	assert.True(t, status.Command.Result.Succeed)
+
+	status, err = f.CreateDeviceStatus(&Message{Topic: "acme/SN01/up", Payload: []byte(`{"msgId":43,"code":2}`)})
+	assert.NoError(t, err)
+	assert.False(t, status.Command.Result.Succeed)
+
+	// 仅带消息id、无结果字段的上报不视为应答
+	status, err = f.CreateDeviceStatus(&Message{Topic: "acme/SN01/up", Payload: []byte(`{"msgId":44,"bat":50}`)})
+	assert.NoError(t, err)
+	assert.Nil(t, status.Command)
+	assert.Equal(t, 50, *status.Device.Electricity)
+}
+
+func TestCreateDeviceStatus_Invalid(t *testing.T) {
+	f, err := newStatusFactory(testConfig())
+	assert.NoError(t, err)
+
+	_, err = f.CreateDeviceStatus(&Message{Topic: "acme/SN01/up", Payload: []byte(`not json`)})
+	assert.Error(t, err)
+	_, err = f.CreateDeviceStatus(&Message{Topic: "other/SN01", Payload: []byte(`{}`)})
+	assert.Error(t, err)
+	_, err = f.CreateDeviceStatus(&Message{Topic: "acme/SN01/up", Payload: []byte(`{"bat":"full"}`)})
+	assert.Error(t, err)
+}
+
+func TestNewStatusFactory_InvalidConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.Fields = map[string]string{"user_id": "uid"}
+	_, err := newStatusFactory(cfg)
+	assert.Error(t, err)
+
+	cfg = testConfig()
+	cfg.ReportTopic = "acme/up"
+	_, err = newStatusFactory(cfg)
+	assert.Error(t, err)
+
+	cfg = testConfig()
+	cfg.CoordSystem = "utm"
+	_, err = newStatusFactory(cfg)
+	assert.Error(t, err)
+}
+
+func TestPublish_Unsupported(t *testing.T) {
+	h, err := NewMqttJsonHandler(testConfig(), config.MqttConfig{}, nil)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, h.Reboot(1, "SN01"), vendors.ErrUnsupportedCommand)
+
+	caps := h.Capabilities()
+	assert.Len(t, caps.Actions, 2)
+	_, ok := caps.Action(vendors.ACTION_LOCATE)
+	assert.True(t, ok)
+	_, ok = caps.Action(vendors.ACTION_REBOOT)
+	assert.False(t, ok)
+
+	cfg := testConfig()
+	cfg.Commands = map[string]string{"SELF_DESTRUCT": "{}"}
+	_, err = NewMqttJsonHandler(cfg, config.MqttConfig{}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,296 @@
+package mqttjson
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/Daneel-Li/gps-back/internal/config"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+	"github.com/Daneel-Li/gps-back/internal/vendors/btt"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//通用mqtt-json驱动，topic、字段映射、坐标系、指令模板均来自配置，接入白牌mqtt设备无需编写代码
+//
+//配置示例:
+//	{
+//	    "type": "acme",
+//	    "report_topic": "acme/{sn}/up",
+//	    "command_topic": "acme/{sn}/down",
+//	    "message_id_field": "msgId",
+//	    "result_field": "code",
+//	    "result_success": "0",
+//	    "coord_system": "wgs84",
+//	    "fields": {"latitude": "gps.lat", "longitude": "gps.lng", "electricity": "bat", "loc_time": "ts"},
+//	    "commands": {"LOCATE": "{\"msgId\":{{.MessageID}},\"cmd\":\"locate\"}"}
+//	}
+//
+//指令模板为text/template，可用变量: .MessageID .SN .Interval(仅SET_REPORTINTERVAL)
+
+// CmdArgs 指令模板参数
+type CmdArgs struct {
+	MessageID int64
+	SN        string
+	Interval  int
+}
+
+// 实现VendorDriver接口
+type MqttJsonHandler struct {
+	unifiedFunc vendors.MessageHandler
+	cfg         config.MqttJsonConfig
+	mqttCfg     config.MqttConfig
+	provider    btt.TopicProvider
+	mqClient    mqtt.Client
+	factory     btt.DeviceStatusFactory
+	commands    map[string]*template.Template
+	caps        vendors.Capabilities
+	mu          sync.Mutex
+	connErr     error //最近一次断线原因
+}
+
+// NewMqttJsonHandler mqttCfg为该驱动使用的mqtt连接参数，配置有误时返回错误
+func NewMqttJsonHandler(cfg config.MqttJsonConfig, mqttCfg config.MqttConfig, provider btt.TopicProvider) (*MqttJsonHandler, error) {
+	factory, err := newStatusFactory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Commands) > 0 && !strings.Contains(cfg.CommandTopic, "{sn}") {
+		return nil, fmt.Errorf("%s command_topic must contain {sn}", cfg.Type)
+	}
+	interval := cfg.IntervalRange
+	if interval == [2]int{} {
+		interval = [2]int{10, 3600}
+	}
+	specs := map[string]vendors.ActionSpec{
+		vendors.ACTION_SET_REPORTINTERVAL: vendors.ActionSetReportInterval(interval[0], interval[1]),
+		vendors.ACTION_LOCATE:             vendors.ActionLocate,
+		vendors.ACTION_REBOOT:             vendors.ActionReboot,
+		vendors.ACTION_POWER_OFF:          vendors.ActionPowerOff,
+		vendors.ACTION_FIND:               vendors.ActionFind,
+	}
+	commands := make(map[string]*template.Template)
+	var actions []vendors.ActionSpec
+	for action, text := range cfg.Commands {
+		spec, ok := specs[action]
+		if !ok {
+			return nil, fmt.Errorf("%s unknown command: %s", cfg.Type, action)
+		}
+		tpl, err := template.New(action).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s command %s: %v", cfg.Type, action, err)
+		}
+		commands[action] = tpl
+		actions = append(actions, spec)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Action < actions[j].Action })
+	return &MqttJsonHandler{
+		cfg:      cfg,
+		mqttCfg:  mqttCfg,
+		provider: provider,
+		factory:  factory,
+		commands: commands,
+		caps:     vendors.NewCapabilities(actions...),
+	}, nil
+}
+
+func (h *MqttJsonHandler) SetMessageHandler(handler vendors.MessageHandler) {
+	h.unifiedFunc = handler
+}
+
+// 启动mqtt客户端并订阅已分配设备的上报topic
+func (h *MqttJsonHandler) Start() error {
+	opts, err := btt.NewClientOptions(btt.MqttConfig(h.mqttCfg))
+	if err != nil {
+		return fmt.Errorf("%s mqtt config: %v", h.cfg.Type, err)
+	}
+	opts.SetDefaultPublishHandler(h.messageCallback)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		h.setConnErr(nil)
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		slog.Warn(h.cfg.Type + " mqtt client disconnected. trying to reconnect...")
+		h.setConnErr(err)
+	})
+	cli := mqtt.NewClient(opts)
+	if err := btt.Connect(cli); err != nil {
+		return fmt.Errorf("%s mqtt client failed: %v", h.cfg.Type, err)
+	}
+	h.mu.Lock()
+	h.mqClient = cli
+	h.mu.Unlock()
+
+	devs, err := h.provider.GetSubscriptionList()
+	if err != nil {
+		return fmt.Errorf("get device list failed: %v", err)
+	}
+	return h.subscribe(devs)
+}
+
+// 断开mqtt连接
+func (h *MqttJsonHandler) Stop() error {
+	h.mu.Lock()
+	cli := h.mqClient
+	h.mqClient = nil
+	h.mu.Unlock()
+	if cli != nil {
+		cli.Disconnect(250)
+	}
+	return nil
+}
+
+func (h *MqttJsonHandler) client() mqtt.Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.mqClient
+}
+
+func (h *MqttJsonHandler) setConnErr(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connErr = err
+}
+
+// Health mqtt断线时返回断线原因，自动重连成功后恢复
+func (h *MqttJsonHandler) Health() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.mqClient == nil {
+		return errors.New("mqtt client not started")
+	}
+	if h.mqClient.IsConnectionOpen() {
+		return nil
+	}
+	if h.connErr != nil {
+		return fmt.Errorf("mqtt disconnected: %v", h.connErr)
+	}
+	return errors.New("mqtt not connected")
+}
+
+func topicOf(pattern, sn string) string {
+	return strings.ReplaceAll(pattern, "{sn}", sn)
+}
+
+func (h *MqttJsonHandler) subscribe(devs []string) error {
+	if len(devs) == 0 {
+		return nil
+	}
+	cli := h.client()
+	if cli == nil {
+		return errors.New("mq client is invalid")
+	}
+	m := make(map[string]byte)
+	for _, sn := range devs {
+		m[topicOf(h.cfg.ReportTopic, sn)] = btt.MqttConfig(h.mqttCfg).UpQoS()
+	}
+	if err := btt.WaitToken(cli.SubscribeMultiple(m, nil)); err != nil {
+		return fmt.Errorf("subscribe failed: %v", err)
+	}
+	return nil
+}
+
+func (h *MqttJsonHandler) messageCallback(_ mqtt.Client, m mqtt.Message) {
+	go func() {
+		topic, payload := m.Topic(), m.Payload()
+		slog.Debug(h.cfg.Type+" received message", "topic", topic, "msg", payload)
+
+		status, err := h.factory.CreateDeviceStatus(&Message{Topic: topic, Payload: payload})
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s factory failed to create device status: %s", h.cfg.Type, err.Error()), "payload", string(payload))
+			return
+		}
+		if h.unifiedFunc == nil {
+			slog.Error("message handler of " + h.cfg.Type + " is not set")
+			return
+		}
+		if err := h.unifiedFunc.Process(status); err != nil {
+			slog.Error("Failed to process message", "error", err)
+		}
+	}()
+}
+
+// publish 按模板生成指令并下发，未配置模板的指令返回不支持
+func (h *MqttJsonHandler) publish(action string, args CmdArgs) error {
+	tpl, ok := h.commands[action]
+	if !ok {
+		return vendors.NewUnsupportedError(h.cfg.Type, action)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, args); err != nil {
+		return fmt.Errorf("render %s command failed: %v", action, err)
+	}
+	cli := h.client()
+	if cli == nil {
+		return errors.New("mq client is invalid")
+	}
+	if token := cli.Publish(topicOf(h.cfg.CommandTopic, args.SN), btt.MqttConfig(h.mqttCfg).DownQoS(), false, buf.Bytes()); token.Error() != nil {
+		return fmt.Errorf("publish failed: %v", token.Error())
+	}
+	return nil
+}
+
+func (h *MqttJsonHandler) SetReportInterval(CommandID int64, deviceSN string, interval int) error {
+	return h.publish("SET_REPORTINTERVAL", CmdArgs{MessageID: CommandID, SN: deviceSN, Interval: interval})
+}
+
+func (h *MqttJsonHandler) Locate(CommandID int64, deviceSN string) error {
+	return h.publish("LOCATE", CmdArgs{MessageID: CommandID, SN: deviceSN})
+}
+
+func (h *MqttJsonHandler) Reboot(CommandID int64, deviceSN string) error {
+	return h.publish("REBOOT", CmdArgs{MessageID: CommandID, SN: deviceSN})
+}
+
+func (h *MqttJsonHandler) PowerOff(CommandID int64, deviceSN string) error {
+	return h.publish("POWER_OFF", CmdArgs{MessageID: CommandID, SN: deviceSN})
+}
+
+func (h *MqttJsonHandler) Find(CommandID int64, deviceSN string) error {
+	return h.publish("FIND", CmdArgs{MessageID: CommandID, SN: deviceSN})
+}
+
+// SendRaw 透传原始payload到指令topic，payload同样按模板渲染，可引用{{.MessageID}}
+func (h *MqttJsonHandler) SendRaw(CommandID int64, deviceSN string, payload string) error {
+	tpl, err := template.New(vendors.ACTION_RAW).Parse(payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", vendors.ErrInvalidArgument, err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, CmdArgs{MessageID: CommandID, SN: deviceSN}); err != nil {
+		return fmt.Errorf("%w: %v", vendors.ErrInvalidArgument, err)
+	}
+	cli := h.client()
+	if cli == nil {
+		return errors.New("mq client is invalid")
+	}
+	if token := cli.Publish(topicOf(h.cfg.CommandTopic, deviceSN), btt.MqttConfig(h.mqttCfg).DownQoS(), false, buf.Bytes()); token.Error() != nil {
+		return fmt.Errorf("publish failed: %v", token.Error())
+	}
+	return nil
+}
+
+func (h *MqttJsonHandler) Activate(deviceSN string) error {
+	return h.subscribe([]string{deviceSN})
+}
+
+func (h *MqttJsonHandler) Deactivate(deviceSN string) error {
+	cli := h.client()
+	if cli == nil {
+		return errors.New("mq client is invalid")
+	}
+	if err := btt.WaitToken(cli.Unsubscribe(topicOf(h.cfg.ReportTopic, deviceSN))); err != nil {
+		return fmt.Errorf("unsubscribe failed: %v", err)
+	}
+	return nil
+}
+
+// 支持配置了模板的指令
+func (h *MqttJsonHandler) Capabilities() vendors.Capabilities {
+	return h.caps
+}
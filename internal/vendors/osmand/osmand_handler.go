@@ -0,0 +1,355 @@
+package osmand
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/services"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+
+	"github.com/qichengzx/coordtransform"
+)
+
+//osmand驱动，接收OsmAnd/Traccar Client等手机定位应用的http上报
+//手机应用只上报不接收指令，所有指令均返回不支持
+
+var _osmand = "osmand"
+
+const (
+	_KNOTS_TO_KMH = 1.852
+	_MPS_TO_KMH   = 3.6
+	_MAX_BODY     = 64 * 1024
+)
+
+type osmand_Handler struct {
+	listenerPort   int                    //监听端口
+	messageHandler vendors.MessageHandler //统一消息处理接口
+	locS           []services.LocationService
+	server         *http.Server
+}
+
+// 统一后的上报内容，同时作为原始报文存档（his_data表要求json）
+type Report struct {
+	ID        string    `json:"id"`
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lon"`
+	Time      time.Time `json:"timestamp"`
+	Speed     *float64  `json:"speed,omitempty"` // km/h
+	Bearing   *float64  `json:"bearing,omitempty"`
+	Altitude  *float64  `json:"altitude,omitempty"`
+	Accuracy  *float64  `json:"accuracy,omitempty"`
+	Battery   *int      `json:"batt,omitempty"`
+	Charging  *bool     `json:"charge,omitempty"`
+}
+
+// Traccar Client(新版)以json上报
+type jsonReport struct {
+	DeviceID string `json:"device_id"`
+	Location struct {
+		Timestamp string `json:"timestamp"`
+		Coords    struct {
+			Latitude  float64  `json:"latitude"`
+			Longitude float64  `json:"longitude"`
+			Accuracy  *float64 `json:"accuracy"`
+			Speed     *float64 `json:"speed"` // m/s
+			Heading   *float64 `json:"heading"`
+			Altitude  *float64 `json:"altitude"`
+		} `json:"coords"`
+		Battery *struct {
+			Level      float64 `json:"level"` // 0-1
+			IsCharging bool    `json:"is_charging"`
+		} `json:"battery"`
+	} `json:"location"`
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n > 1e12 { // 毫秒
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp: %s", s)
+}
+
+func parseFloat(values url.Values, keys ...string) (*float64, error) {
+	for _, k := range keys {
+		if v := values.Get(k); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", k, v)
+			}
+			return &f, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseQuery 解析OsmAnd查询参数(GET查询串或POST表单)
+func parseQuery(values url.Values) (*Report, error) {
+	r := &Report{ID: values.Get("id")}
+	if r.ID == "" {
+		r.ID = values.Get("deviceid")
+	}
+
+	lat, err := parseFloat(values, "lat")
+	if err != nil {
+		return nil, err
+	}
+	lon, err := parseFloat(values, "lon")
+	if err != nil {
+		return nil, err
+	}
+	if lat == nil || lon == nil {
+		// 部分客户端以 location=lat,lon 上报
+		parts := strings.Split(values.Get("location"), ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("lat and lon are required")
+		}
+		loc := url.Values{"lat": {parts[0]}, "lon": {parts[1]}}
+		if lat, err = parseFloat(loc, "lat"); err != nil {
+			return nil, err
+		}
+		if lon, err = parseFloat(loc, "lon"); err != nil {
+			return nil, err
+		}
+	}
+	r.Latitude, r.Longitude = *lat, *lon
+
+	if r.Time, err = parseTime(values.Get("timestamp")); err != nil {
+		return nil, err
+	}
+	if r.Speed, err = parseFloat(values, "speed"); err != nil {
+		return nil, err
+	}
+	if r.Speed != nil {
+		speed := *r.Speed * _KNOTS_TO_KMH // OsmAnd协议速度单位为节
+		r.Speed = &speed
+	}
+	if r.Bearing, err = parseFloat(values, "bearing", "heading"); err != nil {
+		return nil, err
+	}
+	if r.Altitude, err = parseFloat(values, "altitude"); err != nil {
+		return nil, err
+	}
+	if r.Accuracy, err = parseFloat(values, "accuracy"); err != nil {
+		return nil, err
+	}
+	batt, err := parseFloat(values, "batt", "battery")
+	if err != nil {
+		return nil, err
+	}
+	if batt != nil {
+		b := int(*batt)
+		r.Battery = &b
+	}
+	if v := values.Get("charge"); v != "" {
+		charging := v == "true" || v == "1"
+		r.Charging = &charging
+	}
+	return r, nil
+}
+
+// parseJSON 解析Traccar Client的json上报
+func parseJSON(body []byte) (*Report, error) {
+	var j jsonReport
+	if err := json.Unmarshal(body, &j); err != nil {
+		return nil, fmt.Errorf("invalid json: %v", err)
+	}
+	coords := j.Location.Coords
+	r := &Report{
+		ID:        j.DeviceID,
+		Latitude:  coords.Latitude,
+		Longitude: coords.Longitude,
+		Bearing:   coords.Heading,
+		Altitude:  coords.Altitude,
+		Accuracy:  coords.Accuracy,
+	}
+	var err error
+	if r.Time, err = parseTime(j.Location.Timestamp); err != nil {
+		return nil, err
+	}
+	if coords.Speed != nil && *coords.Speed >= 0 {
+		speed := *coords.Speed * _MPS_TO_KMH
+		r.Speed = &speed
+	}
+	if b := j.Location.Battery; b != nil {
+		level := int(b.Level * 100)
+		r.Battery, r.Charging = &level, &b.IsCharging
+	}
+	return r, nil
+}
+
+// parseRequest 支持GET查询串、POST表单、POST json三种上报方式
+func parseRequest(req *http.Request) (*Report, error) {
+	var r *Report
+	var err error
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		body, rerr := io.ReadAll(io.LimitReader(req.Body, _MAX_BODY))
+		if rerr != nil {
+			return nil, rerr
+		}
+		r, err = parseJSON(body)
+	} else {
+		req.Body = io.NopCloser(io.LimitReader(req.Body, _MAX_BODY))
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+		r, err = parseQuery(req.Form)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.ID == "" || len(r.ID) > 16 {
+		return nil, fmt.Errorf("invalid device id: %q", r.ID)
+	}
+	if r.Latitude < -90 || r.Latitude > 90 || r.Longitude < -180 || r.Longitude > 180 {
+		return nil, fmt.Errorf("invalid location: %v,%v", r.Latitude, r.Longitude)
+	}
+	return r, nil
+}
+
+func (h *osmand_Handler) toStatus(r *Report) *mxm.DeviceStatus1 {
+	raw, _ := json.Marshal(r)
+	dev := &mxm.Device{
+		OriginSN: &r.ID,
+		Type:     &_osmand,
+	}
+	now := time.Now()
+	dev.LastOnline = &now
+	dev.LocTime = &r.Time
+	dev.Speed, dev.Heading, dev.Altitude, dev.Accuracy = r.Speed, r.Bearing, r.Altitude, r.Accuracy
+	dev.Electricity, dev.Charging = r.Battery, r.Charging
+	locT := "GPS"
+	dev.LocType = &locT
+
+	longi, lati := coordtransform.WGS84toGCJ02(r.Longitude, r.Latitude)
+	dev.Latitude, dev.Longitude = &lati, &longi
+	geoRes, err := services.GeocodeWithFallback(h.locS, lati, longi, 2*time.Second)
+	if err != nil {
+		slog.Error("geocode failed", "error", err.Error())
+	} else {
+		dev.Address = &geoRes.Address
+	}
+
+	return &mxm.DeviceStatus1{
+		OriginSN: r.ID,
+		Type:     _osmand,
+		Device:   dev,
+		RawMsg:   raw,
+	}
+}
+
+func (h *osmand_Handler) HandleReport(w http.ResponseWriter, req *http.Request) {
+	r, err := parseRequest(req)
+	if err != nil {
+		slog.Warn("osmand bad request", "remote", req.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if h.messageHandler == nil {
+		slog.Error("message handler of osmand is not set")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// 处理失败（如设备未入库）时仍返回200，避免客户端无限重发
+	if err := h.messageHandler.Process(h.toStatus(r)); err != nil {
+		slog.Error("Failed to process message", "id", r.ID, "error", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func NewOsmAndHandler(port int) vendors.VendorDriver {
+	return &osmand_Handler{
+		listenerPort: port,
+		locS:         []services.LocationService{services.NewTxLocationService(), services.NewWzLocationService()},
+	}
+}
+
+func (h *osmand_Handler) SetMessageHandler(handler vendors.MessageHandler) {
+	h.messageHandler = handler
+}
+
+// 厂商自己的启动逻辑
+func (h *osmand_Handler) Start() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", h.listenerPort))
+	if err != nil {
+		return fmt.Errorf("osmand listen failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.HandleReport)
+	h.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("Starting osmand driver http server:" + ln.Addr().String() + "...")
+		if err := h.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("osmand http server failed:" + err.Error())
+		}
+	}()
+	return nil
+}
+
+func (h *osmand_Handler) Stop() error {
+	if h.server == nil {
+		return nil
+	}
+	err := h.server.Close()
+	h.server = nil
+	return err
+}
+
+func (h *osmand_Handler) Activate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+func (h *osmand_Handler) Deactivate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+func (h *osmand_Handler) SetReportInterval(CommandID int64, originSN string, interval int) error {
+	return vendors.NewUnsupportedError(_osmand, "SET_REPORTINTERVAL")
+}
+
+func (h *osmand_Handler) Locate(CommandID int64, originSN string) error {
+	return vendors.NewUnsupportedError(_osmand, "LOCATE")
+}
+
+func (h *osmand_Handler) Reboot(CommandID int64, originSN string) error {
+	return vendors.NewUnsupportedError(_osmand, "REBOOT")
+}
+
+func (h *osmand_Handler) PowerOff(CommandID int64, originSN string) error {
+	return vendors.NewUnsupportedError(_osmand, "POWER_OFF")
+}
+
+func (h *osmand_Handler) Find(CommandID int64, originSN string) error {
+	return vendors.NewUnsupportedError(_osmand, "FIND")
+}
+
+// 手机应用只上报，不支持任何指令
+func (h *osmand_Handler) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities()
+}
@@ -0,0 +1,71 @@
+package osmand
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequest_Query(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?id=123456&lat=22.5431&lon=114.0579&timestamp=1700000000&speed=10&bearing=90.5&altitude=12&accuracy=8&batt=76&charge=true", nil)
+	r, err := parseRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "123456", r.ID)
+	assert.Equal(t, 22.5431, r.Latitude)
+	assert.Equal(t, 114.0579, r.Longitude)
+	assert.Equal(t, time.Unix(1700000000, 0), r.Time)
+	assert.InDelta(t, 18.52, *r.Speed, 1e-9)
+	assert.Equal(t, 90.5, *r.Bearing)
+	assert.Equal(t, 76, *r.Battery)
+	assert.True(t, *r.Charging)
+}
+
+func TestParseRequest_Form(t *testing.T) {
+	form := url.Values{"deviceid": {"654321"}, "location": {"22.5,114.1"}, "timestamp": {"2024-01-02T03:04:05Z"}}
+	req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r, err := parseRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "654321", r.ID)
+	assert.Equal(t, 22.5, r.Latitude)
+	assert.Equal(t, 114.1, r.Longitude)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), r.Time.UTC())
+	assert.Nil(t, r.Speed)
+}
+
+func TestParseRequest_JSON(t *testing.T) {
+	body := `{"device_id":"998877","location":{"timestamp":"2024-01-02T03:04:05.000Z","coords":{"latitude":22.5,"longitude":114.1,"speed":2,"heading":180},"battery":{"level":0.5,"is_charging":false}}}`
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r, err := parseRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "998877", r.ID)
+	assert.InDelta(t, 7.2, *r.Speed, 1e-9)
+	assert.Equal(t, 50, *r.Battery)
+	assert.False(t, *r.Charging)
+}
+
+func TestParseRequest_Invalid(t *testing.T) {
+	for _, q := range []string{
+		"/?lat=1&lon=2",                      // 缺少id
+		"/?id=1&lat=1",                       // 缺少经度
+		"/?id=1&lat=abc&lon=2",               // 非法纬度
+		"/?id=1&lat=91&lon=2",                // 超出范围
+		"/?id=1&lat=1&lon=2&timestamp=later", // 非法时间
+	} {
+		_, err := parseRequest(httptest.NewRequest("GET", q, nil))
+		assert.Error(t, err, q)
+	}
+}
+
+func TestHandleReport_BadRequest(t *testing.T) {
+	h := &osmand_Handler{}
+	w := httptest.NewRecorder()
+	h.HandleReport(w, httptest.NewRequest("GET", "/?id=1", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,296 @@
+package sg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/services"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+	"github.com/Daneel-Li/gps-back/internal/vendors/httppush"
+
+	"github.com/qichengzx/coordtransform"
+)
+
+//sg驱动，设备数据由sg平台http推送，指令调用sg平台接口下发
+//推送格式: {"sn":"...","msg_type":"location|heartbeat|cmd_result","data":{...}}
+
+var _sg = "sg"
+
+const (
+	MSG_LOCATION   = "location"
+	MSG_HEARTBEAT  = "heartbeat"
+	MSG_CMD_RESULT = "cmd_result"
+)
+
+type PushMsg struct {
+	SN      string          `json:"sn"`
+	MsgType string          `json:"msg_type"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// 位置推送，与tdengine中stb_location一致
+type Location struct {
+	Time      string  `json:"time"` // yyyy-MM-dd HH:mm:ss 本地时间
+	Lati      float64 `json:"lati"` // WGS84
+	Long      float64 `json:"long"`
+	Type      string  `json:"type"` // GPS/WIFI/LBS
+	Satellite int     `json:"satellite"`
+	Wifi      string  `json:"wifi"` // mac1,rssi1|mac2,rssi2
+	Address   string  `json:"address"`
+}
+
+type Heartbeat struct {
+	Time     string `json:"time"`
+	Battery  *int   `json:"battery"`
+	Charging *bool  `json:"charging"`
+	Signal   *int   `json:"signal"` // 0-100
+	Steps    *int   `json:"steps"`
+}
+
+type CmdResult struct {
+	MessageID int64  `json:"message_id"`
+	Succeed   bool   `json:"succeed"`
+	Msg       string `json:"msg"`
+}
+
+// 指令下发请求及平台应答
+type cmdRequest struct {
+	SN        string                 `json:"sn"`
+	MessageID int64                  `json:"message_id"`
+	Cmd       string                 `json:"cmd"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+}
+
+type cmdResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type sg_Handler struct {
+	messageHandler vendors.MessageHandler //统一消息处理接口
+	locS           []services.LocationService
+	server         *httppush.Server
+}
+
+func NewSgHandler(cfg httppush.Config) vendors.VendorDriver {
+	h := &sg_Handler{
+		locS: []services.LocationService{services.NewTxLocationService(), services.NewWzLocationService()},
+	}
+	h.server = httppush.NewServer(_sg, cfg, h.handlePush)
+	return h
+}
+
+func parseTime(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+// parseWifi 解析 mac1,rssi1|mac2,rssi2
+func parseWifi(s string) ([]*mxm.WiFiInfo, error) {
+	var wifis []*mxm.WiFiInfo
+	for _, item := range strings.Split(s, "|") {
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid wifi: %s", item)
+		}
+		rssi, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid wifi rssi: %s", item)
+		}
+		wifis = append(wifis, &mxm.WiFiInfo{Mac: parts[0], Rssi: rssi})
+	}
+	return wifis, nil
+}
+
+func (h *sg_Handler) handlePush(body []byte) error {
+	var msg PushMsg
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return fmt.Errorf("invalid push: %v", err)
+	}
+	if msg.SN == "" {
+		return fmt.Errorf("sn is required")
+	}
+	status := &mxm.DeviceStatus1{
+		OriginSN: msg.SN,
+		Type:     _sg,
+		RawMsg:   body,
+	}
+	switch msg.MsgType {
+	case MSG_LOCATION:
+		var loc Location
+		if err := json.Unmarshal(msg.Data, &loc); err != nil {
+			return fmt.Errorf("invalid location: %v", err)
+		}
+		dev, err := h.locationToDevice(msg.SN, &loc)
+		if err != nil {
+			return err
+		}
+		status.Device = dev
+	case MSG_HEARTBEAT:
+		var hb Heartbeat
+		if err := json.Unmarshal(msg.Data, &hb); err != nil {
+			return fmt.Errorf("invalid heartbeat: %v", err)
+		}
+		now := time.Now()
+		status.Device = &mxm.Device{
+			OriginSN:      &status.OriginSN,
+			Type:          &_sg,
+			LastOnline:    &now,
+			Electricity:   hb.Battery,
+			Charging:      hb.Charging,
+			SimCardSignal: hb.Signal,
+			Steps:         hb.Steps,
+		}
+	case MSG_CMD_RESULT:
+		var res CmdResult
+		if err := json.Unmarshal(msg.Data, &res); err != nil {
+			return fmt.Errorf("invalid cmd result: %v", err)
+		}
+		status.Command = &mxm.Command{
+			Result: &mxm.CommandResult{
+				CommandID: res.MessageID,
+				Succeed:   res.Succeed,
+				Msg:       res.Msg,
+			},
+		}
+	default:
+		return fmt.Errorf("unknown msg_type: %s", msg.MsgType)
+	}
+
+	// 调用统一消息处理接口
+	if h.messageHandler == nil {
+		slog.Error("message handler of sg is not set")
+		return nil
+	}
+	if err := h.messageHandler.Process(status); err != nil {
+		slog.Error("Failed to process message", "error", err)
+	}
+	return nil
+}
+
+func (h *sg_Handler) locationToDevice(sn string, loc *Location) (*mxm.Device, error) {
+	now := time.Now()
+	locTime := parseTime(loc.Time)
+	locT := strings.ToUpper(loc.Type)
+	dev := &mxm.Device{
+		OriginSN:   &sn,
+		Type:       &_sg,
+		LastOnline: &now,
+		LocTime:    &locTime,
+		LocType:    &locT,
+	}
+	if loc.Address != "" {
+		dev.Address = &loc.Address
+	}
+
+	switch {
+	case loc.Lati != 0 || loc.Long != 0:
+		longi, lati := coordtransform.WGS84toGCJ02(loc.Long, loc.Lati)
+		dev.Latitude, dev.Longitude = &lati, &longi
+		sate := loc.Satellite
+		dev.Satellites = &sate
+		if dev.Address == nil {
+			geoRes, err := services.GeocodeWithFallback(h.locS, lati, longi, 2*time.Second)
+			if err != nil {
+				slog.Error("geocode failed", "error", err.Error())
+			} else {
+				dev.Address = &geoRes.Address
+			}
+		}
+	case loc.Wifi != "":
+		// 平台未解析坐标时使用wifi定位
+		wifis, err := parseWifi(loc.Wifi)
+		if err != nil {
+			return nil, err
+		}
+		locRes, err := services.LocateWithFallback(h.locS, services.LocationRequest{WifiInfo: wifis}, 2*time.Second)
+		if err != nil {
+			slog.Error("wifi locate failed", "error", err.Error())
+		} else if locRes.Location != nil {
+			dev.Address = &locRes.Address
+			dev.Latitude, dev.Longitude = &locRes.Location.Latitude, &locRes.Location.Longitude
+			dev.Accuracy = &locRes.Location.Accuracy
+		}
+	}
+	return dev, nil
+}
+
+func (h *sg_Handler) SetMessageHandler(handler vendors.MessageHandler) {
+	h.messageHandler = handler
+}
+
+// 厂商自己的启动逻辑
+func (h *sg_Handler) Start() error {
+	return h.server.Start()
+}
+
+func (h *sg_Handler) Stop() error {
+	return h.server.Stop()
+}
+
+func (h *sg_Handler) Activate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+func (h *sg_Handler) Deactivate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+// 指令执行结果由平台以cmd_result推送，message_id即CommandID
+func (h *sg_Handler) sendCmd(CommandID int64, originSN string, cmd string, params map[string]interface{}) error {
+	body, err := h.server.Post("/command", cmdRequest{
+		SN:        originSN,
+		MessageID: CommandID,
+		Cmd:       cmd,
+		Params:    params,
+	})
+	if err != nil {
+		return err
+	}
+	var resp cmdResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid sg api response: %s", body)
+	}
+	if resp.Code != 0 {
+		return fmt.Errorf("sg api error: %d %s", resp.Code, resp.Msg)
+	}
+	return nil
+}
+
+func (h *sg_Handler) SetReportInterval(CommandID int64, originSN string, interval int) error {
+	return h.sendCmd(CommandID, originSN, "set_interval", map[string]interface{}{"interval": interval})
+}
+
+func (h *sg_Handler) Locate(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "locate", nil)
+}
+
+func (h *sg_Handler) Reboot(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "reboot", nil)
+}
+
+func (h *sg_Handler) PowerOff(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "power_off", nil)
+}
+
+func (h *sg_Handler) Find(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "find", nil)
+}
+
+func (h *sg_Handler) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities(vendors.ActionSetReportInterval(10, 3600), vendors.ActionLocate,
+		vendors.ActionReboot, vendors.ActionPowerOff, vendors.ActionFind)
+}
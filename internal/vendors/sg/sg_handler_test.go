@@ -0,0 +1,58 @@
+package sg
+
+import (
+	"testing"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/vendors/httppush"
+	"github.com/stretchr/testify/assert"
+)
+
+type captureHandler struct {
+	msgs []*mxm.DeviceStatus1
+}
+
+func (c *captureHandler) Process(msg *mxm.DeviceStatus1) error {
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func TestParseWifi(t *testing.T) {
+	wifis, err := parseWifi("aa:bb:cc:dd:ee:ff,-60|11:22:33:44:55:66,-75")
+	assert.NoError(t, err)
+	assert.Len(t, wifis, 2)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", wifis[0].Mac)
+	assert.Equal(t, -75, wifis[1].Rssi)
+
+	_, err = parseWifi("aa:bb:cc:dd:ee:ff")
+	assert.Error(t, err)
+}
+
+func TestHandlePush(t *testing.T) {
+	c := &captureHandler{}
+	h := NewSgHandler(httppush.Config{}).(*sg_Handler)
+	h.SetMessageHandler(c)
+
+	body := []byte(`{"sn":"SG001","msg_type":"location","data":{"time":"2024-01-02 03:04:05","lati":22.5,"long":114.1,"type":"gps","satellite":7,"address":"深圳"}}`)
+	assert.NoError(t, h.handlePush(body))
+	dev := c.msgs[0].Device
+	assert.Equal(t, "SG001", c.msgs[0].OriginSN)
+	assert.Equal(t, "GPS", *dev.LocType)
+	assert.Equal(t, 7, *dev.Satellites)
+	assert.Equal(t, "深圳", *dev.Address)
+	assert.NotEqual(t, 22.5, *dev.Latitude) // 已转为GCJ02
+
+	body = []byte(`{"sn":"SG001","msg_type":"heartbeat","data":{"battery":80,"charging":true,"signal":60}}`)
+	assert.NoError(t, h.handlePush(body))
+	assert.Equal(t, 80, *c.msgs[1].Device.Electricity)
+	assert.Equal(t, 60, *c.msgs[1].Device.SimCardSignal)
+
+	body = []byte(`{"sn":"SG001","msg_type":"cmd_result","data":{"message_id":12,"succeed":true,"msg":"ok"}}`)
+	assert.NoError(t, h.handlePush(body))
+	assert.Equal(t, int64(12), c.msgs[2].Command.Result.CommandID)
+	assert.True(t, c.msgs[2].Command.Result.Succeed)
+
+	assert.Error(t, h.handlePush([]byte(`{"sn":"SG001","msg_type":"unknown"}`)))
+	assert.Error(t, h.handlePush([]byte(`{"msg_type":"heartbeat"}`)))
+	assert.Len(t, c.msgs, 3)
+}
@@ -0,0 +1,155 @@
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+)
+
+const (
+	_KM_PER_DEGREE = 111.32 // 每纬度对应的公里数
+	_MAX_SPEED     = 8.0    // 随机游走最大速度(km/h)，模拟步行
+	_RADIUS        = 2.0    // 随机游走活动半径(km)，超出后掉头
+	_STEP_LENGTH   = 0.7    // 步长(m)
+)
+
+// device 虚拟设备状态，坐标均为GCJ02
+type device struct {
+	mu         sync.Mutex
+	sn         string
+	rnd        *rand.Rand
+	center     [2]float64 // [经度, 纬度]
+	lon, lat   float64
+	heading    float64
+	speed      float64 // km/h
+	battery    float64
+	charging   bool
+	steps      int
+	interval   int // 上报间隔(秒)
+	poweredOff bool
+	track      []*mxm.Location // 回放轨迹，为空时随机游走
+	trackPos   int
+	wake       chan struct{} // 立即上报或间隔变更时唤醒
+}
+
+func newDevice(sn string, seed int64, center [2]float64, interval int, track []*mxm.Location) *device {
+	rnd := rand.New(rand.NewSource(seed))
+	d := &device{
+		sn:       sn,
+		rnd:      rnd,
+		center:   center,
+		lon:      center[0] + (rnd.Float64()-0.5)*0.01,
+		lat:      center[1] + (rnd.Float64()-0.5)*0.01,
+		heading:  rnd.Float64() * 360,
+		battery:  50 + rnd.Float64()*50,
+		interval: interval,
+		track:    track,
+		wake:     make(chan struct{}, 1),
+	}
+	if len(track) > 0 {
+		d.trackPos = rnd.Intn(len(track)) // 各设备从不同位置开始回放
+	}
+	return d
+}
+
+// distance 两点间近似距离(km)
+func distance(lon1, lat1, lon2, lat2 float64) float64 {
+	dx := (lon2 - lon1) * _KM_PER_DEGREE * math.Cos(lat1*math.Pi/180)
+	dy := (lat2 - lat1) * _KM_PER_DEGREE
+	return math.Sqrt(dx*dx + dy*dy)
+}
+
+// step 推进dt秒，更新位置、电量和步数
+func (d *device) step(dt float64) {
+	if len(d.track) > 0 {
+		d.trackPos = (d.trackPos + 1) % len(d.track)
+		loc := d.track[d.trackPos]
+		moved := distance(d.lon, d.lat, loc.Longitude, loc.Latitude)
+		d.lon, d.lat = loc.Longitude, loc.Latitude
+		d.heading = loc.Heading
+		d.speed = math.Min(moved/(dt/3600), 120)
+		d.steps += int(moved * 1000 / _STEP_LENGTH)
+	} else {
+		d.speed = math.Max(0, math.Min(_MAX_SPEED, d.speed+d.rnd.NormFloat64()))
+		d.heading = math.Mod(d.heading+d.rnd.NormFloat64()*20+360, 360)
+		if distance(d.center[0], d.center[1], d.lon, d.lat) > _RADIUS {
+			// 朝活动中心掉头
+			d.heading = math.Mod(math.Atan2(d.center[0]-d.lon, d.center[1]-d.lat)*180/math.Pi+360, 360)
+		}
+		moved := d.speed * dt / 3600
+		rad := d.heading * math.Pi / 180
+		d.lat += moved * math.Cos(rad) / _KM_PER_DEGREE
+		d.lon += moved * math.Sin(rad) / (_KM_PER_DEGREE * math.Cos(d.lat*math.Pi/180))
+		d.steps += int(moved * 1000 / _STEP_LENGTH)
+	}
+
+	// 电量：持续消耗，低于10%时随机开始充电，充满后停止，期间会产生低电量报警
+	if d.charging {
+		d.battery += 2
+		if d.battery >= 100 {
+			d.battery, d.charging = 100, false
+		}
+	} else {
+		d.battery = math.Max(1, d.battery-0.2)
+		if d.battery < 10 && d.rnd.Float64() < 0.15 {
+			d.charging = true
+		}
+	}
+}
+
+// report 当前状态
+func (d *device) report(now time.Time) *mxm.Device {
+	lon, lat := d.lon, d.lat
+	speed, heading := d.speed, d.heading
+	altitude := 10 + d.rnd.Float64()*5
+	accuracy := 5 + d.rnd.Float64()*10
+	satellites := 6 + d.rnd.Intn(6)
+	electricity := int(d.battery)
+	charging := d.charging
+	steps := d.steps
+	interval := d.interval
+	signal := 60 + d.rnd.Intn(40)
+	locType := "GPS"
+	typ := _sim
+	sn := d.sn
+	return &mxm.Device{
+		OriginSN:      &sn,
+		Type:          &typ,
+		LastOnline:    &now,
+		LocTime:       &now,
+		LocType:       &locType,
+		Longitude:     &lon,
+		Latitude:      &lat,
+		Altitude:      &altitude,
+		Accuracy:      &accuracy,
+		Satellites:    &satellites,
+		Speed:         &speed,
+		Heading:       &heading,
+		Electricity:   &electricity,
+		Charging:      &charging,
+		Steps:         &steps,
+		Interval:      &interval,
+		SimCardSignal: &signal,
+	}
+}
+
+// alarm 以rate的概率随机产生一条SOS或拆除报警
+func (d *device) alarm(now time.Time, rate float64) []mxm.Alarm {
+	if rate <= 0 || d.rnd.Float64() >= rate {
+		return nil
+	}
+	if d.rnd.Intn(2) == 0 {
+		return []mxm.Alarm{{Time: now, Type: mxm.SOS, Msg: "SOS"}}
+	}
+	return []mxm.Alarm{{Time: now, Type: mxm.REMOVED, Msg: "removed"}}
+}
+
+func (d *device) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,281 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Daneel-Li/gps-back/internal/config"
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+)
+
+//sim驱动，生成虚拟设备的位置、电量、步数及报警数据，经统一消息处理接口入库，用于演示和压测
+//低电量报警由消息处理器按电量产生，围栏报警由位置产生，SOS/拆除报警按alarm_rate随机产生
+
+var _sim = "sim"
+
+const (
+	MODE_RANDOM = "random"
+	MODE_REPLAY = "replay"
+)
+
+// 原始报文存档格式（his_data表要求json）
+type NotifyMsg struct {
+	SN        string      `json:"sn"`
+	Event     string      `json:"event"` // report/ack
+	Data      interface{} `json:"data"`
+	Simulated bool        `json:"simulated"`
+}
+
+// TrackSource 回放轨迹来源，由dao.Repository实现
+type TrackSource interface {
+	GetPosHis(deviceID, startTime, endTime string, types []string) ([]*mxm.Location, error)
+}
+
+type sim_Handler struct {
+	cfg            config.SimConfig
+	src            TrackSource
+	messageHandler vendors.MessageHandler //统一消息处理接口
+	track          []*mxm.Location
+	mu             sync.RWMutex
+	devices        map[string]*device
+	stop           chan struct{} // 未启动时为nil
+}
+
+func NewSimHandler(cfg config.SimConfig, src TrackSource) vendors.VendorDriver {
+	if cfg.SNPrefix == "" {
+		cfg.SNPrefix = "SIM"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10
+	}
+	if cfg.ReplayDays <= 0 {
+		cfg.ReplayDays = 1
+	}
+	if cfg.Center == [2]float64{} {
+		cfg.Center = [2]float64{114.0579, 22.5431} // 深圳
+	}
+	return &sim_Handler{
+		cfg:     cfg,
+		src:     src,
+		devices: make(map[string]*device),
+	}
+}
+
+func (h *sim_Handler) SetMessageHandler(handler vendors.MessageHandler) {
+	h.messageHandler = handler
+}
+
+func (h *sim_Handler) process(sn, event string, data interface{}, status *mxm.DeviceStatus1) {
+	status.OriginSN, status.Type = sn, _sim
+	status.RawMsg, _ = json.Marshal(NotifyMsg{SN: sn, Event: event, Data: data, Simulated: true})
+	// 调用统一消息处理接口
+	if h.messageHandler == nil {
+		slog.Error("message handler of sim is not set")
+		return
+	}
+	if err := h.messageHandler.Process(status); err != nil {
+		slog.Error("Failed to process message", "sn", sn, "error", err)
+	}
+}
+
+// loadTrack replay模式加载回放轨迹，失败时退回随机游走
+func (h *sim_Handler) loadTrack() {
+	if h.cfg.Mode != MODE_REPLAY {
+		return
+	}
+	if h.src == nil || h.cfg.ReplayDeviceID == "" {
+		slog.Warn("sim replay source is not configured, fallback to random walk")
+		return
+	}
+	layout := "2006-1-2 15:4:5"
+	now := time.Now()
+	track, err := h.src.GetPosHis(h.cfg.ReplayDeviceID,
+		now.AddDate(0, 0, -h.cfg.ReplayDays).Format(layout), now.Format(layout), []string{"GPS"})
+	if err != nil || len(track) < 2 {
+		slog.Warn("sim load replay track failed, fallback to random walk", "device", h.cfg.ReplayDeviceID, "points", len(track), "error", err)
+		return
+	}
+	h.track = track
+	slog.Info("sim replay track loaded", "device", h.cfg.ReplayDeviceID, "points", len(track))
+}
+
+// 厂商自己的启动逻辑
+func (h *sim_Handler) Start() error {
+	h.loadTrack()
+	h.mu.Lock()
+	h.stop = make(chan struct{})
+	h.mu.Unlock()
+	for i := 1; i <= h.cfg.Devices; i++ {
+		h.addDevice(fmt.Sprintf("%s%04d", h.cfg.SNPrefix, i))
+	}
+	slog.Info("Starting sim driver...", "devices", h.cfg.Devices, "mode", h.cfg.Mode)
+	return nil
+}
+
+// 停止所有虚拟设备
+func (h *sim_Handler) Stop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+	h.devices = make(map[string]*device)
+	return nil
+}
+
+func (h *sim_Handler) addDevice(sn string) *device {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if d, ok := h.devices[sn]; ok || h.stop == nil {
+		return d
+	}
+	d := newDevice(sn, time.Now().UnixNano()+int64(len(h.devices)), h.cfg.Center, h.cfg.Interval, h.track)
+	h.devices[sn] = d
+	go h.run(d, h.stop)
+	return d
+}
+
+func (h *sim_Handler) getDevice(sn string) (*device, error) {
+	h.mu.RLock()
+	d, ok := h.devices[sn]
+	h.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("sim device %s is not connected", sn)
+	}
+	d.mu.Lock()
+	off := d.poweredOff
+	d.mu.Unlock()
+	if off {
+		return nil, fmt.Errorf("sim device %s is not connected", sn)
+	}
+	return d, nil
+}
+
+// run 按上报间隔推进并上报，关机时停止上报
+func (h *sim_Handler) run(d *device, stop chan struct{}) {
+	last := time.Now()
+	for {
+		d.mu.Lock()
+		interval := time.Duration(d.interval) * time.Second
+		d.mu.Unlock()
+
+		select {
+		case <-time.After(interval):
+		case <-d.wake:
+		case <-stop:
+			return
+		}
+
+		now := time.Now()
+		d.mu.Lock()
+		if d.poweredOff {
+			d.mu.Unlock()
+			last = now
+			continue
+		}
+		d.step(max(now.Sub(last).Seconds(), 1))
+		dev := d.report(now)
+		alarms := d.alarm(now, h.cfg.AlarmRate)
+		d.mu.Unlock()
+		last = now
+
+		h.process(d.sn, "report", dev, &mxm.DeviceStatus1{Device: dev, Alarms: alarms})
+	}
+}
+
+// ack 延迟模拟指令应答
+func (h *sim_Handler) ack(CommandID int64, d *device, action string, after func()) {
+	time.AfterFunc(time.Duration(h.cfg.AckDelayMs)*time.Millisecond, func() {
+		result := &mxm.CommandResult{CommandID: CommandID, Succeed: true, Msg: "ok"}
+		h.process(d.sn, "ack", map[string]interface{}{"action": action, "command_id": CommandID},
+			&mxm.DeviceStatus1{Command: &mxm.Command{Result: result}})
+		if after != nil {
+			after()
+		}
+	})
+}
+
+// Activate 以前缀开头的设备加入模拟
+func (h *sim_Handler) Activate(originSN string) error {
+	if strings.HasPrefix(originSN, h.cfg.SNPrefix) {
+		h.addDevice(originSN)
+	}
+	return nil
+}
+
+func (h *sim_Handler) Deactivate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+func (h *sim_Handler) SetReportInterval(CommandID int64, originSN string, interval int) error {
+	d, err := h.getDevice(originSN)
+	if err != nil {
+		return err
+	}
+	h.ack(CommandID, d, "SET_REPORTINTERVAL", func() {
+		d.mu.Lock()
+		d.interval = max(interval, 1)
+		d.mu.Unlock()
+		d.notify()
+	})
+	return nil
+}
+
+func (h *sim_Handler) Locate(CommandID int64, originSN string) error {
+	d, err := h.getDevice(originSN)
+	if err != nil {
+		return err
+	}
+	h.ack(CommandID, d, "LOCATE", d.notify)
+	return nil
+}
+
+func (h *sim_Handler) Reboot(CommandID int64, originSN string) error {
+	d, err := h.getDevice(originSN)
+	if err != nil {
+		return err
+	}
+	h.ack(CommandID, d, "REBOOT", nil)
+	return nil
+}
+
+// 关机后1分钟自动开机，方便演示
+func (h *sim_Handler) PowerOff(CommandID int64, originSN string) error {
+	d, err := h.getDevice(originSN)
+	if err != nil {
+		return err
+	}
+	h.ack(CommandID, d, "POWER_OFF", func() {
+		d.mu.Lock()
+		d.poweredOff = true
+		d.mu.Unlock()
+		time.AfterFunc(time.Minute, func() {
+			d.mu.Lock()
+			d.poweredOff = false
+			d.mu.Unlock()
+			d.notify()
+		})
+	})
+	return nil
+}
+
+func (h *sim_Handler) Find(CommandID int64, originSN string) error {
+	d, err := h.getDevice(originSN)
+	if err != nil {
+		return err
+	}
+	h.ack(CommandID, d, "FIND", nil)
+	return nil
+}
+
+func (h *sim_Handler) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities(vendors.ActionSetReportInterval(1, 3600), vendors.ActionLocate,
+		vendors.ActionReboot, vendors.ActionPowerOff, vendors.ActionFind)
+}
@@ -0,0 +1,137 @@
+package sim
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Daneel-Li/gps-back/internal/config"
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type captureHandler struct {
+	mu   sync.Mutex
+	msgs []*mxm.DeviceStatus1
+}
+
+func (c *captureHandler) Process(msg *mxm.DeviceStatus1) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func (c *captureHandler) results() []*mxm.CommandResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var res []*mxm.CommandResult
+	for _, m := range c.msgs {
+		if m.Command != nil {
+			res = append(res, m.Command.Result)
+		}
+	}
+	return res
+}
+
+type trackSource []*mxm.Location
+
+func (s trackSource) GetPosHis(deviceID, startTime, endTime string, types []string) ([]*mxm.Location, error) {
+	return s, nil
+}
+
+func TestRandomWalk(t *testing.T) {
+	center := [2]float64{114.0579, 22.5431}
+	d := newDevice("SIM0001", 1, center, 10, nil)
+	for i := 0; i < 5000; i++ {
+		d.step(10)
+		// 活动半径外会掉头，允许一步的越界
+		assert.Less(t, distance(center[0], center[1], d.lon, d.lat), _RADIUS+1)
+		assert.GreaterOrEqual(t, d.speed, 0.0)
+		assert.LessOrEqual(t, d.speed, _MAX_SPEED)
+		assert.GreaterOrEqual(t, d.battery, 1.0)
+		assert.LessOrEqual(t, d.battery, 100.0)
+	}
+	assert.Greater(t, d.steps, 0)
+}
+
+func TestBatteryCycle(t *testing.T) {
+	d := newDevice("SIM0001", 1, [2]float64{114, 22}, 10, nil)
+	d.battery = 10.1
+	charged := false
+	for i := 0; i < 1000 && !charged; i++ {
+		d.step(10)
+		charged = d.charging
+	}
+	assert.True(t, charged)
+	for d.charging {
+		d.step(10)
+	}
+	assert.Equal(t, 100.0, d.battery)
+}
+
+func TestRandomAlarm(t *testing.T) {
+	d := newDevice("SIM0001", 1, [2]float64{114, 22}, 10, nil)
+	now := time.Now()
+	assert.Empty(t, d.alarm(now, 0))
+	for i := 0; i < 20; i++ {
+		alarms := d.alarm(now, 1)
+		assert.Len(t, alarms, 1)
+		assert.Contains(t, []int{mxm.SOS, mxm.REMOVED}, alarms[0].Type)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	track := []*mxm.Location{
+		{Longitude: 114.0, Latitude: 22.0, Heading: 90},
+		{Longitude: 114.001, Latitude: 22.0, Heading: 90},
+		{Longitude: 114.002, Latitude: 22.0, Heading: 180},
+	}
+	d := newDevice("SIM0001", 1, [2]float64{114, 22}, 10, track)
+	pos := d.trackPos
+	d.step(10)
+	next := track[(pos+1)%len(track)]
+	assert.Equal(t, next.Longitude, d.lon)
+	assert.Equal(t, next.Latitude, d.lat)
+	assert.Equal(t, next.Heading, d.heading)
+
+	dev := d.report(time.Now())
+	assert.Equal(t, "SIM0001", *dev.OriginSN)
+	assert.Equal(t, "sim", *dev.Type)
+	assert.Equal(t, next.Longitude, *dev.Longitude)
+}
+
+func TestLoadTrack(t *testing.T) {
+	track := trackSource{{Longitude: 114.0, Latitude: 22.0}, {Longitude: 114.001, Latitude: 22.0}}
+	h := NewSimHandler(config.SimConfig{Mode: MODE_REPLAY, ReplayDeviceID: "abc"}, track).(*sim_Handler)
+	h.loadTrack()
+	assert.Len(t, h.track, 2)
+
+	// 轨迹点不足时退回随机游走
+	h = NewSimHandler(config.SimConfig{Mode: MODE_REPLAY, ReplayDeviceID: "abc"}, track[:1]).(*sim_Handler)
+	h.loadTrack()
+	assert.Nil(t, h.track)
+}
+
+func TestCommandAck(t *testing.T) {
+	c := &captureHandler{}
+	h := NewSimHandler(config.SimConfig{Devices: 1, Interval: 3600}, nil).(*sim_Handler)
+	h.SetMessageHandler(c)
+	assert.NoError(t, h.Start())
+
+	assert.NoError(t, h.Locate(7, "SIM0001"))
+	assert.NoError(t, h.SetReportInterval(8, "SIM0001", 60))
+	assert.Error(t, h.Find(9, "SIM0002"))
+
+	assert.Eventually(t, func() bool { return len(c.results()) == 2 }, time.Second, 10*time.Millisecond)
+	for _, res := range c.results() {
+		assert.True(t, res.Succeed)
+		assert.Contains(t, []int64{7, 8}, res.CommandID)
+	}
+	// Locate立即上报一次位置
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.msgs) >= 3
+	}, time.Second, 10*time.Millisecond)
+}
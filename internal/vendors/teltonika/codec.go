@@ -0,0 +1,278 @@
+package teltonika
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Teltonika 数据协议
+// TCP: 终端连接后先发送IMEI(长度2字节+ASCII)，服务器回复0x01接受
+//      之后每个数据包: 前导0(4) + 数据长度(4) + [编解码器ID(1) + 记录数1(1) + AVL记录... + 记录数2(1)] + CRC-16/IBM(4)
+//      服务器以4字节记录数应答
+// UDP: 长度(2) + 包ID(2) + 不可用字节(1) + AVL包ID(1) + IMEI长度(2) + IMEI + [编解码器ID ... 记录数2]，无CRC
+
+const (
+	CODEC_8  = 0x08
+	CODEC_8E = 0x8e
+	CODEC_12 = 0x0c
+
+	_TYPE_COMMAND  = 0x05
+	_TYPE_RESPONSE = 0x06
+
+	_MAX_DATA_LEN = 64 * 1024
+)
+
+// 常用IO元素ID
+const (
+	IO_TOTAL_ODOMETER   = 16  // 总里程(m)
+	IO_GSM_SIGNAL       = 21  // 信号等级0-5
+	IO_EXTERNAL_VOLTAGE = 66  // 外部电压(mV)
+	IO_BATTERY_VOLTAGE  = 67  // 电池电压(mV)
+	IO_BATTERY_LEVEL    = 113 // 电池电量(%)
+	IO_IGNITION         = 239 // 点火状态
+)
+
+const PRIORITY_PANIC = 2 // 紧急按键触发的记录
+
+// AVL记录
+type Record struct {
+	Time       time.Time         `json:"time"`
+	Priority   byte              `json:"priority"` // 0-low,1-high,2-panic
+	Longitude  float64           `json:"longitude"`
+	Latitude   float64           `json:"latitude"`
+	Altitude   int               `json:"altitude"`
+	Angle      int               `json:"angle"`
+	Satellites int               `json:"satellites"`
+	Speed      int               `json:"speed"` // km/h
+	EventID    uint16            `json:"event_id"`
+	IO         map[uint16]uint64 `json:"io"`
+	IOX        map[uint16][]byte `json:"iox,omitempty"` // 8E变长IO
+}
+
+// crc16IBM CRC-16/IBM(ARC)校验
+func crc16IBM(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// readIMEI 读取TCP握手中的IMEI
+func readIMEI(r io.Reader) (string, error) {
+	lenField := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenField); err != nil {
+		return "", err
+	}
+	n := int(binary.BigEndian.Uint16(lenField))
+	if n == 0 || n > 32 {
+		return "", fmt.Errorf("invalid imei length: %d", n)
+	}
+	imei := make([]byte, n)
+	if _, err := io.ReadFull(r, imei); err != nil {
+		return "", err
+	}
+	return string(imei), nil
+}
+
+// readFrame 读取TCP数据包并校验CRC，返回编解码器ID至记录数2之间的数据
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(head[:4]) != 0 {
+		return nil, fmt.Errorf("invalid preamble: %x", head[:4])
+	}
+	n := int(binary.BigEndian.Uint32(head[4:]))
+	if n < 3 || n > _MAX_DATA_LEN {
+		return nil, fmt.Errorf("invalid data length: %d", n)
+	}
+	data := make([]byte, n+4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	crc := binary.BigEndian.Uint32(data[n:])
+	if sum := uint32(crc16IBM(data[:n])); sum != crc {
+		return nil, fmt.Errorf("crc mismatch: expect %04x, got %04x", sum, crc)
+	}
+	return data[:n], nil
+}
+
+// encodeFrame 组TCP数据包
+func encodeFrame(data []byte) []byte {
+	buf := make([]byte, 8, len(data)+12)
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(data)))
+	buf = append(buf, data...)
+	return binary.BigEndian.AppendUint32(buf, uint32(crc16IBM(data)))
+}
+
+type reader struct {
+	b   []byte
+	off int
+	err error
+}
+
+// 出错后定长读取返回的零值，长度来自终端，不能按它分配内存
+var _zeros [8]byte
+
+func (r *reader) next(n int) []byte {
+	if r.err == nil && (n < 0 || n > len(r.b)-r.off) {
+		r.err = fmt.Errorf("unexpected end of data at %d, need %d", r.off, n)
+	}
+	if r.err != nil {
+		if n >= 0 && n <= len(_zeros) {
+			return _zeros[:n]
+		}
+		return nil
+	}
+	v := r.b[r.off : r.off+n]
+	r.off += n
+	return v
+}
+
+func (r *reader) u8() uint8   { return r.next(1)[0] }
+func (r *reader) u16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *reader) u32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *reader) u64() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+
+func (r *reader) uint(n int) uint64 {
+	switch n {
+	case 1:
+		return uint64(r.u8())
+	case 2:
+		return uint64(r.u16())
+	case 4:
+		return uint64(r.u32())
+	default:
+		return r.u64()
+	}
+}
+
+// id/计数字段在Codec8中为1字节，在Codec8E中为2字节
+func (r *reader) field(extended bool) int {
+	if extended {
+		return int(r.u16())
+	}
+	return int(r.u8())
+}
+
+// DecodeAVL 解析Codec8/8E数据(编解码器ID至记录数2)
+func DecodeAVL(data []byte) (byte, []*Record, error) {
+	r := &reader{b: data}
+	codec := r.u8()
+	if codec != CODEC_8 && codec != CODEC_8E {
+		return codec, nil, fmt.Errorf("unsupported codec: %02x", codec)
+	}
+	extended := codec == CODEC_8E
+	count := int(r.u8())
+	records := make([]*Record, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		rec := &Record{
+			Time:     time.UnixMilli(int64(r.u64())),
+			Priority: r.u8(),
+		}
+		rec.Longitude = float64(int32(r.u32())) / 1e7
+		rec.Latitude = float64(int32(r.u32())) / 1e7
+		rec.Altitude = int(int16(r.u16()))
+		rec.Angle = int(r.u16())
+		rec.Satellites = int(r.u8())
+		rec.Speed = int(r.u16())
+
+		rec.EventID = uint16(r.field(extended))
+		r.field(extended) // IO总数
+		rec.IO = make(map[uint16]uint64)
+		for _, size := range []int{1, 2, 4, 8} {
+			n := r.field(extended)
+			for j := 0; j < n && r.err == nil; j++ {
+				id := uint16(r.field(extended))
+				rec.IO[id] = r.uint(size)
+			}
+		}
+		if extended {
+			n := int(r.u16())
+			for j := 0; j < n && r.err == nil; j++ {
+				if rec.IOX == nil {
+					rec.IOX = make(map[uint16][]byte)
+				}
+				id := r.u16()
+				rec.IOX[id] = append([]byte(nil), r.next(int(r.u16()))...)
+			}
+		}
+		records = append(records, rec)
+	}
+	if count2 := int(r.u8()); r.err == nil && count2 != count {
+		return codec, nil, fmt.Errorf("record count mismatch: %d != %d", count, count2)
+	}
+	if r.err != nil {
+		return codec, nil, r.err
+	}
+	return codec, records, nil
+}
+
+// encodeCommand Codec12指令: 编解码器ID + 指令数(1) + 类型(0x05) + 长度(4) + 指令 + 指令数(1)
+func encodeCommand(cmd string) []byte {
+	data := []byte{CODEC_12, 1, _TYPE_COMMAND}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(cmd)))
+	data = append(data, cmd...)
+	data = append(data, 1)
+	return encodeFrame(data)
+}
+
+// decodeResponse 解析Codec12终端应答
+func decodeResponse(data []byte) (string, error) {
+	r := &reader{b: data}
+	if codec := r.u8(); codec != CODEC_12 {
+		return "", fmt.Errorf("unexpected codec: %02x", codec)
+	}
+	r.u8()
+	if typ := r.u8(); r.err == nil && typ != _TYPE_RESPONSE {
+		return "", fmt.Errorf("unexpected codec12 type: %02x", typ)
+	}
+	text := r.next(int(r.u32()))
+	if r.err != nil {
+		return "", r.err
+	}
+	return string(text), nil
+}
+
+// UDP数据包头
+type udpHeader struct {
+	PacketID uint16
+	AvlID    byte
+	IMEI     string
+}
+
+// decodeUDP 解析UDP数据包，返回包头和AVL数据(编解码器ID至记录数2)
+func decodeUDP(pkt []byte) (*udpHeader, []byte, error) {
+	r := &reader{b: pkt}
+	n := int(r.u16())
+	if r.err == nil && n+2 != len(pkt) {
+		return nil, nil, fmt.Errorf("udp length mismatch: %d != %d", n+2, len(pkt))
+	}
+	h := &udpHeader{PacketID: r.u16()}
+	r.u8()
+	h.AvlID = r.u8()
+	h.IMEI = string(r.next(int(r.u16())))
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return h, pkt[r.off:], nil
+}
+
+// encodeUDPAck UDP应答: 长度(2) + 包ID(2) + 不可用字节(1) + AVL包ID(1) + 接受的记录数(1)
+func encodeUDPAck(h *udpHeader, count int) []byte {
+	buf := []byte{0x00, 0x05}
+	buf = binary.BigEndian.AppendUint16(buf, h.PacketID)
+	return append(buf, 0x01, h.AvlID, byte(count))
+}
@@ -0,0 +1,94 @@
+package teltonika
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCrc16IBM(t *testing.T) {
+	assert.Equal(t, uint16(0xbb3d), crc16IBM([]byte("123456789")))
+}
+
+func TestDecodeAVL_Codec8(t *testing.T) {
+	// 协议文档中的Codec8示例
+	r := bufio.NewReader(bytes.NewReader(mustHex(t, "000000000000003608010000016B40D8EA30010000000000000000000000000000000105021503010101425E0F01F10000601A014E0000000000000000010000C7CF")))
+	data, err := readFrame(r)
+	assert.NoError(t, err)
+
+	codec, records, err := DecodeAVL(data)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(CODEC_8), codec)
+	assert.Len(t, records, 1)
+	rec := records[0]
+	assert.Equal(t, time.UnixMilli(0x16B40D8EA30), rec.Time)
+	assert.Equal(t, byte(1), rec.Priority)
+	assert.Equal(t, uint16(1), rec.EventID)
+	assert.Equal(t, map[uint16]uint64{21: 3, 1: 1, IO_EXTERNAL_VOLTAGE: 0x5e0f, 241: 0x601a, 78: 0}, rec.IO)
+}
+
+func TestDecodeAVL_Codec8E(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(mustHex(t, "000000000000004A8E010000016B412CEE000100000000000000000000000000000000010005000100010100010011001D00010010015E2C880002000B000000003544C87A000E000000001DD7E06A00000100002994")))
+	data, err := readFrame(r)
+	assert.NoError(t, err)
+
+	codec, records, err := DecodeAVL(data)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(CODEC_8E), codec)
+	assert.Len(t, records, 1)
+	assert.Equal(t, uint64(0x015e2c88), records[0].IO[IO_TOTAL_ODOMETER])
+	assert.Equal(t, uint64(0x3544c87a), records[0].IO[0x0b])
+	assert.Len(t, records[0].IO, 5)
+}
+
+func TestDecodeAVL_Truncated(t *testing.T) {
+	data := mustHex(t, "08010000016B40D8EA300100000000")
+	_, _, err := DecodeAVL(data)
+	assert.Error(t, err)
+}
+
+func TestReadFrame_BadCrc(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(mustHex(t, "000000000000003608010000016B40D8EA30010000000000000000000000000000000105021503010101425E0F01F10000601A014E0000000000000000010000C7CE")))
+	_, err := readFrame(r)
+	assert.Error(t, err)
+}
+
+func TestCodec12(t *testing.T) {
+	assert.Equal(t, mustHex(t, "000000000000000F0C010500000007676574696E666F0100004312"), encodeCommand("getinfo"))
+
+	r := bufio.NewReader(bytes.NewReader(encodeFrame(append(mustHex(t, "0C010600000002"), "OK"...))))
+	data, err := readFrame(r)
+	assert.NoError(t, err)
+	text, err := decodeResponse(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", text)
+}
+
+func TestCodec12_BadLength(t *testing.T) {
+	// 长度字段远超实际数据，不能按它分配内存
+	_, err := decodeResponse(mustHex(t, "0C0106FFFFFFFF4F4B"))
+	assert.Error(t, err)
+}
+
+func TestDecodeUDP(t *testing.T) {
+	hdr, data, err := decodeUDP(mustHex(t, "003DCAFE0105000F33353230393330383634303336353508010000016B4F815B30010000000000000000000000000000000103021503010101425DBC000001"))
+	assert.NoError(t, err)
+	assert.Equal(t, "352093086403655", hdr.IMEI)
+
+	_, records, err := DecodeAVL(data)
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, mustHex(t, "0005CAFE010501"), encodeUDPAck(hdr, len(records)))
+}
@@ -0,0 +1,200 @@
+package teltonika
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// 终端无数据的最长等待时间，超过则断开连接
+const _READ_TIMEOUT = 30 * time.Minute
+
+// 指令应答的最长等待时间，与指令管理器的默认超时一致，超过后不再等待该指令的应答
+const _REPLY_TIMEOUT = 30 * time.Second
+
+type sentCommand struct {
+	id     int64
+	sentAt time.Time
+}
+
+// 单个终端的tcp会话
+type session struct {
+	conn    net.Conn
+	imei    string
+	pending []sentCommand // 已下发未应答的指令，Codec12无流水号，按下发顺序对应应答
+	mu      sync.Mutex
+}
+
+func (s *session) write(b []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := s.conn.Write(b)
+	return err
+}
+
+// sendCommand 下发Codec12指令并记录CommandID
+func (s *session) sendCommand(CommandID int64, cmd string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(encodeCommand(cmd)); err != nil {
+		return fmt.Errorf("write command to %s failed: %v", s.imei, err)
+	}
+	s.pending = append(s.pending, sentCommand{id: CommandID, sentAt: time.Now()})
+	return nil
+}
+
+// popCommand 取出最早下发且未超时的指令，超时未应答的指令丢弃，以免之后的应答错位
+func (s *session) popCommand() (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline := time.Now().Add(-_REPLY_TIMEOUT)
+	for len(s.pending) > 0 && s.pending[0].sentAt.Before(deadline) {
+		slog.Debug("teltonika command reply timed out", "imei", s.imei, "commandID", s.pending[0].id)
+		s.pending = s.pending[1:]
+	}
+	if len(s.pending) == 0 {
+		return 0, false
+	}
+	id := s.pending[0].id
+	s.pending = s.pending[1:]
+	return id, true
+}
+
+// clearCommands 连接断开后不会再收到之前指令的应答
+func (s *session) clearCommands() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = nil
+}
+
+func (s *session) ack(count int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(binary.BigEndian.AppendUint32(nil, uint32(count)))
+}
+
+// 在线终端表
+type sessionStore struct {
+	sync.RWMutex
+	data map[string]*session
+}
+
+func (s *sessionStore) get(imei string) (*session, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	ss, ok := s.data[imei]
+	return ss, ok
+}
+
+func (s *sessionStore) put(ss *session) {
+	s.Lock()
+	defer s.Unlock()
+	if old, ok := s.data[ss.imei]; ok && old != ss {
+		old.conn.Close() //同一终端重连，关闭旧连接
+	}
+	s.data[ss.imei] = ss
+}
+
+func (s *sessionStore) remove(ss *session) {
+	s.Lock()
+	defer s.Unlock()
+	if cur, ok := s.data[ss.imei]; ok && cur == ss {
+		delete(s.data, ss.imei)
+	}
+}
+
+// closeAll 断开所有终端，驱动停止时调用
+func (s *sessionStore) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+	for k, ss := range s.data {
+		ss.conn.Close()
+		delete(s.data, k)
+	}
+}
+
+func (h *teltonika_Handler) serveConn(conn net.Conn) {
+	ss := &session{conn: conn}
+	defer func() {
+		conn.Close()
+		ss.clearCommands()
+		if ss.imei != "" {
+			h.sessions.remove(ss)
+			slog.Info("teltonika terminal disconnected", "imei", ss.imei)
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(_READ_TIMEOUT))
+	imei, err := readIMEI(r)
+	if err != nil {
+		slog.Warn("teltonika read imei failed", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	if err := ss.write([]byte{0x01}); err != nil {
+		slog.Warn("teltonika accept imei failed", "imei", imei, "error", err)
+		return
+	}
+	ss.imei = imei
+	h.sessions.put(ss)
+	slog.Info("teltonika terminal login", "imei", imei, "remote", conn.RemoteAddr().String())
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(_READ_TIMEOUT))
+		data, err := readFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("teltonika read frame failed", "imei", imei, "error", err)
+			}
+			return
+		}
+		if data[0] == CODEC_12 {
+			h.handleResponse(ss, data)
+			continue
+		}
+		codec, records, err := DecodeAVL(data)
+		if err != nil {
+			// 不应答，终端会重发
+			slog.Warn("teltonika decode avl failed", "imei", imei, "error", err)
+			continue
+		}
+		if err := ss.ack(len(records)); err != nil {
+			slog.Error("teltonika ack failed", "imei", imei, "error", err)
+		}
+		h.handleRecords(imei, codec, records)
+	}
+}
+
+// serveUDP 处理UDP上报，UDP终端无会话，不能下发指令
+func (h *teltonika_Handler) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, _MAX_DATA_LEN)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("teltonika udp read failed:" + err.Error())
+			continue
+		}
+		hdr, data, err := decodeUDP(buf[:n])
+		if err != nil {
+			slog.Warn("teltonika decode udp failed", "remote", addr.String(), "error", err)
+			continue
+		}
+		codec, records, err := DecodeAVL(data)
+		if err != nil {
+			slog.Warn("teltonika decode avl failed", "imei", hdr.IMEI, "error", err)
+			continue
+		}
+		if _, err := pc.WriteTo(encodeUDPAck(hdr, len(records)), addr); err != nil {
+			slog.Error("teltonika udp ack failed", "imei", hdr.IMEI, "error", err)
+		}
+		h.handleRecords(hdr.IMEI, codec, records)
+	}
+}
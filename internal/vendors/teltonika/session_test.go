@@ -0,0 +1,24 @@
+package teltonika
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPopCommandDropsExpired(t *testing.T) {
+	now := time.Now()
+	ss := &session{pending: []sentCommand{
+		{id: 1, sentAt: now.Add(-2 * _REPLY_TIMEOUT)}, // 未应答，已超时
+		{id: 2, sentAt: now},
+	}}
+	id, ok := ss.popCommand()
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), id)
+
+	ss.pending = []sentCommand{{id: 3, sentAt: now}}
+	ss.clearCommands()
+	_, ok = ss.popCommand()
+	assert.False(t, ok)
+}
@@ -0,0 +1,263 @@
+package teltonika
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/services"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+
+	"github.com/qichengzx/coordtransform"
+)
+
+//teltonika驱动，支持Codec8/8E上报(TCP/UDP)和Codec12指令(TCP)
+
+var _teltonika = "teltonika"
+
+type teltonika_Handler struct {
+	listenerPort   int                    //监听端口，TCP和UDP共用
+	messageHandler vendors.MessageHandler //统一消息处理接口
+	locS           []services.LocationService
+	listener       net.Listener
+	packetConn     net.PacketConn
+	sessions       *sessionStore //在线终端(TCP)
+}
+
+// 原始报文存档格式（his_data表要求json）
+type NotifyMsg struct {
+	Codec    string      `json:"codec"`
+	IMEI     string      `json:"imei"`
+	Record   *Record     `json:"record,omitempty"`
+	Response string      `json:"response,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+func newStatus(imei string, msg NotifyMsg) *mxm.DeviceStatus1 {
+	msg.IMEI = imei
+	raw, _ := json.Marshal(msg)
+	return &mxm.DeviceStatus1{
+		OriginSN: imei,
+		Type:     _teltonika,
+		RawMsg:   raw,
+	}
+}
+
+func (h *teltonika_Handler) process(status *mxm.DeviceStatus1) {
+	// 调用统一消息处理接口
+	if h.messageHandler == nil {
+		slog.Error("message handler of teltonika is not set")
+		return
+	}
+	if err := h.messageHandler.Process(status); err != nil {
+		slog.Error("Failed to process message", "error", err)
+	}
+}
+
+// handleRecords 按时间顺序逐条处理，只对最新一条做逆地理编码
+func (h *teltonika_Handler) handleRecords(imei string, codec byte, records []*Record) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	for i, rec := range records {
+		status := newStatus(imei, NotifyMsg{Codec: fmt.Sprintf("%02x", codec), Record: rec})
+		status.Device = h.recordToDevice(imei, rec, i == len(records)-1)
+		if rec.Priority == PRIORITY_PANIC {
+			// 紧急按键产生的记录，由消息处理器入库并推送
+			status.Alarms = []mxm.Alarm{{Time: rec.Time, Type: mxm.SOS, Msg: "SOS"}}
+		}
+		h.process(status)
+	}
+}
+
+func (h *teltonika_Handler) recordToDevice(imei string, rec *Record, geocode bool) *mxm.Device {
+	dev := &mxm.Device{
+		OriginSN: &imei,
+		Type:     &_teltonika,
+	}
+	now := time.Now()
+	dev.LastOnline = &now
+
+	if rec.Latitude != 0 || rec.Longitude != 0 {
+		longi, lati := coordtransform.WGS84toGCJ02(rec.Longitude, rec.Latitude)
+		dev.Latitude, dev.Longitude = &lati, &longi
+		alt, speed, heading := float64(rec.Altitude), float64(rec.Speed), float64(rec.Angle)
+		dev.Altitude, dev.Speed, dev.Heading = &alt, &speed, &heading
+		sate := rec.Satellites
+		dev.Satellites = &sate
+		locT := "GPS"
+		dev.LocType = &locT
+		dev.LocTime = &rec.Time
+
+		if geocode {
+			geoRes, err := services.GeocodeWithFallback(h.locS, lati, longi, 2*time.Second)
+			if err != nil {
+				slog.Error("geocode failed", "error", err.Error())
+			} else {
+				dev.Address = &geoRes.Address
+			}
+		}
+	}
+
+	if v, ok := rec.IO[IO_IGNITION]; ok {
+		ignition := v != 0
+		dev.Ignition = &ignition
+	}
+	if v, ok := rec.IO[IO_BATTERY_VOLTAGE]; ok {
+		voltage := float64(v) / 1000
+		dev.BatteryVoltage = &voltage
+	}
+	if v, ok := rec.IO[IO_TOTAL_ODOMETER]; ok {
+		odometer := float64(v) / 1000
+		dev.Odometer = &odometer
+	}
+	if v, ok := rec.IO[IO_BATTERY_LEVEL]; ok {
+		ele := int(min(v, 100))
+		dev.Electricity = &ele
+	}
+	if v, ok := rec.IO[IO_GSM_SIGNAL]; ok {
+		signal := int(min(v, 5)) * 20
+		dev.SimCardSignal = &signal
+	}
+	if v, ok := rec.IO[IO_EXTERNAL_VOLTAGE]; ok {
+		charging := v > 6000 // 接外部电源即视为充电
+		dev.Charging = &charging
+	}
+	return dev
+}
+
+// handleResponse Codec12指令应答，对应最早下发的未应答指令
+func (h *teltonika_Handler) handleResponse(ss *session, data []byte) {
+	text, err := decodeResponse(data)
+	if err != nil {
+		slog.Warn("teltonika decode response failed", "imei", ss.imei, "error", err)
+		return
+	}
+	CommandID, ok := ss.popCommand()
+	if !ok {
+		slog.Info("teltonika response without pending command", "imei", ss.imei, "response", text)
+		return
+	}
+	status := newStatus(ss.imei, NotifyMsg{Codec: fmt.Sprintf("%02x", CODEC_12), Response: text})
+	lower := strings.ToLower(text)
+	status.Command = &mxm.Command{
+		Result: &mxm.CommandResult{
+			CommandID: CommandID,
+			Succeed:   !strings.Contains(lower, "error") && !strings.Contains(lower, "fail"),
+			Msg:       text,
+		},
+	}
+	h.process(status)
+}
+
+func NewTeltonikaHandler(port int) vendors.VendorDriver {
+	return &teltonika_Handler{
+		listenerPort: port,
+		sessions:     &sessionStore{data: make(map[string]*session)},
+		locS:         []services.LocationService{services.NewTxLocationService(), services.NewWzLocationService()},
+	}
+}
+
+func (h *teltonika_Handler) SetMessageHandler(handler vendors.MessageHandler) {
+	h.messageHandler = handler
+}
+
+// 厂商自己的启动逻辑
+func (h *teltonika_Handler) Start() error {
+	addr := fmt.Sprintf(":%v", h.listenerPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("teltonika listen tcp failed: %v", err)
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("teltonika listen udp failed: %v", err)
+	}
+	h.listener, h.packetConn = ln, pc
+
+	go func() {
+		slog.Info("Starting teltonika driver server:" + ln.Addr().String() + "...")
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("teltonika accept failed:" + err.Error())
+				continue
+			}
+			go h.serveConn(conn)
+		}
+	}()
+	go h.serveUDP(pc)
+
+	return nil
+}
+
+// 关闭侦听并断开所有终端
+func (h *teltonika_Handler) Stop() error {
+	if h.listener == nil {
+		return nil
+	}
+	err := errors.Join(h.listener.Close(), h.packetConn.Close())
+	h.listener, h.packetConn = nil, nil
+	h.sessions.closeAll()
+	return err
+}
+
+func (h *teltonika_Handler) Activate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+func (h *teltonika_Handler) Deactivate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+func (h *teltonika_Handler) sendCommand(CommandID int64, originSN string, cmd string) error {
+	ss, ok := h.sessions.get(originSN)
+	if !ok {
+		return fmt.Errorf("teltonika device %s is not connected", originSN)
+	}
+	return ss.sendCommand(CommandID, cmd)
+}
+
+// 设置静止(10000)和运动(10050)时的最小上报周期，单位秒
+func (h *teltonika_Handler) SetReportInterval(CommandID int64, originSN string, interval int) error {
+	return h.sendCommand(CommandID, originSN, fmt.Sprintf("setparam 10000:%d;10050:%d", interval, interval))
+}
+
+// 终端立即生成并上报一条记录
+func (h *teltonika_Handler) Locate(CommandID int64, originSN string) error {
+	return h.sendCommand(CommandID, originSN, "getrecord")
+}
+
+func (h *teltonika_Handler) Reboot(CommandID int64, originSN string) error {
+	return h.sendCommand(CommandID, originSN, "cpureset")
+}
+
+// 车载终端由车辆供电，不支持远程关机
+func (h *teltonika_Handler) PowerOff(CommandID int64, originSN string) error {
+	return vendors.NewUnsupportedError(_teltonika, "POWER_OFF")
+}
+
+func (h *teltonika_Handler) Find(CommandID int64, originSN string) error {
+	return vendors.NewUnsupportedError(_teltonika, "FIND")
+}
+
+// 透传codec12文本指令，如 getinfo
+func (h *teltonika_Handler) SendRaw(CommandID int64, originSN string, payload string) error {
+	return h.sendCommand(CommandID, originSN, payload)
+}
+
+func (h *teltonika_Handler) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities(vendors.ActionSetReportInterval(5, 86400), vendors.ActionLocate, vendors.ActionReboot)
+}
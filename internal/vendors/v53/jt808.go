@@ -0,0 +1,421 @@
+package v53
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JT/T 808 协议编解码（支持2013版与2019版消息头）
+
+const (
+	_FLAG_BYTE   = 0x7e
+	_ESCAPE_BYTE = 0x7d
+
+	// 终端上行消息
+	MSG_TERMINAL_RESPONSE = 0x0001 // 终端通用应答
+	MSG_HEARTBEAT         = 0x0002 // 终端心跳
+	MSG_REGISTER          = 0x0100 // 终端注册
+	MSG_UNREGISTER        = 0x0003 // 终端注销
+	MSG_AUTH              = 0x0102 // 终端鉴权
+	MSG_PARAMS_RESPONSE   = 0x0104 // 查询终端参数应答
+	MSG_LOCATION          = 0x0200 // 位置信息汇报
+	MSG_LOCATION_RESPONSE = 0x0201 // 位置信息查询应答
+
+	// 平台下行消息
+	MSG_PLATFORM_RESPONSE = 0x8001 // 平台通用应答
+	MSG_REGISTER_RESPONSE = 0x8100 // 终端注册应答
+	MSG_SET_PARAMS        = 0x8103 // 设置终端参数
+	MSG_QUERY_PARAMS      = 0x8104 // 查询终端参数
+	MSG_QUERY_LOCATION    = 0x8201 // 位置信息查询
+	MSG_TEXT              = 0x8300 // 文本信息下发
+
+	// 通用应答结果
+	RESULT_SUCCESS     = 0
+	RESULT_FAILURE     = 1
+	RESULT_WRONG_MSG   = 2
+	RESULT_UNSUPPORTED = 3
+
+	// 终端参数ID
+	PARAM_HEARTBEAT_INTERVAL = 0x0001 // 终端心跳发送间隔(s)
+	PARAM_REPORT_INTERVAL    = 0x0029 // 缺省时间汇报间隔(s)
+
+	// 位置附加信息ID，0x01~0x31为标准定义，其余为v53厂商扩展
+	ADDI_MILEAGE    = 0x01 // 里程，DWORD，1/10km
+	ADDI_CSQ        = 0x30 // 无线通信网络信号强度，BYTE
+	ADDI_SATELLITES = 0x31 // GNSS定位卫星数，BYTE
+	ADDI_BATTERY    = 0xE1 // 电池信息：充电状态BYTE + 电量BYTE
+	ADDI_STEPS      = 0xE2 // 计步，DWORD
+	ADDI_WIFI       = 0x54 // WIFI列表
+	ADDI_LBS        = 0x5D // 基站列表
+)
+
+var shanghai = time.FixedZone("CST", 8*3600)
+
+// 消息头
+type Header struct {
+	MsgID       uint16
+	BodyLen     uint16
+	Encrypted   bool
+	SubPackage  bool
+	Version2019 bool
+	ProtoVer    byte   // 2019版协议版本号
+	Phone       string // 终端手机号(BCD解码后去掉前导0)
+	Serial      uint16 // 消息流水号
+	PkgTotal    uint16 // 分包总数
+	PkgIndex    uint16 // 包序号
+}
+
+type Packet struct {
+	Header Header
+	Body   []byte
+}
+
+// 反转义，同时去掉首尾标识位
+func unescape(frame []byte) []byte {
+	out := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); i++ {
+		b := frame[i]
+		if b == _ESCAPE_BYTE && i+1 < len(frame) {
+			switch frame[i+1] {
+			case 0x01:
+				out = append(out, _ESCAPE_BYTE)
+				i++
+				continue
+			case 0x02:
+				out = append(out, _FLAG_BYTE)
+				i++
+				continue
+			}
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func escape(data []byte) []byte {
+	out := make([]byte, 0, len(data)+4)
+	for _, b := range data {
+		switch b {
+		case _FLAG_BYTE:
+			out = append(out, _ESCAPE_BYTE, 0x02)
+		case _ESCAPE_BYTE:
+			out = append(out, _ESCAPE_BYTE, 0x01)
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func checksum(data []byte) byte {
+	var cs byte
+	for _, b := range data {
+		cs ^= b
+	}
+	return cs
+}
+
+// Decode 解析一帧数据（不含首尾0x7e）
+func Decode(frame []byte) (*Packet, error) {
+	data := unescape(frame)
+	if len(data) < 13 {
+		return nil, fmt.Errorf("frame too short: %d", len(data))
+	}
+	payload, cs := data[:len(data)-1], data[len(data)-1]
+	if checksum(payload) != cs {
+		return nil, fmt.Errorf("checksum mismatch, expect %02x, got %02x", checksum(payload), cs)
+	}
+
+	h := Header{}
+	h.MsgID = binary.BigEndian.Uint16(payload[0:2])
+	props := binary.BigEndian.Uint16(payload[2:4])
+	h.BodyLen = props & 0x03ff
+	h.Encrypted = props&0x1c00 != 0
+	h.SubPackage = props&0x2000 != 0
+	h.Version2019 = props&0x4000 != 0
+
+	offset := 4
+	phoneLen := 6
+	if h.Version2019 {
+		h.ProtoVer = payload[offset]
+		offset++
+		phoneLen = 10
+	}
+	if len(payload) < offset+phoneLen+2 {
+		return nil, fmt.Errorf("header too short for msg %04x", h.MsgID)
+	}
+	h.Phone = strings.TrimLeft(bcdToString(payload[offset:offset+phoneLen]), "0")
+	offset += phoneLen
+	h.Serial = binary.BigEndian.Uint16(payload[offset : offset+2])
+	offset += 2
+	if h.SubPackage {
+		if len(payload) < offset+4 {
+			return nil, fmt.Errorf("sub package header too short for msg %04x", h.MsgID)
+		}
+		h.PkgTotal = binary.BigEndian.Uint16(payload[offset : offset+2])
+		h.PkgIndex = binary.BigEndian.Uint16(payload[offset+2 : offset+4])
+		offset += 4
+	}
+	body := payload[offset:]
+	if len(body) != int(h.BodyLen) {
+		return nil, fmt.Errorf("body length mismatch, header %d, actual %d", h.BodyLen, len(body))
+	}
+	return &Packet{Header: h, Body: body}, nil
+}
+
+// Encode 组包并转义，返回包含首尾标识位的完整帧
+func Encode(h Header, body []byte) ([]byte, error) {
+	if len(body) > 0x03ff {
+		return nil, fmt.Errorf("body too long: %d", len(body))
+	}
+	buf := &bytes.Buffer{}
+	props := uint16(len(body))
+	if h.Version2019 {
+		props |= 0x4000
+	}
+	binary.Write(buf, binary.BigEndian, h.MsgID)
+	binary.Write(buf, binary.BigEndian, props)
+	phoneLen := 6
+	if h.Version2019 {
+		buf.WriteByte(h.ProtoVer)
+		phoneLen = 10
+	}
+	phone, err := stringToBCD(h.Phone, phoneLen)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(phone)
+	binary.Write(buf, binary.BigEndian, h.Serial)
+	buf.Write(body)
+
+	payload := buf.Bytes()
+	payload = append(payload, checksum(payload))
+	frame := append([]byte{_FLAG_BYTE}, escape(payload)...)
+	return append(frame, _FLAG_BYTE), nil
+}
+
+func bcdToString(b []byte) string {
+	sb := strings.Builder{}
+	for _, v := range b {
+		sb.WriteByte('0' + (v >> 4))
+		sb.WriteByte('0' + (v & 0x0f))
+	}
+	return sb.String()
+}
+
+func stringToBCD(s string, n int) ([]byte, error) {
+	if len(s) > n*2 {
+		return nil, fmt.Errorf("phone number too long: %s", s)
+	}
+	s = strings.Repeat("0", n*2-len(s)) + s
+	out := make([]byte, n)
+	for i := 0; i < n; i++ {
+		hi, lo := s[2*i]-'0', s[2*i+1]-'0'
+		if hi > 9 || lo > 9 {
+			return nil, fmt.Errorf("invalid phone number: %s", s)
+		}
+		out[i] = hi<<4 | lo
+	}
+	return out, nil
+}
+
+// 通用应答体（0001/8001）
+type GeneralResponse struct {
+	ReplySerial uint16
+	ReplyID     uint16
+	Result      byte
+}
+
+func decodeGeneralResponse(body []byte) (*GeneralResponse, error) {
+	if len(body) < 5 {
+		return nil, errors.New("general response too short")
+	}
+	return &GeneralResponse{
+		ReplySerial: binary.BigEndian.Uint16(body[0:2]),
+		ReplyID:     binary.BigEndian.Uint16(body[2:4]),
+		Result:      body[4],
+	}, nil
+}
+
+func encodeGeneralResponse(r GeneralResponse) []byte {
+	b := make([]byte, 5)
+	binary.BigEndian.PutUint16(b[0:2], r.ReplySerial)
+	binary.BigEndian.PutUint16(b[2:4], r.ReplyID)
+	b[4] = r.Result
+	return b
+}
+
+// 8100 注册应答，鉴权码仅在成功时携带
+func encodeRegisterResponse(replySerial uint16, result byte, authCode string) []byte {
+	b := make([]byte, 3, 3+len(authCode))
+	binary.BigEndian.PutUint16(b[0:2], replySerial)
+	b[2] = result
+	if result == RESULT_SUCCESS {
+		b = append(b, []byte(authCode)...)
+	}
+	return b
+}
+
+// decodeAuth 解析0102终端鉴权，2019版为 鉴权码长度(1)+鉴权码+IMEI(15)+软件版本号(20)，2013版消息体即鉴权码
+func decodeAuth(body []byte, version2019 bool) (string, error) {
+	if !version2019 {
+		return string(body), nil
+	}
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return "", errors.New("auth body too short")
+	}
+	return string(body[1 : 1+int(body[0])]), nil
+}
+
+// 8300 文本信息下发，标志位0x08表示终端TTS播读/显示，这里只用于指令透传，置0即可
+func encodeText(text string, version2019 bool) []byte {
+	if version2019 {
+		return append([]byte{0x00, 0x01}, []byte(text)...) //标志 + 文本类型(1:通知)
+	}
+	return append([]byte{0x00}, []byte(text)...)
+}
+
+// 8103 设置终端参数，仅支持DWORD类型参数
+func encodeSetParams(params map[uint32]uint32) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(len(params)))
+	for id, v := range params {
+		binary.Write(buf, binary.BigEndian, id)
+		buf.WriteByte(4)
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// 0104 查询终端参数应答，返回应答流水号和参数表
+func decodeParamsResponse(body []byte) (uint16, map[uint32][]byte, error) {
+	if len(body) < 3 {
+		return 0, nil, errors.New("params response too short")
+	}
+	replySerial := binary.BigEndian.Uint16(body[0:2])
+	count := int(body[2])
+	params := make(map[uint32][]byte, count)
+	offset := 3
+	for i := 0; i < count; i++ {
+		if len(body) < offset+5 {
+			return 0, nil, fmt.Errorf("params item %d truncated", i)
+		}
+		id := binary.BigEndian.Uint32(body[offset : offset+4])
+		l := int(body[offset+4])
+		offset += 5
+		if len(body) < offset+l {
+			return 0, nil, fmt.Errorf("params item %x value truncated", id)
+		}
+		params[id] = body[offset : offset+l]
+		offset += l
+	}
+	return replySerial, params, nil
+}
+
+// 0200 位置信息汇报
+func decodeLocation(body []byte) (*DeviceGeo, error) {
+	if len(body) < 28 {
+		return nil, fmt.Errorf("location body too short: %d", len(body))
+	}
+	geo := &DeviceGeo{}
+	status := binary.BigEndian.Uint32(body[4:8])
+	meta := decodeStatus(status)
+	geo.Geo = meta
+
+	lat := float64(binary.BigEndian.Uint32(body[8:12])) / 1e6
+	lng := float64(binary.BigEndian.Uint32(body[12:16])) / 1e6
+	if meta.LatitudeType == 1 {
+		lat = -lat
+	}
+	if meta.LongitudeType == 1 {
+		lng = -lng
+	}
+	if meta.LocationStatus == 1 {
+		geo.Location = &Location{
+			Latitude:  lat,
+			Longitude: lng,
+			Altitude:  binary.BigEndian.Uint16(body[16:18]),
+		}
+	}
+	geo.Drive = &Drive{
+		Speed:     float64(binary.BigEndian.Uint16(body[18:20])) / 10,
+		Direction: binary.BigEndian.Uint16(body[20:22]),
+	}
+	tm, err := time.ParseInLocation("060102150405", bcdToString(body[22:28]), shanghai)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location time: %v", err)
+	}
+	geo.Time = tm
+
+	// 附加信息
+	offset := 28
+	for offset+2 <= len(body) {
+		id, l := body[offset], int(body[offset+1])
+		offset += 2
+		if offset+l > len(body) {
+			return nil, fmt.Errorf("additional info %02x truncated", id)
+		}
+		v := body[offset : offset+l]
+		offset += l
+		switch id {
+		case ADDI_CSQ:
+			if l >= 1 {
+				geo.CsqLevel = int8(v[0])
+			}
+		case ADDI_SATELLITES:
+			if l >= 1 {
+				geo.Sattelite = int8(v[0])
+			}
+		case ADDI_BATTERY:
+			b := &Battery{}
+			if err := b.Decode(v); err == nil {
+				geo.Battery = b
+			}
+		case ADDI_STEPS:
+			if l == 4 {
+				geo.Steps = int(binary.BigEndian.Uint32(v))
+			}
+		case ADDI_WIFI:
+			var wifis WifiList
+			if err := wifis.Decode(v); err == nil {
+				geo.WifiInfos = wifis
+			}
+		case ADDI_LBS:
+			var lbss LBSList
+			if err := lbss.Decode(v); err == nil {
+				geo.LBSInfos = lbss
+			}
+		}
+	}
+	return geo, nil
+}
+
+func decodeStatus(s uint32) *GeoMeta {
+	bit := func(n uint) uint8 { return uint8((s >> n) & 1) }
+	return &GeoMeta{
+		ACCStatus:              bit(0),
+		LocationStatus:         bit(1),
+		LatitudeType:           bit(2),
+		LongitudeType:          bit(3),
+		OperatingStatus:        bit(4),
+		GeoEncryptionStatus:    bit(5),
+		LoadStatus:             uint8((s >> 8) & 0x03),
+		FuelSystemStatus:       bit(10),
+		AlternatorSystemStatus: bit(11),
+		DoorLockedStatus:       bit(12),
+		FrontDoorStatus:        bit(13),
+		MidDoorStatus:          bit(14),
+		BackDoorStatus:         bit(15),
+		DriverDoorStatus:       bit(16),
+		CustomDoorStatus:       bit(17),
+		GPSLocationStatus:      bit(18),
+		BeidouLocationStatus:   bit(19),
+		GLONASSLocationStatus:  bit(20),
+		GalileoLocationStatus:  bit(21),
+		DrivingStatus:          bit(22),
+	}
+}
@@ -0,0 +1,97 @@
+package v53
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode_RoundTrip(t *testing.T) {
+	// 消息体包含需要转义的0x7e和0x7d
+	body := []byte{0x7e, 0x01, 0x7d, 0x02}
+	frame, err := Encode(Header{MsgID: MSG_TEXT, Phone: "13800138000", Serial: 42}, body)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(_FLAG_BYTE), frame[0])
+	assert.Equal(t, byte(_FLAG_BYTE), frame[len(frame)-1])
+	assert.NotContains(t, frame[1:len(frame)-1], byte(_FLAG_BYTE))
+
+	p, err := Decode(frame[1 : len(frame)-1])
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(MSG_TEXT), p.Header.MsgID)
+	assert.Equal(t, "13800138000", p.Header.Phone)
+	assert.Equal(t, uint16(42), p.Header.Serial)
+	assert.Equal(t, body, p.Body)
+}
+
+func TestEncodeDecode_Version2019(t *testing.T) {
+	frame, err := Encode(Header{MsgID: MSG_HEARTBEAT, Version2019: true, ProtoVer: 1, Phone: "12345678901234567890", Serial: 1}, nil)
+	assert.NoError(t, err)
+
+	p, err := Decode(frame[1 : len(frame)-1])
+	assert.NoError(t, err)
+	assert.True(t, p.Header.Version2019)
+	assert.Equal(t, byte(1), p.Header.ProtoVer)
+	assert.Equal(t, "12345678901234567890", p.Header.Phone)
+}
+
+func TestDecode_BadChecksum(t *testing.T) {
+	frame, _ := Encode(Header{MsgID: MSG_HEARTBEAT, Phone: "13800138000", Serial: 1}, nil)
+	frame[len(frame)-2] ^= 0xff
+	_, err := Decode(frame[1 : len(frame)-1])
+	assert.Error(t, err)
+}
+
+func TestReadFrame_SkipsEmptyFrames(t *testing.T) {
+	frame, _ := Encode(Header{MsgID: MSG_HEARTBEAT, Phone: "13800138000", Serial: 7}, nil)
+	stream := append([]byte{0x00, _FLAG_BYTE}, frame...)
+	r := bufio.NewReader(bytes.NewReader(stream))
+
+	f, err := readFrame(r)
+	assert.NoError(t, err)
+	p, err := Decode(f)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(7), p.Header.Serial)
+}
+
+func TestDecodeLocation(t *testing.T) {
+	body := make([]byte, 28)
+	binary.BigEndian.PutUint32(body[4:8], 0b1110) // 已定位、南纬、西经
+	binary.BigEndian.PutUint32(body[8:12], 22543210)
+	binary.BigEndian.PutUint32(body[12:16], 114057890)
+	binary.BigEndian.PutUint16(body[16:18], 35)
+	binary.BigEndian.PutUint16(body[18:20], 123)
+	binary.BigEndian.PutUint16(body[20:22], 90)
+	copy(body[22:28], []byte{0x25, 0x04, 0x03, 0x13, 0x43, 0x42})
+	body = append(body, ADDI_SATELLITES, 1, 9)
+	body = append(body, ADDI_BATTERY, 2, 1, 80)
+	body = append(body, ADDI_STEPS, 4, 0, 0, 0x03, 0xe8)
+
+	geo, err := decodeLocation(body)
+	assert.NoError(t, err)
+	assert.NotNil(t, geo.Location)
+	assert.InDelta(t, -22.54321, geo.Location.Latitude, 1e-9)
+	assert.InDelta(t, -114.05789, geo.Location.Longitude, 1e-9)
+	assert.Equal(t, uint16(35), geo.Location.Altitude)
+	assert.InDelta(t, 12.3, geo.Drive.Speed, 1e-9)
+	assert.Equal(t, time.Date(2025, 4, 3, 5, 43, 42, 0, time.UTC), geo.Time.UTC())
+	assert.Equal(t, int8(9), geo.Sattelite)
+	assert.True(t, geo.Battery.Charging)
+	assert.Equal(t, int8(80), geo.Battery.BatteryLevel)
+	assert.Equal(t, 1000, geo.Steps)
+}
+
+func TestDecodeParamsResponse(t *testing.T) {
+	body := []byte{0x00, 0x05, 1}
+	body = binary.BigEndian.AppendUint32(body, PARAM_REPORT_INTERVAL)
+	body = append(body, 4)
+	body = binary.BigEndian.AppendUint32(body, 60)
+
+	serial, params, err := decodeParamsResponse(body)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(5), serial)
+	assert.Equal(t, uint32(60), binary.BigEndian.Uint32(params[PARAM_REPORT_INTERVAL]))
+}
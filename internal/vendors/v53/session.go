@@ -0,0 +1,239 @@
+package v53
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// 终端无数据的最长等待时间，超过则断开连接
+const _READ_TIMEOUT = 30 * time.Minute
+
+// 单个终端的tcp会话
+type session struct {
+	conn        net.Conn
+	phone       string
+	version2019 bool //收到终端消息时更新，下发时读取，需持有mu
+	protoVer    byte
+	serial      uint16           //平台流水号
+	authed      bool             //鉴权通过后才处理其他消息并加入在线终端表，只在读协程中访问
+	commands    map[uint16]int64 //指令流水号到CommandID，终端应答时据此回传指令结果
+	mu          sync.Mutex
+}
+
+func (s *session) nextSerial() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serial++
+	return s.serial
+}
+
+// setVersion 按终端最近一条消息的协议版本下发
+func (s *session) setVersion(version2019 bool, protoVer byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version2019, s.protoVer = version2019, protoVer
+}
+
+func (s *session) version() (bool, byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version2019, s.protoVer
+}
+
+// sendCommand 以会话流水号下发指令，并记下流水号对应的CommandID
+// 流水号只有16位，CommandID不能直接用作流水号
+func (s *session) sendCommand(msgID uint16, commandID int64, body []byte) error {
+	serial := s.nextSerial()
+	s.mu.Lock()
+	if s.commands == nil {
+		s.commands = make(map[uint16]int64)
+	}
+	s.commands[serial] = commandID
+	s.mu.Unlock()
+	if err := s.send(msgID, serial, body); err != nil {
+		s.takeCommand(serial)
+		return err
+	}
+	return nil
+}
+
+// takeCommand 取出应答流水号对应的CommandID，不是指令应答时返回false
+func (s *session) takeCommand(serial uint16) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	commandID, ok := s.commands[serial]
+	delete(s.commands, serial)
+	return commandID, ok
+}
+
+// send 下发消息，serial为0时使用会话自增流水号
+func (s *session) send(msgID uint16, serial uint16, body []byte) error {
+	if serial == 0 {
+		serial = s.nextSerial()
+	}
+	version2019, protoVer := s.version()
+	frame, err := Encode(Header{
+		MsgID:       msgID,
+		Version2019: version2019,
+		ProtoVer:    protoVer,
+		Phone:       s.phone,
+		Serial:      serial,
+	}, body)
+	if err != nil {
+		return fmt.Errorf("encode %04x failed: %v", msgID, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.conn.Write(frame); err != nil {
+		return fmt.Errorf("write %04x to %s failed: %v", msgID, s.phone, err)
+	}
+	return nil
+}
+
+func (s *session) reply(p *Packet, result byte) error {
+	return s.send(MSG_PLATFORM_RESPONSE, 0, encodeGeneralResponse(GeneralResponse{
+		ReplySerial: p.Header.Serial,
+		ReplyID:     p.Header.MsgID,
+		Result:      result,
+	}))
+}
+
+// 注册时下发的鉴权码，只保存在内存中，重启后终端鉴权失败会重新注册
+type authStore struct {
+	sync.Mutex
+	codes map[string]string
+}
+
+// issue 为终端生成新的鉴权码，旧鉴权码作废
+func (a *authStore) issue(phone string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	a.Lock()
+	defer a.Unlock()
+	a.codes[phone] = code
+	return code, nil
+}
+
+func (a *authStore) check(phone, code string) bool {
+	a.Lock()
+	defer a.Unlock()
+	expected, ok := a.codes[phone]
+	return ok && code != "" && code == expected
+}
+
+func (a *authStore) revoke(phone string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.codes, phone)
+}
+
+// 在线终端表
+type sessionStore struct {
+	sync.RWMutex
+	data map[string]*session
+}
+
+func (s *sessionStore) get(phone string) (*session, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	ss, ok := s.data[phone]
+	return ss, ok
+}
+
+func (s *sessionStore) put(ss *session) {
+	s.Lock()
+	defer s.Unlock()
+	if old, ok := s.data[ss.phone]; ok && old != ss {
+		old.conn.Close() //同一终端重连，关闭旧连接
+	}
+	s.data[ss.phone] = ss
+}
+
+func (s *sessionStore) remove(ss *session) {
+	s.Lock()
+	defer s.Unlock()
+	if cur, ok := s.data[ss.phone]; ok && cur == ss {
+		delete(s.data, ss.phone)
+	}
+}
+
+// closeAll 断开所有终端，驱动停止时调用
+func (s *sessionStore) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+	for k, ss := range s.data {
+		ss.conn.Close()
+		delete(s.data, k)
+	}
+}
+
+// readFrame 读取下一帧（不含首尾标识位），跳过标识位之间的空帧
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.ReadBytes(_FLAG_BYTE); err != nil {
+		return nil, err
+	}
+	for {
+		frame, err := r.ReadBytes(_FLAG_BYTE)
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) > 1 {
+			return frame[:len(frame)-1], nil
+		}
+	}
+}
+
+func (h *v53_Handler) serveConn(conn net.Conn) {
+	ss := &session{conn: conn}
+	defer func() {
+		conn.Close()
+		if ss.authed {
+			h.sessions.remove(ss)
+			slog.Info("v53 terminal disconnected", "phone", ss.phone)
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(_READ_TIMEOUT))
+		frame, err := readFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("v53 read frame failed", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		p, err := Decode(frame)
+		if err != nil {
+			slog.Warn("v53 decode frame failed", "remote", conn.RemoteAddr().String(), "error", err)
+			continue
+		}
+		// 鉴权前只处理注册和鉴权，鉴权通过后由handlePacket加入在线终端表，之后不允许更换手机号
+		if !ss.authed {
+			if p.Header.MsgID != MSG_REGISTER && p.Header.MsgID != MSG_AUTH {
+				slog.Warn("v53 message before auth dropped", "remote", conn.RemoteAddr().String(),
+					"phone", p.Header.Phone, "msgID", fmt.Sprintf("%04x", p.Header.MsgID))
+				continue
+			}
+			ss.phone = p.Header.Phone
+		} else if p.Header.Phone != ss.phone {
+			slog.Warn("v53 phone mismatch dropped", "phone", ss.phone, "got", p.Header.Phone)
+			continue
+		}
+		ss.setVersion(p.Header.Version2019, p.Header.ProtoVer)
+
+		h.handlePacket(ss, p)
+	}
+}
@@ -0,0 +1,63 @@
+package v53
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type countHandler struct{ n atomic.Int32 }
+
+func (c *countHandler) Process(*mxm.DeviceStatus1) error {
+	c.n.Add(1)
+	return nil
+}
+
+func TestServeConnRequiresAuth(t *testing.T) {
+	h := NewV53Handler(0).(*v53_Handler)
+	mh := &countHandler{}
+	h.SetMessageHandler(mh)
+	client, server := net.Pipe()
+	defer client.Close()
+	go h.serveConn(server)
+
+	phone := "13800138000"
+	r := bufio.NewReader(client)
+	request := func(msgID uint16, body []byte) *Packet {
+		frame, err := Encode(Header{MsgID: msgID, Phone: phone, Serial: 1}, body)
+		assert.NoError(t, err)
+		_, err = client.Write(frame)
+		assert.NoError(t, err)
+		reply, err := readFrame(r)
+		assert.NoError(t, err)
+		p, err := Decode(reply)
+		assert.NoError(t, err)
+		return p
+	}
+
+	// 鉴权前的心跳被丢弃，不应答，下一条应答即注册应答
+	frame, _ := Encode(Header{MsgID: MSG_HEARTBEAT, Phone: phone, Serial: 1}, nil)
+	client.Write(frame)
+	p := request(MSG_REGISTER, nil)
+	assert.Equal(t, uint16(MSG_REGISTER_RESPONSE), p.Header.MsgID)
+	code := p.Body[3:]
+	assert.NotEqual(t, phone, string(code))
+
+	p = request(MSG_AUTH, []byte(phone))
+	assert.Equal(t, byte(RESULT_FAILURE), p.Body[4])
+	_, ok := h.sessions.get(phone)
+	assert.False(t, ok)
+
+	p = request(MSG_AUTH, code)
+	assert.Equal(t, byte(RESULT_SUCCESS), p.Body[4])
+	_, ok = h.sessions.get(phone)
+	assert.True(t, ok)
+
+	request(MSG_HEARTBEAT, nil) // 先应答再处理
+	assert.Eventually(t, func() bool { return mh.n.Load() == 1 }, time.Second, 10*time.Millisecond)
+}
@@ -1,20 +1,19 @@
 package v53
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
+	"net"
 	"time"
 
-	"github.com/Daneel-Li/gps-back/internal/config"
 	mxm "github.com/Daneel-Li/gps-back/internal/models"
 	"github.com/Daneel-Li/gps-back/internal/services"
 	"github.com/Daneel-Li/gps-back/internal/vendors"
-	"github.com/Daneel-Li/gps-back/pkg/utils"
 
-	"github.com/gorilla/mux"
 	"github.com/qichengzx/coordtransform"
 )
 
@@ -25,91 +24,142 @@ type v53_Handler struct {
 	listenerPort   int                    //监听端口
 	messageHandler vendors.MessageHandler //统一消息处理接口
 	locS           []services.LocationService
+	listener       net.Listener
+	sessions       *sessionStore //在线终端
+	auth           *authStore    //终端鉴权码
 }
 
+// 原始报文存档格式（his_data表要求json）
 type NotifyMsg struct {
 	MsgType string      `json:"msg_type"`
+	Phone   string      `json:"phone"`
+	Serial  uint16      `json:"serial"`
 	Data    interface{} `json:"data"`
+	Hex     string      `json:"hex"`
 }
 
-func (h *v53_Handler) HandleNotify(w http.ResponseWriter, r *http.Request) {
-
-	// 请帮我完善这里，服务器会收到notify消息，可能会是0200位置上报也可能是别的
-	// 读取请求体
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		slog.Error("Failed to read request body", "error", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
+func newStatus(p *Packet, data interface{}) *mxm.DeviceStatus1 {
+	raw, _ := json.Marshal(NotifyMsg{
+		MsgType: fmt.Sprintf("%04x", p.Header.MsgID),
+		Phone:   p.Header.Phone,
+		Serial:  p.Header.Serial,
+		Data:    data,
+		Hex:     hex.EncodeToString(p.Body),
+	})
+	return &mxm.DeviceStatus1{
+		OriginSN: p.Header.Phone,
+		Type:     _v53,
+		RawMsg:   raw,
 	}
-	defer r.Body.Close()
+}
 
-	msg := NotifyMsg{}
-	if err := json.Unmarshal(body, &msg); err != nil {
-		slog.Error("Failed to parse message type", "error", err)
-		http.Error(w, "Invalid message format", http.StatusBadRequest)
+func (h *v53_Handler) handlePacket(ss *session, p *Packet) {
+	if p.Header.SubPackage {
+		//v53终端不会主动分包，多媒体等长消息暂不支持
+		slog.Warn("v53 sub package not supported", "phone", p.Header.Phone, "msgID", fmt.Sprintf("%04x", p.Header.MsgID))
+		ss.reply(p, RESULT_UNSUPPORTED)
 		return
 	}
 
-	tp := "v53"
-	status := &mxm.DeviceStatus1{
-		Type:   tp,
-		RawMsg: body,
-	}
-	switch msg.MsgType {
-	case "0200", "0201": // 位置上报消息,立即定位的回应位置上报消息
-		h.handle0200(status, msg.Data)
-	case "0202": // 立即定位的回应位置上报消息
-	case "0002": // 心跳
-		handle0002(status, msg.Data)
-	case "0104": // 参数查询回应
-		handle0104(status, msg.Data)
-	case "8103_reply": // 终端通用应答
-		handle8103_reply(status, msg.Data)
-	case "8300_reply": //文本指令应答
-		handle8300_reply(status, msg.Data)
-
-	case "0300": // 假设的其他消息类型
-		var otherMsg struct {
-			SerialNumber string `json:"sn"`
-			// 其他字段...
+	var status *mxm.DeviceStatus1
+	switch p.Header.MsgID {
+	case MSG_REGISTER: // 注册，下发随机鉴权码，终端此后凭它鉴权
+		code, err := h.auth.issue(p.Header.Phone)
+		result := byte(RESULT_SUCCESS)
+		if err != nil {
+			slog.Error("issue auth code failed", "phone", p.Header.Phone, "error", err)
+			result = RESULT_FAILURE
+		}
+		if err := ss.send(MSG_REGISTER_RESPONSE, 0, encodeRegisterResponse(p.Header.Serial, result, code)); err != nil {
+			slog.Error("reply register failed", "error", err)
 		}
-		if err := json.Unmarshal(body, &otherMsg); err != nil {
-			slog.Error("Failed to parse other message", "error", err)
-			http.Error(w, "Invalid message data", http.StatusBadRequest)
+		return
+	case MSG_AUTH:
+		code, err := decodeAuth(p.Body, p.Header.Version2019)
+		if err != nil || !h.auth.check(p.Header.Phone, code) {
+			slog.Warn("v53 auth failed", "phone", p.Header.Phone, "error", err)
+			ss.reply(p, RESULT_FAILURE)
 			return
 		}
-
-		status = &mxm.DeviceStatus1{
-			OriginSN: otherMsg.SerialNumber,
-			// 设置其他状态字段...
+		if !ss.authed {
+			ss.authed = true
+			h.sessions.put(ss)
+		}
+		ss.reply(p, RESULT_SUCCESS)
+		return
+	case MSG_UNREGISTER:
+		h.auth.revoke(p.Header.Phone)
+		ss.reply(p, RESULT_SUCCESS)
+		return
+	case MSG_HEARTBEAT: // 心跳
+		ss.reply(p, RESULT_SUCCESS)
+		status = newStatus(p, nil)
+		handle0002(status)
+	case MSG_LOCATION, MSG_LOCATION_RESPONSE: // 位置上报消息,立即定位的回应位置上报消息
+		ss.reply(p, RESULT_SUCCESS)
+		body := p.Body
+		if p.Header.MsgID == MSG_LOCATION_RESPONSE && len(body) >= 2 {
+			body = body[2:] // 去掉应答流水号
+		}
+		geo, err := decodeLocation(body)
+		if err != nil {
+			slog.Error("decode location failed", "phone", p.Header.Phone, "error", err)
+			return
+		}
+		geo.Phone = p.Header.Phone
+		status = newStatus(p, geo)
+		h.handle0200(status, geo)
+	case MSG_PARAMS_RESPONSE: // 参数查询回应
+		_, params, err := decodeParamsResponse(p.Body)
+		if err != nil {
+			slog.Error("decode params response failed", "phone", p.Header.Phone, "error", err)
+			return
+		}
+		status = newStatus(p, params)
+		handle0104(status, params)
+	case MSG_TERMINAL_RESPONSE: // 终端通用应答
+		resp, err := decodeGeneralResponse(p.Body)
+		if err != nil {
+			slog.Error("decode terminal response failed", "phone", p.Header.Phone, "error", err)
+			return
+		}
+		status = newStatus(p, resp)
+		switch resp.ReplyID {
+		case MSG_SET_PARAMS:
+			if commandID, ok := ss.takeCommand(resp.ReplySerial); ok {
+				handle8103_reply(status, commandID, resp)
+			}
+			if resp.Result == RESULT_SUCCESS {
+				h.refreshParams(p.Header.Phone)
+			}
+		case MSG_TEXT: //文本指令应答
+			commandID, ok := ss.takeCommand(resp.ReplySerial)
+			if !ok {
+				slog.Debug("text response without command", "phone", p.Header.Phone, "serial", resp.ReplySerial)
+				return
+			}
+			handle8300_reply(status, commandID, resp)
+		default:
+			slog.Debug("terminal response ignored", "phone", p.Header.Phone, "replyID", fmt.Sprintf("%04x", resp.ReplyID))
+			return
 		}
-
 	default:
-		slog.Error("Unknown message type", "type", msg.MsgType)
-		http.Error(w, "Unsupported message type", http.StatusBadRequest)
+		slog.Warn("Unknown message type", "type", fmt.Sprintf("%04x", p.Header.MsgID))
+		ss.reply(p, RESULT_UNSUPPORTED)
 		return
 	}
 
 	// 调用统一消息处理接口
+	if h.messageHandler == nil {
+		slog.Error("message handler of v53 is not set")
+		return
+	}
 	if err := h.messageHandler.Process(status); err != nil {
 		slog.Error("Failed to process message", "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
 }
 
-func (h *v53_Handler) handle0200(status *mxm.DeviceStatus1, data interface{}) {
-	bytes, e := json.Marshal(data)
-	if e != nil {
-		slog.Error("Failed to marshal message", "error", e)
-		return
-	}
-	geo := DeviceGeo{}
-	json.Unmarshal(bytes, &geo)
+func (h *v53_Handler) handle0200(status *mxm.DeviceStatus1, geo *DeviceGeo) {
 	if status.Device == nil {
 		tp := "v53"
 		status.Device = &mxm.Device{
@@ -142,26 +192,10 @@ func (h *v53_Handler) handle0200(status *mxm.DeviceStatus1, data interface{}) {
 	locT := "GPS"
 	if dev.Latitude != nil && *dev.Latitude != 0 {
 		locT = "GPS"
-		var geoRes *services.GeoCoderResult = nil
-		var lastErr error
-
-		// 循环尝试不同的地理编码服务
-		for i, locService := range h.locS {
-			var err error
-			geoRes, err = locService.Geocode(*dev.Latitude, *dev.Longitude, 2*time.Second)
-			if err == nil {
-				break // 成功则跳出循环
-			}
-			lastErr = err
-			if i < len(h.locS)-1 {
-				slog.Warn("invoking geocoder service failed, trying next service...", "error", err.Error())
-			}
-		}
-
-		if geoRes == nil && lastErr != nil {
-			slog.Error("all geocoder services failed", "error", lastErr.Error())
-		}
-		if geoRes != nil {
+		geoRes, err := services.GeocodeWithFallback(h.locS, *dev.Latitude, *dev.Longitude, 2*time.Second)
+		if err != nil {
+			slog.Error("geocode failed", "error", err.Error())
+		} else {
 			dev.Address = &geoRes.Address
 		}
 	} else if len(geo.WifiInfos) > 0 {
@@ -177,29 +211,13 @@ func (h *v53_Handler) handle0200(status *mxm.DeviceStatus1, data interface{}) {
 		req := services.LocationRequest{
 			WifiInfo: wifis,
 		}
-
-		var locRes *services.LocationResult
-		var lastErr error
-
-		// 循环尝试不同的位置服务
-		for i, locService := range h.locS {
-			var err error
-			locRes, err = locService.LocateByNetwork(req, 2*time.Second)
-			if err == nil {
-				break // 成功则跳出循环
-			}
-			lastErr = err
-			if i < len(h.locS)-1 {
-				slog.Warn("invoking loc service failed, trying next service...", "error", err.Error())
-			}
-		}
-
-		if locRes != nil {
+		locRes, err := services.LocateWithFallback(h.locS, req, 2*time.Second)
+		if err != nil {
+			slog.Error("wifi locate failed", "error", err.Error())
+		} else if locRes.Location != nil {
 			dev.Address = &locRes.Address
 			dev.Longitude = &locRes.Location.Longitude
 			dev.Latitude = &locRes.Location.Latitude
-		} else if lastErr != nil {
-			slog.Error("all loc services failed", "error", lastErr.Error())
 		}
 	} else if len(geo.LBSInfos) > 0 {
 		locT = "LBS"
@@ -207,128 +225,70 @@ func (h *v53_Handler) handle0200(status *mxm.DeviceStatus1, data interface{}) {
 	dev.LocType = &locT
 }
 
-func handle0002(status *mxm.DeviceStatus1, data interface{}) {
-	// 心跳推送回来的也是整个geo，直接按0200处理 //TODO 后续再完善细化
-	//但是只处理电量更新，其它的都是旧值，不更新
-	bytes, e := json.Marshal(data)
-	if e != nil {
-		slog.Error("Failed to marshal message", "error", e)
-		return
-	}
-	geo := DeviceGeo{}
-	json.Unmarshal(bytes, &geo)
+func handle0002(status *mxm.DeviceStatus1) {
+	// 心跳无消息体，只更新通信时间
 	if status.Device == nil {
-		tp := "v53"
 		status.Device = &mxm.Device{
-			Type: &tp,
+			Type: &_v53,
 		}
 	}
-	dev := status.Device
-	dev.OriginSN = &geo.Phone
-	status.OriginSN = geo.Phone
-	if geo.Battery != nil {
-		ele := int(geo.Battery.BatteryLevel)
-		dev.Electricity = &ele
-	}
-	dev.LastOnline = &geo.Time
+	now := time.Now()
+	status.Device.OriginSN = &status.OriginSN
+	status.Device.LastOnline = &now
 }
 
 var _v53 = "v53"
 
-type v53_params struct {
-	DevicePhone    string `json:"device_phone"`   // 关联device phone
-	ReportInterval int    `json:"reportInterval"` // 上报间隔(s)
-}
-
-func handle0104(status *mxm.DeviceStatus1, data interface{}) {
+func handle0104(status *mxm.DeviceStatus1, params map[uint32][]byte) {
 	if status.Device == nil {
 		status.Device = &mxm.Device{}
 	}
 	status.Type, status.Device.Type = _v53, &_v53
+	status.Device.OriginSN = &status.OriginSN
 
-	bytes, e := json.Marshal(data)
-	if e != nil {
-		slog.Error("Failed to marshal message", "error", e)
-		return
+	if v, ok := params[PARAM_REPORT_INTERVAL]; ok && len(v) == 4 {
+		interval := int(binary.BigEndian.Uint32(v))
+		status.Device.Interval = &interval
 	}
-	params := v53_params{}
-	if err := json.Unmarshal(bytes, &params); err != nil {
-		slog.Error("Failed to unmarshal message", "error", err)
-		return
-	}
-	status.OriginSN = params.DevicePhone
-	status.Device.OriginSN = &params.DevicePhone
-	status.Device.Interval = &params.ReportInterval
 }
 
-func handle8103_reply(status *mxm.DeviceStatus1, data interface{}) {
-	type cmdResult struct {
-		PhoneNumber string `json:"phone_number"`
-		CommandID   uint32 `json:"command_id"`
-		Succeed     bool   `json:"succeed"`
-		Msg         string `json:"msg"`
-	}
-	cr := cmdResult{}
-	bytes, e := json.Marshal(data)
-	if e != nil {
-		slog.Error("Failed to marshal message", "error", e)
-		return
-	}
-	if err := json.Unmarshal(bytes, &cr); err != nil {
-		slog.Error("Failed to unmarshal message", "error", err)
-		return
-	}
-	status.OriginSN = cr.PhoneNumber
+func handle8103_reply(status *mxm.DeviceStatus1, commandID int64, resp *GeneralResponse) {
 	status.Command = &mxm.Command{
 		Result: &mxm.CommandResult{
-			CommandID: int64(cr.CommandID),
-			Succeed:   cr.Succeed,
+			CommandID: commandID,
+			Succeed:   resp.Result == RESULT_SUCCESS,
 		},
 	}
-
-	refreshParams(status.OriginSN)
 }
 
 // 文本指令应答
-func handle8300_reply(status *mxm.DeviceStatus1, data interface{}) {
-	slog.Debug("handle8300_reply", "data", data)
-	type cmdResult struct {
-		PhoneNumber string `json:"phone_number"`
-		CommandID   uint32 `json:"command_id"`
-		Succeed     bool   `json:"succeed"`
-		Msg         string `json:"msg"`
-	}
-	cr := cmdResult{}
-	bytes, e := json.Marshal(data)
-	if e != nil {
-		slog.Error("Failed to marshal message", "error", e)
-		return
-	}
-	if err := json.Unmarshal(bytes, &cr); err != nil {
-		slog.Error("Failed to unmarshal message", "error", err)
-		return
-	}
-	status.OriginSN = cr.PhoneNumber
+func handle8300_reply(status *mxm.DeviceStatus1, commandID int64, resp *GeneralResponse) {
+	slog.Debug("handle8300_reply", "resp", resp)
 	status.Command = &mxm.Command{
 		Result: &mxm.CommandResult{
-			CommandID: int64(cr.CommandID),
-			Succeed:   cr.Succeed,
+			CommandID: commandID,
+			Succeed:   resp.Result == RESULT_SUCCESS,
 		},
 	}
 }
 
-func refreshParams(phoneNumber string) {
-	_, err := utils.HttpGet("http://localhost:8008/device/" + phoneNumber + "/params")
-	if err != nil {
-		slog.Error("Failed to get refresh params", "error", err)
+// 查询终端参数，终端以0104应答
+func (h *v53_Handler) refreshParams(phone string) {
+	ss, ok := h.sessions.get(phone)
+	if !ok {
 		return
 	}
+	if err := ss.send(MSG_QUERY_PARAMS, 0, nil); err != nil {
+		slog.Error("Failed to refresh params", "error", err)
+	}
 }
 
 func NewV53Handler(port int) vendors.VendorDriver {
 
 	return &v53_Handler{
 		listenerPort: port,
+		sessions:     &sessionStore{data: make(map[string]*session)},
+		auth:         &authStore{codes: make(map[string]string)},
 		locS:         []services.LocationService{services.NewTxLocationService(), services.NewWzLocationService()},
 	}
 }
@@ -339,25 +299,41 @@ func (h *v53_Handler) SetMessageHandler(handler vendors.MessageHandler) {
 
 // 厂商自己的启动逻辑
 func (h *v53_Handler) Start() error {
-	// 订阅/侦听来自808平台的协议推送
-	r := mux.NewRouter()
-	// 配置 HTTPS 服务器
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%v", h.listenerPort),
-		Handler: r, // 使用 ServeMux 作为请求处理器
+	// 直接侦听终端的JT/T 808 tcp连接
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", h.listenerPort))
+	if err != nil {
+		return fmt.Errorf("v53 listen failed: %v", err)
 	}
-
-	r.HandleFunc("/v53/notify", h.HandleNotify).Methods("POST")
+	h.listener = ln
 
 	go func() {
-		slog.Info("Starting v53 driver HTTP server:" + server.Addr + "...")
-		if err := server.ListenAndServe(); err != nil {
-			slog.Error("Failed to start HTTP server:" + err.Error())
+		slog.Info("Starting v53 driver JT808 server:" + ln.Addr().String() + "...")
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("v53 accept failed:" + err.Error())
+				continue
+			}
+			go h.serveConn(conn)
 		}
 	}()
 
 	return nil
 }
+
+// 关闭侦听并断开所有终端
+func (h *v53_Handler) Stop() error {
+	if h.listener == nil {
+		return nil
+	}
+	err := h.listener.Close()
+	h.listener = nil
+	h.sessions.closeAll()
+	return err
+}
 func (h *v53_Handler) Activate(originSN string) error {
 	//Do nothing
 	return nil
@@ -367,19 +343,25 @@ func (h *v53_Handler) Deactivate(originSN string) error {
 	return nil
 }
 
-func (h *v53_Handler) SetReportInterval(CommandID int64, originSN string, interval int) error {
-	defer func() {
-		go func() {
-			<-time.After(time.Second * 1)
-			utils.HttpGet(config.GetConfig().JT808Url + originSN + "/params")
-		}()
-	}()
-
-	bytes, _ := json.Marshal(map[string]interface{}{
-		"command_id":   CommandID,
-		"text_content": fmt.Sprintf("upload,%v#", interval)})
+// 下发文本指令，终端应答(0001)时按流水号回传指令结果
+func (h *v53_Handler) sendText(CommandID int64, originSN string, text string) error {
+	ss, ok := h.sessions.get(originSN)
+	if !ok {
+		return fmt.Errorf("v53 device %s is not connected", originSN)
+	}
+	version2019, _ := ss.version()
+	return ss.sendCommand(MSG_TEXT, CommandID, encodeText(text, version2019))
+}
 
-	return utils.HttpPost(config.GetConfig().JT808Url+originSN+"/text", bytes)
+func (h *v53_Handler) SetReportInterval(CommandID int64, originSN string, interval int) error {
+	ss, ok := h.sessions.get(originSN)
+	if !ok {
+		return fmt.Errorf("v53 device %s is not connected", originSN)
+	}
+	// 终端应答成功后会查询一次参数，以刷新数据库中的上报间隔
+	return ss.sendCommand(MSG_SET_PARAMS, CommandID, encodeSetParams(map[uint32]uint32{
+		PARAM_REPORT_INTERVAL: uint32(interval),
+	}))
 }
 
 // 定时开机tm格式为hh:mm,指令内容AUTOMATIC,1,1,09:00# 表示9点开机
@@ -388,10 +370,7 @@ func (h *v53_Handler) AutoStart(CommandID int64, originSN string, tm string, ena
 	if !enable {
 		enableS = "0"
 	}
-	bytes, _ := json.Marshal(map[string]interface{}{
-		"command_id":   CommandID,
-		"text_content": fmt.Sprintf("AUTOMATIC,%s,1,%s#", enableS, tm)})
-	return utils.HttpPost(config.GetConfig().JT808Url+originSN+"/text", bytes)
+	return h.sendText(CommandID, originSN, fmt.Sprintf("AUTOMATIC,%s,1,%s#", enableS, tm))
 }
 
 // 定时开机tm格式为hh:mm,指令内容AUTOMATIC,1,0,09:00# 表示9点关机
@@ -400,36 +379,31 @@ func (h *v53_Handler) AutoShut(CommandID int64, originSN string, tm string, enab
 	if !enable {
 		enableS = "0"
 	}
-	bytes, _ := json.Marshal(map[string]interface{}{
-		"command_id":   CommandID,
-		"text_content": fmt.Sprintf("AUTOMATIC,%s,0,%s#", enableS, tm)})
-	return utils.HttpPost(config.GetConfig().JT808Url+originSN+"/text", bytes)
+	return h.sendText(CommandID, originSN, fmt.Sprintf("AUTOMATIC,%s,0,%s#", enableS, tm))
 }
 
 func (h *v53_Handler) Locate(CommandID int64, originSN string) error {
-	bytes, _ := json.Marshal(map[string]interface{}{
-		"command_id":   CommandID,
-		"text_content": "LJDW#"})
-	return utils.HttpPost(config.GetConfig().JT808Url+originSN+"/text", bytes)
+	return h.sendText(CommandID, originSN, "LJDW#")
 }
 func (h *v53_Handler) Reboot(CommandID int64, originSN string) error {
-	bytes, _ := json.Marshal(map[string]interface{}{
-		"command_id":   CommandID,
-		"text_content": "RESET#"})
-	return utils.HttpPost(config.GetConfig().JT808Url+originSN+"/text", bytes)
+	return h.sendText(CommandID, originSN, "RESET#")
 }
 func (h *v53_Handler) PowerOff(CommandID int64, originSN string) error {
-	bytes, _ := json.Marshal(map[string]interface{}{
-		"command_id":   CommandID,
-		"text_content": "SHUTDOWN#"})
-	return utils.HttpPost(config.GetConfig().JT808Url+originSN+"/text", bytes)
+	return h.sendText(CommandID, originSN, "SHUTDOWN#")
 }
 
 // 查找设备（寻宠）
 func (h *v53_Handler) Find(CommandID int64, originSN string) error {
-	// 调用808平台接口，设置设备上报间隔
-	bytes, _ := json.Marshal(map[string]interface{}{
-		"command_id":   CommandID,
-		"text_content": "bon,1#"})
-	return utils.HttpPost(config.GetConfig().JT808Url+originSN+"/text", bytes)
+	return h.sendText(CommandID, originSN, "bon,1#")
+}
+
+// 透传文本指令，如 upload,60#
+func (h *v53_Handler) SendRaw(CommandID int64, originSN string, payload string) error {
+	return h.sendText(CommandID, originSN, payload)
+}
+
+// v53支持定时开关机
+func (h *v53_Handler) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities(vendors.ActionSetReportInterval(10, 86400), vendors.ActionLocate,
+		vendors.ActionReboot, vendors.ActionPowerOff, vendors.ActionFind, vendors.ActionAutoStart, vendors.ActionAutoShut)
 }
@@ -13,8 +13,11 @@ type VendorDriver interface {
 	// Must call unified processor (via dependency injection)
 	SetMessageHandler(handler MessageHandler)
 
-	// Vendor's own startup logic
+	// Vendor's own startup logic. Must return within a bounded time, reporting an unreachable
+	// backend as an error rather than waiting for it; the driver is locked against Stop meanwhile
 	Start() error
+	// Releases what Start acquired (connections, listeners, goroutines); Start may be called again afterwards
+	Stop() error
 	Activate(originSN string) error
 	Deactivate(originSN string) error
 
@@ -23,9 +26,41 @@ type VendorDriver interface {
 	Reboot(CommandID int64, originSN string) error                          // Remote restart
 	PowerOff(CommandID int64, originSN string) error
 	Find(CommandID int64, originSN string) error // Find device (pet finder)
+
+	// Actions and arguments the driver accepts, checked before any command is sent
+	Capabilities() Capabilities
+}
+
+// HealthChecker is optionally implemented by drivers that can lose their
+// upstream after a successful Start, e.g. an MQTT broker connection
+type HealthChecker interface {
+	// Health returns nil while the driver works normally, otherwise the reason it is degraded
+	Health() error
+}
+
+// RawCommander is optionally implemented by drivers that can pass a
+// vendor-specific command through unchanged, for support engineers. The
+// device's reply is reported as the result of CommandID like any other command
+type RawCommander interface {
+	SendRaw(CommandID int64, originSN string, payload string) error
 }
 
 type AdvancedDriver interface {
 	AutoStart(CommandID int64, originSN string, tm string, enable bool) error // Scheduled power on
 	AutoShut(CommandID int64, originSN string, tm string, enable bool) error  // Scheduled power off
 }
+
+// FirmwarePackage describes a firmware image the device downloads by itself
+type FirmwarePackage struct {
+	Version string
+	URL     string
+	MD5     string
+	Size    int64
+}
+
+// FirmwareUpdater is optionally implemented by drivers whose devices support
+// over-the-air upgrades. Success only means the device accepted the command;
+// the upgrade is confirmed once the device reports the new version
+type FirmwareUpdater interface {
+	UpgradeFirmware(CommandID int64, originSN string, fw FirmwarePackage) error
+}
@@ -0,0 +1,291 @@
+package yc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/services"
+	"github.com/Daneel-Li/gps-back/internal/vendors"
+	"github.com/Daneel-Li/gps-back/internal/vendors/httppush"
+
+	"github.com/qichengzx/coordtransform"
+)
+
+//yc驱动，设备数据由yc平台http推送，指令调用yc平台接口下发
+//推送格式: {"imei":"...","event":"gps|status|ack",...}
+
+var _yc = "yc"
+
+const (
+	EVENT_GPS    = "gps"
+	EVENT_STATUS = "status"
+	EVENT_ACK    = "ack"
+)
+
+// 定位类型
+const (
+	POS_GPS  = 1
+	POS_WIFI = 2
+	POS_LBS  = 3
+)
+
+type Wifi struct {
+	Mac  string `json:"mac"`
+	Rssi int    `json:"rssi"`
+}
+
+type Cell struct {
+	Mcc  int `json:"mcc"`
+	Mnc  int `json:"mnc"`
+	Lac  int `json:"lac"`
+	Ci   int `json:"ci"`
+	Rssi int `json:"rssi"`
+}
+
+// PushMsg 各事件字段平铺在同一层
+type PushMsg struct {
+	IMEI  string `json:"imei"`
+	Event string `json:"event"`
+
+	// gps
+	GpsTime    int64    `json:"gpsTime"` // unix秒
+	Lat        float64  `json:"lat"`     // WGS84
+	Lng        float64  `json:"lng"`
+	Speed      *float64 `json:"speed"` // km/h
+	Course     *float64 `json:"course"`
+	Altitude   *float64 `json:"altitude"`
+	Satellites int      `json:"satellites"`
+	PosType    int      `json:"posType"`
+	Wifis      []Wifi   `json:"wifis"`
+	Cells      []Cell   `json:"cells"`
+
+	// status
+	Battery  *int  `json:"battery"`
+	Charging *bool `json:"charging"`
+	Csq      *int  `json:"csq"` // 0-31
+	Steps    *int  `json:"steps"`
+
+	// ack
+	CmdID  int64  `json:"cmdId"`
+	Result int    `json:"result"` // 0成功
+	Desc   string `json:"desc"`
+}
+
+// 指令下发请求及平台应答
+type cmdRequest struct {
+	IMEI    string                 `json:"imei"`
+	CmdID   int64                  `json:"cmdId"`
+	CmdType string                 `json:"cmdType"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+type cmdResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+type yc_Handler struct {
+	messageHandler vendors.MessageHandler //统一消息处理接口
+	locS           []services.LocationService
+	server         *httppush.Server
+}
+
+func NewYcHandler(cfg httppush.Config) vendors.VendorDriver {
+	h := &yc_Handler{
+		locS: []services.LocationService{services.NewTxLocationService(), services.NewWzLocationService()},
+	}
+	h.server = httppush.NewServer(_yc, cfg, h.handlePush)
+	return h
+}
+
+func (h *yc_Handler) handlePush(body []byte) error {
+	var msg PushMsg
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return fmt.Errorf("invalid push: %v", err)
+	}
+	if msg.IMEI == "" {
+		return fmt.Errorf("imei is required")
+	}
+	status := &mxm.DeviceStatus1{
+		OriginSN: msg.IMEI,
+		Type:     _yc,
+		RawMsg:   body,
+	}
+	now := time.Now()
+	switch msg.Event {
+	case EVENT_GPS:
+		status.Device = h.gpsToDevice(&msg)
+	case EVENT_STATUS:
+		dev := &mxm.Device{
+			OriginSN:    &status.OriginSN,
+			Type:        &_yc,
+			LastOnline:  &now,
+			Electricity: msg.Battery,
+			Charging:    msg.Charging,
+			Steps:       msg.Steps,
+		}
+		if msg.Csq != nil {
+			signal := min(max(*msg.Csq, 0), 31) * 100 / 31
+			dev.SimCardSignal = &signal
+		}
+		status.Device = dev
+	case EVENT_ACK:
+		status.Command = &mxm.Command{
+			Result: &mxm.CommandResult{
+				CommandID: msg.CmdID,
+				Succeed:   msg.Result == 0,
+				Msg:       msg.Desc,
+			},
+		}
+	default:
+		return fmt.Errorf("unknown event: %s", msg.Event)
+	}
+
+	// 调用统一消息处理接口
+	if h.messageHandler == nil {
+		slog.Error("message handler of yc is not set")
+		return nil
+	}
+	if err := h.messageHandler.Process(status); err != nil {
+		slog.Error("Failed to process message", "error", err)
+	}
+	return nil
+}
+
+func (h *yc_Handler) gpsToDevice(msg *PushMsg) *mxm.Device {
+	now := time.Now()
+	locTime := now
+	if msg.GpsTime > 0 {
+		locTime = time.Unix(msg.GpsTime, 0)
+	}
+	dev := &mxm.Device{
+		OriginSN:   &msg.IMEI,
+		Type:       &_yc,
+		LastOnline: &now,
+		LocTime:    &locTime,
+	}
+
+	locT := "GPS"
+	if msg.PosType == POS_GPS && (msg.Lat != 0 || msg.Lng != 0) {
+		longi, lati := coordtransform.WGS84toGCJ02(msg.Lng, msg.Lat)
+		dev.Latitude, dev.Longitude = &lati, &longi
+		dev.Speed, dev.Heading, dev.Altitude = msg.Speed, msg.Course, msg.Altitude
+		sate := msg.Satellites
+		dev.Satellites = &sate
+
+		geoRes, err := services.GeocodeWithFallback(h.locS, lati, longi, 2*time.Second)
+		if err != nil {
+			slog.Error("geocode failed", "error", err.Error())
+		} else {
+			dev.Address = &geoRes.Address
+		}
+	} else {
+		// wifi/基站由平台上报原始数据，自行定位
+		var req services.LocationRequest
+		if len(msg.Wifis) > 0 {
+			locT = "WIFI"
+			for _, w := range msg.Wifis {
+				req.WifiInfo = append(req.WifiInfo, &mxm.WiFiInfo{Mac: w.Mac, Rssi: w.Rssi})
+			}
+		}
+		if len(msg.Cells) > 0 {
+			if len(msg.Wifis) == 0 {
+				locT = "LBS"
+			}
+			for _, c := range msg.Cells {
+				req.CellInfo = append(req.CellInfo, services.CellInfo{
+					Mcc:    c.Mcc,
+					Mnc:    c.Mnc,
+					Lac:    c.Lac,
+					Cellid: c.Ci,
+					Rss:    float64(c.Rssi),
+				})
+			}
+		}
+		if req.WifiInfo != nil || req.CellInfo != nil {
+			locRes, err := services.LocateWithFallback(h.locS, req, 2*time.Second)
+			if err != nil {
+				slog.Error("locate failed", "error", err.Error())
+			} else if locRes.Location != nil {
+				dev.Address = &locRes.Address
+				dev.Latitude, dev.Longitude = &locRes.Location.Latitude, &locRes.Location.Longitude
+				dev.Accuracy = &locRes.Location.Accuracy
+			}
+		}
+	}
+	dev.LocType = &locT
+	return dev
+}
+
+func (h *yc_Handler) SetMessageHandler(handler vendors.MessageHandler) {
+	h.messageHandler = handler
+}
+
+// 厂商自己的启动逻辑
+func (h *yc_Handler) Start() error {
+	return h.server.Start()
+}
+
+func (h *yc_Handler) Stop() error {
+	return h.server.Stop()
+}
+
+func (h *yc_Handler) Activate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+func (h *yc_Handler) Deactivate(originSN string) error {
+	//Do nothing
+	return nil
+}
+
+// 指令执行结果由平台以ack事件推送，cmdId即CommandID
+func (h *yc_Handler) sendCmd(CommandID int64, originSN string, cmdType string, params map[string]interface{}) error {
+	body, err := h.server.Post("/api/device/command", cmdRequest{
+		IMEI:    originSN,
+		CmdID:   CommandID,
+		CmdType: cmdType,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	var resp cmdResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid yc api response: %s", body)
+	}
+	if !resp.Success {
+		return fmt.Errorf("yc api error: %s", resp.Message)
+	}
+	return nil
+}
+
+// 上报间隔，单位秒
+func (h *yc_Handler) SetReportInterval(CommandID int64, originSN string, interval int) error {
+	return h.sendCmd(CommandID, originSN, "UPLOAD_INTERVAL", map[string]interface{}{"seconds": interval})
+}
+
+func (h *yc_Handler) Locate(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "LOCATE", nil)
+}
+
+func (h *yc_Handler) Reboot(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "RESTART", nil)
+}
+
+func (h *yc_Handler) PowerOff(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "POWER_OFF", nil)
+}
+
+func (h *yc_Handler) Find(CommandID int64, originSN string) error {
+	return h.sendCmd(CommandID, originSN, "FIND", nil)
+}
+
+func (h *yc_Handler) Capabilities() vendors.Capabilities {
+	return vendors.NewCapabilities(vendors.ActionSetReportInterval(10, 3600), vendors.ActionLocate,
+		vendors.ActionReboot, vendors.ActionPowerOff, vendors.ActionFind)
+}
@@ -0,0 +1,44 @@
+package yc
+
+import (
+	"testing"
+
+	mxm "github.com/Daneel-Li/gps-back/internal/models"
+	"github.com/Daneel-Li/gps-back/internal/vendors/httppush"
+	"github.com/stretchr/testify/assert"
+)
+
+type captureHandler struct {
+	msgs []*mxm.DeviceStatus1
+}
+
+func (c *captureHandler) Process(msg *mxm.DeviceStatus1) error {
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func TestHandlePush(t *testing.T) {
+	c := &captureHandler{}
+	h := NewYcHandler(httppush.Config{}).(*yc_Handler)
+	h.SetMessageHandler(c)
+
+	body := []byte(`{"imei":"861234567890123","event":"status","battery":55,"charging":false,"csq":31,"steps":1200}`)
+	assert.NoError(t, h.handlePush(body))
+	dev := c.msgs[0].Device
+	assert.Equal(t, "861234567890123", c.msgs[0].OriginSN)
+	assert.Equal(t, 55, *dev.Electricity)
+	assert.Equal(t, 100, *dev.SimCardSignal)
+	assert.Equal(t, 1200, *dev.Steps)
+	assert.Equal(t, body, []byte(c.msgs[0].RawMsg))
+
+	body = []byte(`{"imei":"861234567890123","event":"ack","cmdId":7,"result":1,"desc":"busy"}`)
+	assert.NoError(t, h.handlePush(body))
+	res := c.msgs[1].Command.Result
+	assert.Equal(t, int64(7), res.CommandID)
+	assert.False(t, res.Succeed)
+	assert.Equal(t, "busy", res.Msg)
+
+	assert.Error(t, h.handlePush([]byte(`{"imei":"861234567890123","event":"other"}`)))
+	assert.Error(t, h.handlePush([]byte(`not json`)))
+	assert.Len(t, c.msgs, 2)
+}
@@ -21,6 +21,26 @@ func (g *IDGenerator) Next() int64 {
 	return g.counter
 }
 
+// SeqGenerator 单调递增且不回绕的序号，重启后由调用方用已持久化的最大值恢复
+type SeqGenerator struct {
+	counter int64
+	mutex   sync.Mutex
+}
+
+func (g *SeqGenerator) Next() int64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.counter++
+	return g.counter
+}
+
+// Restore 保证之后生成的序号都大于n
+func (g *SeqGenerator) Restore(n int64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.counter = max(g.counter, n)
+}
+
 func ParseFloatWithDefault(value string, defaultValue float64) float64 {
 	if value == "" {
 		return defaultValue
@@ -11,6 +11,8 @@ use mxm;
   `deleted_at` timestamp NULL DEFAULT NULL,
   `avatar_url` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci DEFAULT NULL,
   `enroll_admin` tinyint(1) DEFAULT '0',
+  `admin` tinyint(1) DEFAULT '0',
+  `timezone` varchar(64) NOT NULL DEFAULT '' COMMENT 'IANA时区，为空时取服务器时区',
   PRIMARY KEY (`id`),
   UNIQUE KEY `idx_openid` (`openid`),
   KEY `idx_deleted_at` (`deleted_at`)
@@ -54,6 +56,13 @@ use mxm;
   `weight` int DEFAULT NULL,
   `charging` tinyint(1) DEFAULT '0',
   `buzzer` tinyint(1) DEFAULT '0',
+  `ignition` tinyint(1) DEFAULT NULL,
+  `battery_voltage` double DEFAULT NULL,
+  `odometer` double DEFAULT NULL,
+  `sw_version` varchar(32) DEFAULT NULL,
+  `hw_version` varchar(32) DEFAULT NULL,
+  `project` varchar(64) DEFAULT NULL,
+  `luatos_version` varchar(32) DEFAULT NULL,
   `note` varchar(256) DEFAULT NULL,
   `species` int DEFAULT '1',
   PRIMARY KEY (`id`),
@@ -91,6 +100,8 @@ CREATE TABLE device_his_pos_template (
     altitude FLOAT,                      
     speed FLOAT,                         
     heading FLOAT,                       
+    rejected TINYINT(1) NOT NULL DEFAULT 0 COMMENT '被轨迹过滤判定为异常点',
+    reject_reason VARCHAR(32) COMMENT 'speed/worse_than_gps',
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
@@ -137,9 +148,37 @@ CREATE TABLE `safe_region` (
   `device_id` CHAR(36) NOT NULL,
   `name`      varchar(32),
   `type`      CHAR(12) NOT NULL,
-  `area`      VARCHAR(255) NOT NULL
+  `area`      TEXT NOT NULL COMMENT '区域描述JSON，多边形顶点较多',
+  `trigger_type` varchar(16) NOT NULL DEFAULT '' COMMENT '触发方式：空(进出都告警)/enter/exit/stay_inside',
+  `schedule`  TEXT COMMENT '生效时段JSON，为空时始终生效',
+  `dwell`     int NOT NULL DEFAULT '0' COMMENT '最短停留秒数'
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+CREATE TABLE `fence_states` (
+  `device_id`   CHAR(36) NOT NULL,
+  `region_name` varchar(32) NOT NULL,
+  `inside`      tinyint(1) NOT NULL COMMENT '当前是否在围栏内',
+  `pending`     int NOT NULL DEFAULT '0' COMMENT '连续落在另一侧的定位次数',
+  `since`       datetime NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '进入当前一侧的时间',
+  `fired`       tinyint(1) NOT NULL DEFAULT '1' COMMENT '当前一侧是否已告警或已判定不告警',
+  `updated_at`  datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`device_id`, `region_name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='设备围栏内外状态';
+
+CREATE TABLE `fence_events` (
+  `id`          bigint AUTO_INCREMENT PRIMARY KEY,
+  `device_id`   CHAR(36) NOT NULL,
+  `region_name` varchar(32) NOT NULL,
+  `trigger_type` varchar(16) NOT NULL DEFAULT '',
+  `inside`      tinyint(1) NOT NULL COMMENT '事件发生时是否在围栏内',
+  `fired`       tinyint(1) NOT NULL COMMENT '1已告警，0被抑制',
+  `reason`      varchar(32) NOT NULL DEFAULT '' COMMENT '抑制原因：inactive(不在生效时段)/dwell(停留时间不足)',
+  `alarm_type`  int NOT NULL DEFAULT '0',
+  `time`        datetime NOT NULL COMMENT '定位时间',
+  `created_at`  datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `idx_device_time` (`device_id`, `time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='围栏触发和抑制记录';
+
 CREATE TABLE `recovery_cmds` (
   `id`        int AUTO_INCREMENT PRIMARY KEY,
   `device_id` CHAR(36) NOT NULL,
@@ -153,7 +192,7 @@ CREATE TABLE `alarms` (
   `time`  TIMESTAMP,
   `device_id` CHAR(36) NOT NULL REFERENCES `devices`(`id`) ON DELETE CASCADE,
   `type` int NOT NULL, 
-  `msg` VARCHAR(32)
+  `msg` VARCHAR(64)
 )
 
 CREATE TABLE feedback (
@@ -204,3 +243,104 @@ CREATE TABLE device_settings (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
+
+CREATE TABLE `firmwares` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `device_type` varchar(12) NOT NULL COMMENT '设备类型',
+  `model` varchar(32) NOT NULL DEFAULT '' COMMENT '型号(设备上报的project)，空表示该类型所有设备',
+  `version` varchar(32) NOT NULL COMMENT '固件版本，与设备上报的swVersion比对',
+  `file_name` varchar(128) NOT NULL,
+  `size` bigint NOT NULL DEFAULT '0',
+  `md5` char(32) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_type_model` (`device_type`,`model`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='固件包';
+
+CREATE TABLE `ota_rollouts` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `firmware_id` int unsigned NOT NULL,
+  `percent` int NOT NULL DEFAULT '0' COMMENT '放量比例(0-100)',
+  `status` enum('active','paused') NOT NULL DEFAULT 'active',
+  `created_by` int unsigned NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='固件升级任务';
+
+CREATE TABLE `ota_rollout_devices` (
+  `rollout_id` int unsigned NOT NULL,
+  `device_id` char(16) NOT NULL,
+  `staged` tinyint(1) NOT NULL DEFAULT '0' COMMENT '是否已进入放量范围',
+  `state` enum('pending','downloading','applied','failed') NOT NULL DEFAULT 'pending',
+  `command_id` bigint NOT NULL DEFAULT '0' COMMENT '最近一次下发的升级指令id',
+  `attempts` int NOT NULL DEFAULT '0' COMMENT '下发次数',
+  `last_error` varchar(255) NOT NULL DEFAULT '',
+  `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`rollout_id`,`device_id`),
+  KEY `idx_device_state` (`device_id`,`state`),
+  KEY `idx_command_id` (`command_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='固件升级任务设备';
+
+CREATE TABLE `command_queue` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `command_id` bigint NOT NULL COMMENT '下发给设备的指令ID，设备应答时回传',
+  `device_id` char(16) NOT NULL,
+  `user_id` int unsigned NOT NULL DEFAULT '0' COMMENT '提交指令的用户',
+  `terminal_key` varchar(64) NOT NULL DEFAULT '',
+  `action` varchar(32) NOT NULL,
+  `args` json DEFAULT NULL,
+  `state` enum('queued','delivered','acknowledged','expired','failed') NOT NULL DEFAULT 'queued',
+  `succeed` tinyint(1) DEFAULT NULL COMMENT '设备应答结果',
+  `msg` varchar(255) NOT NULL DEFAULT '',
+  `expire_at` datetime NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_device_command` (`device_id`,`command_id`),
+  KEY `idx_device_state` (`device_id`,`state`),
+  KEY `idx_state_expire` (`state`,`expire_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='离线指令队列';
+
+CREATE TABLE `command_history` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `command_id` bigint NOT NULL,
+  `device_id` char(16) NOT NULL,
+  `user_id` int unsigned NOT NULL DEFAULT '0' COMMENT '操作人',
+  `action` varchar(32) NOT NULL,
+  `args` json DEFAULT NULL,
+  `state` enum('queued','delivered','acknowledged','expired','failed','timeout') NOT NULL,
+  `send_error` varchar(255) NOT NULL DEFAULT '' COMMENT '下发失败原因',
+  `reply` varchar(255) NOT NULL DEFAULT '' COMMENT '设备应答',
+  `succeed` tinyint(1) DEFAULT NULL,
+  `latency_ms` bigint DEFAULT NULL COMMENT '下发到应答的耗时(毫秒)',
+  `retries` int NOT NULL DEFAULT '0' COMMENT '超时重发次数',
+  `sent_at` datetime(3) DEFAULT NULL,
+  `replied_at` datetime(3) DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_device_command` (`device_id`,`command_id`),
+  KEY `idx_device_created` (`device_id`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='指令历史';
+
+CREATE TABLE `command_schedules` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `device_id` char(16) NOT NULL,
+  `user_id` int unsigned NOT NULL COMMENT '创建人，定时指令以其身份下发',
+  `action` varchar(32) NOT NULL,
+  `args` json DEFAULT NULL,
+  `cron` varchar(64) NOT NULL DEFAULT '' COMMENT '周期执行的cron表达式，为空时为单次执行',
+  `run_at` datetime DEFAULT NULL COMMENT '单次执行时间',
+  `enabled` tinyint(1) NOT NULL DEFAULT '1',
+  `next_run_at` datetime DEFAULT NULL,
+  `last_run_at` datetime DEFAULT NULL,
+  `last_command_id` bigint NOT NULL DEFAULT '0',
+  `last_state` varchar(16) NOT NULL DEFAULT '',
+  `last_error` varchar(255) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_device` (`device_id`),
+  KEY `idx_enabled_next` (`enabled`,`next_run_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='定时指令';